@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// providerDeleted marks the pseudonymous row a deleted user leaves
+	// behind when reports against them must be kept (see deleteAccount).
+	providerDeleted = "deleted"
+	// closeAccountDeleted is the event that closes a deleted user's socket,
+	// and the reason in its close frame.
+	closeAccountDeleted = "account_deleted"
+)
+
+// deletedPrincipal returns a fresh pseudonym for a deleted user's row. It is
+// random, so it cannot be linked back to the provider subject it replaces.
+func deletedPrincipal() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return principalID(providerDeleted, hex.EncodeToString(b))
+}
+
+// meHandler serves /me, the authenticated user's own account.
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getMeHandler(w, r)
+	case http.MethodDelete:
+		deleteMeHandler(w, r)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+}
+
+// getMeHandler returns the caller's account status (see AccountStatus), so
+// the app can explain a refused connection: a ban with its reason, source
+// and expiry, or terms still to accept. It answers banned users too. Like
+// /ws, it creates the user's row on first sight.
+func getMeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	sub, ok := authenticate(ctx, r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid_token", "token invalid or expired")
+		return
+	}
+	id, _, err := upsertUser(ctx, sub)
+	if err != nil {
+		slog.Error("account status: upsert user", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
+	}
+	st, err := loadAccountStatus(ctx, id, termsVersion)
+	if err != nil {
+		slog.Error("account status: load", "user_id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// deleteMeHandler erases the caller's account. A banned user is refused
+// with 409 until the ban ends. Otherwise screenshots they uploaded
+// are deleted from storage first, so a storage outage fails the request
+// before anything else is lost and the client can retry. Then their rows
+// are deleted or pseudonymized (see deleteAccount), their socket is closed
+// on whichever pod holds it and their Redis state is cleared.
+func deleteMeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	sub, ok := authenticate(ctx, r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid_token", "token invalid or expired")
+		return
+	}
+
+	id, err := getUserIDBySub(ctx, sub)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Never persisted: only Redis can hold anything.
+		matchMaker.Forget(ctx, sub, nil)
+		writeDeleted(w)
+		return
+	}
+	if err != nil {
+		slog.Error("delete account: lookup user", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
+	}
+
+	// Checked again under the row lock in deleteAccount; this keeps a banned
+	// user's screenshots from being deleted before the refusal.
+	if banned, err := isUserBanned(ctx, sub); err != nil {
+		slog.Error("delete account: check ban", "user_id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
+	} else if banned {
+		writeAccountBanned(w)
+		return
+	}
+
+	keys, err := reportScreenshotKeys(ctx, id)
+	if err != nil {
+		slog.Error("delete account: list screenshots", "user_id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
+	}
+	if err := deleteScreenshots(ctx, keys); err != nil {
+		slog.Error("delete account: delete screenshots", "user_id", id, "error", err)
+		writeError(w, http.StatusBadGateway, "purge_failed", "could not delete uploaded screenshots, retry later")
+		return
+	}
+
+	// Blocks are symmetric, so this is everyone whose online block SET may
+	// name the user.
+	partners, err := loadUserBlocks(ctx, id)
+	if err != nil {
+		slog.Error("delete account: load blocks", "user_id", id, "error", err)
+	}
+
+	del, err := deleteAccount(ctx, id, deletedPrincipal())
+	if errors.Is(err, errAccountBanned) {
+		writeAccountBanned(w)
+		return
+	}
+	if err != nil {
+		slog.Error("delete account: purge rows", "user_id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
+	}
+	// A report filed between listing and deleting left its screenshot
+	// behind; its row is gone now, so this is the last chance.
+	var late []string
+	for _, k := range del.ScreenshotKeys {
+		if !slices.Contains(keys, k) {
+			late = append(late, k)
+		}
+	}
+	if err := deleteScreenshots(ctx, late); err != nil {
+		slog.Error("delete account: orphaned screenshots", "user_id", id, "keys", late, "error", err)
+	}
+
+	if job, found, _ := matchMaker.ExportJob(ctx, sub); found && job.Object != "" {
+		if err := storageClient.Delete(ctx, job.Object); err != nil {
+			slog.Error("delete account: delete export", "user_id", id, "object", job.Object, "error", err)
+		}
+	}
+
+	if err := matchMaker.Deliver(ctx, sub, Message{Type: closeAccountDeleted, Payload: strconv.FormatInt(id, 10)}); err != nil {
+		slog.Error("delete account: failed to close socket", "user_id", id, "error", err)
+		disconnectClient(sub)
+	}
+	matchMaker.Forget(ctx, sub, partners)
+
+	accountDeletionsTotal.WithLabelValues(strconv.FormatBool(del.Pseudonymized)).Inc()
+	slog.Info("Account deleted",
+		"user_id", id,
+		"provider", del.Provider,
+		"pseudonymized", del.Pseudonymized,
+		"reports_deleted", del.ReportsDeleted,
+		"screenshots", len(del.ScreenshotKeys),
+	)
+	writeDeleted(w)
+}
+
+func writeDeleted(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"deleted":true}`))
+}
+
+func writeAccountBanned(w http.ResponseWriter) {
+	writeError(w, http.StatusConflict, "account_suspended", "a suspended account cannot be deleted until the suspension ends")
+}
+
+// deleteScreenshots deletes every key, returning the failures joined.
+func deleteScreenshots(ctx context.Context, keys []string) error {
+	var errs []error
+	for _, key := range keys {
+		if err := storageClient.Delete(ctx, key); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Forget erases what Redis holds about a deleted user: their queue entry,
+// their match state (after sending a partner still in the call a bye), the
+// handle their current partner knows them by, their block SET, profile,
+// priority allowance, data export job and audit timelines, and their ID
+// from the block SETs of partners. Their event stream is kept because it
+// carries the account_deleted event that closes their socket; the socket's
+// disconnect cleanup deletes it (see ClearEvents), and without a socket it
+// expires after eventMaxAge. Handles from earlier matches expire with
+// peerHandleTTL.
+func (m *MatchMaker) Forget(ctx context.Context, userID string, partners []string) {
+	m.remove(ctx, userID, closeAccountDeleted)
+	st, _ := m.leaveMatch(ctx, userID, leaveDisconnect)
+
+	keys := []string{
+		sessionKey(userID), matchKey(userID), blocksKey(userID), profileKey(userID),
+		priorityGrantsKey(userID), exportKey(userID), auditUserKey(userID),
+	}
+	if st.Peer != "" && m.Session(ctx, st.Peer) == userID {
+		if h := m.PeerHandle(ctx, st.Peer); h != "" {
+			keys = append(keys, peerHandleKey(h))
+		}
+	}
+	if evs, err := m.auditTimeline(ctx, auditUserKey(userID)); err == nil {
+		for _, ev := range evs {
+			if ev.MatchID != "" && !slices.Contains(keys, auditMatchKey(ev.MatchID)) {
+				keys = append(keys, auditMatchKey(ev.MatchID))
+			}
+		}
+	}
+	// The keys span several hash tags, so delete them one by one.
+	for _, key := range keys {
+		if err := m.rdb.Del(ctx, key).Err(); err != nil {
+			slog.Error("MatchMaker: failed to forget user", "user_id", userID, "key", key, "error", err)
+		}
+	}
+	for _, p := range partners {
+		if err := m.rdb.SRem(ctx, blocksKey(p), userID).Err(); err != nil {
+			slog.Error("MatchMaker: failed to drop forgotten user from blocks", "user_id", p, "error", err)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+// memStorage is an in-memory Storage for tests.
+type memStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func useMemStorage(t *testing.T) *memStorage {
+	t.Helper()
+	s := &memStorage{objects: map[string][]byte{}}
+	prev := storageClient
+	storageClient = s
+	t.Cleanup(func() { storageClient = prev })
+	return s
+}
+
+func (s *memStorage) Upload(_ context.Context, key, _ string, body io.Reader, _ int64) (string, error) {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = b
+	return "mem://" + key, nil
+}
+
+func (s *memStorage) Sign(_ context.Context, key string, _ time.Duration) (string, error) {
+	return "mem://" + key, nil
+}
+
+func (s *memStorage) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memStorage) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.objects[key]
+	return ok
+}
+
+func TestForget_ClearsRedisState(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	_, bobSeesAlice := pairPeers(ctx, mm, "alice", "bob", "m1")
+	mm.audit(ctx, AuditEvent{Type: auditMatched, UserID: "alice", PeerID: "bob", MatchID: "m1"})
+	mm.SetProfile(ctx, "alice", Profile{Interests: []string{"music"}})
+	mm.HydrateBlocks(ctx, "alice", []string{"carol"})
+	mm.HydrateBlocks(ctx, "carol", []string{"alice", "dave"})
+
+	mm.Forget(ctx, "alice", []string{"carol"})
+
+	for _, key := range []string{
+		sessionKey("alice"), matchKey("alice"), blocksKey("alice"), profileKey("alice"),
+		auditUserKey("alice"), auditMatchKey("m1"), peerHandleKey(bobSeesAlice),
+	} {
+		if n, _ := client.Exists(ctx, key).Result(); n != 0 {
+			t.Errorf("%s survived Forget", key)
+		}
+	}
+	if got, _ := client.SMembers(ctx, blocksKey("carol")).Result(); len(got) != 1 || got[0] != "dave" {
+		t.Fatalf("carol's blocks = %v, want [dave]", got)
+	}
+	// bob was still in the call and is told it ended.
+	if msgs := readEvents(t, mm, "bob"); len(msgs) != 1 || msgs[0].Type != "bye" {
+		t.Fatalf("bob: want a bye, got %+v", msgs)
+	}
+}
+
+func TestMeHandler_RejectsOtherMethods(t *testing.T) {
+	rr := httptest.NewRecorder()
+	meHandler(rr, httptest.NewRequest(http.MethodPut, "/me", nil))
+	allow := rr.Header().Get("Allow")
+	if rr.Code != http.StatusMethodNotAllowed || !strings.Contains(allow, http.MethodDelete) || !strings.Contains(allow, http.MethodGet) {
+		t.Fatalf("PUT /me: %d Allow=%q", rr.Code, allow)
+	}
+}
+
+func TestGetMe_ReportsStatus(t *testing.T) {
+	setupTestDB(t)
+	stubSubjectValidator(t)
+	useTerms(t, "v2", "")
+	ctx := context.Background()
+
+	alice, _, _ := upsertUser(ctx, "alice")
+	bob, _, _ := upsertUser(ctx, "bob")
+	_ = insertBlock(ctx, alice, bob)
+	_, _ = recordTermsAcceptance(ctx, alice, "v1")
+	until := time.Now().Add(time.Hour)
+	if _, _, _, err := banUser(ctx, alice, Ban{Reason: "harassment", Source: banSourceAdmin, ExpiresAt: &until}); err != nil {
+		t.Fatalf("banUser: %v", err)
+	}
+
+	getMe := func() AccountStatus {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set("Authorization", "Bearer alice")
+		rr := httptest.NewRecorder()
+		meHandler(rr, req)
+		var st AccountStatus
+		if err := json.NewDecoder(rr.Body).Decode(&st); rr.Code != http.StatusOK || err != nil {
+			t.Fatalf("GET /me: %d %v", rr.Code, err)
+		}
+		return st
+	}
+
+	st := getMe()
+	if st.UserID != "alice" || st.BlocksCount != 1 {
+		t.Fatalf("status = %+v", st)
+	}
+	if !st.Ban.Banned || st.Ban.Reason == nil || *st.Ban.Reason != "harassment" ||
+		st.Ban.Source == nil || *st.Ban.Source != banSourceAdmin || st.Ban.ExpiresAt == nil {
+		t.Fatalf("ban = %+v", st.Ban)
+	}
+	if st.Terms.Accepted || st.Terms.CurrentVersion != "v2" || st.Terms.AcceptedVersion == nil || *st.Terms.AcceptedVersion != "v1" {
+		t.Fatalf("terms = %+v", st.Terms)
+	}
+
+	// Once the suspension lapses the user is no longer banned anywhere.
+	if _, err := db.Exec(ctx, `UPDATE users SET ban_expires_at = NOW() - INTERVAL '1 minute' WHERE id = $1`, alice); err != nil {
+		t.Fatalf("expire ban: %v", err)
+	}
+	if banned, err := isUserBanned(ctx, "alice"); err != nil || banned {
+		t.Fatalf("isUserBanned after expiry = %v, %v", banned, err)
+	}
+	if st := getMe(); st.Ban.Banned || st.Ban.Reason != nil {
+		t.Fatalf("ban after expiry = %+v", st.Ban)
+	}
+}
+
+func TestDeleteMe_PurgesOrPseudonymizes(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	store := useMemStorage(t)
+	stubValidator(t, func(_ context.Context, token, _ string) (*idtoken.Payload, error) {
+		return &idtoken.Payload{Audience: googleClientIDs[0], Subject: token, Expires: time.Now().Add(time.Hour).Unix()}, nil
+	})
+	mm, _, _ := newTestMatchMaker(t)
+	prevMM := matchMaker
+	matchMaker = mm
+	t.Cleanup(func() { matchMaker = prevMM })
+
+	ids := map[string]int64{}
+	for _, sub := range []string{"alice", "bob", "carol"} {
+		ids[sub], _, _ = upsertUser(ctx, sub)
+	}
+	// alice reported bob; carol reported alice.
+	_, _ = store.Upload(ctx, "reports/alice.png", "image/png", bytes.NewReader([]byte("png")), 3)
+	_, _ = store.Upload(ctx, "reports/carol.png", "image/png", bytes.NewReader([]byte("png")), 3)
+	if _, err := recordReport(ctx, ids["alice"], ids["bob"], "spam", "mem://reports/alice.png", "reports/alice.png"); err != nil {
+		t.Fatalf("recordReport: %v", err)
+	}
+	if _, err := recordReport(ctx, ids["carol"], ids["alice"], "abuse", "mem://reports/carol.png", "reports/carol.png"); err != nil {
+		t.Fatalf("recordReport: %v", err)
+	}
+
+	deleteMe := func(sub string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodDelete, "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+sub)
+		rr := httptest.NewRecorder()
+		meHandler(rr, req)
+		var body map[string]bool
+		_ = json.NewDecoder(rr.Body).Decode(&body)
+		if rr.Code != http.StatusOK || !body["deleted"] {
+			t.Fatalf("DELETE /me as %s: %d %v", sub, rr.Code, body)
+		}
+	}
+
+	// alice has a report against her: her row stays, pseudonymized, with
+	// the report, but her own report and its screenshot are gone.
+	deleteMe("alice")
+	if store.has("reports/alice.png") || !store.has("reports/carol.png") {
+		t.Fatalf("only alice's upload should be deleted")
+	}
+	if _, err := getUserIDBySub(ctx, "alice"); err == nil {
+		t.Fatalf("alice is still findable by her subject")
+	}
+	if n, err := listReportsAgainst(ctx, ids["alice"]); err != nil || n != 1 {
+		t.Fatalf("reports against alice = %d, %v; want 1 kept", n, err)
+	}
+	var sub string
+	if err := db.QueryRow(ctx, `SELECT `+subColumn("users")+` FROM users WHERE id = $1`, ids["alice"]).Scan(&sub); err != nil || !strings.HasPrefix(sub, providerDeleted+":") {
+		t.Fatalf("alice's row = %q, %v; want a pseudonym", sub, err)
+	}
+
+	// bob has nothing against him now: his row goes entirely.
+	deleteMe("bob")
+	var users int
+	_ = db.QueryRow(ctx, `SELECT COUNT(*) FROM users WHERE id = $1`, ids["bob"]).Scan(&users)
+	if users != 0 {
+		t.Fatalf("bob's row should be deleted")
+	}
+
+	var logged, pseudonymized int
+	_ = db.QueryRow(ctx, `SELECT COUNT(*), COUNT(*) FILTER (WHERE pseudonymized) FROM account_deletions`).Scan(&logged, &pseudonymized)
+	if logged != 2 || pseudonymized != 1 {
+		t.Fatalf("account_deletions: %d rows, %d pseudonymized; want 2, 1", logged, pseudonymized)
+	}
+}
+
+func TestDeleteMe_RefusedWhileBanned(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	store := useMemStorage(t)
+	stubSubjectValidator(t)
+	mm, _, _ := newTestMatchMaker(t)
+	prevMM := matchMaker
+	matchMaker = mm
+	t.Cleanup(func() { matchMaker = prevMM })
+
+	mallory, _, _ := upsertUser(ctx, "mallory")
+	bob, _, _ := upsertUser(ctx, "bob")
+	_, _ = store.Upload(ctx, "reports/mallory.png", "image/png", bytes.NewReader([]byte("png")), 3)
+	if _, err := recordReport(ctx, mallory, bob, "spam", "mem://reports/mallory.png", "reports/mallory.png"); err != nil {
+		t.Fatalf("recordReport: %v", err)
+	}
+	if _, _, _, err := banUser(ctx, mallory, Ban{Source: banSourceAdmin}); err != nil {
+		t.Fatalf("banUser: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/me", nil)
+	req.Header.Set("Authorization", "Bearer mallory")
+	rr := httptest.NewRecorder()
+	meHandler(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("DELETE /me while banned: %d %s; want 409", rr.Code, rr.Body)
+	}
+	if !store.has("reports/mallory.png") {
+		t.Fatalf("refused deletion still deleted screenshots")
+	}
+	if _, err := deleteAccount(ctx, mallory, deletedPrincipal()); !errors.Is(err, errAccountBanned) {
+		t.Fatalf("deleteAccount while banned: %v; want errAccountBanned", err)
+	}
+	if banned, err := isUserBanned(ctx, "mallory"); err != nil || !banned {
+		t.Fatalf("mallory's ban = %v, %v; want it kept", banned, err)
+	}
+}
+
+func listReportsAgainst(ctx context.Context, id int64) (int, error) {
+	var n int
+	err := db.QueryRow(ctx, `SELECT COUNT(*) FROM reports WHERE reported_id = $1`, id).Scan(&n)
+	return n, err
+}
@@ -6,6 +6,7 @@ import (
 	"embed"
 	"encoding/json"
 	"errors"
+	"io"
 	"io/fs"
 	"log/slog"
 	"net/http"
@@ -23,6 +24,12 @@ const (
 	adminSignedURLTTL = 15 * time.Minute
 	adminDefaultLimit = 20
 	adminMaxLimit     = 100
+
+	adminDefaultRatingDays = 30
+	adminMaxRatingDays     = 365
+
+	adminDefaultQueueLimit = 100
+	adminMaxQueueLimit     = 1000
 )
 
 var (
@@ -51,6 +58,12 @@ func initAdmin() bool {
 	http.HandleFunc("/admin/api/reports", adminAuth(adminListReports))
 	http.HandleFunc("/admin/api/reports/", adminAuth(adminGetReport))
 	http.HandleFunc("/admin/api/users/", adminAuth(adminUserAction))
+	http.HandleFunc("/admin/api/ratings/daily", adminAuth(adminRatingsDaily))
+	http.HandleFunc("/admin/api/audit", adminAuth(adminAudit))
+	http.HandleFunc("/admin/api/matchmaker", adminAuth(adminMatchmakerStatus))
+	http.HandleFunc("/admin/api/matchmaker/pause", adminAuth(adminPauseMatchmaker))
+	http.HandleFunc("/admin/api/matchmaker/resume", adminAuth(adminResumeMatchmaker))
+	http.HandleFunc("/admin/api/queue", adminAuth(adminListQueue))
 	http.HandleFunc("/admin/", adminAuth(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/admin/" {
 			r2 := r.Clone(r.Context())
@@ -172,11 +185,9 @@ func adminGetReport(w http.ResponseWriter, r *http.Request) {
 }
 
 // POST /admin/api/users/{id}/ban    (or .../unban)
+// GET  /admin/api/users/{id}/trust
+// POST /admin/api/users/{id}/pool   {"pool": "shadow" | "general" | null}
 func adminUserAction(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
 	rest := strings.TrimPrefix(r.URL.Path, "/admin/api/users/")
 	parts := strings.Split(rest, "/")
 	if len(parts) != 2 {
@@ -189,9 +200,30 @@ func adminUserAction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	want := http.MethodPost
+	if parts[1] == "trust" || (parts[1] == "age" && r.Method == http.MethodGet) {
+		want = http.MethodGet
+	}
+	if r.Method != want {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	switch parts[1] {
+	case "trust":
+		adminGetTrust(w, r, id)
+	case "pool":
+		adminSetPool(w, r, id)
+	case "age":
+		adminUserAge(w, r, id)
+	case "evict":
+		adminEvict(w, r, id)
 	case "ban":
-		sub, changed, err := banUser(r.Context(), id)
+		ban, ok := parseAdminBan(w, r)
+		if !ok {
+			return
+		}
+		sub, stored, changed, err := banUser(r.Context(), id, ban)
 		if err != nil {
 			if errors.Is(err, pgx.ErrNoRows) {
 				http.NotFound(w, r)
@@ -202,13 +234,17 @@ func adminUserAction(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if changed {
-			disconnectClient(sub)
-			slog.Info("Admin banned user", "user_id", id, "google_sub", sub)
+			suspendClient(r.Context(), sub)
+			slog.Info("Admin banned user", "user_id", id, "sub", sub)
+		} else {
+			slog.Info("Admin updated ban", "user_id", id, "sub", sub)
 		}
 		writeJSON(w, http.StatusOK, map[string]any{
-			"id":      id,
-			"banned":  true,
-			"changed": changed,
+			"id":         id,
+			"banned":     true,
+			"changed":    changed,
+			"reason":     stored.Reason,
+			"expires_at": stored.ExpiresAt,
 		})
 	case "unban":
 		sub, changed, err := unbanUser(r.Context(), id)
@@ -222,7 +258,7 @@ func adminUserAction(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if changed {
-			slog.Info("Admin unbanned user", "user_id", id, "google_sub", sub)
+			slog.Info("Admin unbanned user", "user_id", id, "sub", sub)
 		}
 		writeJSON(w, http.StatusOK, map[string]any{
 			"id":      id,
@@ -234,6 +270,333 @@ func adminUserAction(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func adminGetTrust(w http.ResponseWriter, r *http.Request, id int64) {
+	a, err := assessTrust(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		slog.Error("admin: assess trust", "id", id, "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+// parseAdminBan reads the optional body of POST /admin/api/users/{id}/ban:
+// {"reason": "...", "duration": "72h"}. Without a duration the ban lasts
+// until lifted; with one it is a suspension.
+func parseAdminBan(w http.ResponseWriter, r *http.Request) (Ban, bool) {
+	var body struct {
+		Reason   string `json:"reason"`
+		Duration string `json:"duration"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<10)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return Ban{}, false
+	}
+	ban := Ban{Reason: strings.TrimSpace(body.Reason), Source: banSourceAdmin}
+	if body.Duration != "" {
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, "duration must be a positive Go duration such as \"72h\"", http.StatusBadRequest)
+			return Ban{}, false
+		}
+		at := time.Now().Add(d)
+		ban.ExpiresAt = &at
+	}
+	return ban, true
+}
+
+// adminSetPool pins a user to a pool, or with {"pool": null} returns them to
+// score-based routing. A connected user is moved immediately.
+func adminSetPool(w http.ResponseWriter, r *http.Request, id int64) {
+	var body struct {
+		Pool *string `json:"pool"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<10)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if body.Pool != nil && !validPool(*body.Pool) {
+		http.Error(w, "pool must be \"general\", \"shadow\" or null", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	sub, err := setPoolOverride(ctx, id, body.Pool)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		slog.Error("admin: set pool", "id", id, "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	a, err := assessTrust(ctx, id)
+	if err != nil {
+		slog.Error("admin: assess trust", "id", id, "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	matchMaker.SetPool(ctx, sub, a.Pool)
+	slog.Info("Admin set pool override", "user_id", id, "sub", sub, "override", body.Pool, "pool", a.Pool)
+	writeJSON(w, http.StatusOK, a)
+}
+
+// GET  /admin/api/users/{id}/age
+// POST /admin/api/users/{id}/age  {"age_band": "adult" | "minor" | null}
+//
+// An admin-set band wins over the verification provider; null hands the
+// user back to it. A connected user is disconnected so they reconnect in
+// their new band rather than finishing a call across bands.
+func adminUserAge(w http.ResponseWriter, r *http.Request, id int64) {
+	ctx := r.Context()
+	if r.Method == http.MethodPost {
+		var body struct {
+			AgeBand *string `json:"age_band"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<10)
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if body.AgeBand != nil && !validAgeBand(*body.AgeBand) {
+			http.Error(w, "age_band must be \"adult\", \"minor\" or null", http.StatusBadRequest)
+			return
+		}
+		sub, err := setAgeBand(ctx, id, body.AgeBand, ageSourceAdmin)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				http.NotFound(w, r)
+				return
+			}
+			slog.Error("admin: set age band", "id", id, "error", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		band := ""
+		if body.AgeBand != nil {
+			band = *body.AgeBand
+		}
+		matchMaker.SetAgeBand(ctx, sub, band)
+		disconnectClient(sub)
+		slog.Info("Admin set age band", "user_id", id, "sub", sub, "age_band", body.AgeBand)
+	}
+
+	st, err := loadAgeStatus(ctx, id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		slog.Error("admin: load age band", "id", id, "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// GET /admin/api/ratings/daily?days=30
+func adminRatingsDaily(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	days, _ := strconv.Atoi(r.URL.Query().Get("days"))
+	if days < 1 {
+		days = adminDefaultRatingDays
+	}
+	if days > adminMaxRatingDays {
+		days = adminMaxRatingDays
+	}
+	// Start at midnight UTC so the oldest day is complete.
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -(days - 1))
+
+	out, err := ratingsByDay(r.Context(), since)
+	if err != nil {
+		slog.Error("admin: ratings by day", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"days":  days,
+		"items": out,
+	})
+}
+
+// adminAudit handles GET /admin/api/audit?user_id=<id> or ?match_id=<id>:
+// the match lifecycle timeline for one user or one match, oldest first.
+func adminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	q := r.URL.Query()
+	userParam, matchID := q.Get("user_id"), q.Get("match_id")
+	if (userParam == "") == (matchID == "") {
+		http.Error(w, "exactly one of user_id or match_id is required", http.StatusBadRequest)
+		return
+	}
+	key := auditMatchKey(matchID)
+	if userParam != "" {
+		id, err := strconv.ParseInt(userParam, 10, 64)
+		if err != nil || id <= 0 {
+			http.Error(w, "invalid user_id", http.StatusBadRequest)
+			return
+		}
+		sub, err := userSubByID(ctx, id)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				http.NotFound(w, r)
+				return
+			}
+			slog.Error("admin: audit user lookup", "id", id, "error", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		key = auditUserKey(sub)
+	}
+	items, err := matchMaker.auditTimeline(ctx, key)
+	if err != nil {
+		slog.Error("admin: audit timeline", "key", key, "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"items": items})
+}
+
+// adminMatchmakerStatus handles GET /admin/api/matchmaker: whether pairing
+// is paused.
+func adminMatchmakerStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st, err := matchMaker.PauseState(r.Context())
+	if err != nil {
+		slog.Error("admin: pause state", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// adminPauseMatchmaker handles POST /admin/api/matchmaker/pause with an
+// optional {"reason": "..."} body. Pausing an already paused matchmaker
+// keeps the original time and reason.
+func adminPauseMatchmaker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<10)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	st, err := matchMaker.Pause(r.Context(), body.Reason)
+	if err != nil {
+		slog.Error("admin: pause matchmaker", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	adminQueueActionsTotal.WithLabelValues("pause").Inc()
+	slog.Warn("Admin paused matchmaking", "reason", st.Reason)
+	writeJSON(w, http.StatusOK, st)
+}
+
+// adminResumeMatchmaker handles POST /admin/api/matchmaker/resume.
+func adminResumeMatchmaker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := matchMaker.Resume(r.Context()); err != nil {
+		slog.Error("admin: resume matchmaker", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	adminQueueActionsTotal.WithLabelValues("resume").Inc()
+	slog.Warn("Admin resumed matchmaking")
+	writeJSON(w, http.StatusOK, PauseState{})
+}
+
+// adminListQueue handles GET /admin/api/queue?limit=100: the users waiting
+// in every shard, longest waiting first.
+func adminListQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 {
+		limit = adminDefaultQueueLimit
+	}
+	if limit > adminMaxQueueLimit {
+		limit = adminMaxQueueLimit
+	}
+	ctx := r.Context()
+	items, err := matchMaker.listQueue(ctx, limit)
+	if err != nil {
+		slog.Error("admin: list queue", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if len(items) > 0 {
+		subs := make([]string, len(items))
+		for i, e := range items {
+			subs[i] = e.Sub
+		}
+		ids, err := userIDsBySubs(ctx, subs)
+		if err != nil {
+			slog.Error("admin: queue user lookup", "error", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		for i := range items {
+			items[i].UserID = ids[items[i].Sub]
+		}
+	}
+	if items == nil {
+		items = []QueueEntry{}
+	}
+	adminQueueActionsTotal.WithLabelValues("list").Inc()
+	writeJSON(w, http.StatusOK, map[string]any{"items": items})
+}
+
+// adminEvict handles POST /admin/api/users/{id}/evict: takes the user out of
+// the queue without disconnecting them.
+func adminEvict(w http.ResponseWriter, r *http.Request, id int64) {
+	sub, err := userSubByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		slog.Error("admin: evict lookup", "id", id, "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	evicted := matchMaker.Evict(r.Context(), sub)
+	if evicted {
+		adminQueueActionsTotal.WithLabelValues("evict").Inc()
+		slog.Info("Admin evicted user from queue", "user_id", id, "sub", sub)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":      id,
+		"evicted": evicted,
+	})
+}
+
 // signScreenshot returns a URL the dashboard can fetch for the report's
 // screenshot. Falls back to the stored URL if signing fails (dev/local file
 // storage, etc.).
@@ -249,12 +612,12 @@ func signScreenshot(ctx context.Context, row ReportRow) string {
 	return url
 }
 
-// disconnectClient closes the websocket of the given user if one is open. It
-// mirrors the auto-ban flow in reportHandler.
-func disconnectClient(googleSub string) {
+// disconnectClient closes the websocket of the given user if one is open on
+// this pod.
+func disconnectClient(sub string) {
 	clientsMu.Lock()
 	defer clientsMu.Unlock()
-	if c, ok := clients[googleSub]; ok {
+	if c, ok := clients[sub]; ok {
 		_ = c.Conn.Close()
 	}
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAdminBan(t *testing.T) {
+	parse := func(body string) (Ban, int) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		ban, _ := parseAdminBan(rr, httptest.NewRequest(http.MethodPost, "/admin/api/users/1/ban", strings.NewReader(body)))
+		return ban, rr.Code
+	}
+
+	if ban, code := parse(""); code != http.StatusOK || ban.ExpiresAt != nil || ban.Source != banSourceAdmin {
+		t.Fatalf("empty body: %d %+v", code, ban)
+	}
+	ban, code := parse(`{"reason":" spam ","duration":"72h"}`)
+	if code != http.StatusOK || ban.Reason != "spam" || ban.ExpiresAt == nil ||
+		time.Until(*ban.ExpiresAt) < 71*time.Hour {
+		t.Fatalf("suspension: %d %+v", code, ban)
+	}
+	for _, body := range []string{`{"duration":"-1h"}`, `{"duration":"soon"}`, `not json`} {
+		if _, code := parse(body); code != http.StatusBadRequest {
+			t.Errorf("%s: %d, want 400", body, code)
+		}
+	}
+}
+
+func TestBanUser_UpdatesActiveBan(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+
+	id, _, _ := upsertUser(ctx, "mallory")
+	until := time.Now().Add(time.Hour)
+	if _, _, changed, err := banUser(ctx, id, Ban{Reason: "spam", Source: banSourceAdmin, ExpiresAt: &until}); err != nil || !changed {
+		t.Fatalf("first ban: changed=%v err=%v", changed, err)
+	}
+	var bannedAt time.Time
+	_ = db.QueryRow(ctx, `SELECT banned_at FROM users WHERE id = $1`, id).Scan(&bannedAt)
+
+	// Banning again without a duration or reason makes the suspension
+	// permanent and keeps the reason and the original ban time.
+	_, stored, changed, err := banUser(ctx, id, Ban{Source: banSourceAdmin})
+	if err != nil || changed {
+		t.Fatalf("second ban: changed=%v err=%v; want an update", changed, err)
+	}
+	if stored.ExpiresAt != nil || stored.Reason != "spam" {
+		t.Fatalf("stored ban = %+v; want no expiry and the original reason", stored)
+	}
+	var again time.Time
+	_ = db.QueryRow(ctx, `SELECT banned_at FROM users WHERE id = $1`, id).Scan(&again)
+	if !again.Equal(bannedAt) {
+		t.Fatalf("banned_at moved from %v to %v", bannedAt, again)
+	}
+}
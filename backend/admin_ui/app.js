@@ -184,11 +184,20 @@ async function renderDetail(id) {
         <button class="ban" ${r.reported_banned_at ? "disabled" : ""}>Ban user</button>
         <button class="unban" ${r.reported_banned_at ? "" : "disabled"}>Unban user</button>
       </div>
+      <h3>Trust</h3>
+      <div class="trust"><div class="loading">Loading…</div></div>
+      <h3>Age</h3>
+      <div class="age"><div class="loading">Loading…</div></div>
+      <h3>Match timeline</h3>
+      <div class="audit"><div class="loading">Loading…</div></div>
     </div>
   `;
 
   detail.querySelector(".ban").addEventListener("click", () => userAction(r.reported_id, "ban", id));
   detail.querySelector(".unban").addEventListener("click", () => userAction(r.reported_id, "unban", id));
+  renderTrust(detail.querySelector(".trust"), r.reported_id);
+  renderAge(detail.querySelector(".age"), r.reported_id);
+  renderAudit(detail.querySelector(".audit"), r.reported_id);
 
   view.innerHTML = "";
   view.appendChild(tpl);
@@ -207,6 +216,130 @@ async function userAction(userID, action, reportID) {
   renderDetail(reportID);
 }
 
+// ---- Trust / pool ----
+
+async function renderTrust(box, userID) {
+  let t;
+  try {
+    t = await api(`/admin/api/users/${userID}/trust`);
+  } catch (err) {
+    box.innerHTML = `<div class="error">Failed to load trust: ${escapeHTML(err.message)}</div>`;
+    return;
+  }
+  const pinned = t.override !== null;
+  box.innerHTML = `
+    <dl>
+      <dt>Score</dt><dd>${t.score} (shadow below ${t.threshold})</dd>
+      <dt>Pool</dt><dd>
+        <span class="badge ${t.pool === "shadow" ? "banned" : "ok"}">${escapeHTML(t.pool)}</span>
+        ${pinned ? "(admin override)" : "(from score)"}
+      </dd>
+      <dt>Inputs</dt><dd>${t.inputs.reports_total} reports, ${t.inputs.blocks_received} blocks received,
+        account created ${fmtDate(t.inputs.account_created_at)}</dd>
+    </dl>
+    <div class="actions">
+      <button data-pool="shadow" ${pinned && t.override === "shadow" ? "disabled" : ""}>Pin to shadow pool</button>
+      <button data-pool="general" ${pinned && t.override === "general" ? "disabled" : ""}>Pin to general pool</button>
+      <button data-pool="" ${pinned ? "" : "disabled"}>Clear override</button>
+    </div>
+  `;
+  for (const btn of box.querySelectorAll("button[data-pool]")) {
+    btn.addEventListener("click", async () => {
+      const pool = btn.dataset.pool || null;
+      try {
+        await api(`/admin/api/users/${userID}/pool`, {
+          method: "POST",
+          headers: { "Content-Type": "application/json" },
+          body: JSON.stringify({ pool }),
+        });
+      } catch (err) {
+        alert(`Pool change failed: ${err.message}`);
+        return;
+      }
+      renderTrust(box, userID);
+    });
+  }
+}
+
+// ---- Age band ----
+
+async function renderAge(box, userID) {
+  let a;
+  try {
+    a = await api(`/admin/api/users/${userID}/age`);
+  } catch (err) {
+    box.innerHTML = `<div class="error">Failed to load age band: ${escapeHTML(err.message)}</div>`;
+    return;
+  }
+  const byAdmin = a.source === "admin";
+  box.innerHTML = `
+    <dl>
+      <dt>Band</dt><dd>
+        <span class="badge ${a.age_band ? "ok" : "banned"}">${escapeHTML(a.age_band || "unknown")}</span>
+        ${a.source ? `(${escapeHTML(a.source)}, ${fmtDate(a.verified_at)})` : ""}
+      </dd>
+    </dl>
+    <div class="actions">
+      <button data-band="adult" ${byAdmin && a.age_band === "adult" ? "disabled" : ""}>Set adult</button>
+      <button data-band="minor" ${byAdmin && a.age_band === "minor" ? "disabled" : ""}>Set minor</button>
+      <button data-band="" ${a.age_band ? "" : "disabled"}>Clear</button>
+    </div>
+  `;
+  for (const btn of box.querySelectorAll("button[data-band]")) {
+    btn.addEventListener("click", async () => {
+      const band = btn.dataset.band || null;
+      if (!confirm(`Set age band for user ${userID} to ${band || "unknown"}? They will be disconnected.`)) return;
+      try {
+        await api(`/admin/api/users/${userID}/age`, {
+          method: "POST",
+          headers: { "Content-Type": "application/json" },
+          body: JSON.stringify({ age_band: band }),
+        });
+      } catch (err) {
+        alert(`Age band change failed: ${err.message}`);
+        return;
+      }
+      renderAge(box, userID);
+    });
+  }
+}
+
+// ---- Match audit timeline ----
+
+async function renderAudit(box, userID) {
+  let data;
+  try {
+    data = await api(`/admin/api/audit?user_id=${encodeURIComponent(userID)}`);
+  } catch (err) {
+    box.innerHTML = `<div class="error">Failed to load timeline: ${escapeHTML(err.message)}</div>`;
+    return;
+  }
+  if (!data.items.length) {
+    box.innerHTML = `<div class="empty">no recent match activity</div>`;
+    return;
+  }
+  const rows = data.items
+    .slice()
+    .reverse()
+    .map(
+      (e) => `
+      <tr>
+        <td>${fmtDate(e.at)}</td>
+        <td>${escapeHTML(e.type)}</td>
+        <td>${escapeHTML(e.peer_id || "")}</td>
+        <td>${escapeHTML(e.reason || "")}</td>
+        <td>${escapeHTML(e.match_id || "")}</td>
+      </tr>`,
+    )
+    .join("");
+  box.innerHTML = `
+    <table>
+      <thead><tr><th>At</th><th>Event</th><th>Peer</th><th>Reason</th><th>Match</th></tr></thead>
+      <tbody>${rows}</tbody>
+    </table>
+  `;
+}
+
 // ---- Router ----
 
 function route() {
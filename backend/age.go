@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Age bands. Users are only ever paired within one band, and a user whose
+// band is unknown (stored as "") is a band of their own: they never meet
+// verified adults or verified minors.
+const (
+	ageBandAdult = "adult"
+	ageBandMinor = "minor"
+	// adultAge is the age from which a birthdate counts as adult.
+	adultAge = 18
+)
+
+// ageSourceAdmin marks a band set from the admin dashboard. It wins over any
+// verification provider until an admin clears it.
+const ageSourceAdmin = "admin"
+
+// ageStrict is read from AGE_STRICT in main. When set, /ws refuses users
+// whose age band is unknown.
+var ageStrict bool
+
+// ageVerifier is chosen at startup from AGE_VERIFICATION_PROVIDER. Nil means
+// bands only come from admins.
+var ageVerifier AgeVerifier
+
+// AgeVerifier determines a user's age band when they connect. Implementations
+// are chosen at startup via the AGE_VERIFICATION_PROVIDER environment
+// variable.
+type AgeVerifier interface {
+	// Name identifies the provider; it is stored as the band's source.
+	Name() string
+	// Verify returns the user's age band, or "" if the provider cannot
+	// tell. claims are the verified ID token's claims.
+	Verify(ctx context.Context, sub string, claims map[string]any) (string, error)
+}
+
+func newAgeVerifier() (AgeVerifier, error) {
+	switch provider := strings.ToLower(getEnv("AGE_VERIFICATION_PROVIDER", "")); provider {
+	case "", "none":
+		return nil, nil
+	case "claims":
+		return claimsAgeVerifier{claim: getEnv("AGE_CLAIM", "birthdate")}, nil
+	case "fake":
+		return newFakeAgeVerifier(getEnv("AGE_FAKE_BANDS", ""), getEnv("AGE_FAKE_DEFAULT", ""))
+	default:
+		return nil, fmt.Errorf("unsupported AGE_VERIFICATION_PROVIDER %q (want claims or fake)", provider)
+	}
+}
+
+func validAgeBand(b string) bool {
+	return b == ageBandAdult || b == ageBandMinor
+}
+
+// --- ID token claims ---
+
+// claimsAgeVerifier reads the band from a claim the identity provider puts in
+// the ID token. The claim may hold an OIDC birthdate ("2001-04-30"), an age
+// in years, a boolean "is adult", or the band name itself.
+type claimsAgeVerifier struct {
+	claim string
+}
+
+func (v claimsAgeVerifier) Name() string { return "claims" }
+
+func (v claimsAgeVerifier) Verify(_ context.Context, _ string, claims map[string]any) (string, error) {
+	return ageBandFromClaim(claims[v.claim], time.Now()), nil
+}
+
+func ageBandFromClaim(v any, now time.Time) string {
+	switch c := v.(type) {
+	case bool:
+		if c {
+			return ageBandAdult
+		}
+		return ageBandMinor
+	case float64:
+		return ageBandForAge(int(c))
+	case string:
+		if validAgeBand(c) {
+			return c
+		}
+		// OIDC allows "0000" as the year when it is withheld, which
+		// tells us nothing about age.
+		born, err := time.Parse(time.DateOnly, c)
+		if err != nil || born.Year() == 0 || born.After(now) {
+			return ""
+		}
+		age := now.Year() - born.Year()
+		if now.Month() < born.Month() || (now.Month() == born.Month() && now.Day() < born.Day()) {
+			age--
+		}
+		return ageBandForAge(age)
+	}
+	return ""
+}
+
+func ageBandForAge(age int) string {
+	if age >= adultAge {
+		return ageBandAdult
+	}
+	return ageBandMinor
+}
+
+// --- Local fake ---
+
+// fakeAgeVerifier assigns bands from a fixed table, for local development and
+// tests. AGE_FAKE_BANDS is a comma-separated list of sub=band pairs;
+// AGE_FAKE_DEFAULT is the band for anyone else ("" for unknown).
+type fakeAgeVerifier struct {
+	bands map[string]string
+	def   string
+}
+
+func newFakeAgeVerifier(table, def string) (*fakeAgeVerifier, error) {
+	if def != "" && !validAgeBand(def) {
+		return nil, fmt.Errorf("invalid AGE_FAKE_DEFAULT %q", def)
+	}
+	f := &fakeAgeVerifier{bands: make(map[string]string), def: def}
+	for _, pair := range strings.Split(table, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		sub, band, ok := strings.Cut(pair, "=")
+		if !ok || !validAgeBand(band) {
+			return nil, fmt.Errorf("invalid AGE_FAKE_BANDS entry %q", pair)
+		}
+		f.bands[sub] = band
+	}
+	return f, nil
+}
+
+func (f *fakeAgeVerifier) Name() string { return "fake" }
+
+func (f *fakeAgeVerifier) Verify(_ context.Context, sub string, _ map[string]any) (string, error) {
+	if b, ok := f.bands[sub]; ok {
+		return b, nil
+	}
+	return f.def, nil
+}
+
+// --- Resolution ---
+
+// AgeStatus is a user's stored age band and where it came from. It is what
+// the admin age endpoint returns.
+type AgeStatus struct {
+	UserID     int64      `json:"user_id"`
+	AgeBand    *string    `json:"age_band"`
+	Source     *string    `json:"source"`
+	VerifiedAt *time.Time `json:"verified_at"`
+}
+
+// resolveAgeBand returns the band a connecting user is matched in. An admin
+// decision wins; otherwise the verification provider, if any, is asked and
+// its answer stored. Provider failures fall back to the stored band. Storage
+// failures leave the band unknown, which strict mode refuses: age
+// segregation fails closed.
+func resolveAgeBand(ctx context.Context, id int64, sub string, claims map[string]any) string {
+	st, err := loadAgeStatus(ctx, id)
+	if err != nil {
+		slog.Error("Failed to load age band", "user_id", sub, "error", err)
+		return ""
+	}
+	stored := ""
+	if st.AgeBand != nil {
+		stored = *st.AgeBand
+	}
+	if ageVerifier == nil || (st.Source != nil && *st.Source == ageSourceAdmin) {
+		return stored
+	}
+
+	band, err := ageVerifier.Verify(ctx, sub, claims)
+	if err != nil {
+		ageVerificationsTotal.WithLabelValues(ageVerifier.Name(), "error").Inc()
+		slog.Error("Age verification failed", "user_id", sub, "provider", ageVerifier.Name(), "error", err)
+		return stored
+	}
+	if band == "" {
+		ageVerificationsTotal.WithLabelValues(ageVerifier.Name(), "unknown").Inc()
+		return stored
+	}
+	ageVerificationsTotal.WithLabelValues(ageVerifier.Name(), band).Inc()
+	if band != stored {
+		if _, err := setAgeBand(ctx, id, &band, ageVerifier.Name()); err != nil {
+			slog.Error("Failed to store age band", "user_id", sub, "error", err)
+		}
+	}
+	return band
+}
+
+// SetAgeBand moves a connected user to another age band for the rest of
+// their session. Offline users are left alone, as with SetPool.
+func (m *MatchMaker) SetAgeBand(ctx context.Context, userID, band string) {
+	m.setLiveProfileField(ctx, userID, "age_band", band)
+}
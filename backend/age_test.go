@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+func TestAgeBandFromClaim(t *testing.T) {
+	now := time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		claim any
+		want  string
+	}{
+		{"2008-06-15", ageBandAdult}, // 18 today
+		{"2008-06-16", ageBandMinor}, // 18 tomorrow
+		{"1990-01-01", ageBandAdult},
+		{"0000-03-04", ""}, // year withheld
+		{"2030-01-01", ""}, // in the future
+		{"soon", ""},
+		{"minor", ageBandMinor},
+		{float64(17), ageBandMinor},
+		{float64(18), ageBandAdult},
+		{true, ageBandAdult},
+		{false, ageBandMinor},
+		{nil, ""},
+	}
+	for _, tc := range cases {
+		if got := ageBandFromClaim(tc.claim, now); got != tc.want {
+			t.Fatalf("claim %v: got %q, want %q", tc.claim, got, tc.want)
+		}
+	}
+}
+
+func TestNewFakeAgeVerifier(t *testing.T) {
+	f, err := newFakeAgeVerifier("kid=minor, grownup=adult", "adult")
+	if err != nil {
+		t.Fatalf("newFakeAgeVerifier: %v", err)
+	}
+	for sub, want := range map[string]string{"kid": ageBandMinor, "grownup": ageBandAdult, "anyone": ageBandAdult} {
+		if got, _ := f.Verify(context.Background(), sub, nil); got != want {
+			t.Fatalf("%s: got %q, want %q", sub, got, want)
+		}
+	}
+	for _, bad := range [][2]string{{"kid=child", ""}, {"kid", ""}, {"", "teen"}} {
+		if _, err := newFakeAgeVerifier(bad[0], bad[1]); err == nil {
+			t.Fatalf("table %q default %q: want error", bad[0], bad[1])
+		}
+	}
+}
+
+func TestMatchMaker_NeverPairsAcrossAgeBands(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	for _, u := range []struct{ id, band string }{
+		{"adult1", ageBandAdult},
+		{"minor1", ageBandMinor},
+		{"unknown1", ""},
+		{"adult2", ageBandAdult},
+		{"unknown2", ""},
+	} {
+		mm.SetProfile(ctx, u.id, Profile{AgeBand: u.band})
+		mm.Add(ctx, u.id)
+	}
+
+	mm.processMatches(ctx)
+
+	for a, b := range map[string]string{"adult1": "adult2", "unknown1": "unknown2"} {
+		if peer, _ := client.Get(ctx, sessionKey(a)).Result(); peer != b {
+			t.Fatalf("%s paired with %q, want %q", a, peer, b)
+		}
+	}
+	if !mm.isQueued(ctx, "minor1") {
+		t.Fatalf("the only minor must stay queued rather than meet anyone else")
+	}
+}
+
+func TestResolveAgeBand_ProviderAndAdmin(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+
+	f, _ := newFakeAgeVerifier("kid=minor", "")
+	prev := ageVerifier
+	ageVerifier = f
+	t.Cleanup(func() { ageVerifier = prev })
+
+	kid, _, _ := upsertUser(ctx, "kid")
+	stranger, _, _ := upsertUser(ctx, "stranger")
+
+	if got := resolveAgeBand(ctx, kid, "kid", nil); got != ageBandMinor {
+		t.Fatalf("kid band = %q, want minor", got)
+	}
+	if st, _ := loadAgeStatus(ctx, kid); st.AgeBand == nil || *st.AgeBand != ageBandMinor || *st.Source != "fake" {
+		t.Fatalf("provider band not stored: %+v", st)
+	}
+	if got := resolveAgeBand(ctx, stranger, "stranger", nil); got != "" {
+		t.Fatalf("stranger band = %q, want unknown", got)
+	}
+
+	adult := ageBandAdult
+	if _, err := setAgeBand(ctx, kid, &adult, ageSourceAdmin); err != nil {
+		t.Fatalf("setAgeBand: %v", err)
+	}
+	if got := resolveAgeBand(ctx, kid, "kid", nil); got != ageBandAdult {
+		t.Fatalf("an admin decision must win over the provider, got %q", got)
+	}
+}
+
+func TestAdminUserAge(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+
+	mm, _, _ := newTestMatchMaker(t)
+	prevMM := matchMaker
+	matchMaker = mm
+	t.Cleanup(func() { matchMaker = prevMM })
+
+	id, _, _ := upsertUser(ctx, "teen")
+	mm.SetProfile(ctx, "teen", Profile{AgeBand: ageBandAdult})
+	path := "/admin/api/users/" + strconv.FormatInt(id, 10) + "/age"
+
+	rr := httptest.NewRecorder()
+	adminUserAction(rr, httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(`{"age_band":"minor"}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("POST status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	var st AgeStatus
+	_ = json.NewDecoder(rr.Body).Decode(&st)
+	if st.AgeBand == nil || *st.AgeBand != ageBandMinor || st.Source == nil || *st.Source != ageSourceAdmin {
+		t.Fatalf("after set: %+v", st)
+	}
+	if got := mm.Profile(ctx, "teen").AgeBand; got != ageBandMinor {
+		t.Fatalf("live profile band = %q, want minor", got)
+	}
+
+	rr = httptest.NewRecorder()
+	adminUserAction(rr, httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(`{"age_band":"teen"}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("invalid band: status=%d, want 400", rr.Code)
+	}
+}
+
+func TestHandleConnections_StrictRefusesUnknownAge(t *testing.T) {
+	setupTestDB(t)
+	stubValidator(t, func(_ context.Context, _, _ string) (*idtoken.Payload, error) {
+		return &idtoken.Payload{Audience: googleClientIDs[0], Subject: "nobody-knows", Expires: time.Now().Add(time.Hour).Unix()}, nil
+	})
+	prevLimiter, prevStrict := wsLimiter, ageStrict
+	wsLimiter = newIPRateLimiter(wsConnectionsPerMinute, false)
+	ageStrict = true
+	t.Cleanup(func() { wsLimiter, ageStrict = prevLimiter, prevStrict })
+
+	rr := httptest.NewRecorder()
+	handleConnections(rr, httptest.NewRequest(http.MethodGet, "/ws?token=t", nil))
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status=%d, want 403", rr.Code)
+	}
+	var body errorResponse
+	_ = json.NewDecoder(rr.Body).Decode(&body)
+	if body.Code != "age_verification_required" {
+		t.Fatalf("code = %q, body %s", body.Code, rr.Body.String())
+	}
+}
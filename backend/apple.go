@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	appleIssuer  = "https://appleid.apple.com"
+	appleKeysURL = "https://appleid.apple.com/auth/keys"
+)
+
+var (
+	// appleClientIDs are the audiences Apple identity tokens must be issued
+	// to: the iOS bundle ID and, for web sign-in, the Services ID. Read from
+	// APPLE_CLIENT_IDS in main; empty disables Sign in with Apple.
+	appleClientIDs []string
+	// appleKeys caches Apple's signing keys. Tests point it at a fixture.
+	appleKeys = newJWKSCache(appleKeysURL)
+)
+
+// verifyAppleToken validates a Sign in with Apple identity token and returns
+// Apple's subject claim, with the same tokenErr* codes as verifyTokenClaims.
+func verifyAppleToken(ctx context.Context, token string) (sub string, claims map[string]any, code string, err error) {
+	if len(appleClientIDs) == 0 {
+		return "", nil, tokenErrInvalid, errors.New("sign in with apple is not configured")
+	}
+	c, err := verifyJWT(ctx, token, appleKeys)
+	if err != nil {
+		return "", nil, tokenErrInvalid, err
+	}
+	if iss := c.str("iss"); iss != appleIssuer {
+		return "", nil, tokenErrInvalid, fmt.Errorf("apple token: unexpected issuer %q", iss)
+	}
+	if !c.hasAudience(appleClientIDs) {
+		return "", nil, tokenErrWrongAudience, fmt.Errorf("apple token: unexpected audience %v", c["aud"])
+	}
+	if c.unix("exp") <= time.Now().Unix() {
+		return "", nil, tokenErrExpired, nil
+	}
+	if c.str("sub") == "" {
+		return "", nil, tokenErrNoSub, nil
+	}
+	return c.str("sub"), c, "", nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+const testAppleClientID = "com.example.roulette"
+
+// appleFixture serves testdata/apple_jwks.json as Apple's key endpoint and
+// signs tokens with the matching testdata/apple_test_key.pem. The key is a
+// throwaway generated for these tests.
+type appleFixture struct {
+	key     *rsa.PrivateKey
+	fetches atomic.Int32
+	down    atomic.Bool
+}
+
+func newAppleFixture(t *testing.T) *appleFixture {
+	t.Helper()
+	key, jwks := readTestKeys(t)
+	f := &appleFixture{key: key}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		f.fetches.Add(1)
+		if f.down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(jwks)
+	}))
+	t.Cleanup(srv.Close)
+
+	prevKeys, prevIDs := appleKeys, appleClientIDs
+	appleKeys = newJWKSCache(srv.URL)
+	appleClientIDs = []string{testAppleClientID}
+	t.Cleanup(func() { appleKeys, appleClientIDs = prevKeys, prevIDs })
+	return f
+}
+
+// readTestKeys returns the throwaway signing key and the JWK Set publishing
+// it as TEST_KID_1.
+func readTestKeys(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	pemBytes, err := os.ReadFile("testdata/apple_test_key.pem")
+	if err != nil {
+		t.Fatalf("read key: %v", err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse key: %v", err)
+	}
+	jwks, err := os.ReadFile("testdata/apple_jwks.json")
+	if err != nil {
+		t.Fatalf("read jwks: %v", err)
+	}
+	return parsed.(*rsa.PrivateKey), jwks
+}
+
+// token signs claims with the fixture key under the given kid.
+func (f *appleFixture) token(t *testing.T, kid string, claims map[string]any) string {
+	t.Helper()
+	return signTestToken(t, f.key, kid, claims)
+}
+
+// signTestToken returns an RS256 token of claims signed by key.
+func signTestToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signing := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signing + "." + enc.EncodeToString(sig)
+}
+
+func appleClaims() map[string]any {
+	return map[string]any{
+		"iss": appleIssuer,
+		"aud": testAppleClientID,
+		"sub": "001234.abcdef.5678",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestVerifyToken_Apple(t *testing.T) {
+	f := newAppleFixture(t)
+	stubValidator(t, func(context.Context, string, string) (*idtoken.Payload, error) {
+		t.Fatalf("Google's verifier should not see an Apple token")
+		return nil, nil
+	})
+
+	sub, code, err := verifyToken(context.Background(), f.token(t, "TEST_KID_1", appleClaims()))
+	if code != "" || err != nil {
+		t.Fatalf("code=%q err=%v", code, err)
+	}
+	if sub != "apple:001234.abcdef.5678" {
+		t.Fatalf("sub = %q", sub)
+	}
+	if p, s := splitPrincipal(sub); p != providerApple || s != "001234.abcdef.5678" {
+		t.Fatalf("splitPrincipal(%q) = %q, %q", sub, p, s)
+	}
+}
+
+func TestVerifyAppleToken_Rejects(t *testing.T) {
+	f := newAppleFixture(t)
+	ctx := context.Background()
+
+	with := func(k string, v any) map[string]any {
+		c := appleClaims()
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+	tampered := f.token(t, "TEST_KID_1", appleClaims())
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		code  string
+	}{
+		{"wrong issuer", f.token(t, "TEST_KID_1", with("iss", "https://evil.example")), tokenErrInvalid},
+		{"wrong audience", f.token(t, "TEST_KID_1", with("aud", "com.someone.else")), tokenErrWrongAudience},
+		{"audience list", f.token(t, "TEST_KID_1", with("aud", []string{"other", testAppleClientID})), ""},
+		{"expired", f.token(t, "TEST_KID_1", with("exp", time.Now().Add(-time.Second).Unix())), tokenErrExpired},
+		{"no subject", f.token(t, "TEST_KID_1", with("sub", nil)), tokenErrNoSub},
+		{"unknown kid", f.token(t, "ROTATED", appleClaims()), tokenErrInvalid},
+		{"non-RSA kid", f.token(t, "TEST_EC", appleClaims()), tokenErrInvalid},
+		{"bad signature", tampered, tokenErrInvalid},
+		{"not a jwt", "garbage", tokenErrInvalid},
+	} {
+		if _, _, code, _ := verifyAppleToken(ctx, tc.token); code != tc.code {
+			t.Errorf("%s: code = %q, want %q", tc.name, code, tc.code)
+		}
+	}
+
+	appleClientIDs = nil
+	if _, _, code, _ := verifyAppleToken(ctx, f.token(t, "TEST_KID_1", appleClaims())); code != tokenErrInvalid {
+		t.Fatalf("unconfigured: code = %q, want %q", code, tokenErrInvalid)
+	}
+}
+
+func TestJWKSCache(t *testing.T) {
+	f := newAppleFixture(t)
+	ctx := context.Background()
+
+	for range 3 {
+		if _, err := appleKeys.key(ctx, "TEST_KID_1"); err != nil {
+			t.Fatalf("key: %v", err)
+		}
+	}
+	if n := f.fetches.Load(); n != 1 {
+		t.Fatalf("fetched %d times, want once", n)
+	}
+
+	// An unknown kid refetches, but not again within jwksMinRefresh.
+	appleKeys.attempted = time.Now().Add(-jwksMinRefresh)
+	for range 3 {
+		if _, err := appleKeys.key(ctx, "ROTATED"); !errors.Is(err, errUnknownKey) {
+			t.Fatalf("err = %v, want errUnknownKey", err)
+		}
+	}
+	if n := f.fetches.Load(); n != 2 {
+		t.Fatalf("fetched %d times, want 2", n)
+	}
+
+	// Once stale the set is refetched; if Apple is down it is still used.
+	f.down.Store(true)
+	appleKeys.fetched = time.Now().Add(-2 * defaultJWKSTTL)
+	appleKeys.attempted = appleKeys.fetched
+	if _, err := appleKeys.key(ctx, "TEST_KID_1"); err != nil {
+		t.Fatalf("stale key should be served while Apple is down: %v", err)
+	}
+	if n := f.fetches.Load(); n != 3 {
+		t.Fatalf("fetched %d times, want 3", n)
+	}
+}
+
+func TestJWKSCache_ThrottlesWithoutKeys(t *testing.T) {
+	f := newAppleFixture(t)
+	ctx := context.Background()
+
+	// Apple is down on a cold start: one fetch, then fail fast with its
+	// error instead of refetching for every token.
+	f.down.Store(true)
+	for range 3 {
+		if _, err := appleKeys.key(ctx, "TEST_KID_1"); err == nil || errors.Is(err, errUnknownKey) {
+			t.Fatalf("err = %v, want the fetch error", err)
+		}
+	}
+	if n := f.fetches.Load(); n != 1 {
+		t.Fatalf("fetched %d times, want once", n)
+	}
+
+	// After jwksMinRefresh it tries again.
+	f.down.Store(false)
+	appleKeys.attempted = time.Now().Add(-jwksMinRefresh)
+	if _, err := appleKeys.key(ctx, "TEST_KID_1"); err != nil {
+		t.Fatalf("key after recovery: %v", err)
+	}
+	if n := f.fetches.Load(); n != 2 {
+		t.Fatalf("fetched %d times, want 2", n)
+	}
+}
+
+func TestPrincipalID(t *testing.T) {
+	if got := principalID(providerGoogle, "1234567890"); got != "1234567890" {
+		t.Fatalf("google principal = %q, want the bare subject", got)
+	}
+	for _, id := range []string{"1234567890", "apple:001234.abcdef.5678"} {
+		if got := principalID(splitPrincipal(id)); got != id {
+			t.Fatalf("round trip %q -> %q", id, got)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// defaultAuditRetention is how long match lifecycle events are kept. Long
+	// enough to answer a support ticket about yesterday's session.
+	defaultAuditRetention = 24 * time.Hour
+	// auditMaxEvents caps each timeline. A user churning through matches all
+	// day keeps their most recent history rather than growing without bound.
+	auditMaxEvents = 500
+	// auditRejectionInterval is how often the same blocked pair is recorded.
+	// The pair is re-evaluated on every pairing pass while both wait, and one
+	// event per interval is enough to explain the wait.
+	auditRejectionInterval = time.Minute
+)
+
+// auditRetention is read from AUDIT_RETENTION in main. Zero disables the
+// audit log.
+var auditRetention = defaultAuditRetention
+
+// Match lifecycle event types.
+const (
+	auditEnqueued     = "enqueued"
+	auditDequeued     = "dequeued"
+	auditRebalanced   = "rebalanced"
+	auditRejected     = "candidate_rejected"
+	auditMatched      = "matched"
+	auditNotified     = "notified"
+	auditNotifyFailed = "notify_failed"
+)
+
+// AuditEvent is one entry in a user's or match's timeline.
+type AuditEvent struct {
+	At      time.Time      `json:"at"`
+	Type    string         `json:"type"`
+	UserID  string         `json:"user_id,omitempty"`
+	PeerID  string         `json:"peer_id,omitempty"`
+	MatchID string         `json:"match_id,omitempty"`
+	Reason  string         `json:"reason,omitempty"`
+	Detail  map[string]any `json:"detail,omitempty"`
+}
+
+// audit appends ev to the timeline of its user and, if it has one, its
+// match. Writes are best-effort: losing an audit entry must never hold up
+// pairing.
+func (m *MatchMaker) audit(ctx context.Context, ev AuditEvent) {
+	if auditRetention <= 0 {
+		return
+	}
+	if ev.At.IsZero() {
+		ev.At = time.Now()
+	}
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	var keys []string
+	if ev.UserID != "" {
+		keys = append(keys, auditUserKey(ev.UserID))
+	}
+	if ev.MatchID != "" {
+		keys = append(keys, auditMatchKey(ev.MatchID))
+	}
+	pipe := m.rdb.Pipeline()
+	for _, key := range keys {
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: key,
+			MaxLen: auditMaxEvents,
+			Approx: true,
+			Values: map[string]any{"e": raw},
+		})
+		pipe.Expire(ctx, key, auditRetention)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("MatchMaker: failed to write audit event", "type", ev.Type, "user_id", ev.UserID, "error", err)
+	}
+}
+
+// auditRejection records that a and b were not paired, once per pair per
+// auditRejectionInterval, on both users' timelines.
+func (m *MatchMaker) auditRejection(ctx context.Context, a, b, reason string, now time.Time) {
+	if auditRetention <= 0 || !m.rejections.due([2]string{a, b}, now) {
+		return
+	}
+	m.audit(ctx, AuditEvent{At: now, Type: auditRejected, UserID: a, PeerID: b, Reason: reason})
+	m.audit(ctx, AuditEvent{At: now, Type: auditRejected, UserID: b, PeerID: a, Reason: reason})
+}
+
+// rejectionLog remembers when each pair's rejection was last recorded. It is
+// local to the leader; after a failover a pair may be recorded once early.
+type rejectionLog struct {
+	mu   sync.Mutex
+	last map[[2]string]time.Time
+}
+
+func (l *rejectionLog) due(pair [2]string, now time.Time) bool {
+	if pair[1] < pair[0] {
+		pair[0], pair[1] = pair[1], pair[0]
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last == nil {
+		l.last = make(map[[2]string]time.Time)
+	}
+	if at, ok := l.last[pair]; ok && now.Sub(at) < auditRejectionInterval {
+		return false
+	}
+	// Forget pairs not seen for a while so the map tracks only recent
+	// rejections.
+	if len(l.last) > 10000 {
+		for p, at := range l.last {
+			if now.Sub(at) >= auditRejectionInterval {
+				delete(l.last, p)
+			}
+		}
+	}
+	l.last[pair] = now
+	return true
+}
+
+// auditTimeline returns the events in one timeline, oldest first.
+func (m *MatchMaker) auditTimeline(ctx context.Context, key string) ([]AuditEvent, error) {
+	msgs, err := m.rdb.XRange(ctx, key, "-", "+").Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]AuditEvent, 0, len(msgs))
+	for _, msg := range msgs {
+		raw, _ := msg.Values["e"].(string)
+		var ev AuditEvent
+		if err := json.Unmarshal([]byte(raw), &ev); err != nil {
+			continue
+		}
+		out = append(out, ev)
+	}
+	return out, nil
+}
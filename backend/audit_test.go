@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func auditTypes(t *testing.T, mm *MatchMaker, key string) []string {
+	t.Helper()
+	evs, err := mm.auditTimeline(context.Background(), key)
+	if err != nil {
+		t.Fatalf("auditTimeline(%s): %v", key, err)
+	}
+	out := make([]string, len(evs))
+	for i, ev := range evs {
+		out[i] = ev.Type
+	}
+	return out
+}
+
+func TestAudit_MatchLifecycle(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	mm.Add(ctx, "alice")
+	mm.Add(ctx, "bob")
+	mm.processMatches(ctx)
+
+	want := []string{auditEnqueued, auditMatched, auditNotified}
+	for _, id := range []string{"alice", "bob"} {
+		if got := auditTypes(t, mm, auditUserKey(id)); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+			t.Fatalf("%s timeline = %v, want %v", id, got, want)
+		}
+	}
+
+	matchID, _ := client.HGet(ctx, matchKey("alice"), "id").Result()
+	evs, err := mm.auditTimeline(ctx, auditMatchKey(matchID))
+	if err != nil || len(evs) != 4 {
+		t.Fatalf("match timeline = %+v (err %v), want two matched and two notified", evs, err)
+	}
+	if evs[0].Type != auditMatched || evs[0].MatchID != matchID || evs[0].PeerID == "" {
+		t.Fatalf("first match event = %+v", evs[0])
+	}
+	if _, ok := evs[0].Detail["wait_ms"]; !ok {
+		t.Fatalf("matched event missing wait_ms: %+v", evs[0].Detail)
+	}
+}
+
+func TestAudit_BlockedRejectionRecordedOncePerInterval(t *testing.T) {
+	mm, _, _ := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	mm.HydrateBlocks(ctx, "alice", []string{"bob"})
+	mm.Add(ctx, "alice")
+	mm.Add(ctx, "bob")
+	mm.processMatches(ctx)
+	mm.processMatches(ctx)
+
+	evs, _ := mm.auditTimeline(ctx, auditUserKey("alice"))
+	var rejected []AuditEvent
+	for _, ev := range evs {
+		if ev.Type == auditRejected {
+			rejected = append(rejected, ev)
+		}
+	}
+	if len(rejected) != 1 || rejected[0].PeerID != "bob" || rejected[0].Reason != "blocked" {
+		t.Fatalf("rejections = %+v, want one blocked by bob", rejected)
+	}
+}
+
+func TestAudit_RetentionAndDisable(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	mm.Add(ctx, "alice")
+	if ttl := client.TTL(ctx, auditUserKey("alice")).Val(); ttl <= 0 || ttl > auditRetention {
+		t.Fatalf("audit TTL = %v, want (0, %v]", ttl, auditRetention)
+	}
+
+	prev := auditRetention
+	auditRetention = 0
+	t.Cleanup(func() { auditRetention = prev })
+	mm.Add(ctx, "bob")
+	if client.Exists(ctx, auditUserKey("bob")).Val() != 0 {
+		t.Fatalf("AUDIT_RETENTION=0 should disable the audit log")
+	}
+}
+
+func TestRejectionLog_Due(t *testing.T) {
+	var l rejectionLog
+	now := time.Now()
+	if !l.due([2]string{"a", "b"}, now) {
+		t.Fatalf("first rejection should be due")
+	}
+	if l.due([2]string{"b", "a"}, now.Add(time.Second)) {
+		t.Fatalf("the pair is unordered and was just recorded")
+	}
+	if !l.due([2]string{"a", "b"}, now.Add(auditRejectionInterval)) {
+		t.Fatalf("rejection should be due again after the interval")
+	}
+}
+
+func TestAdminAudit(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+
+	mm, _, _ := newTestMatchMaker(t)
+	prevMM := matchMaker
+	matchMaker = mm
+	t.Cleanup(func() { matchMaker = prevMM })
+
+	id, _, _ := upsertUser(ctx, "audited")
+	mm.Add(ctx, "audited")
+
+	rr := httptest.NewRecorder()
+	adminAudit(rr, httptest.NewRequest(http.MethodGet, "/admin/api/audit?user_id="+strconv.FormatInt(id, 10), nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	var body struct {
+		Items []AuditEvent `json:"items"`
+	}
+	_ = json.NewDecoder(rr.Body).Decode(&body)
+	if len(body.Items) != 1 || body.Items[0].Type != auditEnqueued {
+		t.Fatalf("items = %+v, want one enqueued event", body.Items)
+	}
+
+	for query, want := range map[string]int{
+		"":                        http.StatusBadRequest,
+		"?user_id=1&match_id=m":   http.StatusBadRequest,
+		"?user_id=abc":            http.StatusBadRequest,
+		"?user_id=999999999":      http.StatusNotFound,
+		"?match_id=no-such-match": http.StatusOK,
+	} {
+		rr := httptest.NewRecorder()
+		adminAudit(rr, httptest.NewRequest(http.MethodGet, "/admin/api/audit"+query, nil))
+		if rr.Code != want {
+			t.Fatalf("%q: status=%d, want %d", query, rr.Code, want)
+		}
+	}
+}
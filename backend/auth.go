@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
@@ -17,8 +19,59 @@ const (
 	tokenErrInvalid = "invalid_token"
 	tokenErrExpired = "token_expired"
 	tokenErrNoSub   = "invalid_token_claims"
+	// tokenErrWrongAudience is a genuine token minted for some other app's
+	// client ID.
+	tokenErrWrongAudience = "token_wrong_audience"
 )
 
+// defaultGoogleClientIDs is the app's web OAuth client, the audience of the
+// ID tokens the Android app requests.
+var defaultGoogleClientIDs = []string{
+	"774973448609-nio4jsbacsm16irumk21v66js92d8j2e.apps.googleusercontent.com",
+}
+
+// googleClientIDs are the audiences Google ID tokens must be issued to: the
+// app's Android, iOS and web OAuth client IDs. Read from GOOGLE_CLIENT_IDS
+// in main.
+var googleClientIDs = defaultGoogleClientIDs
+
+// parseClientIDs splits a comma-separated list of OAuth client IDs.
+func parseClientIDs(v string) []string {
+	var out []string
+	for _, id := range strings.Split(v, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// Identity providers users can sign in with.
+const (
+	providerGoogle = "google"
+	providerApple  = "apple"
+)
+
+// principalID is a user's ID across the backend: Redis keys, the clients
+// map, peer IDs sent to the other side of a match. Google users keep their
+// bare subject, as before Apple sign-in existed; other providers' subjects
+// are prefixed with the provider, e.g. "apple:001234.abcd".
+func principalID(provider, subject string) string {
+	if provider == providerGoogle {
+		return subject
+	}
+	return provider + ":" + subject
+}
+
+// splitPrincipal is the inverse of principalID. Google subjects are digits,
+// so a colon always means a prefixed provider.
+func splitPrincipal(id string) (provider, subject string) {
+	if p, s, ok := strings.Cut(id, ":"); ok {
+		return p, s
+	}
+	return providerGoogle, id
+}
+
 // tokenValidate is a package-level indirection so tests can stub the verifier
 // without contacting Google's keyserver. Defaults to idtoken.Validate.
 var tokenValidate = func(ctx context.Context, token, audience string) (*idtoken.Payload, error) {
@@ -38,26 +91,73 @@ func bearerToken(r *http.Request) string {
 	return ""
 }
 
-// verifyToken validates a Google ID token and returns the subject claim. On
-// failure it returns one of the tokenErr* codes plus the underlying error
-// when available (used only for logging — the code is what callers branch on).
+// verifyToken validates one of this backend's access tokens (see
+// session.go), a Google ID token, an Apple identity token or an ID token from
+// one of OIDC_ISSUERS (see oidc.go), and returns the user's principal ID (see
+// principalID). On failure it returns one of the tokenErr* codes plus the
+// underlying error when available (used only for logging — the code is what
+// callers branch on).
 func verifyToken(ctx context.Context, token string) (sub string, code string, err error) {
+	sub, _, code, err = verifyTokenClaims(ctx, token)
+	return sub, code, err
+}
+
+// verifyTokenClaims is verifyToken for callers that also need the token's
+// other claims, such as age verification on connect.
+func verifyTokenClaims(ctx context.Context, token string) (sub string, claims map[string]any, code string, err error) {
 	if token == "" {
-		return "", tokenErrMissing, nil
+		return "", nil, tokenErrMissing, nil
 	}
+	// The unverified issuer only picks the verifier; each verifier checks
+	// the issuer again once the signature holds.
+	if c, err := parseJWTClaims(token); err == nil && c.str("iss") == sessionIssuer {
+		return verifySessionToken(token)
+	}
+	return verifyProviderToken(ctx, token)
+}
+
+// verifyProviderToken is verifyTokenClaims restricted to identity provider
+// tokens, for /auth/login: an access token cannot mint a new session.
+func verifyProviderToken(ctx context.Context, token string) (sub string, claims map[string]any, code string, err error) {
+	if token == "" {
+		return "", nil, tokenErrMissing, nil
+	}
+	// Route by the unverified issuer; anything unclaimed goes to Google.
+	if c, err := parseJWTClaims(token); err == nil {
+		iss := c.str("iss")
+		if iss == appleIssuer {
+			sub, claims, code, err = verifyAppleToken(ctx, token)
+			if code != "" {
+				return "", nil, code, err
+			}
+			return principalID(providerApple, sub), claims, "", nil
+		}
+		if p := oidcIssuers[iss]; p != nil {
+			sub, claims, code, err = p.verify(ctx, token)
+			if code != "" {
+				return "", nil, code, err
+			}
+			return principalID(p.name, sub), claims, "", nil
+		}
+	}
+	// idtoken.Validate takes a single audience, so check against the list
+	// here instead.
 	payload, err := tokenValidate(ctx, token, "")
 	if err != nil {
-		return "", tokenErrInvalid, err
+		return "", nil, tokenErrInvalid, err
+	}
+	if !slices.Contains(googleClientIDs, payload.Audience) {
+		return "", nil, tokenErrWrongAudience, fmt.Errorf("google token: unexpected audience %q", payload.Audience)
 	}
 	// Defense-in-depth: idtoken.Validate already enforces exp, but pin the
 	// policy at our boundary so future library tweaks cannot silently relax it.
 	if payload.Expires <= time.Now().Unix() {
-		return "", tokenErrExpired, nil
+		return "", nil, tokenErrExpired, nil
 	}
 	if payload.Subject == "" {
-		return "", tokenErrNoSub, nil
+		return "", nil, tokenErrNoSub, nil
 	}
-	return payload.Subject, "", nil
+	return payload.Subject, payload.Claims, "", nil
 }
 
 // tokenErrMessage maps a tokenErr* code to the user-facing message returned
@@ -72,14 +172,18 @@ func tokenErrMessage(code string) string {
 		return "token expired"
 	case tokenErrNoSub:
 		return "token missing subject"
+	case tokenErrWrongAudience:
+		return "token was not issued for this app"
 	default:
 		return "unauthorized"
 	}
 }
 
 // logTokenFailure mirrors the per-code logging the WS handler used to emit
-// inline. Kept here so report.go and any future caller log the same context.
+// inline, and counts the rejection. Kept here so report.go and any future
+// caller log the same context.
 func logTokenFailure(code string, verr error, token, remoteAddr string) {
+	tokenRejectionsTotal.WithLabelValues(code).Inc()
 	switch code {
 	case tokenErrMissing:
 		slog.Warn("Connection attempt without token", "remote_addr", remoteAddr)
@@ -93,5 +197,7 @@ func logTokenFailure(code string, verr error, token, remoteAddr string) {
 		slog.Info("JWT expired at connect", "remote_addr", remoteAddr)
 	case tokenErrNoSub:
 		slog.Error("Token payload missing subject", "remote_addr", remoteAddr)
+	case tokenErrWrongAudience:
+		slog.Warn("Token issued for another client ID", "error", verr, "remote_addr", remoteAddr)
 	}
 }
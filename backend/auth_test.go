@@ -22,8 +22,9 @@ func stubValidator(t *testing.T, fn func(ctx context.Context, token, audience st
 func TestVerifyToken_Valid(t *testing.T) {
 	stubValidator(t, func(_ context.Context, _, _ string) (*idtoken.Payload, error) {
 		return &idtoken.Payload{
-			Subject: "user-123",
-			Expires: time.Now().Add(time.Hour).Unix(),
+			Audience: googleClientIDs[0],
+			Subject:  "user-123",
+			Expires:  time.Now().Add(time.Hour).Unix(),
 		}, nil
 	})
 
@@ -73,8 +74,9 @@ func TestVerifyToken_Malformed(t *testing.T) {
 func TestVerifyToken_Expired(t *testing.T) {
 	stubValidator(t, func(context.Context, string, string) (*idtoken.Payload, error) {
 		return &idtoken.Payload{
-			Subject: "user-123",
-			Expires: time.Now().Add(-time.Second).Unix(),
+			Audience: googleClientIDs[0],
+			Subject:  "user-123",
+			Expires:  time.Now().Add(-time.Second).Unix(),
 		}, nil
 	})
 
@@ -90,8 +92,9 @@ func TestVerifyToken_Expired(t *testing.T) {
 func TestVerifyToken_MissingSubject(t *testing.T) {
 	stubValidator(t, func(context.Context, string, string) (*idtoken.Payload, error) {
 		return &idtoken.Payload{
-			Subject: "",
-			Expires: time.Now().Add(time.Hour).Unix(),
+			Audience: googleClientIDs[0],
+			Subject:  "",
+			Expires:  time.Now().Add(time.Hour).Unix(),
 		}, nil
 	})
 
@@ -136,7 +139,7 @@ func TestBearerToken_IgnoresNonBearerScheme(t *testing.T) {
 }
 
 func TestTokenErrMessage_Mapping(t *testing.T) {
-	for _, code := range []string{tokenErrMissing, tokenErrInvalid, tokenErrExpired, tokenErrNoSub} {
+	for _, code := range []string{tokenErrMissing, tokenErrInvalid, tokenErrExpired, tokenErrNoSub, tokenErrWrongAudience} {
 		if tokenErrMessage(code) == "" {
 			t.Fatalf("code %q produced empty message", code)
 		}
@@ -145,3 +148,35 @@ func TestTokenErrMessage_Mapping(t *testing.T) {
 		t.Fatalf("default: want unauthorized, got %q", got)
 	}
 }
+
+func TestVerifyToken_WrongAudience(t *testing.T) {
+	aud := "other-app.apps.googleusercontent.com"
+	stubValidator(t, func(context.Context, string, string) (*idtoken.Payload, error) {
+		return &idtoken.Payload{
+			Audience: aud,
+			Subject:  "user-123",
+			Expires:  time.Now().Add(time.Hour).Unix(),
+		}, nil
+	})
+
+	_, code, err := verifyToken(context.Background(), "someone-elses-token")
+	if code != tokenErrWrongAudience || err == nil {
+		t.Fatalf("code=%q err=%v, want %q", code, err, tokenErrWrongAudience)
+	}
+
+	// Every configured client ID is accepted, e.g. the iOS app's.
+	prev := googleClientIDs
+	googleClientIDs = parseClientIDs("android-client, " + aud)
+	t.Cleanup(func() { googleClientIDs = prev })
+	if sub, code, _ := verifyToken(context.Background(), "ios-token"); code != "" || sub != "user-123" {
+		t.Fatalf("configured audience rejected: sub=%q code=%q", sub, code)
+	}
+}
+
+func TestLogTokenFailure_CountsByReason(t *testing.T) {
+	before := readCounter(t, tokenRejectionsTotal.WithLabelValues(tokenErrWrongAudience))
+	logTokenFailure(tokenErrWrongAudience, errors.New("aud"), "tok", "127.0.0.1:1")
+	if got := readCounter(t, tokenRejectionsTotal.WithLabelValues(tokenErrWrongAudience)); got != before+1 {
+		t.Fatalf("rejections = %v, want %v", got, before+1)
+	}
+}
@@ -10,7 +10,8 @@ import (
 	"github.com/jackc/pgx/v5"
 )
 
-// blockRequest is the JSON body accepted by POST /block.
+// blockRequest is the JSON body accepted by POST /block. BlockedUserID is
+// the peer handle from the match event, not a user ID.
 type blockRequest struct {
 	BlockedUserID string `json:"blocked_user_id"`
 }
@@ -33,7 +34,7 @@ func blockHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, 1<<10) // 1 KiB; only a sub fits.
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<10) // 1 KiB; only a handle fits.
 	defer func() { _ = r.Body.Close() }()
 
 	var req blockRequest
@@ -42,11 +43,16 @@ func blockHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	blockedSub := strings.TrimSpace(req.BlockedUserID)
-	if blockedSub == "" {
+	blockedHandle := strings.TrimSpace(req.BlockedUserID)
+	if blockedHandle == "" {
 		writeError(w, http.StatusBadRequest, "missing_blocked_user", "blocked_user_id is required")
 		return
 	}
+	blockedSub, ok := matchMaker.ResolvePeer(ctx, blockerSub, blockedHandle)
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown_peer", "blocked_user_id is not a recent match")
+		return
+	}
 	if blockedSub == blockerSub {
 		writeError(w, http.StatusBadRequest, "self_block", "cannot block yourself")
 		return
@@ -59,18 +65,17 @@ func blockHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	blockedID, err := getUserIDByGoogleSub(ctx, blockedSub)
+	blockedID, err := getUserIDBySub(ctx, blockedSub)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Every matched user has a row from connecting, so the blocked user
+		// has deleted their account since.
+		writeError(w, http.StatusNotFound, "unknown_peer", "blocked_user_id is not a recent match")
+		return
+	}
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			// Stub the row so matchmaker bookkeeping has a target FK; mirrors
-			// the same fallback in reportHandler.
-			blockedID, _, err = upsertUser(ctx, blockedSub)
-		}
-		if err != nil {
-			slog.Error("block: lookup blocked", "error", err)
-			writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
-			return
-		}
+		slog.Error("block: lookup blocked", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
 	}
 
 	if err := insertBlock(ctx, blockerID, blockedID); err != nil {
@@ -92,12 +97,12 @@ func blockHandler(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte(`{"blocked":true}`))
 }
 
-// blocksHandler returns the authenticated user's full block list as
-// `{"blocked_ids": [...]}`. Clients call this on launch to rehydrate their
-// local cache so blocks survive reinstalls, new devices, and long offline
-// periods. The matchmaker treats blocks as symmetric (insertBlock writes both
-// directions), so this list also covers blocks where the caller was the
-// blocked party.
+// blocksHandler returns how many users the authenticated user is blocked
+// from matching with, as `{"blocked_count": n}`. The matchmaker treats
+// blocks as symmetric (insertBlock writes both directions), so this also
+// counts blocks where the caller was the blocked party. The blocked users'
+// IDs are not returned: clients only ever know peers by per-match handles,
+// and the list would reveal who blocked the caller.
 func blocksHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.Header().Set("Allow", http.MethodGet)
@@ -113,11 +118,11 @@ func blocksHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID, err := getUserIDByGoogleSub(ctx, sub)
+	userID, err := getUserIDBySub(ctx, sub)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			// Caller has never been seen — no row, no blocks.
-			writeBlocksResponse(w, nil)
+			writeBlocksResponse(w, 0)
 			return
 		}
 		slog.Error("blocks: lookup user", "error", err)
@@ -131,13 +136,10 @@ func blocksHandler(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
 		return
 	}
-	writeBlocksResponse(w, subs)
+	writeBlocksResponse(w, len(subs))
 }
 
-func writeBlocksResponse(w http.ResponseWriter, subs []string) {
-	if subs == nil {
-		subs = []string{}
-	}
+func writeBlocksResponse(w http.ResponseWriter, count int) {
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string][]string{"blocked_ids": subs})
+	_ = json.NewEncoder(w).Encode(map[string]int{"blocked_count": count})
 }
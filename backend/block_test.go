@@ -6,7 +6,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -140,39 +140,58 @@ func TestLoadUserBlocks_EmptyForFreshUser(t *testing.T) {
 	}
 }
 
-// End-to-end coverage for the launch-time hydrate flow: post a couple of
-// blocks via POST /block, then GET /blocks and confirm the body lists both
-// targets. Guards against the "fresh install loses block list" regression.
-func TestBlocksHandler_ReturnsListAfterPosts(t *testing.T) {
+// End-to-end coverage for blocking a peer by handle: post a couple of blocks
+// via POST /block, then GET /blocks and confirm both are counted. A handle
+// the caller was never given is refused.
+func TestBlocksHandler_CountsBlocksAfterPosts(t *testing.T) {
 	setupTestDB(t)
+	ctx := context.Background()
 
 	// Stub auth: the bearer string is treated as the google_sub directly so
 	// each request maps cleanly to a known user.
 	stubValidator(t, func(_ context.Context, token, _ string) (*idtoken.Payload, error) {
-		return &idtoken.Payload{Subject: token, Expires: time.Now().Add(time.Hour).Unix()}, nil
+		return &idtoken.Payload{Audience: googleClientIDs[0], Subject: token, Expires: time.Now().Add(time.Hour).Unix()}, nil
 	})
 
-	// blockHandler calls matchMaker.AddBlock against Redis; back it with
-	// miniredis for the duration of the test.
+	// blockHandler resolves handles and calls matchMaker.AddBlock against
+	// Redis; back it with miniredis for the duration of the test.
 	mm, _, _ := newTestMatchMaker(t)
 	prevMM := matchMaker
 	matchMaker = mm
 	t.Cleanup(func() { matchMaker = prevMM })
 
-	post := func(blockerSub, blockedSub string) {
+	post := func(blockerSub, handle string) *httptest.ResponseRecorder {
 		t.Helper()
-		body := bytes.NewBufferString(`{"blocked_user_id":"` + blockedSub + `"}`)
+		body := bytes.NewBufferString(`{"blocked_user_id":"` + handle + `"}`)
 		req := httptest.NewRequest(http.MethodPost, "/block", body)
 		req.Header.Set("Authorization", "Bearer "+blockerSub)
 		rr := httptest.NewRecorder()
 		blockHandler(rr, req)
-		if rr.Code != http.StatusCreated {
-			t.Fatalf("POST /block (block %s): status=%d body=%s", blockedSub, rr.Code, rr.Body.String())
-		}
+		return rr
 	}
 
-	post("blocker-sub", "victim-a")
-	post("blocker-sub", "victim-b")
+	// Matched users always have a row from connecting.
+	for _, sub := range []string{"victim-a", "victim-b"} {
+		if _, _, err := upsertUser(ctx, sub); err != nil {
+			t.Fatalf("upsertUser %s: %v", sub, err)
+		}
+	}
+	seesA, _ := pairPeers(ctx, mm, "blocker-sub", "victim-a", "m1")
+	seesB, victimSeesBlocker := pairPeers(ctx, mm, "blocker-sub", "victim-b", "m2")
+	for _, h := range []string{seesA, seesB} {
+		if rr := post("blocker-sub", h); rr.Code != http.StatusCreated {
+			t.Fatalf("POST /block (%s): status=%d body=%s", h, rr.Code, rr.Body.String())
+		}
+	}
+	if rr := post("blocker-sub", "victim-a"); rr.Code != http.StatusNotFound {
+		t.Fatalf("POST /block with a raw user ID: want 404, got %d", rr.Code)
+	}
+	if rr := post("someone-else", victimSeesBlocker); rr.Code != http.StatusNotFound {
+		t.Fatalf("POST /block with another user's handle: want 404, got %d", rr.Code)
+	}
+	if blocked, _ := mm.rdb.SIsMember(ctx, blocksKey("blocker-sub"), "victim-b").Result(); !blocked {
+		t.Fatalf("the handle must resolve to victim-b in the online block set")
+	}
 
 	req := httptest.NewRequest(http.MethodGet, "/blocks", nil)
 	req.Header.Set("Authorization", "Bearer blocker-sub")
@@ -181,18 +200,18 @@ func TestBlocksHandler_ReturnsListAfterPosts(t *testing.T) {
 	if rr.Code != http.StatusOK {
 		t.Fatalf("GET /blocks: status=%d body=%s", rr.Code, rr.Body.String())
 	}
+	if strings.Contains(rr.Body.String(), "victim") {
+		t.Fatalf("GET /blocks must not reveal user IDs: %s", rr.Body.String())
+	}
 
 	var resp struct {
-		BlockedIDs []string `json:"blocked_ids"`
+		BlockedCount int `json:"blocked_count"`
 	}
 	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
 		t.Fatalf("decode response: %v (body=%s)", err, rr.Body.String())
 	}
-	got := append([]string(nil), resp.BlockedIDs...)
-	sort.Strings(got)
-	want := []string{"victim-a", "victim-b"}
-	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
-		t.Fatalf("blocked_ids: want %v, got %v", want, got)
+	if resp.BlockedCount != 2 {
+		t.Fatalf("blocked_count: want 2, got %d", resp.BlockedCount)
 	}
 }
 
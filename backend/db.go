@@ -59,8 +59,107 @@ CREATE TABLE IF NOT EXISTS blocks (
 
 CREATE INDEX IF NOT EXISTS blocks_blocked_idx
 	ON blocks (blocked_id);
+
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS blocks_received_count INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS pool_override TEXT;
+
+CREATE TABLE IF NOT EXISTS call_ratings (
+	rater_id   BIGINT      NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	rated_id   BIGINT      NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	match_id   TEXT        NOT NULL,
+	rating     SMALLINT    NOT NULL CHECK (rating IN (-1, 1)),
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (rater_id, match_id)
+);
+
+CREATE INDEX IF NOT EXISTS call_ratings_rated_created_idx
+	ON call_ratings (rated_id, created_at DESC);
+
+CREATE INDEX IF NOT EXISTS call_ratings_created_idx
+	ON call_ratings (created_at);
+
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS age_band TEXT CHECK (age_band IN ('adult', 'minor')),
+	ADD COLUMN IF NOT EXISTS age_source TEXT,
+	ADD COLUMN IF NOT EXISTS age_verified_at TIMESTAMPTZ;
+
+-- Users are keyed by identity provider plus that provider's subject, so a
+-- Google and an Apple account can never collide. Rows created before Apple
+-- sign-in are all Google's.
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM information_schema.columns
+	            WHERE table_schema = current_schema()
+	              AND table_name = 'users' AND column_name = 'google_sub') THEN
+		ALTER TABLE users RENAME COLUMN google_sub TO subject;
+		ALTER TABLE users DROP CONSTRAINT IF EXISTS users_google_sub_key;
+	END IF;
+END $$;
+
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS provider TEXT NOT NULL DEFAULT 'google';
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_provider_subject_key
+	ON users (provider, subject);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token_hash TEXT        PRIMARY KEY,
+	user_id    BIGINT      NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	family_id  TEXT        NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	expires_at TIMESTAMPTZ NOT NULL,
+	used_at    TIMESTAMPTZ,
+	revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_user_idx
+	ON refresh_tokens (user_id);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx
+	ON refresh_tokens (family_id);
+
+-- Account deletion (DELETE /me). A deleted user with reports against them
+-- keeps a pseudonymous row so those reports can still be moderated.
+-- account_deletions is the compliance log and holds no identifiers beyond
+-- the former row ID.
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS account_deletions (
+	id              BIGSERIAL   PRIMARY KEY,
+	user_id         BIGINT      NOT NULL,
+	provider        TEXT        NOT NULL,
+	pseudonymized   BOOLEAN     NOT NULL,
+	reports_deleted INTEGER     NOT NULL,
+	screenshots     INTEGER     NOT NULL,
+	deleted_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Why, by whom and until when a user is banned. A ban with an expiry is a
+-- suspension and lapses on its own (see banActive).
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS ban_reason TEXT,
+	ADD COLUMN IF NOT EXISTS ban_source TEXT,
+	ADD COLUMN IF NOT EXISTS ban_expires_at TIMESTAMPTZ;
+
+-- Terms of service acceptance (POST /me/accept-terms), one row per version
+-- a user accepted.
+CREATE TABLE IF NOT EXISTS terms_acceptances (
+	user_id     BIGINT      NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	version     TEXT        NOT NULL,
+	accepted_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (user_id, version)
+);
 `
 
+// subColumn is the SQL expression for the principal ID (see principalID) of
+// the users row named table in a query.
+func subColumn(table string) string {
+	return "CASE WHEN " + table + ".provider = '" + providerGoogle + "' THEN " + table + ".subject" +
+		" ELSE " + table + ".provider || ':' || " + table + ".subject END"
+}
+
 func initDB(ctx context.Context, dsn string) (*pgxpool.Pool, error) {
 	pool, err := pgxpool.New(ctx, dsn)
 	if err != nil {
@@ -81,31 +180,33 @@ func initDB(ctx context.Context, dsn string) (*pgxpool.Pool, error) {
 }
 
 // upsertUser inserts a new user row on first login; does nothing if the user
-// already exists. Returns the internal users.id and whether this was a
-// brand-new user.
-func upsertUser(ctx context.Context, googleSub string) (id int64, isNew bool, err error) {
+// already exists. sub is the user's principal ID (see principalID). Returns
+// the internal users.id and whether this was a brand-new user.
+func upsertUser(ctx context.Context, sub string) (id int64, isNew bool, err error) {
+	provider, subject := splitPrincipal(sub)
 	err = db.QueryRow(ctx,
-		`INSERT INTO users (google_sub) VALUES ($1)
-		 ON CONFLICT (google_sub) DO UPDATE SET google_sub = EXCLUDED.google_sub
+		`INSERT INTO users (provider, subject) VALUES ($1, $2)
+		 ON CONFLICT (provider, subject) DO UPDATE SET subject = EXCLUDED.subject
 		 RETURNING id, (xmax = 0)`,
-		googleSub,
+		provider, subject,
 	).Scan(&id, &isNew)
 	if err != nil {
 		return 0, false, fmt.Errorf("upsertUser: %w", err)
 	}
 	if isNew {
-		slog.Info("New user registered", "google_sub", googleSub)
+		slog.Info("New user registered", "provider", provider, "subject", subject)
 	}
 	return id, isNew, nil
 }
 
-// getUserIDByGoogleSub looks up the internal user id for a given google_sub.
+// getUserIDBySub looks up the internal user id for a principal ID.
 // Returns pgx.ErrNoRows if the user does not exist.
-func getUserIDByGoogleSub(ctx context.Context, googleSub string) (int64, error) {
+func getUserIDBySub(ctx context.Context, sub string) (int64, error) {
+	provider, subject := splitPrincipal(sub)
 	var id int64
 	err := db.QueryRow(ctx,
-		`SELECT id FROM users WHERE google_sub = $1`,
-		googleSub,
+		`SELECT id FROM users WHERE provider = $1 AND subject = $2`,
+		provider, subject,
 	).Scan(&id)
 	if err != nil {
 		return 0, err
@@ -113,21 +214,37 @@ func getUserIDByGoogleSub(ctx context.Context, googleSub string) (int64, error)
 	return id, nil
 }
 
-// isUserBanned returns true if the user with the given google_sub has a
-// non-null banned_at timestamp.
-func isUserBanned(ctx context.Context, googleSub string) (bool, error) {
-	var bannedAt *time.Time
+// banActive is the SQL expression for whether the users row named table is
+// banned now: it has a ban that has no expiry or has not reached it.
+func banActive(table string) string {
+	return "(" + table + ".banned_at IS NOT NULL AND (" + table + ".ban_expires_at IS NULL OR " + table + ".ban_expires_at > NOW()))"
+}
+
+// Who banned a user (users.ban_source).
+const (
+	banSourceAdmin = "admin"
+	banSourceAuto  = "auto"
+)
+
+// autoBanReason is the ban_reason recorded by the report auto-ban.
+const autoBanReason = "reports"
+
+// isUserBanned returns true if the user with the given principal ID has an
+// active ban (see banActive).
+func isUserBanned(ctx context.Context, sub string) (bool, error) {
+	provider, subject := splitPrincipal(sub)
+	var banned bool
 	err := db.QueryRow(ctx,
-		`SELECT banned_at FROM users WHERE google_sub = $1`,
-		googleSub,
-	).Scan(&bannedAt)
+		`SELECT `+banActive("users")+` FROM users WHERE provider = $1 AND subject = $2`,
+		provider, subject,
+	).Scan(&banned)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return false, nil
 		}
 		return false, err
 	}
-	return bannedAt != nil, nil
+	return banned, nil
 }
 
 // recordReport inserts the report row, increments the reported user's count,
@@ -178,13 +295,20 @@ func recordReport(ctx context.Context, reporterID, reportedID int64, reason, scr
 
 	if recent > AutoBanThreshold {
 		ct, err := tx.Exec(ctx,
-			`UPDATE users SET banned_at = NOW() WHERE id = $1 AND banned_at IS NULL`,
-			reportedID,
+			`UPDATE users
+			    SET banned_at = NOW(), ban_reason = $2, ban_source = $3, ban_expires_at = NULL
+			  WHERE id = $1 AND NOT `+banActive("users"),
+			reportedID, autoBanReason, banSourceAuto,
 		)
 		if err != nil {
 			return false, fmt.Errorf("set banned_at: %w", err)
 		}
 		banned = ct.RowsAffected() > 0
+		if banned {
+			if _, err = tx.Exec(ctx, revokeUserRefreshTokensSQL, reportedID); err != nil {
+				return false, fmt.Errorf("revoke refresh tokens: %w", err)
+			}
+		}
 	}
 
 	if err = tx.Commit(ctx); err != nil {
@@ -194,7 +318,8 @@ func recordReport(ctx context.Context, reporterID, reportedID int64, reason, scr
 }
 
 // ReportRow is a row returned to the admin dashboard. It joins the report
-// with the reported user's google_sub, ban status, and lifetime report count.
+// with both users' principal IDs and the reported user's ban status and
+// lifetime report count.
 type ReportRow struct {
 	ID                   int64      `json:"id"`
 	ReporterID           int64      `json:"reporter_id"`
@@ -231,9 +356,9 @@ func listReports(ctx context.Context, reasonFilter string, limit, offset int) ([
 	}
 
 	query := `
-		SELECT r.id, r.reporter_id, ru.google_sub, r.reported_id, tu.google_sub,
+		SELECT r.id, r.reporter_id, ` + subColumn("ru") + `, r.reported_id, ` + subColumn("tu") + `,
 		       r.reason, r.screenshot_url, r.screenshot_key, r.created_at,
-		       tu.reports_received_count, tu.banned_at
+		       tu.reports_received_count, CASE WHEN ` + banActive("tu") + ` THEN tu.banned_at END
 		  FROM reports r
 		  JOIN users ru ON ru.id = r.reporter_id
 		  JOIN users tu ON tu.id = r.reported_id` + where + `
@@ -281,9 +406,9 @@ func listReports(ctx context.Context, reasonFilter string, limit, offset int) ([
 func getReport(ctx context.Context, id int64) (ReportRow, error) {
 	var r ReportRow
 	err := db.QueryRow(ctx, `
-		SELECT r.id, r.reporter_id, ru.google_sub, r.reported_id, tu.google_sub,
+		SELECT r.id, r.reporter_id, `+subColumn("ru")+`, r.reported_id, `+subColumn("tu")+`,
 		       r.reason, r.screenshot_url, r.screenshot_key, r.created_at,
-		       tu.reports_received_count, tu.banned_at
+		       tu.reports_received_count, CASE WHEN `+banActive("tu")+` THEN tu.banned_at END
 		  FROM reports r
 		  JOIN users ru ON ru.id = r.reporter_id
 		  JOIN users tu ON tu.id = r.reported_id
@@ -299,44 +424,75 @@ func getReport(ctx context.Context, id int64) (ReportRow, error) {
 	return r, nil
 }
 
-// banUser sets banned_at = NOW() if the user is not already banned. Returns
-// the user's google_sub (so callers can drop their websocket) and whether a
-// state change occurred. pgx.ErrNoRows if the user does not exist.
-func banUser(ctx context.Context, id int64) (googleSub string, changed bool, err error) {
+// Ban is why, by whom and until when a user is banned. A nil ExpiresAt
+// bans until an admin lifts it.
+type Ban struct {
+	Reason    string
+	Source    string
+	ExpiresAt *time.Time
+}
+
+// banUser bans the user and revokes their refresh tokens. A user already
+// banned keeps their original banned_at, but their ban takes the new source
+// and expiry, and the new reason when one is given, so an admin can turn a
+// suspension into a ban or extend it. An expired suspension counts as not
+// banned. Returns the user's principal ID (so callers can drop their
+// websocket), the ban as stored and whether the user was newly banned.
+// pgx.ErrNoRows if the user does not exist.
+func banUser(ctx context.Context, id int64, ban Ban) (sub string, stored Ban, changed bool, err error) {
+	var reason *string
+	if ban.Reason != "" {
+		reason = &ban.Reason
+	}
+	var storedReason *string
 	err = db.QueryRow(ctx, `
+		WITH prev AS (
+			SELECT `+banActive("users")+` AS active FROM users WHERE id = $1 FOR UPDATE
+		)
 		UPDATE users
-		   SET banned_at = NOW()
-		 WHERE id = $1 AND banned_at IS NULL
-		RETURNING google_sub`, id,
-	).Scan(&googleSub)
-	if err == nil {
-		return googleSub, true, nil
+		   SET banned_at = CASE WHEN prev.active THEN users.banned_at ELSE NOW() END,
+		       ban_reason = CASE WHEN prev.active THEN COALESCE($2, users.ban_reason) ELSE $2 END,
+		       ban_source = $3, ban_expires_at = $4
+		  FROM prev
+		 WHERE users.id = $1
+		RETURNING `+subColumn("users")+`, users.ban_reason, users.ban_source, users.ban_expires_at, NOT prev.active`,
+		id, reason, ban.Source, ban.ExpiresAt,
+	).Scan(&sub, &storedReason, &stored.Source, &stored.ExpiresAt, &changed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", Ban{}, false, err
 	}
-	if !errors.Is(err, pgx.ErrNoRows) {
-		return "", false, fmt.Errorf("banUser update: %w", err)
-	}
-	// Either the user does not exist or is already banned. Look up to
-	// distinguish.
-	err = db.QueryRow(ctx,
-		`SELECT google_sub FROM users WHERE id = $1`, id,
-	).Scan(&googleSub)
 	if err != nil {
-		return "", false, err
+		return "", Ban{}, false, fmt.Errorf("banUser update: %w", err)
 	}
-	return googleSub, false, nil
+	if storedReason != nil {
+		stored.Reason = *storedReason
+	}
+	if changed {
+		if _, err := db.Exec(ctx, revokeUserRefreshTokensSQL, id); err != nil {
+			return sub, stored, true, fmt.Errorf("banUser revoke refresh tokens: %w", err)
+		}
+	}
+	return sub, stored, changed, nil
 }
 
 // insertBlock records a symmetric block between blockerID and blockedID:
 // neither user can be re-matched with the other from any pod. Two directional
 // rows are written so loadUserBlocks works unchanged on either side.
-// Idempotent: duplicate pairs are silently ignored.
+// Idempotent: duplicate pairs are silently ignored. The blocked user's
+// blocks_received_count (a trust-score input) only counts the first block
+// blockerID initiates against them.
 func insertBlock(ctx context.Context, blockerID, blockedID int64) error {
 	if blockerID == blockedID {
 		return fmt.Errorf("insertBlock: cannot block self")
 	}
 	_, err := db.Exec(ctx,
-		`INSERT INTO blocks (blocker_id, blocked_id) VALUES ($1, $2), ($2, $1)
-		 ON CONFLICT (blocker_id, blocked_id) DO NOTHING`,
+		`WITH ins AS (
+			INSERT INTO blocks (blocker_id, blocked_id) VALUES ($1, $2), ($2, $1)
+			ON CONFLICT (blocker_id, blocked_id) DO NOTHING
+			RETURNING blocker_id
+		)
+		UPDATE users SET blocks_received_count = blocks_received_count + 1
+		 WHERE id = $2 AND EXISTS (SELECT 1 FROM ins WHERE blocker_id = $1)`,
 		blockerID, blockedID,
 	)
 	if err != nil {
@@ -345,11 +501,11 @@ func insertBlock(ctx context.Context, blockerID, blockedID int64) error {
 	return nil
 }
 
-// loadUserBlocks returns the google_subs of every user blockerID has blocked.
-// Used to hydrate the per-user block SET in Redis on connect.
+// loadUserBlocks returns the principal IDs of every user blockerID has
+// blocked. Used to hydrate the per-user block SET in Redis on connect.
 func loadUserBlocks(ctx context.Context, blockerID int64) ([]string, error) {
 	rows, err := db.Query(ctx,
-		`SELECT u.google_sub FROM blocks b
+		`SELECT `+subColumn("u")+` FROM blocks b
 		 JOIN users u ON u.id = b.blocked_id
 		 WHERE b.blocker_id = $1`,
 		blockerID,
@@ -373,26 +529,650 @@ func loadUserBlocks(ctx context.Context, blockerID int64) ([]string, error) {
 	return subs, nil
 }
 
-// unbanUser clears banned_at. Returns whether a state change occurred.
-// pgx.ErrNoRows if the user does not exist.
-func unbanUser(ctx context.Context, id int64) (googleSub string, changed bool, err error) {
+// unbanUser clears the user's ban, active or expired. Returns whether a
+// state change occurred. pgx.ErrNoRows if the user does not exist.
+func unbanUser(ctx context.Context, id int64) (sub string, changed bool, err error) {
 	err = db.QueryRow(ctx, `
 		UPDATE users
-		   SET banned_at = NULL
+		   SET banned_at = NULL, ban_reason = NULL, ban_source = NULL, ban_expires_at = NULL
 		 WHERE id = $1 AND banned_at IS NOT NULL
-		RETURNING google_sub`, id,
-	).Scan(&googleSub)
+		RETURNING `+subColumn("users"), id,
+	).Scan(&sub)
 	if err == nil {
-		return googleSub, true, nil
+		return sub, true, nil
 	}
 	if !errors.Is(err, pgx.ErrNoRows) {
 		return "", false, fmt.Errorf("unbanUser update: %w", err)
 	}
 	err = db.QueryRow(ctx,
-		`SELECT google_sub FROM users WHERE id = $1`, id,
-	).Scan(&googleSub)
+		`SELECT `+subColumn("users")+` FROM users WHERE id = $1`, id,
+	).Scan(&sub)
 	if err != nil {
 		return "", false, err
 	}
-	return googleSub, false, nil
+	return sub, false, nil
+}
+
+// userSubByID returns the principal ID (the matchmaker's user ID) for a
+// user. pgx.ErrNoRows if the user does not exist.
+func userSubByID(ctx context.Context, id int64) (string, error) {
+	var sub string
+	err := db.QueryRow(ctx, `SELECT `+subColumn("users")+` FROM users WHERE id = $1`, id).Scan(&sub)
+	return sub, err
+}
+
+// userIDsBySubs maps each known principal ID to its internal user ID.
+func userIDsBySubs(ctx context.Context, subs []string) (map[string]int64, error) {
+	providers := make([]string, len(subs))
+	subjects := make([]string, len(subs))
+	for i, sub := range subs {
+		providers[i], subjects[i] = splitPrincipal(sub)
+	}
+	rows, err := db.Query(ctx,
+		`SELECT u.id, `+subColumn("u")+`
+		   FROM users u
+		   JOIN unnest($1::text[], $2::text[]) AS k(provider, subject)
+		     ON u.provider = k.provider AND u.subject = k.subject`,
+		providers, subjects,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]int64, len(subs))
+	for rows.Next() {
+		var id int64
+		var sub string
+		if err := rows.Scan(&id, &sub); err != nil {
+			return nil, err
+		}
+		out[sub] = id
+	}
+	return out, rows.Err()
+}
+
+// loadTrustInputs gathers everything trustScore needs for one user: account
+// age, the newest trustReportHistory report timestamps, lifetime report and
+// block counts, plus any admin pool override. pgx.ErrNoRows if the user does
+// not exist.
+func loadTrustInputs(ctx context.Context, id int64) (trustInputs, *string, error) {
+	var in trustInputs
+	var override *string
+	err := db.QueryRow(ctx,
+		`SELECT created_at, reports_received_count, blocks_received_count, pool_override
+		   FROM users WHERE id = $1`, id,
+	).Scan(&in.AccountCreatedAt, &in.ReportsTotal, &in.BlocksReceived, &override)
+	if err != nil {
+		return trustInputs{}, nil, err
+	}
+
+	rows, err := db.Query(ctx,
+		`SELECT created_at FROM reports
+		  WHERE reported_id = $1
+		  ORDER BY created_at DESC
+		  LIMIT $2`,
+		id, trustReportHistory,
+	)
+	if err != nil {
+		return trustInputs{}, nil, fmt.Errorf("loadTrustInputs reports: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var at time.Time
+		if err := rows.Scan(&at); err != nil {
+			return trustInputs{}, nil, fmt.Errorf("loadTrustInputs scan: %w", err)
+		}
+		in.ReportTimes = append(in.ReportTimes, at)
+	}
+	if err := rows.Err(); err != nil {
+		return trustInputs{}, nil, fmt.Errorf("loadTrustInputs rows: %w", err)
+	}
+	return in, override, nil
+}
+
+// setPoolOverride pins the user to a pool, or clears the pin when pool is
+// nil. Returns the user's principal ID so callers can update a live session.
+// pgx.ErrNoRows if the user does not exist.
+func setPoolOverride(ctx context.Context, id int64, pool *string) (sub string, err error) {
+	err = db.QueryRow(ctx,
+		`UPDATE users SET pool_override = $2 WHERE id = $1 RETURNING `+subColumn("users"),
+		id, pool,
+	).Scan(&sub)
+	return sub, err
+}
+
+// loadAgeStatus returns the user's stored age band, if any, and its source.
+func loadAgeStatus(ctx context.Context, id int64) (AgeStatus, error) {
+	st := AgeStatus{UserID: id}
+	err := db.QueryRow(ctx,
+		`SELECT age_band, age_source, age_verified_at FROM users WHERE id = $1`, id,
+	).Scan(&st.AgeBand, &st.Source, &st.VerifiedAt)
+	return st, err
+}
+
+// setAgeBand stores the user's age band and who determined it, or clears
+// both when band is nil. Returns the user's principal ID so callers can update
+// a live session. pgx.ErrNoRows if the user does not exist.
+func setAgeBand(ctx context.Context, id int64, band *string, source string) (sub string, err error) {
+	err = db.QueryRow(ctx,
+		`UPDATE users
+		    SET age_band = $2,
+		        age_source = CASE WHEN $2::text IS NULL THEN NULL ELSE $3 END,
+		        age_verified_at = CASE WHEN $2::text IS NULL THEN NULL ELSE NOW() END
+		  WHERE id = $1
+		 RETURNING `+subColumn("users"),
+		id, band, source,
+	).Scan(&sub)
+	return sub, err
+}
+
+// recordRating stores raterSub's rating of ratedSub for one match. Rating the
+// same match again replaces the earlier value. Both users are looked up by
+// principal ID; it is an error if either does not exist.
+func recordRating(ctx context.Context, raterSub, ratedSub, matchID string, rating int) error {
+	raterProvider, raterSubject := splitPrincipal(raterSub)
+	ratedProvider, ratedSubject := splitPrincipal(ratedSub)
+	ct, err := db.Exec(ctx,
+		`INSERT INTO call_ratings (rater_id, rated_id, match_id, rating)
+		 SELECT r.id, d.id, $5, $6
+		   FROM users r, users d
+		  WHERE r.provider = $1 AND r.subject = $2
+		    AND d.provider = $3 AND d.subject = $4
+		 ON CONFLICT (rater_id, match_id)
+		 DO UPDATE SET rating = EXCLUDED.rating, created_at = NOW()`,
+		raterProvider, raterSubject, ratedProvider, ratedSubject, matchID, rating,
+	)
+	if err != nil {
+		return fmt.Errorf("recordRating: %w", err)
+	}
+	if ct.RowsAffected() == 0 {
+		return fmt.Errorf("recordRating: unknown user")
+	}
+	return nil
+}
+
+// loadRatingCounts returns how many thumbs-up and thumbs-down the user has
+// received since `since`.
+func loadRatingCounts(ctx context.Context, id int64, since time.Time) (up, down int, err error) {
+	err = db.QueryRow(ctx,
+		`SELECT COUNT(*) FILTER (WHERE rating > 0), COUNT(*) FILTER (WHERE rating < 0)
+		   FROM call_ratings
+		  WHERE rated_id = $1 AND created_at >= $2`,
+		id, since,
+	).Scan(&up, &down)
+	if err != nil {
+		return 0, 0, fmt.Errorf("loadRatingCounts: %w", err)
+	}
+	return up, down, nil
+}
+
+// RatingDay is one UTC day of the admin rating distribution.
+type RatingDay struct {
+	Day  string `json:"day"`
+	Up   int    `json:"up"`
+	Down int    `json:"down"`
+}
+
+// ratingsByDay returns per-UTC-day thumbs-up/down counts since `since`,
+// oldest first. Days without ratings are omitted.
+func ratingsByDay(ctx context.Context, since time.Time) ([]RatingDay, error) {
+	rows, err := db.Query(ctx,
+		`SELECT (created_at AT TIME ZONE 'UTC')::date AS day,
+		        COUNT(*) FILTER (WHERE rating > 0),
+		        COUNT(*) FILTER (WHERE rating < 0)
+		   FROM call_ratings
+		  WHERE created_at >= $1
+		  GROUP BY day
+		  ORDER BY day`,
+		since,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ratingsByDay: %w", err)
+	}
+	defer rows.Close()
+
+	out := []RatingDay{}
+	for rows.Next() {
+		var day time.Time
+		var d RatingDay
+		if err := rows.Scan(&day, &d.Up, &d.Down); err != nil {
+			return nil, fmt.Errorf("ratingsByDay scan: %w", err)
+		}
+		d.Day = day.Format(time.DateOnly)
+		out = append(out, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ratingsByDay rows: %w", err)
+	}
+	return out, nil
+}
+
+// revokeUserRefreshTokensSQL revokes every live refresh token of user $1,
+// ending all their sessions once their access tokens expire.
+const revokeUserRefreshTokensSQL = `UPDATE refresh_tokens SET revoked_at = NOW()
+	WHERE user_id = $1 AND revoked_at IS NULL`
+
+// insertRefreshToken stores a new login's first refresh token, clearing out
+// the user's expired ones while at it.
+func insertRefreshToken(ctx context.Context, userID int64, familyID, hash string, expiresAt time.Time) error {
+	if _, err := db.Exec(ctx,
+		`DELETE FROM refresh_tokens WHERE user_id = $1 AND expires_at < NOW()`, userID,
+	); err != nil {
+		return fmt.Errorf("insertRefreshToken cleanup: %w", err)
+	}
+	if _, err := db.Exec(ctx,
+		`INSERT INTO refresh_tokens (token_hash, user_id, family_id, expires_at)
+		 VALUES ($1, $2, $3, $4)`,
+		hash, userID, familyID, expiresAt,
+	); err != nil {
+		return fmt.Errorf("insertRefreshToken: %w", err)
+	}
+	return nil
+}
+
+// rotateRefreshToken spends the refresh token stored under oldHash and
+// stores its successor under newHash in the same family. Returns the
+// owner's principal ID, and errRefreshInvalid, errRefreshExpired,
+// errRefreshReused or errRefreshBanned when the token can't be spent. A
+// reused token revokes its family; a banned owner's tokens are all revoked.
+func rotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (sub string, err error) {
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return "", fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var (
+		userID            int64
+		familyID          string
+		expires           time.Time
+		usedAt, revokedAt *time.Time
+		banned            bool
+	)
+	err = tx.QueryRow(ctx,
+		`SELECT rt.user_id, rt.family_id, rt.expires_at, rt.used_at, rt.revoked_at,
+		        `+banActive("u")+`, `+subColumn("u")+`
+		   FROM refresh_tokens rt
+		   JOIN users u ON u.id = rt.user_id
+		  WHERE rt.token_hash = $1
+		    FOR UPDATE OF rt`,
+		oldHash,
+	).Scan(&userID, &familyID, &expires, &usedAt, &revokedAt, &banned, &sub)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errRefreshInvalid
+	}
+	if err != nil {
+		return "", fmt.Errorf("rotateRefreshToken lookup: %w", err)
+	}
+
+	switch {
+	case revokedAt != nil:
+		return sub, errRefreshInvalid
+	case usedAt != nil:
+		if _, err := tx.Exec(ctx,
+			`UPDATE refresh_tokens SET revoked_at = NOW()
+			  WHERE family_id = $1 AND revoked_at IS NULL`, familyID,
+		); err != nil {
+			return sub, fmt.Errorf("rotateRefreshToken revoke family: %w", err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return sub, fmt.Errorf("commit tx: %w", err)
+		}
+		return sub, errRefreshReused
+	case banned:
+		if _, err := tx.Exec(ctx, revokeUserRefreshTokensSQL, userID); err != nil {
+			return sub, fmt.Errorf("rotateRefreshToken revoke user: %w", err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return sub, fmt.Errorf("commit tx: %w", err)
+		}
+		return sub, errRefreshBanned
+	case !expires.After(time.Now()):
+		return sub, errRefreshExpired
+	}
+
+	if _, err := tx.Exec(ctx,
+		`UPDATE refresh_tokens SET used_at = NOW() WHERE token_hash = $1`, oldHash,
+	); err != nil {
+		return sub, fmt.Errorf("rotateRefreshToken spend: %w", err)
+	}
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO refresh_tokens (token_hash, user_id, family_id, expires_at)
+		 VALUES ($1, $2, $3, $4)`,
+		newHash, userID, familyID, expiresAt,
+	); err != nil {
+		return sub, fmt.Errorf("rotateRefreshToken insert: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return sub, fmt.Errorf("commit tx: %w", err)
+	}
+	return sub, nil
+}
+
+// reportScreenshotKeys returns the storage keys of the screenshots attached
+// to reports the user filed. Reports from before screenshot_key existed have
+// none.
+func reportScreenshotKeys(ctx context.Context, reporterID int64) ([]string, error) {
+	rows, err := db.Query(ctx,
+		`SELECT screenshot_key FROM reports WHERE reporter_id = $1 AND screenshot_key <> ''`,
+		reporterID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("reportScreenshotKeys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("reportScreenshotKeys scan: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reportScreenshotKeys rows: %w", err)
+	}
+	return keys, nil
+}
+
+// AccountDeletion is what deleteAccount did, for the compliance log.
+type AccountDeletion struct {
+	Provider       string
+	Pseudonymized  bool
+	ReportsDeleted int
+	// ScreenshotKeys are the storage keys of the deleted reports'
+	// screenshots, which the caller must delete from storage.
+	ScreenshotKeys []string
+}
+
+// errAccountBanned is returned by deleteAccount for a user under an active
+// ban: deleting the row would let them sign in again as a new, unbanned user.
+var errAccountBanned = errors.New("account banned")
+
+// deleteAccount erases the user in one transaction and records it in
+// account_deletions, refusing with errAccountBanned while the user is
+// banned. Reports the user filed are deleted. If reports were
+// filed against them the row is kept for moderation but pseudonymized:
+// its provider and subject are replaced with pseudonym (see
+// deletedPrincipal), its personal columns cleared and everything else tied
+// to it deleted. Otherwise the row is deleted and the rest cascades.
+func deleteAccount(ctx context.Context, id int64, pseudonym string) (AccountDeletion, error) {
+	var del AccountDeletion
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return del, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var banned bool
+	if err = tx.QueryRow(ctx,
+		`SELECT provider, `+banActive("users")+` FROM users WHERE id = $1 FOR UPDATE`, id,
+	).Scan(&del.Provider, &banned); err != nil {
+		return del, err
+	}
+	if banned {
+		return del, errAccountBanned
+	}
+
+	rows, err := tx.Query(ctx,
+		`DELETE FROM reports WHERE reporter_id = $1 RETURNING screenshot_key`, id)
+	if err != nil {
+		return del, fmt.Errorf("delete filed reports: %w", err)
+	}
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			rows.Close()
+			return del, fmt.Errorf("delete filed reports scan: %w", err)
+		}
+		del.ReportsDeleted++
+		if key != "" {
+			del.ScreenshotKeys = append(del.ScreenshotKeys, key)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return del, fmt.Errorf("delete filed reports: %w", err)
+	}
+
+	if err = tx.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM reports WHERE reported_id = $1)`, id,
+	).Scan(&del.Pseudonymized); err != nil {
+		return del, fmt.Errorf("check reports against user: %w", err)
+	}
+
+	if del.Pseudonymized {
+		provider, subject := splitPrincipal(pseudonym)
+		for _, q := range []string{
+			`DELETE FROM blocks WHERE blocker_id = $1 OR blocked_id = $1`,
+			`DELETE FROM call_ratings WHERE rater_id = $1 OR rated_id = $1`,
+			`DELETE FROM refresh_tokens WHERE user_id = $1`,
+			`DELETE FROM terms_acceptances WHERE user_id = $1`,
+		} {
+			if _, err = tx.Exec(ctx, q, id); err != nil {
+				return del, fmt.Errorf("pseudonymize: %w", err)
+			}
+		}
+		if _, err = tx.Exec(ctx, `
+			UPDATE users
+			   SET provider = $2, subject = $3, pool_override = NULL,
+			       age_band = NULL, age_source = NULL, age_verified_at = NULL,
+			       deleted_at = NOW()
+			 WHERE id = $1`,
+			id, provider, subject,
+		); err != nil {
+			return del, fmt.Errorf("pseudonymize user: %w", err)
+		}
+	} else if _, err = tx.Exec(ctx, `DELETE FROM users WHERE id = $1`, id); err != nil {
+		return del, fmt.Errorf("delete user: %w", err)
+	}
+
+	if _, err = tx.Exec(ctx,
+		`INSERT INTO account_deletions (user_id, provider, pseudonymized, reports_deleted, screenshots)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		id, del.Provider, del.Pseudonymized, del.ReportsDeleted, len(del.ScreenshotKeys),
+	); err != nil {
+		return del, fmt.Errorf("log deletion: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return del, fmt.Errorf("commit tx: %w", err)
+	}
+	return del, nil
+}
+
+// exportRowCount returns how many blocks, reports and ratings the user's
+// data export will list, to decide whether it is built inline.
+func exportRowCount(ctx context.Context, id int64) (int, error) {
+	var n int
+	err := db.QueryRow(ctx,
+		`SELECT (SELECT COUNT(*) FROM blocks WHERE blocker_id = $1)
+		      + (SELECT COUNT(*) FROM reports WHERE reporter_id = $1)
+		      + (SELECT COUNT(*) FROM call_ratings WHERE rater_id = $1)`,
+		id,
+	).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("exportRowCount: %w", err)
+	}
+	return n, nil
+}
+
+// loadAccountExport reads everything Postgres holds about the user for a
+// data export. Rows naming another user are reduced to the caller's side:
+// who was blocked, reported or rated is left out. pgx.ErrNoRows if the user
+// does not exist.
+func loadAccountExport(ctx context.Context, id int64) (AccountExport, error) {
+	var ex AccountExport
+	a := &ex.Account
+	err := db.QueryRow(ctx,
+		`SELECT `+subColumn("users")+`, provider, created_at, age_band, age_source, age_verified_at,
+		        pool_override, reports_received_count, blocks_received_count,
+		        `+banActive("users")+`, banned_at, ban_reason, ban_source, ban_expires_at
+		   FROM users WHERE id = $1`,
+		id,
+	).Scan(&a.UserID, &a.Provider, &a.CreatedAt, &a.AgeBand, &a.AgeSource, &a.AgeVerifiedAt,
+		&a.PoolOverride, &a.ReportsReceived, &a.BlocksReceived,
+		&ex.Ban.Banned, &ex.Ban.BannedAt, &ex.Ban.Reason, &ex.Ban.Source, &ex.Ban.ExpiresAt)
+	if err != nil {
+		return ex, err
+	}
+
+	rows, err := db.Query(ctx,
+		`SELECT created_at FROM blocks WHERE blocker_id = $1 ORDER BY created_at`, id)
+	if err != nil {
+		return ex, fmt.Errorf("loadAccountExport blocks: %w", err)
+	}
+	defer rows.Close()
+	ex.Blocks = []ExportBlock{}
+	for rows.Next() {
+		var b ExportBlock
+		if err := rows.Scan(&b.CreatedAt); err != nil {
+			return ex, fmt.Errorf("loadAccountExport blocks scan: %w", err)
+		}
+		ex.Blocks = append(ex.Blocks, b)
+	}
+	if err := rows.Err(); err != nil {
+		return ex, fmt.Errorf("loadAccountExport blocks rows: %w", err)
+	}
+
+	rows, err = db.Query(ctx,
+		`SELECT reason, created_at FROM reports WHERE reporter_id = $1 ORDER BY created_at`, id)
+	if err != nil {
+		return ex, fmt.Errorf("loadAccountExport reports: %w", err)
+	}
+	defer rows.Close()
+	ex.ReportsFiled = []ExportReport{}
+	for rows.Next() {
+		var r ExportReport
+		if err := rows.Scan(&r.Reason, &r.CreatedAt); err != nil {
+			return ex, fmt.Errorf("loadAccountExport reports scan: %w", err)
+		}
+		ex.ReportsFiled = append(ex.ReportsFiled, r)
+	}
+	if err := rows.Err(); err != nil {
+		return ex, fmt.Errorf("loadAccountExport reports rows: %w", err)
+	}
+
+	rows, err = db.Query(ctx,
+		`SELECT match_id, rating, created_at FROM call_ratings WHERE rater_id = $1 ORDER BY created_at`, id)
+	if err != nil {
+		return ex, fmt.Errorf("loadAccountExport ratings: %w", err)
+	}
+	defer rows.Close()
+	ex.RatingsGiven = []ExportRating{}
+	for rows.Next() {
+		var r ExportRating
+		if err := rows.Scan(&r.MatchID, &r.Rating, &r.CreatedAt); err != nil {
+			return ex, fmt.Errorf("loadAccountExport ratings scan: %w", err)
+		}
+		ex.RatingsGiven = append(ex.RatingsGiven, r)
+	}
+	if err := rows.Err(); err != nil {
+		return ex, fmt.Errorf("loadAccountExport ratings rows: %w", err)
+	}
+
+	rows, err = db.Query(ctx,
+		`SELECT version, accepted_at FROM terms_acceptances WHERE user_id = $1 ORDER BY accepted_at`, id)
+	if err != nil {
+		return ex, fmt.Errorf("loadAccountExport terms: %w", err)
+	}
+	defer rows.Close()
+	ex.Terms = []ExportTerms{}
+	for rows.Next() {
+		var t ExportTerms
+		if err := rows.Scan(&t.Version, &t.AcceptedAt); err != nil {
+			return ex, fmt.Errorf("loadAccountExport terms scan: %w", err)
+		}
+		ex.Terms = append(ex.Terms, t)
+	}
+	if err := rows.Err(); err != nil {
+		return ex, fmt.Errorf("loadAccountExport terms rows: %w", err)
+	}
+	return ex, nil
+}
+
+// recordTermsAcceptance stores that the user accepted a terms version and
+// returns when they first did; accepting it again keeps that time.
+func recordTermsAcceptance(ctx context.Context, id int64, version string) (time.Time, error) {
+	var at time.Time
+	err := db.QueryRow(ctx,
+		`INSERT INTO terms_acceptances (user_id, version) VALUES ($1, $2)
+		 ON CONFLICT (user_id, version) DO UPDATE SET version = EXCLUDED.version
+		 RETURNING accepted_at`,
+		id, version,
+	).Scan(&at)
+	if err != nil {
+		return at, fmt.Errorf("recordTermsAcceptance: %w", err)
+	}
+	return at, nil
+}
+
+// hasAcceptedTerms reports whether the user accepted the given terms version.
+func hasAcceptedTerms(ctx context.Context, id int64, version string) (bool, error) {
+	var ok bool
+	err := db.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM terms_acceptances WHERE user_id = $1 AND version = $2)`,
+		id, version,
+	).Scan(&ok)
+	if err != nil {
+		return false, fmt.Errorf("hasAcceptedTerms: %w", err)
+	}
+	return ok, nil
+}
+
+// AccountStatus is what GET /me reports about the user's own account.
+type AccountStatus struct {
+	UserID    string    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Ban       struct {
+		Banned    bool       `json:"banned"`
+		BannedAt  *time.Time `json:"banned_at"`
+		Reason    *string    `json:"reason"`
+		Source    *string    `json:"source"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	} `json:"ban"`
+	Terms struct {
+		AcceptedVersion *string    `json:"accepted_version"`
+		AcceptedAt      *time.Time `json:"accepted_at"`
+		CurrentVersion  string     `json:"current_version"`
+		Accepted        bool       `json:"accepted"`
+	} `json:"terms"`
+	BlocksCount int `json:"blocks_count"`
+}
+
+// loadAccountStatus reads the user's account status. Ban details are only
+// filled in while the ban is active. terms is the current terms version;
+// when it is empty there is nothing to accept. pgx.ErrNoRows if the user
+// does not exist.
+func loadAccountStatus(ctx context.Context, id int64, terms string) (AccountStatus, error) {
+	var st AccountStatus
+	var (
+		bannedAt, expiresAt *time.Time
+		reason, source      *string
+	)
+	err := db.QueryRow(ctx,
+		`SELECT `+subColumn("u")+`, u.created_at, `+banActive("u")+`,
+		        u.banned_at, u.ban_reason, u.ban_source, u.ban_expires_at,
+		        t.version, t.accepted_at,
+		        $2 = '' OR EXISTS (SELECT 1 FROM terms_acceptances a WHERE a.user_id = u.id AND a.version = $2),
+		        (SELECT COUNT(*) FROM blocks b WHERE b.blocker_id = u.id)
+		   FROM users u
+		   LEFT JOIN LATERAL (
+		        SELECT version, accepted_at FROM terms_acceptances
+		         WHERE user_id = u.id ORDER BY accepted_at DESC LIMIT 1
+		   ) t ON TRUE
+		  WHERE u.id = $1`,
+		id, terms,
+	).Scan(&st.UserID, &st.CreatedAt, &st.Ban.Banned,
+		&bannedAt, &reason, &source, &expiresAt,
+		&st.Terms.AcceptedVersion, &st.Terms.AcceptedAt, &st.Terms.Accepted, &st.BlocksCount)
+	if err != nil {
+		return st, err
+	}
+	st.Terms.CurrentVersion = terms
+	if st.Ban.Banned {
+		st.Ban.BannedAt, st.Ban.Reason, st.Ban.Source, st.Ban.ExpiresAt = bannedAt, reason, source, expiresAt
+	}
+	return st, nil
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// eventsGroup and eventsConsumer name the single consumer of every user
+	// stream. A user has at most one socket at a time, so a fixed consumer
+	// name lets a new socket pick up whatever the previous one left
+	// unacknowledged.
+	eventsGroup    = "delivery"
+	eventsConsumer = "socket"
+	// eventStreamMaxLen caps a stream nobody is reading (approximate trim).
+	eventStreamMaxLen = 256
+	// eventMaxAge bounds how long an undelivered event is worth keeping. It
+	// covers a reconnect after a network switch; an offer from a call the
+	// peer has long given up on is worse than nothing. It is also the
+	// stream's TTL once no socket is reading it.
+	eventMaxAge = 2 * time.Minute
+	// eventReadBatch is how many entries one XREADGROUP returns.
+	eventReadBatch = 64
+	// eventPollInterval is a safety net for a doorbell lost between a
+	// subscriber gap and the next event.
+	eventPollInterval = 5 * time.Second
+	// eventRetryMin and eventRetryMax bound the backoff after a failed read.
+	eventRetryMin = 500 * time.Millisecond
+	eventRetryMax = 30 * time.Second
+)
+
+// Deliver appends msg to the user's event stream and rings their doorbell so
+// whichever pod holds their socket drains it. Unlike a bare PUBLISH the event
+// is kept until that socket acknowledges it, so it survives a brief gap in
+// the subscription and is redelivered after a reconnect.
+func (m *MatchMaker) Deliver(ctx context.Context, userID string, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	key := eventsKey(userID)
+	pipe := m.rdb.TxPipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: key,
+		MaxLen: eventStreamMaxLen,
+		Approx: true,
+		Values: map[string]any{"msg": body},
+	})
+	pipe.Expire(ctx, key, eventMaxAge)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	if err := m.rdb.Publish(ctx, redisNotifyPfx+userID, "1").Err(); err != nil {
+		// The event is stored; the reader's poll picks it up.
+		slog.Warn("MatchMaker: event doorbell failed", "user_id", userID, "error", err)
+	}
+	return nil
+}
+
+// eventReader consumes one user's event stream on behalf of their socket.
+type eventReader struct {
+	rdb    redis.UniversalClient
+	userID string
+	key    string
+}
+
+// openEvents ensures the user's stream and consumer group exist. The group
+// starts at the beginning of the stream so events delivered before the
+// socket attached (e.g. a match that raced the connect) are not skipped.
+func (m *MatchMaker) openEvents(ctx context.Context, userID string) (*eventReader, error) {
+	r := &eventReader{rdb: m.rdb, userID: userID, key: eventsKey(userID)}
+	if err := r.createGroup(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ClearEvents deletes the user's event stream when their socket closes.
+// The disconnect tears down their match, so whatever the stream still holds
+// (a match, relayed signaling from the peer) is about a call that no longer
+// exists and must not be replayed to the next socket.
+func (m *MatchMaker) ClearEvents(ctx context.Context, userID string) {
+	if err := m.rdb.Del(ctx, eventsKey(userID)).Err(); err != nil {
+		slog.Error("MatchMaker: failed to clear events", "user_id", userID, "error", err)
+	}
+}
+
+// createGroup creates the stream and its group if missing, with the
+// stream's TTL, so a group recreated by a reader outliving ClearEvents
+// does not leave a stream behind.
+func (r *eventReader) createGroup(ctx context.Context) error {
+	err := r.rdb.XGroupCreateMkStream(ctx, r.key, eventsGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	r.rdb.Expire(ctx, r.key, eventMaxAge)
+	return nil
+}
+
+// read returns the next batch of entries. With pending set it returns
+// entries previously handed to this consumer but never acknowledged, after
+// the given ID; otherwise it returns new entries. If the stream expired or
+// was trimmed away with its group, the group is recreated at the start of
+// whatever Deliver has added since and the read retried.
+func (r *eventReader) read(ctx context.Context, pending bool, after string) ([]redis.XMessage, error) {
+	id := ">"
+	if pending {
+		id = after
+	}
+	args := &redis.XReadGroupArgs{
+		Group:    eventsGroup,
+		Consumer: eventsConsumer,
+		Streams:  []string{r.key, id},
+		Count:    eventReadBatch,
+		Block:    -1,
+	}
+	res, err := r.rdb.XReadGroup(ctx, args).Result()
+	if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+		slog.Info("Events: consumer group gone, recreating", "user_id", r.userID)
+		if err := r.createGroup(ctx); err != nil {
+			return nil, err
+		}
+		res, err = r.rdb.XReadGroup(ctx, args).Result()
+	}
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil || len(res) == 0 {
+		return nil, err
+	}
+	return res[0].Messages, nil
+}
+
+func (r *eventReader) ack(ctx context.Context, id string) {
+	if err := r.rdb.XAck(ctx, r.key, eventsGroup, id).Err(); err != nil {
+		slog.Error("Events: XACK failed", "user_id", r.userID, "id", id, "error", err)
+	}
+}
+
+// sendError is a failed socket write returned by drain, as opposed to a
+// failed Redis read.
+type sendError struct{ err error }
+
+func (e sendError) Error() string { return e.err.Error() }
+func (e sendError) Unwrap() error { return e.err }
+
+// drain writes every available entry to send, acknowledging each one only
+// after send succeeds. It returns the first send error as a sendError,
+// leaving that entry and everything after it pending for the next socket.
+// Each drain also renews the stream's TTL, so it does not expire under an
+// idle socket.
+func (r *eventReader) drain(ctx context.Context, pending bool, send func(Message) error) error {
+	r.rdb.Expire(ctx, r.key, eventMaxAge)
+	after := "0"
+	for {
+		entries, err := r.read(ctx, pending, after)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			after = e.ID
+			msg, ok := decodeEvent(e, time.Now())
+			if ok {
+				if err := send(msg); err != nil {
+					return sendError{err}
+				}
+				eventsDeliveredTotal.WithLabelValues(eventKind(msg), strconv.FormatBool(pending)).Inc()
+			}
+			r.ack(ctx, e.ID)
+		}
+		if len(entries) < eventReadBatch {
+			return nil
+		}
+	}
+}
+
+// decodeEvent parses a stream entry. Entries older than eventMaxAge, or ones
+// that don't parse, are reported as not ok so the caller drops them.
+func decodeEvent(e redis.XMessage, now time.Time) (Message, bool) {
+	if ms, err := strconv.ParseInt(strings.SplitN(e.ID, "-", 2)[0], 10, 64); err == nil {
+		if now.Sub(time.UnixMilli(ms)) > eventMaxAge {
+			return Message{}, false
+		}
+	}
+	raw, _ := e.Values["msg"].(string)
+	var msg Message
+	if err := json.Unmarshal([]byte(raw), &msg); err != nil {
+		slog.Error("Events: malformed entry", "id", e.ID, "error", err)
+		return Message{}, false
+	}
+	return msg, true
+}
+
+// eventKind buckets event types for metrics: peer-to-peer relay messages
+// carry client-chosen types, so they share one label.
+func eventKind(msg Message) string {
+	if msg.From != "" {
+		return "relay"
+	}
+	return msg.Type
+}
+
+// pumpEvents delivers the user's stream to their socket until the doorbell
+// subscription closes or a write to the socket fails. Anything the previous
+// socket left unacknowledged goes out first, then new events as the doorbell
+// rings. A failed read is retried with backoff rather than ending delivery.
+func pumpEvents(ctx context.Context, r *eventReader, doorbell <-chan *redis.Message, send func(Message) error) {
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+	redelivered := false
+	backoff := eventRetryMin
+	for {
+		err := r.drain(ctx, !redelivered, send)
+		if err == nil && !redelivered {
+			redelivered = true
+			err = r.drain(ctx, false, send)
+		}
+		var se sendError
+		switch {
+		case errors.As(err, &se):
+			slog.Warn("Events: delivery failed", "user_id", r.userID, "error", err)
+			return
+		case err != nil:
+			slog.Warn("Events: read failed, retrying", "user_id", r.userID, "error", err, "backoff", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, eventRetryMax)
+			continue
+		}
+		backoff = eventRetryMin
+		select {
+		case _, ok := <-doorbell:
+			if !ok {
+				return
+			}
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// readEvents drains everything currently deliverable to id, acknowledging it.
+func readEvents(t *testing.T, mm *MatchMaker, id string) []Message {
+	t.Helper()
+	ctx := context.Background()
+	r, err := mm.openEvents(ctx, id)
+	if err != nil {
+		t.Fatalf("openEvents: %v", err)
+	}
+	var out []Message
+	for _, pending := range []bool{true, false} {
+		if err := r.drain(ctx, pending, func(m Message) error {
+			out = append(out, m)
+			return nil
+		}); err != nil {
+			t.Fatalf("drain: %v", err)
+		}
+	}
+	return out
+}
+
+func TestEvents_DeliveredBeforeReaderAttaches(t *testing.T) {
+	mm, _, _ := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	if err := mm.Deliver(ctx, "alice", Message{Type: "match", Payload: MatchEvent{PeerID: "bob"}}); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	got := readEvents(t, mm, "alice")
+	if len(got) != 1 || got[0].Type != "match" {
+		t.Fatalf("want the match delivered before attach, got %+v", got)
+	}
+	if again := readEvents(t, mm, "alice"); len(again) != 0 {
+		t.Fatalf("acknowledged events must not be redelivered, got %+v", again)
+	}
+}
+
+func TestEvents_RedeliveredAfterFailedWrite(t *testing.T) {
+	mm, _, _ := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	r, err := mm.openEvents(ctx, "alice")
+	if err != nil {
+		t.Fatalf("openEvents: %v", err)
+	}
+	for _, typ := range []string{"match", "offer"} {
+		if err := mm.Deliver(ctx, "alice", Message{Type: typ}); err != nil {
+			t.Fatalf("Deliver: %v", err)
+		}
+	}
+
+	// The socket dies while writing the first event.
+	errClosed := errors.New("socket closed")
+	if err := r.drain(ctx, false, func(Message) error { return errClosed }); !errors.Is(err, errClosed) {
+		t.Fatalf("drain: want send error, got %v", err)
+	}
+
+	// The next socket gets both events, in order, from the pending list.
+	got := readEvents(t, mm, "alice")
+	if len(got) != 2 || got[0].Type != "match" || got[1].Type != "offer" {
+		t.Fatalf("want match then offer redelivered, got %+v", got)
+	}
+}
+
+func TestEvents_ReaderSurvivesStreamExpiry(t *testing.T) {
+	mm, mr, _ := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	r, err := mm.openEvents(ctx, "alice")
+	if err != nil {
+		t.Fatalf("openEvents: %v", err)
+	}
+	// The socket sits idle long enough for the stream and its group to expire.
+	mr.FastForward(eventMaxAge + time.Second)
+	if mr.Exists(eventsKey("alice")) {
+		t.Fatalf("stream should have expired")
+	}
+	if err := mm.Deliver(ctx, "alice", Message{Type: "match"}); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	var got []Message
+	if err := r.drain(ctx, false, func(m Message) error {
+		got = append(got, m)
+		return nil
+	}); err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+	if len(got) != 1 || got[0].Type != "match" {
+		t.Fatalf("want the match delivered after expiry, got %+v", got)
+	}
+}
+
+func TestEvents_DrainRenewsTTL(t *testing.T) {
+	mm, mr, _ := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	r, err := mm.openEvents(ctx, "alice")
+	if err != nil {
+		t.Fatalf("openEvents: %v", err)
+	}
+	for range 3 {
+		mr.FastForward(eventMaxAge / 2)
+		if err := r.drain(ctx, false, func(Message) error { return nil }); err != nil {
+			t.Fatalf("drain: %v", err)
+		}
+	}
+	if !mr.Exists(eventsKey("alice")) {
+		t.Fatalf("stream expired while its reader was polling")
+	}
+}
+
+func TestEvents_NotReplayedAfterDisconnect(t *testing.T) {
+	mm, mr, _ := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	old, err := mm.openEvents(ctx, "alice")
+	if err != nil {
+		t.Fatalf("openEvents: %v", err)
+	}
+	_, bobSeesAlice := pairPeers(ctx, mm, "alice", "bob", "m1")
+	if err := mm.Deliver(ctx, "alice", Message{Type: "match", Payload: MatchEvent{MatchID: "m1"}}); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	if err := mm.Deliver(ctx, "alice", Message{Type: "offer", From: bobSeesAlice}); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+
+	// The socket drops before writing them; its cleanup ends the call.
+	mm.leaveMatch(ctx, "alice", leaveDisconnect)
+	mm.DeleteSession(ctx, "alice")
+	mm.ClearEvents(ctx, "alice")
+
+	// The old pump may still be draining; it must not resurrect the events
+	// or leave a stream without a TTL.
+	if err := old.drain(ctx, false, func(Message) error { return nil }); err != nil {
+		t.Fatalf("drain after clear: %v", err)
+	}
+	if ttl := mr.TTL(eventsKey("alice")); ttl <= 0 || ttl > eventMaxAge {
+		t.Fatalf("recreated stream TTL = %v", ttl)
+	}
+
+	// The reconnected socket gets nothing from the old call.
+	if got := readEvents(t, mm, "alice"); len(got) != 0 {
+		t.Fatalf("stale events replayed after reconnect: %+v", got)
+	}
+}
+
+func TestEvents_StaleEntriesDropped(t *testing.T) {
+	old := time.Now().Add(-2 * eventMaxAge)
+	e := redis.XMessage{ID: formatStreamID(old), Values: map[string]any{"msg": `{"type":"offer"}`}}
+	if _, ok := decodeEvent(e, time.Now()); ok {
+		t.Fatalf("events older than eventMaxAge must be dropped")
+	}
+	e.ID = formatStreamID(time.Now())
+	if msg, ok := decodeEvent(e, time.Now()); !ok || msg.Type != "offer" {
+		t.Fatalf("fresh event not decoded: %+v %v", msg, ok)
+	}
+}
+
+func formatStreamID(at time.Time) string {
+	return strconv.FormatInt(at.UnixMilli(), 10) + "-0"
+}
+
+func TestHandleMessage_RelaysOnlyToSessionPeer(t *testing.T) {
+	mm, _, _ := newTestMatchMaker(t)
+	prevMM := matchMaker
+	matchMaker = mm
+	t.Cleanup(func() { matchMaker = prevMM })
+	ctx := context.Background()
+
+	aliceSeesBob, bobSeesAlice := pairPeers(ctx, mm, "alice", "bob", "m1")
+	handleMessage(Message{Type: "offer", From: "alice", To: aliceSeesBob, Payload: map[string]any{"sdp": "x"}})
+	handleMessage(Message{Type: "offer", From: "alice", To: "carol"})
+	// A handle only works for the user it was issued to.
+	handleMessage(Message{Type: "offer", From: "carol", To: aliceSeesBob})
+
+	got := readEvents(t, mm, "bob")
+	if len(got) != 1 || got[0].Type != "offer" || got[0].From != bobSeesAlice || got[0].To != "" {
+		t.Fatalf("bob: want one offer from alice's handle, got %+v", got)
+	}
+	if got := readEvents(t, mm, "carol"); len(got) != 0 {
+		t.Fatalf("carol is not alice's peer and must receive nothing, got %+v", got)
+	}
+
+	// bob moved on and is already in a new call: alice's late bye must not
+	// reach him and end it.
+	mm.SetSession(ctx, "bob", "dave", "m2", "")
+	handleMessage(Message{Type: "bye", From: "alice", To: aliceSeesBob})
+	if got := readEvents(t, mm, "bob"); len(got) != 0 {
+		t.Fatalf("bob must receive nothing more from his old partner, got %+v", got)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// GET /me/export returns the caller's personal data. Small exports are built
+// and returned inline. Larger ones are built in the background and uploaded
+// to object storage; until the upload is done the endpoint answers 202
+// `pending`, then `ready` with a short-lived download URL. A finished export
+// is reused until it expires, so asking again does not rebuild it.
+const (
+	// exportRequestsPerMinute caps /me/export calls per client IP. Clients
+	// poll a pending export every exportPollAfter.
+	exportRequestsPerMinute = 10
+	// exportInlineRows is the most blocks, reports and ratings an export
+	// may hold and still be built inside the request.
+	exportInlineRows = 1000
+	// exportJobTimeout bounds building and uploading a background export.
+	// A job that has not finished by then is forgotten and may be retried.
+	exportJobTimeout = 5 * time.Minute
+	// exportReadyTTL is how long a finished export can be downloaded again.
+	// The object itself is left to the bucket's lifecycle rule for exports/.
+	exportReadyTTL = 24 * time.Hour
+	// exportURLTTL is the lifetime of each signed download URL.
+	exportURLTTL = 15 * time.Minute
+	// exportPollAfter is the Retry-After sent while an export is pending.
+	exportPollAfter = 10 * time.Second
+)
+
+const (
+	exportPending = "pending"
+	exportReady   = "ready"
+)
+
+var exportLimiter *ipRateLimiter
+
+// AccountExport is the bundle served by /me/export.
+type AccountExport struct {
+	GeneratedAt  time.Time      `json:"generated_at"`
+	Account      ExportAccount  `json:"account"`
+	Ban          ExportBan      `json:"ban"`
+	Blocks       []ExportBlock  `json:"blocks"`
+	ReportsFiled []ExportReport `json:"reports_filed"`
+	RatingsGiven []ExportRating `json:"ratings_given"`
+	Calls        []ExportCall   `json:"calls"`
+	Terms        []ExportTerms  `json:"terms_accepted"`
+}
+
+type ExportAccount struct {
+	UserID          string     `json:"user_id"`
+	Provider        string     `json:"provider"`
+	CreatedAt       time.Time  `json:"created_at"`
+	AgeBand         *string    `json:"age_band"`
+	AgeSource       *string    `json:"age_source"`
+	AgeVerifiedAt   *time.Time `json:"age_verified_at"`
+	PoolOverride    *string    `json:"pool_override"`
+	ReportsReceived int        `json:"reports_received_count"`
+	BlocksReceived  int        `json:"blocks_received_count"`
+}
+
+// ExportBan is the user's current or last ban; Banned is whether it is
+// still in force.
+type ExportBan struct {
+	Banned    bool       `json:"banned"`
+	BannedAt  *time.Time `json:"banned_at"`
+	Reason    *string    `json:"reason"`
+	Source    *string    `json:"source"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// ExportBlock, ExportReport and ExportRating leave out the other user.
+type ExportBlock struct {
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportReport struct {
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportRating struct {
+	MatchID   string    `json:"match_id"`
+	Rating    int       `json:"rating"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportTerms struct {
+	Version    string    `json:"version"`
+	AcceptedAt time.Time `json:"accepted_at"`
+}
+
+// ExportCall is a match from the user's audit timeline, so only calls
+// within auditRetention are listed.
+type ExportCall struct {
+	MatchID   string    `json:"match_id"`
+	MatchedAt time.Time `json:"matched_at"`
+}
+
+// exportJob is the state of the user's background export, stored as JSON
+// under exportKey.
+type exportJob struct {
+	Status      string    `json:"status"`
+	Object      string    `json:"object,omitempty"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// exportResponse answers /me/export while the export is in the background.
+type exportResponse struct {
+	Status    string `json:"status"`
+	URL       string `json:"url,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	if exportLimiter != nil && !exportLimiter.allow(r) {
+		w.Header().Set("Retry-After", "60")
+		writeError(w, http.StatusTooManyRequests, "rate_limited", "too many requests, retry shortly")
+		return
+	}
+	ctx := r.Context()
+
+	sub, ok := authenticate(ctx, r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid_token", "token invalid or expired")
+		return
+	}
+
+	job, found, err := matchMaker.ExportJob(ctx, sub)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
+	}
+	if found {
+		writeExportJob(w, r, job)
+		return
+	}
+
+	id, err := getUserIDBySub(ctx, sub)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "not_found", "no data is stored for this account")
+		return
+	}
+	if err != nil {
+		slog.Error("export: lookup user", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
+	}
+
+	rows, err := exportRowCount(ctx, id)
+	if err != nil {
+		slog.Error("export: count rows", "user_id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
+	}
+	if rows <= exportInlineRows {
+		ex, err := buildExport(ctx, sub, id)
+		if err != nil {
+			slog.Error("export: build", "user_id", id, "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+			return
+		}
+		dataExportsTotal.WithLabelValues("inline").Inc()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="bananatalk-export.json"`)
+		_ = json.NewEncoder(w).Encode(ex)
+		return
+	}
+
+	job = exportJob{Status: exportPending, RequestedAt: time.Now().UTC()}
+	started, err := matchMaker.StartExportJob(ctx, sub, job)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
+	}
+	if started {
+		slog.Info("Export queued", "user_id", id, "rows", rows)
+		go runExport(sub, id)
+	} else if job, found, _ = matchMaker.ExportJob(ctx, sub); !found {
+		// Finished and forgotten in between; ask again.
+		job = exportJob{Status: exportPending}
+	}
+	writeExportJob(w, r, job)
+}
+
+// writeExportJob answers with a background export's state, signing a fresh
+// download URL once it is ready.
+func writeExportJob(w http.ResponseWriter, r *http.Request, job exportJob) {
+	if job.Status != exportReady {
+		w.Header().Set("Retry-After", strconv.Itoa(int(exportPollAfter/time.Second)))
+		writeJSON(w, http.StatusAccepted, exportResponse{Status: exportPending})
+		return
+	}
+	url, err := storageClient.Sign(r.Context(), job.Object, exportURLTTL)
+	if err != nil {
+		slog.Error("export: sign URL", "object", job.Object, "error", err)
+		writeError(w, http.StatusBadGateway, "storage_error", "could not sign the download URL, retry later")
+		return
+	}
+	writeJSON(w, http.StatusOK, exportResponse{
+		Status:    exportReady,
+		URL:       url,
+		ExpiresAt: time.Now().Add(exportURLTTL).Unix(),
+	})
+}
+
+// buildExport assembles the user's export from Postgres and their Redis
+// audit timeline.
+func buildExport(ctx context.Context, sub string, id int64) (AccountExport, error) {
+	ex, err := loadAccountExport(ctx, id)
+	if err != nil {
+		return ex, err
+	}
+	ex.GeneratedAt = time.Now().UTC()
+	ex.Calls = matchMaker.callHistory(ctx, sub)
+	return ex, nil
+}
+
+// runExport builds and uploads a background export. On failure the job is
+// dropped so the next request starts over.
+func runExport(sub string, id int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportJobTimeout)
+	defer cancel()
+
+	ex, err := buildExport(ctx, sub, id)
+	if err == nil {
+		err = matchMaker.finishExport(ctx, sub, ex)
+	}
+	if err != nil {
+		slog.Error("Export failed", "user_id", id, "error", err)
+		dataExportsTotal.WithLabelValues("failed").Inc()
+		matchMaker.dropExportJob(ctx, sub)
+		return
+	}
+	dataExportsTotal.WithLabelValues("async").Inc()
+	slog.Info("Export ready", "user_id", id)
+}
+
+func exportObjectKey() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return "exports/" + hex.EncodeToString(b) + ".json"
+}
+
+// ExportJob returns the user's background export, if one is pending or
+// ready.
+func (m *MatchMaker) ExportJob(ctx context.Context, userID string) (exportJob, bool, error) {
+	var job exportJob
+	raw, err := m.rdb.Get(ctx, exportKey(userID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return job, false, nil
+	}
+	if err != nil {
+		slog.Error("MatchMaker: failed to read export job", "user_id", userID, "error", err)
+		return job, false, err
+	}
+	if err := json.Unmarshal(raw, &job); err != nil {
+		slog.Error("MatchMaker: corrupt export job", "user_id", userID, "error", err)
+		return job, false, err
+	}
+	return job, true, nil
+}
+
+// StartExportJob records a pending export unless the user already has one,
+// reporting whether it did. The record expires with exportJobTimeout so a
+// build lost with its pod does not block the user for good.
+func (m *MatchMaker) StartExportJob(ctx context.Context, userID string, job exportJob) (bool, error) {
+	raw, _ := json.Marshal(job)
+	ok, err := m.rdb.SetNX(ctx, exportKey(userID), raw, exportJobTimeout).Result()
+	if err != nil {
+		slog.Error("MatchMaker: failed to start export job", "user_id", userID, "error", err)
+	}
+	return ok, err
+}
+
+// finishExport uploads the export and marks the user's job ready. If the job
+// is gone meanwhile (the account was deleted, or the job timed out) the
+// upload is deleted again rather than left behind.
+func (m *MatchMaker) finishExport(ctx context.Context, userID string, ex AccountExport) error {
+	body, err := json.Marshal(ex)
+	if err != nil {
+		return err
+	}
+	key := exportObjectKey()
+	if _, err := storageClient.Upload(ctx, key, "application/json", bytes.NewReader(body), int64(len(body))); err != nil {
+		return err
+	}
+	raw, _ := json.Marshal(exportJob{Status: exportReady, Object: key, RequestedAt: ex.GeneratedAt})
+	ok, err := m.rdb.SetXX(ctx, exportKey(userID), raw, exportReadyTTL).Result()
+	if err == nil && !ok {
+		err = errors.New("export job no longer pending")
+	}
+	if err != nil {
+		if derr := storageClient.Delete(ctx, key); derr != nil {
+			slog.Error("Failed to delete abandoned export", "object", key, "error", derr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *MatchMaker) dropExportJob(ctx context.Context, userID string) {
+	if err := m.rdb.Del(ctx, exportKey(userID)).Err(); err != nil {
+		slog.Error("MatchMaker: failed to drop export job", "user_id", userID, "error", err)
+	}
+}
+
+// callHistory lists the user's matches still in their audit timeline, most
+// recent last, without who they were matched with.
+func (m *MatchMaker) callHistory(ctx context.Context, userID string) []ExportCall {
+	calls := []ExportCall{}
+	evs, err := m.auditTimeline(ctx, auditUserKey(userID))
+	if err != nil {
+		slog.Error("MatchMaker: failed to read call history", "user_id", userID, "error", err)
+		return calls
+	}
+	for _, ev := range evs {
+		if ev.Type == auditMatched && ev.MatchID != "" {
+			calls = append(calls, ExportCall{MatchID: ev.MatchID, MatchedAt: ev.At})
+		}
+	}
+	return calls
+}
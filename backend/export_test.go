@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useExportTestDeps(t *testing.T) (*MatchMaker, *memStorage) {
+	t.Helper()
+	store := useMemStorage(t)
+	stubSubjectValidator(t)
+	mm, _, _ := newTestMatchMaker(t)
+	prevMM := matchMaker
+	matchMaker = mm
+	t.Cleanup(func() { matchMaker = prevMM })
+	return mm, store
+}
+
+func getExport(t *testing.T, sub string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/me/export", nil)
+	req.Header.Set("Authorization", "Bearer "+sub)
+	rr := httptest.NewRecorder()
+	exportHandler(rr, req)
+	return rr
+}
+
+func TestExportHandler_ReportsBackgroundJob(t *testing.T) {
+	mm, store := useExportTestDeps(t)
+	ctx := context.Background()
+
+	if ok, err := mm.StartExportJob(ctx, "alice", exportJob{Status: exportPending}); !ok || err != nil {
+		t.Fatalf("StartExportJob: %v %v", ok, err)
+	}
+	if ok, _ := mm.StartExportJob(ctx, "alice", exportJob{Status: exportPending}); ok {
+		t.Fatalf("a second job started while one is pending")
+	}
+	rr := getExport(t, "alice")
+	if rr.Code != http.StatusAccepted || rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("pending export: %d Retry-After=%q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	mm.audit(ctx, AuditEvent{Type: auditMatched, UserID: "alice", PeerID: "bob", MatchID: "m1"})
+	ex := AccountExport{GeneratedAt: time.Now().UTC(), Calls: mm.callHistory(ctx, "alice")}
+	if err := mm.finishExport(ctx, "alice", ex); err != nil {
+		t.Fatalf("finishExport: %v", err)
+	}
+	rr = getExport(t, "alice")
+	var resp exportResponse
+	_ = json.NewDecoder(rr.Body).Decode(&resp)
+	if rr.Code != http.StatusOK || resp.Status != exportReady || !strings.HasPrefix(resp.URL, "mem://exports/") {
+		t.Fatalf("ready export: %d %+v", rr.Code, resp)
+	}
+	key := strings.TrimPrefix(resp.URL, "mem://")
+	store.mu.Lock()
+	raw := store.objects[key]
+	store.mu.Unlock()
+	if strings.Contains(string(raw), "bob") || !strings.Contains(string(raw), `"match_id":"m1"`) {
+		t.Fatalf("uploaded export = %s; want the call without the peer", raw)
+	}
+
+	// Deleting the account forgets the job with the rest of Redis state.
+	mm.Forget(ctx, "alice", nil)
+	if _, found, _ := mm.ExportJob(ctx, "alice"); found {
+		t.Fatalf("export job survived Forget")
+	}
+}
+
+func TestFinishExport_DiscardsUploadWithoutJob(t *testing.T) {
+	mm, store := useExportTestDeps(t)
+
+	if err := mm.finishExport(context.Background(), "alice", AccountExport{}); err == nil {
+		t.Fatalf("finishExport without a pending job should fail")
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.objects) != 0 {
+		t.Fatalf("abandoned export left in storage: %v", store.objects)
+	}
+}
+
+func TestExportHandler_RejectsOtherMethods(t *testing.T) {
+	rr := httptest.NewRecorder()
+	exportHandler(rr, httptest.NewRequest(http.MethodPost, "/me/export", nil))
+	if rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != http.MethodGet {
+		t.Fatalf("POST /me/export: %d Allow=%q", rr.Code, rr.Header().Get("Allow"))
+	}
+}
+
+func TestExportHandler_InlineOmitsOtherParty(t *testing.T) {
+	setupTestDB(t)
+	useExportTestDeps(t)
+	ctx := context.Background()
+
+	alice, _, _ := upsertUser(ctx, "alice")
+	bob, _, _ := upsertUser(ctx, "bob")
+	if err := insertBlock(ctx, alice, bob); err != nil {
+		t.Fatalf("insertBlock: %v", err)
+	}
+	if _, err := recordReport(ctx, alice, bob, "spam", "mem://reports/a.png", "reports/a.png"); err != nil {
+		t.Fatalf("recordReport: %v", err)
+	}
+	if err := recordRating(ctx, "alice", "bob", "m1", 1); err != nil {
+		t.Fatalf("recordRating: %v", err)
+	}
+
+	rr := getExport(t, "alice")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /me/export: %d %s", rr.Code, rr.Body)
+	}
+	body := rr.Body.String()
+	if strings.Contains(body, "bob") || strings.Contains(body, "reports/a.png") {
+		t.Fatalf("export names the other party: %s", body)
+	}
+	var ex AccountExport
+	if err := json.Unmarshal([]byte(body), &ex); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if ex.Account.UserID != "alice" || len(ex.Blocks) != 1 || len(ex.ReportsFiled) != 1 || len(ex.RatingsGiven) != 1 || ex.Ban.Banned {
+		t.Fatalf("export = %+v", ex)
+	}
+}
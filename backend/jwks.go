@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultJWKSTTL is how long a fetched key set is trusted before it is
+	// fetched again. Providers rotate keys rarely and publish the new one
+	// well before signing with it.
+	defaultJWKSTTL = time.Hour
+	// jwksMinRefresh throttles refetches, so a flood of tokens with made-up
+	// kids, or an unreachable provider, cannot stall every sign-in.
+	jwksMinRefresh = time.Minute
+)
+
+var errUnknownKey = errors.New("jwt: signing key not found")
+
+// jwksCache holds one provider's published RSA signing keys by kid.
+type jwksCache struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetched   time.Time
+	attempted time.Time
+	// lastErr is why the last fetch failed, returned while no key set is
+	// held until jwksMinRefresh allows another try.
+	lastErr error
+}
+
+func newJWKSCache(url string) *jwksCache {
+	return &jwksCache{url: url, ttl: defaultJWKSTTL, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// key returns the signing key with the given kid, fetching the key set when
+// it is stale or does not have the kid (the provider may have rotated).
+// Fetches are at most jwksMinRefresh apart, including before any key set is
+// held: until the next try a cache that never fetched fails fast with the
+// last error. If the provider is unreachable a stale set keeps being used.
+func (c *jwksCache) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k, ok := c.keys[kid]
+	if ok && time.Since(c.fetched) < c.ttl {
+		return k, nil
+	}
+	if time.Since(c.attempted) >= jwksMinRefresh {
+		c.attempted = time.Now()
+		c.lastErr = c.refresh(ctx)
+		if c.lastErr != nil && c.keys != nil {
+			slog.Warn("JWKS refresh failed; using cached keys", "url", c.url, "error", c.lastErr)
+		}
+		k, ok = c.keys[kid]
+	}
+	if c.keys == nil {
+		return nil, fmt.Errorf("jwks unavailable: %w", c.lastErr)
+	}
+	if !ok {
+		return nil, errUnknownKey
+	}
+	return k, nil
+}
+
+// refresh fetches the key set. Callers hold c.mu.
+func (c *jwksCache) refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch jwks: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch jwks: status %d", resp.StatusCode)
+	}
+	keys, err := parseJWKS(resp.Body)
+	if err != nil {
+		return err
+	}
+	c.keys = keys
+	c.fetched = time.Now()
+	return nil
+}
+
+// parseJWKS decodes a JWK Set, keeping the RSA keys. Other key types are
+// skipped rather than rejected so a provider adding one doesn't lock
+// everybody out.
+func parseJWKS(r io.Reader) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decode jwks: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("jwks key %q: bad modulus: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("jwks key %q: bad exponent", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// jwtClaims are a token's decoded payload claims.
+type jwtClaims map[string]any
+
+// parseJWTClaims decodes a token's payload without verifying it. Only use
+// the result to decide how to verify the token.
+func parseJWTClaims(token string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jwt: malformed token")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("jwt: bad payload: %w", err)
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, fmt.Errorf("jwt: bad payload: %w", err)
+	}
+	return claims, nil
+}
+
+// jwtHeader is the part of a JOSE header this package looks at.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// splitJWT decodes a compact JWS into its header, the signed input and the
+// signature, without verifying anything.
+func splitJWT(token string) (header jwtHeader, signingInput string, sig []byte, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtHeader{}, "", nil, errors.New("jwt: malformed token")
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return jwtHeader{}, "", nil, fmt.Errorf("jwt: bad header: %w", err)
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return jwtHeader{}, "", nil, fmt.Errorf("jwt: bad header: %w", err)
+	}
+	sig, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtHeader{}, "", nil, fmt.Errorf("jwt: bad signature: %w", err)
+	}
+	return header, parts[0] + "." + parts[1], sig, nil
+}
+
+// verifyJWT checks an RS256 token's signature against keys and returns its
+// claims. It does not look at any claim; that is the caller's policy.
+func verifyJWT(ctx context.Context, token string, keys *jwksCache) (jwtClaims, error) {
+	header, signingInput, sig, err := splitJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("jwt: unsupported alg %q", header.Alg)
+	}
+	pub, err := keys.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(signingInput))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("jwt: signature: %w", err)
+	}
+	return parseJWTClaims(token)
+}
+
+// str returns a string claim, or "" if it is missing or not a string.
+func (c jwtClaims) str(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// unix returns a NumericDate claim, or 0 if it is missing.
+func (c jwtClaims) unix(name string) int64 {
+	f, _ := c[name].(float64)
+	return int64(f)
+}
+
+// hasAudience reports whether the aud claim, a string or an array of
+// strings, names any of the allowed audiences.
+func (c jwtClaims) hasAudience(allowed []string) bool {
+	var auds []string
+	switch v := c["aud"].(type) {
+	case string:
+		auds = []string{v}
+	case []any:
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+	}
+	for _, a := range auds {
+		for _, want := range allowed {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
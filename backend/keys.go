@@ -0,0 +1,96 @@
+package main
+
+import "fmt"
+
+// Redis key layout. Keys are grouped into families, and every key a single
+// script or MULTI touches must share a hash tag so the command stays within
+// one Redis Cluster slot:
+//
+//   - Queue shard {q<n>}: the shard's waiting and priority lists,
+//     enqueue-time hash and per-tag sets. claimPairScript and the tag
+//     SUNION only ever touch one shard, and different shards spread across
+//     cluster nodes.
+//   - User {u:<id>}: a user's session, match state, block set, matching
+//     profile, event stream, priority-requeue allowance and data export
+//     job, so any per-user cleanup can be done atomically on one node.
+//   - Match {m:<id>}: a match's audit timeline.
+//   - Peer handle {h:<handle>}: which user a per-match handle stands for,
+//     and who may use it (see peerhandle.go).
+//   - Singletons (leader lease, pause flag, recent latency samples,
+//     per-region-pair connect outcomes) are one key each.
+//
+// Pub/Sub channels (trigger, per-user event doorbell) are not keys and are
+// broadcast cluster-wide by Redis, so they keep plain names.
+const (
+	redisNotifyPfx     = "matchmaker:notify:"
+	redisTriggerKey    = "matchmaker:trigger"
+	redisRecentLatency = "matchmaker:recent_latency"
+	redisLeaderKey     = "matchmaker:leader"
+	redisConnectStats  = "matchmaker:connect_stats"
+	redisPausedKey     = "matchmaker:paused"
+)
+
+func queueKey(shard int) string {
+	return fmt.Sprintf("matchmaker:{q%d}:queue", shard)
+}
+
+// priorityQueueKey is the shard's priority lane: users requeued after a
+// match that ended on them (see requeue.go). It is paired from before the
+// regular queue.
+func priorityQueueKey(shard int) string {
+	return fmt.Sprintf("matchmaker:{q%d}:priority", shard)
+}
+
+func enqueuedAtKey(shard int) string {
+	return fmt.Sprintf("matchmaker:{q%d}:enqueued_at", shard)
+}
+
+func tagKey(shard int, tag string) string {
+	return fmt.Sprintf("matchmaker:{q%d}:tag:%s", shard, tag)
+}
+
+func sessionKey(userID string) string {
+	return "matchmaker:{u:" + userID + "}:session"
+}
+
+// matchKey is a hash describing the user's current or most recent match:
+// its ID, when it started, and how it ended (see matchState).
+func matchKey(userID string) string {
+	return "matchmaker:{u:" + userID + "}:match"
+}
+
+func blocksKey(userID string) string {
+	return "matchmaker:{u:" + userID + "}:blocks"
+}
+
+func profileKey(userID string) string {
+	return "matchmaker:{u:" + userID + "}:profile"
+}
+
+func eventsKey(userID string) string {
+	return "matchmaker:{u:" + userID + "}:events"
+}
+
+func priorityGrantsKey(userID string) string {
+	return "matchmaker:{u:" + userID + "}:priority_grants"
+}
+
+// auditUserKey and auditMatchKey are the match lifecycle timelines (see
+// audit.go).
+func auditUserKey(userID string) string {
+	return "matchmaker:{u:" + userID + "}:audit"
+}
+
+func auditMatchKey(matchID string) string {
+	return "matchmaker:{m:" + matchID + "}:audit"
+}
+
+// peerHandleKey maps a peer handle back to the user it stands for.
+func peerHandleKey(handle string) string {
+	return "matchmaker:{h:" + handle + "}:peer"
+}
+
+// exportKey is the user's background data export job (see export.go).
+func exportKey(userID string) string {
+	return "matchmaker:{u:" + userID + "}:export"
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// keySlot computes the Redis Cluster hash slot of key (CRC16/XMODEM of the
+// hash tag, or of the whole key if it has none, mod 16384). miniredis answers
+// CLUSTER KEYSLOT with a constant, so the layout is checked here instead.
+func keySlot(key string) uint16 {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	var crc uint16
+	for k := 0; k < len(key); k++ {
+		crc ^= uint16(key[k]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc % 16384
+}
+
+func assertSameSlot(t *testing.T, keys ...string) {
+	t.Helper()
+	want := keySlot(keys[0])
+	for _, k := range keys[1:] {
+		if got := keySlot(k); got != want {
+			t.Fatalf("%s is in slot %d, %s in slot %d", k, got, keys[0], want)
+		}
+	}
+}
+
+func TestKeySlot_KnownValues(t *testing.T) {
+	// Reference values from the Redis Cluster specification.
+	if got := keySlot("123456789"); got != 0x31C3%16384 {
+		t.Fatalf("keySlot(123456789) = %d", got)
+	}
+	if keySlot("{user1000}.following") != keySlot("{user1000}.followers") {
+		t.Fatalf("hash tag not honoured")
+	}
+}
+
+func TestKeys_ShardFamilySharesSlot(t *testing.T) {
+	for shard := 0; shard < 4; shard++ {
+		assertSameSlot(t,
+			queueKey(shard), priorityQueueKey(shard), enqueuedAtKey(shard), tagKey(shard, "music"), tagKey(shard, "games"))
+	}
+}
+
+func TestKeys_ShardsSpreadAcrossSlots(t *testing.T) {
+	slots := make(map[uint16]bool)
+	for shard := 0; shard < 8; shard++ {
+		slots[keySlot(queueKey(shard))] = true
+	}
+	if len(slots) < 2 {
+		t.Fatalf("8 shards all hash to one slot; sharding gains nothing in a cluster")
+	}
+}
+
+func TestKeys_UserFamilySharesSlot(t *testing.T) {
+	for _, id := range []string{"alice", "google-sub-1234567890", "a:b{c}"} {
+		assertSameSlot(t, sessionKey(id), matchKey(id), blocksKey(id), profileKey(id), eventsKey(id), priorityGrantsKey(id))
+	}
+}
+
+// TestMatchMaker_ClusterClient runs the matchmaker through a cluster client.
+// miniredis answers CLUSTER SLOTS as a single node owning every slot, which
+// exercises the cluster client's routing, script and pipeline paths.
+func TestMatchMaker_ClusterClient(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{mr.Addr()}})
+	t.Cleanup(func() { _ = client.Close() })
+	mm := NewMatchMaker(client)
+	mm.shards = 4
+	ctx := context.Background()
+
+	ids := usersInShards(mm, 1, 1, 1)
+	for _, id := range ids {
+		mm.SetProfile(ctx, id, Profile{Interests: []string{"music"}})
+	}
+	mm.HydrateBlocks(ctx, ids[0], []string{ids[1]})
+	for _, id := range ids {
+		mm.Add(ctx, id)
+	}
+
+	mm.processMatches(ctx)
+
+	if peer, _ := client.Get(ctx, sessionKey(ids[0])).Result(); peer != ids[2] {
+		t.Fatalf("session for %s = %q, want %q", ids[0], peer, ids[2])
+	}
+	if got, _ := client.LRange(ctx, queueKey(1), 0, -1).Result(); len(got) != 1 || got[0] != ids[1] {
+		t.Fatalf("shard 1 queue = %v, want [%s]", got, ids[1])
+	}
+
+	mm.Remove(ctx, ids[1])
+	mm.ClearProfile(ctx, ids[1])
+	if n, _ := client.Exists(ctx, queueKey(1), profileKey(ids[1])).Result(); n != 0 {
+		t.Fatalf("%d keys left after Remove/ClearProfile", n)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultLatencyBucket is the width of the estimated-RTT buckets pairing
+	// sorts candidates into. Within a bucket queue order still decides, so
+	// small measurement noise never reorders anyone.
+	defaultLatencyBucket = 50 * time.Millisecond
+	// defaultClientRTT stands in for a client whose RTT hasn't been measured
+	// yet (the first pong is still in flight).
+	defaultClientRTT = 100 * time.Millisecond
+	// crossRegionPenalty is added to the estimate for two users served from
+	// different regions: their RTTs to the server say little about the path
+	// between them.
+	crossRegionPenalty = 100 * time.Millisecond
+	// connectFailurePenalty is what a certain failure to connect costs in the
+	// estimate; a failed call wastes roughly a whole retry. It is scaled by
+	// the region pair's observed failure rate.
+	connectFailurePenalty = time.Second
+	// minConnectSamples is how many outcomes a region pair needs before its
+	// failure rate is trusted.
+	minConnectSamples = 20
+	// connectStatsCap bounds each region pair's counters. Once exceeded both
+	// are halved, so recent outcomes outweigh last month's.
+	connectStatsCap = 1000
+	// maxClientRTT discards implausible samples (a pong stuck behind a
+	// stalled socket).
+	maxClientRTT = 5 * time.Second
+	// rttSmoothing is the weight of a new RTT sample in the moving average.
+	rttSmoothing = 0.3
+)
+
+var (
+	// latencyBucket is read from MATCH_LATENCY_BUCKET in main. Zero disables
+	// latency-aware ordering, leaving plain queue order.
+	latencyBucket = defaultLatencyBucket
+	// podRegion is read from POD_REGION in main and recorded on the profile
+	// of every user this pod serves. Empty means unknown.
+	podRegion string
+)
+
+// pingPayload and parsePong carry the send time through a WebSocket
+// ping, which the client echoes back unchanged in its pong.
+func pingPayload(now time.Time) []byte {
+	return []byte(strconv.FormatInt(now.UnixNano(), 10))
+}
+
+func parsePong(data string, now time.Time) (time.Duration, bool) {
+	ns, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	rtt := now.Sub(time.Unix(0, ns))
+	if rtt <= 0 || rtt > maxClientRTT {
+		return 0, false
+	}
+	return rtt, true
+}
+
+// smoothRTT folds a new sample into the running average; prev is zero
+// before the first sample.
+func smoothRTT(prev, sample time.Duration) time.Duration {
+	if prev == 0 {
+		return sample
+	}
+	return time.Duration(rttSmoothing*float64(sample) + (1-rttSmoothing)*float64(prev))
+}
+
+// SetRTT records the user's smoothed RTT to the server for the rest of their
+// session.
+func (m *MatchMaker) SetRTT(ctx context.Context, userID string, rtt time.Duration) {
+	clientRTTSeconds.Observe(rtt.Seconds())
+	m.setLiveProfileField(ctx, userID, "rtt_ms", strconv.FormatInt(rtt.Milliseconds(), 10))
+}
+
+// regionPairLabel is the order-independent label of a pair of regions, e.g.
+// "eu-west|us-east", with "unknown" for a user whose region isn't known.
+func regionPairLabel(a, b string) string {
+	if a == "" {
+		a = "unknown"
+	}
+	if b == "" {
+		b = "unknown"
+	}
+	if b < a {
+		a, b = b, a
+	}
+	return a + "|" + b
+}
+
+// connectStats holds the observed call outcomes by region pair.
+type connectStats map[string]connectCounts
+
+type connectCounts struct {
+	OK, Fail int64
+}
+
+// failureRate is the share of calls between the two regions that never
+// connected, or 0 while there are too few samples to say.
+func (s connectStats) failureRate(a, b string) float64 {
+	c := s[regionPairLabel(a, b)]
+	n := c.OK + c.Fail
+	if n < minConnectSamples {
+		return 0
+	}
+	return float64(c.Fail) / float64(n)
+}
+
+// loadConnectStats reads every region pair's outcome counters. A failure
+// leaves pairing without the history rather than stopping it.
+func (m *MatchMaker) loadConnectStats(ctx context.Context) connectStats {
+	h, err := m.rdb.HGetAll(ctx, redisConnectStats).Result()
+	if err != nil {
+		slog.Error("MatchMaker: failed to load connect stats", "error", err)
+		return nil
+	}
+	out := make(connectStats)
+	for field, v := range h {
+		pair, outcome, ok := strings.Cut(field, ":")
+		n, err := strconv.ParseInt(v, 10, 64)
+		if !ok || err != nil {
+			continue
+		}
+		c := out[pair]
+		switch outcome {
+		case "ok":
+			c.OK = n
+		case "fail":
+			c.Fail = n
+		}
+		out[pair] = c
+	}
+	return out
+}
+
+// recordConnectOutcome counts whether a call between the two users got
+// media flowing, by their regions.
+func (m *MatchMaker) recordConnectOutcome(ctx context.Context, a, b string, connected bool) {
+	pipe := m.rdb.Pipeline()
+	regionA := pipe.HGet(ctx, profileKey(a), "region")
+	regionB := pipe.HGet(ctx, profileKey(b), "region")
+	_, _ = pipe.Exec(ctx)
+	pair := regionPairLabel(regionA.Val(), regionB.Val())
+	outcome := "fail"
+	if connected {
+		outcome = "ok"
+	}
+	connectOutcomesTotal.WithLabelValues(pair, outcome).Inc()
+
+	pipe = m.rdb.Pipeline()
+	pipe.HIncrBy(ctx, redisConnectStats, pair+":"+outcome, 1)
+	counts := pipe.HMGet(ctx, redisConnectStats, pair+":ok", pair+":fail")
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("MatchMaker: failed to record connect outcome", "pair", pair, "error", err)
+		return
+	}
+	var n [2]int64
+	for i, v := range counts.Val() {
+		if s, ok := v.(string); ok {
+			n[i], _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+	if n[0]+n[1] > connectStatsCap {
+		// Racing halvings at worst decay a pair twice; the rate survives.
+		m.rdb.HSet(ctx, redisConnectStats, pair+":ok", n[0]/2, pair+":fail", n[1]/2)
+	}
+}
+
+// estimatedRTT guesses the round trip between two users from what the
+// server can see: each side's RTT to its pod bounds the path through the
+// server, users in different regions pay a fixed penalty, and region pairs
+// whose calls often fail to connect are penalized by their failure rate.
+func estimatedRTT(a, b Profile, stats connectStats) time.Duration {
+	est := a.rttOrDefault() + b.rttOrDefault()
+	if a.Region != "" && b.Region != "" && a.Region != b.Region {
+		est += crossRegionPenalty
+	}
+	est += time.Duration(stats.failureRate(a.Region, b.Region) * float64(connectFailurePenalty))
+	return est
+}
+
+func (p Profile) rttOrDefault() time.Duration {
+	if p.RTT <= 0 {
+		return defaultClientRTT
+	}
+	return p.RTT
+}
+
+// latencyRank is the bucket of the estimated RTT between a and b; lower
+// is better. All pairs rank equal when latency-aware pairing is disabled.
+func latencyRank(a, b Profile, stats connectStats) int64 {
+	if latencyBucket <= 0 {
+		return 0
+	}
+	return int64(estimatedRTT(a, b, stats) / latencyBucket)
+}
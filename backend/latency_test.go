@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParsePong(t *testing.T) {
+	now := time.Now()
+	if rtt, ok := parsePong(string(pingPayload(now.Add(-80*time.Millisecond))), now); !ok || rtt != 80*time.Millisecond {
+		t.Fatalf("parsePong = %v, %v; want 80ms", rtt, ok)
+	}
+	for _, data := range []string{"", "garbage", string(pingPayload(now.Add(time.Second))), string(pingPayload(now.Add(-time.Minute)))} {
+		if _, ok := parsePong(data, now); ok {
+			t.Fatalf("parsePong(%q) should be rejected", data)
+		}
+	}
+	if got := smoothRTT(0, 100*time.Millisecond); got != 100*time.Millisecond {
+		t.Fatalf("first sample should be taken as is, got %v", got)
+	}
+	if got := smoothRTT(100*time.Millisecond, 200*time.Millisecond); got != 130*time.Millisecond {
+		t.Fatalf("smoothRTT = %v, want 130ms", got)
+	}
+}
+
+func TestEstimatedRTT(t *testing.T) {
+	near := Profile{Region: "us-east", RTT: 30 * time.Millisecond}
+	alsoNear := Profile{Region: "us-east", RTT: 40 * time.Millisecond}
+	far := Profile{Region: "eu-west", RTT: 30 * time.Millisecond}
+
+	if got := estimatedRTT(near, alsoNear, nil); got != 70*time.Millisecond {
+		t.Fatalf("same region = %v, want 70ms", got)
+	}
+	if got := estimatedRTT(near, far, nil); got != 160*time.Millisecond {
+		t.Fatalf("cross region = %v, want 160ms", got)
+	}
+	if got := estimatedRTT(Profile{}, Profile{}, nil); got != 2*defaultClientRTT {
+		t.Fatalf("unmeasured = %v, want %v", got, 2*defaultClientRTT)
+	}
+
+	stats := connectStats{"eu-west|us-east": {OK: 5, Fail: 5}}
+	if got := estimatedRTT(near, far, stats); got != 160*time.Millisecond {
+		t.Fatalf("too few samples should not count, got %v", got)
+	}
+	stats["eu-west|us-east"] = connectCounts{OK: 15, Fail: 5}
+	if got := estimatedRTT(near, far, stats); got != 410*time.Millisecond {
+		t.Fatalf("25%% failures = %v, want 410ms", got)
+	}
+}
+
+func TestConnectOutcomes(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	mm.SetProfile(ctx, "alice", Profile{Region: "us-east"})
+	mm.SetProfile(ctx, "bob", Profile{Region: "eu-west"})
+	startMatch(t, mm, client, "alice", "bob", time.Second, true)
+	mm.MarkConnected(ctx, "bob") // both sides report; counted once
+
+	mm.SetProfile(ctx, "carol", Profile{Region: "us-east"})
+	mm.SetProfile(ctx, "dave", Profile{Region: "eu-west"})
+	startMatch(t, mm, client, "carol", "dave", connectGiveUpWait+time.Second, false)
+	mm.leaveMatch(ctx, "carol", leaveSkip)
+	mm.leaveMatch(ctx, "dave", leaveSkip) // already recorded by carol
+
+	mm.SetProfile(ctx, "erin", Profile{Region: "us-east"})
+	mm.SetProfile(ctx, "frank", Profile{Region: "eu-west"})
+	startMatch(t, mm, client, "erin", "frank", time.Second, false)
+	mm.leaveMatch(ctx, "erin", leaveSkip) // skipped before it could connect
+
+	got := mm.loadConnectStats(ctx)["eu-west|us-east"]
+	if got != (connectCounts{OK: 1, Fail: 1}) {
+		t.Fatalf("connect stats = %+v, want one ok and one fail", got)
+	}
+
+	client.HSet(ctx, redisConnectStats, "eu-west|us-east:ok", connectStatsCap)
+	mm.recordConnectOutcome(ctx, "alice", "bob", false)
+	if got := mm.loadConnectStats(ctx)["eu-west|us-east"]; got != (connectCounts{OK: connectStatsCap / 2, Fail: 1}) {
+		t.Fatalf("counters over the cap should be halved, got %+v", got)
+	}
+}
+
+func TestMatchMaker_PrefersLowerEstimatedRTT(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	for _, u := range []struct {
+		id, region string
+		rtt        time.Duration
+	}{
+		{"alice", "us-east", 30 * time.Millisecond},
+		{"pierre", "eu-west", 30 * time.Millisecond},
+		{"bob", "us-east", 40 * time.Millisecond},
+	} {
+		mm.SetProfile(ctx, u.id, Profile{Region: u.region, RTT: u.rtt})
+		mm.Add(ctx, u.id)
+	}
+	mm.processMatches(ctx)
+
+	if peer, _ := client.Get(ctx, sessionKey("alice")).Result(); peer != "bob" {
+		t.Fatalf("alice paired with %q, want bob from her own region", peer)
+	}
+	if !mm.isQueued(ctx, "pierre") {
+		t.Fatalf("pierre should wait for someone closer")
+	}
+}
+
+// latencyReplay is a recorded queue snapshot; see testdata.
+type latencyReplay struct {
+	ConnectStats map[string]struct {
+		OK   int64 `json:"ok"`
+		Fail int64 `json:"fail"`
+	} `json:"connect_stats"`
+	Waiters []struct {
+		ID     string `json:"id"`
+		Region string `json:"region"`
+		RTTMs  int64  `json:"rtt_ms"`
+	} `json:"waiters"`
+}
+
+type replayResult struct {
+	pairs [][2]string
+	est   []time.Duration
+}
+
+func (r replayResult) mean() time.Duration {
+	var sum time.Duration
+	for _, e := range r.est {
+		sum += e
+	}
+	return sum / time.Duration(len(r.est))
+}
+
+// replayPairing enqueues the snapshot in arrival order into a fresh
+// matchmaker, runs one pairing pass with the given latencyBucket, and
+// returns the resulting pairs with their estimated RTTs.
+func replayPairing(t *testing.T, snap latencyReplay, bucket time.Duration) replayResult {
+	t.Helper()
+	prev := latencyBucket
+	latencyBucket = bucket
+	defer func() { latencyBucket = prev }()
+
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+	stats := make(connectStats)
+	for pair, c := range snap.ConnectStats {
+		client.HSet(ctx, redisConnectStats, pair+":ok", c.OK, pair+":fail", c.Fail)
+		stats[pair] = connectCounts{OK: c.OK, Fail: c.Fail}
+	}
+	profiles := make(map[string]Profile)
+	for _, w := range snap.Waiters {
+		p := Profile{Region: w.Region, RTT: time.Duration(w.RTTMs) * time.Millisecond}
+		profiles[w.ID] = p
+		mm.SetProfile(ctx, w.ID, p)
+		mm.Add(ctx, w.ID)
+	}
+	mm.processMatches(ctx)
+
+	var res replayResult
+	for _, w := range snap.Waiters {
+		peer, _ := client.Get(ctx, sessionKey(w.ID)).Result()
+		if peer == "" || peer < w.ID {
+			continue
+		}
+		res.pairs = append(res.pairs, [2]string{w.ID, peer})
+		res.est = append(res.est, estimatedRTT(profiles[w.ID], profiles[peer], stats))
+	}
+	return res
+}
+
+// TestLatencyReplay pairs a recorded queue snapshot plain FIFO and with
+// latency-aware ordering, and logs how the policy reorders the pairs.
+// Run with -v to see the comparison.
+func TestLatencyReplay(t *testing.T) {
+	raw, err := os.ReadFile("testdata/latency_replay.json")
+	if err != nil {
+		t.Fatalf("read snapshot: %v", err)
+	}
+	var snap latencyReplay
+	if err := json.Unmarshal(raw, &snap); err != nil {
+		t.Fatalf("parse snapshot: %v", err)
+	}
+
+	fifo := replayPairing(t, snap, 0)
+	aware := replayPairing(t, snap, defaultLatencyBucket)
+
+	for _, r := range []struct {
+		name string
+		res  replayResult
+	}{{"fifo", fifo}, {"latency", aware}} {
+		sorted := append([]time.Duration(nil), r.res.est...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		t.Logf("%-8s %d pairs, mean est. RTT %v, worst %v", r.name, len(r.res.pairs), r.res.mean(), sorted[len(sorted)-1])
+		for i, p := range r.res.pairs {
+			t.Logf("  %s-%s %5dms", p[0], p[1], r.res.est[i].Milliseconds())
+		}
+	}
+
+	if len(aware.pairs) != len(fifo.pairs) {
+		t.Fatalf("latency-aware pairing matched %d pairs, FIFO %d: nobody should be left behind", len(aware.pairs), len(fifo.pairs))
+	}
+	if aware.mean() >= fifo.mean() {
+		t.Fatalf("latency-aware mean est. RTT %v should beat FIFO's %v", aware.mean(), fifo.mean())
+	}
+}
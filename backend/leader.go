@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// leaderLeaseTTL is how long a lease survives without a renewal. It bounds
+	// failover time when the leader dies without resigning (OOM kill, node
+	// loss): a follower can take over at most one TTL plus one renew tick
+	// after the last successful renewal.
+	leaderLeaseTTL = 3 * time.Second
+	// leaderRenewInterval must be comfortably below leaderLeaseTTL so a single
+	// slow Redis round-trip doesn't let the lease lapse under a healthy leader.
+	leaderRenewInterval = 1 * time.Second
+)
+
+// renewLeaseScript extends the lease only if it is still held by ARGV[1].
+// A plain PEXPIRE could extend a lease another pod acquired after ours
+// lapsed, leaving two pods convinced they lead.
+var renewLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+    return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseLeaseScript deletes the lease only if it is still held by ARGV[1].
+var releaseLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+    return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// leaderElector holds a Redis lease that elects a single pod to run the
+// pairing loop. Every replica still accepts WebSockets and enqueues users;
+// only the leader pops from the shared queue, so N pods no longer means N
+// concurrent pairing passes per trigger.
+type leaderElector struct {
+	rdb     redis.UniversalClient
+	key     string
+	id      string
+	ttl     time.Duration
+	leading atomic.Bool
+}
+
+func newLeaderElector(rdb redis.UniversalClient, id string) *leaderElector {
+	matchmakerLeader.WithLabelValues(id).Set(0)
+	return &leaderElector{rdb: rdb, key: redisLeaderKey, id: id, ttl: leaderLeaseTTL}
+}
+
+// podID identifies this replica in the leader lease and metrics. POD_NAME is
+// injected via the downward API in k8s; the hostname is the same value inside
+// a pod and a reasonable fallback elsewhere.
+func podID() string {
+	if id := os.Getenv("POD_NAME"); id != "" {
+		return id
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return "unknown"
+}
+
+// IsLeader reports whether this pod held the lease as of the last step.
+func (e *leaderElector) IsLeader() bool {
+	return e.leading.Load()
+}
+
+// step renews the lease if we hold it, or tries to acquire it otherwise.
+// A Redis error while leading demotes us: we can no longer prove the lease
+// is ours, and a follower will take over once it expires.
+func (e *leaderElector) step(ctx context.Context) bool {
+	if e.leading.Load() {
+		n, err := renewLeaseScript.Run(ctx, e.rdb, []string{e.key}, e.id, e.ttl.Milliseconds()).Int()
+		if err != nil || n == 0 {
+			if err != nil {
+				slog.Error("Leader: lease renewal failed", "pod", e.id, "error", err)
+			}
+			e.setLeading(false)
+			return false
+		}
+		return true
+	}
+
+	ok, err := e.rdb.SetNX(ctx, e.key, e.id, e.ttl).Result()
+	if err != nil {
+		slog.Error("Leader: lease acquire failed", "pod", e.id, "error", err)
+		return false
+	}
+	if ok {
+		e.setLeading(true)
+	}
+	return ok
+}
+
+// resign releases the lease so a follower can take over on its next tick
+// instead of waiting out the TTL. Called on graceful shutdown.
+func (e *leaderElector) resign(ctx context.Context) {
+	if !e.leading.Load() {
+		return
+	}
+	if err := releaseLeaseScript.Run(ctx, e.rdb, []string{e.key}, e.id).Err(); err != nil {
+		slog.Error("Leader: lease release failed", "pod", e.id, "error", err)
+	}
+	e.setLeading(false)
+}
+
+func (e *leaderElector) setLeading(v bool) {
+	if e.leading.Swap(v) == v {
+		return
+	}
+	if v {
+		matchmakerLeader.WithLabelValues(e.id).Set(1)
+		leaderTransitionsTotal.Inc()
+		slog.Info("Leader: acquired matchmaker lease", "pod", e.id)
+	} else {
+		matchmakerLeader.WithLabelValues(e.id).Set(0)
+		slog.Info("Leader: lost matchmaker lease", "pod", e.id)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestElector(t *testing.T, mr *miniredis.Miniredis, id string) *leaderElector {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return newLeaderElector(client, id)
+}
+
+func readLeaderGauge(t *testing.T, pod string) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := matchmakerLeader.WithLabelValues(pod).Write(&m); err != nil {
+		t.Fatalf("gauge Write: %v", err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestLeaderElector_SingleLeader(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+
+	a := newTestElector(t, mr, "pod-a")
+	b := newTestElector(t, mr, "pod-b")
+
+	if !a.step(ctx) {
+		t.Fatalf("pod-a should acquire the free lease")
+	}
+	if b.step(ctx) {
+		t.Fatalf("pod-b must not acquire a lease held by pod-a")
+	}
+	// Renewal keeps pod-a leading and pod-b following.
+	if !a.step(ctx) || b.step(ctx) {
+		t.Fatalf("renewal should not change leadership")
+	}
+	if got := readLeaderGauge(t, "pod-a"); got != 1 {
+		t.Fatalf("leader gauge for pod-a: want 1, got %v", got)
+	}
+	if got := readLeaderGauge(t, "pod-b"); got != 0 {
+		t.Fatalf("leader gauge for pod-b: want 0, got %v", got)
+	}
+}
+
+// Simulates the leader pod dying without resigning: it stops renewing, the
+// lease lapses after leaderLeaseTTL, and a follower takes over on its next
+// step. The dead leader must not be able to renew once it has been replaced.
+func TestLeaderElector_FailoverAfterLeaseExpiry(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+
+	a := newTestElector(t, mr, "pod-a")
+	b := newTestElector(t, mr, "pod-b")
+
+	if !a.step(ctx) {
+		t.Fatalf("pod-a should acquire the free lease")
+	}
+
+	// pod-a goes silent; the lease is still valid just before the TTL.
+	mr.FastForward(leaderLeaseTTL / 2)
+	if b.step(ctx) {
+		t.Fatalf("pod-b must not take over before the lease expires")
+	}
+
+	mr.FastForward(leaderLeaseTTL)
+	if !b.step(ctx) {
+		t.Fatalf("pod-b should take over after pod-a's lease expired")
+	}
+
+	// pod-a comes back (e.g. after a long GC pause) and tries to renew.
+	if a.step(ctx) {
+		t.Fatalf("pod-a must not renew a lease now held by pod-b")
+	}
+	if a.IsLeader() {
+		t.Fatalf("pod-a should have demoted itself")
+	}
+	if got, _ := mr.Get(redisLeaderKey); got != "pod-b" {
+		t.Fatalf("lease holder: want pod-b, got %q", got)
+	}
+}
+
+func TestLeaderElector_ResignHandsOverImmediately(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+
+	a := newTestElector(t, mr, "pod-a")
+	b := newTestElector(t, mr, "pod-b")
+
+	a.step(ctx)
+	a.resign(ctx)
+
+	if a.IsLeader() {
+		t.Fatalf("pod-a should not lead after resigning")
+	}
+	if !b.step(ctx) {
+		t.Fatalf("pod-b should acquire the lease without waiting for the TTL")
+	}
+}
+
+func TestLeaderElector_ResignDoesNotDeleteOthersLease(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+
+	a := newTestElector(t, mr, "pod-a")
+	b := newTestElector(t, mr, "pod-b")
+
+	a.step(ctx)
+	mr.FastForward(2 * leaderLeaseTTL)
+	b.step(ctx)
+
+	// pod-a still believes it leads; its release must not touch pod-b's lease.
+	a.resign(ctx)
+	if got, _ := mr.Get(redisLeaderKey); got != "pod-b" {
+		t.Fatalf("lease holder after stale resign: want pod-b, got %q", got)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -45,6 +46,10 @@ type Client struct {
 	ID   string
 	Conn *websocket.Conn
 	mu   sync.Mutex
+	// expiresAt is when the client's token lapses, in Unix seconds; a
+	// reauth moves it on and signals reauthed (see reauth.go).
+	expiresAt atomic.Int64
+	reauthed  chan struct{}
 }
 
 func (c *Client) WriteJSON(v interface{}) error {
@@ -65,7 +70,7 @@ func (c *Client) WriteControl(messageType int, data []byte, deadline time.Time)
 var (
 	clients    = make(map[string]*Client)
 	clientsMu  sync.Mutex
-	rdb        *redis.Client
+	rdb        redis.UniversalClient
 	matchMaker *MatchMaker
 	wsLimiter  *ipRateLimiter
 )
@@ -77,34 +82,114 @@ func getEnv(key, defaultVal string) string {
 	return defaultVal
 }
 
-func main() {
+// serve runs the API server. It is called from main in main_server.go,
+// which the matchsim build (see matchsim.go) replaces with the simulator.
+func serve() {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 	slog.SetDefault(logger)
 
-	redisDB := 0
-	if dbStr := os.Getenv("REDIS_DB"); dbStr != "" {
-		if db, err := strconv.Atoi(dbStr); err == nil {
-			redisDB = db
-		}
-	}
-
-	rdb = redis.NewClient(&redis.Options{
-		Addr:     getEnv("REDIS_ADDR", "localhost:6379"),
-		Password: getEnv("REDIS_PASSWORD", ""),
-		DB:       redisDB,
-	})
+	redisOpts := redisOptionsFromEnv()
+	rdb = redis.NewUniversalClient(redisOpts)
 
 	ctx := context.Background()
 	if _, err := rdb.Ping(ctx).Result(); err != nil {
-		slog.Error("Redis connection failed", "addr", getEnv("REDIS_ADDR", "localhost:6379"), "error", err)
+		slog.Error("Redis connection failed", "addrs", redisOpts.Addrs, "mode", redisMode(redisOpts), "error", err)
 		os.Exit(1)
 	}
-	slog.Info("Connected to Redis", "addr", getEnv("REDIS_ADDR", "localhost:6379"))
+	slog.Info("Connected to Redis", "addrs", redisOpts.Addrs, "mode", redisMode(redisOpts))
 
 	matchMaker = NewMatchMaker(rdb)
+	if v := os.Getenv("MATCH_TAG_WAIT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			matchMaker.tagMatchWait = d
+		} else {
+			slog.Warn("Ignoring invalid MATCH_TAG_WAIT", "value", v)
+		}
+	}
+	if v := os.Getenv("TRUST_SHADOW_THRESHOLD"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f <= 100 {
+			trustShadowThreshold = f
+		} else {
+			slog.Warn("Ignoring invalid TRUST_SHADOW_THRESHOLD", "value", v)
+		}
+	}
+	if v := os.Getenv("MATCHMAKER_SHARDS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= maxQueueShards {
+			matchMaker.shards = n
+		} else {
+			slog.Warn("Ignoring invalid MATCHMAKER_SHARDS", "value", v, "max", maxQueueShards)
+		}
+	}
+	if v := os.Getenv("PRIORITY_REQUEUE_WINDOW"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			priorityRequeueWindow = d
+		} else {
+			slog.Warn("Ignoring invalid PRIORITY_REQUEUE_WINDOW", "value", v)
+		}
+	}
+	if v := os.Getenv("MATCH_LATENCY_BUCKET"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			latencyBucket = d
+		} else {
+			slog.Warn("Ignoring invalid MATCH_LATENCY_BUCKET", "value", v)
+		}
+	}
+	if v := os.Getenv("METRIC_LANGUAGES"); v != "" {
+		if langs := parseMetricLanguages(v); len(langs) > 0 {
+			metricLanguages = langs
+		} else {
+			slog.Warn("Ignoring invalid METRIC_LANGUAGES", "value", v)
+		}
+	}
+	podRegion = os.Getenv("POD_REGION")
+	if v := os.Getenv("GOOGLE_CLIENT_IDS"); v != "" {
+		googleClientIDs = parseClientIDs(v)
+	}
+	appleClientIDs = parseClientIDs(os.Getenv("APPLE_CLIENT_IDS"))
+	if v := os.Getenv("OIDC_ISSUERS"); v != "" {
+		var err error
+		if oidcIssuers, err = parseOIDCIssuers(v); err != nil {
+			slog.Error("Invalid OIDC_ISSUERS", "error", err)
+			os.Exit(1)
+		}
+		for iss, p := range oidcIssuers {
+			slog.Info("OIDC issuer enabled", "name", p.name, "issuer", iss)
+		}
+	}
+	if v := os.Getenv("AUDIT_RETENTION"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			auditRetention = d
+		} else {
+			slog.Warn("Ignoring invalid AUDIT_RETENTION", "value", v)
+		}
+	}
+	if v := os.Getenv("SHARD_REBALANCE_WAIT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			matchMaker.shardRebalanceWait = d
+		} else {
+			slog.Warn("Ignoring invalid SHARD_REBALANCE_WAIT", "value", v)
+		}
+	}
+
+	if v := os.Getenv("ACCESS_TOKEN_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			accessTokenTTL = d
+		} else {
+			slog.Warn("Ignoring invalid ACCESS_TOKEN_TTL", "value", v)
+		}
+	}
+	if v := os.Getenv("REFRESH_TOKEN_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			refreshTokenTTL = d
+		} else {
+			slog.Warn("Ignoring invalid REFRESH_TOKEN_TTL", "value", v)
+		}
+	}
 
 	trustProxy := strings.EqualFold(getEnv("TRUST_PROXY_HEADERS", ""), "true")
 	wsLimiter = newIPRateLimiter(wsConnectionsPerMinute, trustProxy)
+	authLimiter = newIPRateLimiter(authRequestsPerMinute, trustProxy)
+	exportLimiter = newIPRateLimiter(exportRequestsPerMinute, trustProxy)
 
 	dbDSN := getEnv("DB_DSN", "")
 	if dbDSN == "" {
@@ -127,10 +212,40 @@ func main() {
 	}
 	slog.Info("Object storage ready", "provider", getEnv("STORAGE_PROVIDER", ""), "bucket", getEnv("STORAGE_BUCKET", ""))
 
+	if v := os.Getenv("SESSION_SIGNING_KEYS"); v != "" {
+		sessionKeys, dbErr = parseSessionKeys(v)
+		if dbErr != nil {
+			slog.Error("Invalid SESSION_SIGNING_KEYS", "error", dbErr)
+			os.Exit(1)
+		}
+		slog.Info("Session tokens enabled", "signing_kid", sessionKeys.active, "keys", len(sessionKeys.keys))
+	}
+
+	ageVerifier, dbErr = newAgeVerifier()
+	if dbErr != nil {
+		slog.Error("Age verification init failed", "error", dbErr)
+		os.Exit(1)
+	}
+	ageStrict = strings.EqualFold(getEnv("AGE_STRICT", ""), "true")
+	termsVersion = os.Getenv("TERMS_VERSION")
+	termsURL = os.Getenv("TERMS_URL")
+	if termsVersion != "" {
+		slog.Info("Terms of service enforced", "version", termsVersion, "url", termsURL)
+	}
+	if ageVerifier != nil {
+		slog.Info("Age verification ready", "provider", ageVerifier.Name(), "strict", ageStrict)
+	}
+
 	http.HandleFunc("/ws", handleConnections)
+	http.HandleFunc("/auth/login", loginHandler)
+	http.HandleFunc("/auth/refresh", refreshHandler)
 	http.HandleFunc("/report", reportHandler)
 	http.HandleFunc("/block", blockHandler)
 	http.HandleFunc("/blocks", blocksHandler)
+	http.HandleFunc("/me", meHandler)
+	http.HandleFunc("/me/export", exportHandler)
+	http.HandleFunc("/me/accept-terms", acceptTermsHandler)
+	http.HandleFunc("/terms", termsHandler)
 	http.HandleFunc("/healthz", livenessHandler)
 	http.HandleFunc("/readyz", readinessHandler)
 	http.Handle("/metrics", metricsHandler())
@@ -140,7 +255,12 @@ func main() {
 	http.HandleFunc("/", handleNotFound)
 
 	port := ":8080"
-	go matchMaker.Run(ctx)
+	// Cancelled on SIGTERM before the drain starts so the leader lease is
+	// released immediately and another replica takes over pairing.
+	mmCtx, stopMatchMaker := context.WithCancel(ctx)
+	defer stopMatchMaker()
+	go matchMaker.Run(mmCtx)
+	go runQueueStatusLoop(mmCtx)
 
 	server := &http.Server{Addr: port}
 
@@ -164,6 +284,7 @@ func main() {
 		}
 	case sig := <-sigCh:
 		slog.Info("Shutdown signal received", "signal", sig.String())
+		stopMatchMaker()
 		gracefulShutdown(server)
 	}
 }
@@ -192,7 +313,7 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 	// expired / missing-subject in one place (see auth.go).
 	token := bearerToken(r)
 	ctx := context.Background()
-	userID, code, verr := verifyToken(ctx, token)
+	userID, claims, code, verr := verifyTokenClaims(ctx, token)
 	if code != "" {
 		logTokenFailure(code, verr, token, r.RemoteAddr)
 		writeError(w, http.StatusUnauthorized, code, tokenErrMessage(code))
@@ -220,6 +341,20 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !requireTerms(ctx, w, internalID, userID) {
+		return
+	}
+
+	// Age segregation: resolve the band the user is matched in. In strict
+	// mode users nobody has vouched for are turned away.
+	ageBand := resolveAgeBand(ctx, internalID, userID, claims)
+	if ageBand == "" && ageStrict {
+		ageGateRefusalsTotal.Inc()
+		slog.Info("Unverified user denied connection", "user_id", userID)
+		writeError(w, http.StatusForbidden, "age_verification_required", "age verification required")
+		return
+	}
+
 	// Hydrate the user's block SET in Redis before they can be matched.
 	// loadUserBlocks failure is logged but not fatal — the matchmaker would
 	// still pair them with people they've blocked, but that's a degraded
@@ -238,7 +373,8 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 	defer func() { _ = conn.Close() }()
 
 	clientID := userID
-	client := &Client{ID: clientID, Conn: conn}
+	client := &Client{ID: clientID, Conn: conn, reauthed: make(chan struct{}, 1)}
+	client.expiresAt.Store(tokenExpiry(claims).Unix())
 
 	clientsMu.Lock()
 	clients[clientID] = client
@@ -254,55 +390,87 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 
 		// Remove from match queue if still waiting
 		matchMaker.Remove(ctx, clientID)
+		// Tell a partner still in the call that they were left behind, so
+		// their next_match lands in the priority lane.
+		matchMaker.leaveMatch(ctx, clientID, leaveDisconnect)
+		// Drop matching preferences; Remove above needed them to unindex tags.
+		matchMaker.ClearProfile(ctx, clientID)
 		// Clear any active session mapping
 		matchMaker.DeleteSession(ctx, clientID)
 		// Drop the cached block SET; a future connect re-hydrates from DB.
 		matchMaker.ClearBlocks(ctx, clientID)
+		// Drop undelivered events about the call torn down above.
+		matchMaker.ClearEvents(ctx, clientID)
 
 		slog.Info("Client fully disconnected", "client_id", clientID)
 	}()
 
 	slog.Info("Client connected (Authenticated)", "client_id", clientID)
 
-	// Send ID to client
-	if err := client.WriteJSON(Message{
-		Type:    "init",
-		Payload: clientID,
-	}); err != nil {
+	// Tell the client it is connected. Its own ID is deliberately left out:
+	// peers only ever know each other by per-match handles.
+	if err := client.WriteJSON(Message{Type: "init"}); err != nil {
 		slog.Error("Failed to send init message", "client_id", clientID, "error", err)
 		return
 	}
 
-	// Subscribe to per-client match notification channel before enqueuing so
-	// we never miss a notification published by any backend instance.
+	// Attach to the per-client event stream and its doorbell before enqueuing
+	// so a match made by any backend instance is never missed. Events that
+	// arrived while no socket was attached are delivered first.
+	events, err := matchMaker.openEvents(ctx, clientID)
+	if err != nil {
+		slog.Error("Failed to open event stream", "client_id", clientID, "error", err)
+		return
+	}
 	notifySub := rdb.Subscribe(ctx, redisNotifyPfx+clientID)
 	defer func() { _ = notifySub.Close() }()
 
-	go func() {
-		for msg := range notifySub.Channel() {
-			peerID := msg.Payload
-			slog.Info("Client matched via Redis notify", "client_id", clientID, "peer_id", peerID)
-			if err := client.WriteJSON(Message{
-				Type:    "match",
-				Payload: peerID,
-			}); err != nil {
-				slog.Error("Failed to send match message", "client_id", clientID, "error", err)
+	go pumpEvents(ctx, events, notifySub.Channel(), func(msg Message) error {
+		if msg.Type == closeAccountSuspended {
+			suspendOnEvent(ctx, client)
+			return nil
+		}
+		if msg.Type == closeAccountDeleted {
+			// Only the account this socket belongs to; a stale event must
+			// not close a new account under the same identity.
+			if id, _ := msg.Payload.(string); id == strconv.FormatInt(internalID, 10) {
+				client.closePolicy(closeAccountDeleted)
 			}
+			return nil
 		}
-	}()
+		if msg.Type == "match" {
+			slog.Info("Client matched", "client_id", clientID, "payload", msg.Payload)
+		}
+		return client.WriteJSON(msg)
+	})
 
-	// Add to match queue
+	// Record interest tags and spoken languages from the upgrade request,
+	// then add to match queue.
+	langs, anyLanguage := languagesFromRequest(r)
+	matchMaker.SetProfile(ctx, clientID, Profile{
+		Interests:   interestsFromQuery(r.URL.Query()),
+		Languages:   langs,
+		AnyLanguage: anyLanguage,
+		Pool:        matchPool(ctx, internalID, clientID),
+		Quality:     userQuality(ctx, internalID, clientID),
+		AgeBand:     ageBand,
+		Region:      podRegion,
+		Pod:         podID(),
+	})
 	matchMaker.Add(ctx, clientID)
 
-	// Start heartbeat
+	// Start heartbeat. Each ping carries its send time so the pong measures
+	// the client's RTT; the first goes out straight away so the matchmaker
+	// has a measurement within the user's first pairing passes.
 	go func() {
 		ticker := time.NewTicker(pingPeriod)
 		defer ticker.Stop()
-		for range ticker.C {
-			if err := client.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
+		for {
+			if err := client.WriteControl(websocket.PingMessage, pingPayload(time.Now()), time.Now().Add(writeWait)); err != nil {
 				slog.Info("Ping failed, closing connection", "client_id", clientID, "error", err)
 				return
 			}
+			<-ticker.C
 		}
 	}()
 
@@ -312,7 +480,19 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 		slog.Error("Failed to set read deadline", "client_id", clientID, "error", err)
 		return
 	}
-	conn.SetPongHandler(func(string) error { return conn.SetReadDeadline(time.Now().Add(pongWait)) })
+	var rtt time.Duration
+	conn.SetPongHandler(func(data string) error {
+		if sample, ok := parsePong(data, time.Now()); ok {
+			rtt = smoothRTT(rtt, sample)
+			matchMaker.SetRTT(ctx, clientID, rtt)
+		}
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	// Close the socket once its token lapses unless the client reauths.
+	done := make(chan struct{})
+	defer close(done)
+	go watchTokenExpiry(client, done)
 
 	for {
 		var msg Message
@@ -327,6 +507,10 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
+		if msg.Type == "reauth" {
+			handleReauth(ctx, client, msg)
+			continue
+		}
 		msg.From = clientID
 		handleMessage(msg)
 	}
@@ -336,6 +520,19 @@ func handleMessage(msg Message) {
 	// Control messages handled server-side, never relayed to a peer.
 	if msg.Type == "connect_metrics" {
 		recordConnectMetrics(msg)
+		matchMaker.MarkConnected(context.Background(), msg.From)
+		return
+	}
+	if msg.Type == "next_match" {
+		matchMaker.Requeue(context.Background(), msg.From)
+		return
+	}
+	if msg.Type == "set_preferences" {
+		applyPreferences(msg)
+		return
+	}
+	if msg.Type == "rate_call" {
+		rateCall(msg)
 		return
 	}
 
@@ -343,16 +540,83 @@ func handleMessage(msg Message) {
 		return
 	}
 
+	// `to` is the peer handle from the sender's match event. Relay only
+	// between two users currently matched with each other, through the
+	// peer's event stream so it reaches them on whichever pod holds their
+	// socket. Both directions are checked: a user's session outlives their
+	// next_match, and their old partner may already be in a new call.
+	ctx := context.Background()
+	to, ok := matchMaker.ResolvePeer(ctx, msg.From, msg.To)
+	if !ok || matchMaker.Session(ctx, msg.From) != to || matchMaker.Session(ctx, to) != msg.From {
+		slog.Debug("Dropping relay to non-peer", "from", msg.From, "to", msg.To, "type", msg.Type)
+		return
+	}
+	// The recipient sees the sender under the handle they were given.
+	from := matchMaker.PeerHandle(ctx, to)
+	if from == "" {
+		slog.Debug("Dropping relay without a peer handle", "from", msg.From, "to", to, "type", msg.Type)
+		return
+	}
+	msg.From, msg.To = from, ""
+	if err := matchMaker.Deliver(ctx, to, msg); err != nil {
+		slog.Error("Failed to send message", "to", to, "error", err)
+	}
+}
+
+// applyPreferences handles a set_preferences message. Every field is
+// optional; omitted fields keep their current value:
+//
+//	{ "interests": ["music", "games"], "languages": ["en", "es"], "any_language": false }
+//
+// Values are normalized (see normalizeInterests / normalizeLanguages) and the
+// resulting preferences are echoed back in a `preferences` event so the
+// client can show what actually applies.
+func applyPreferences(msg Message) {
+	interests, languages, anyLanguage, ok := preferencesFromPayload(msg.Payload)
+	if !ok {
+		return
+	}
+	ctx := context.Background()
+	if interests != nil {
+		matchMaker.SetInterests(ctx, msg.From, interests)
+	}
+	if languages != nil || anyLanguage != nil {
+		cur := matchMaker.Profile(ctx, msg.From)
+		if languages == nil {
+			languages = cur.Languages
+		}
+		anyLang := cur.AnyLanguage
+		if anyLanguage != nil {
+			anyLang = *anyLanguage
+		}
+		matchMaker.SetLanguages(ctx, msg.From, languages, anyLang)
+	}
+
 	clientsMu.Lock()
-	target, ok := clients[msg.To]
+	c, ok := clients[msg.From]
 	clientsMu.Unlock()
+	if !ok {
+		return
+	}
+	p := matchMaker.Profile(ctx, msg.From)
+	if err := c.WriteJSON(Message{
+		Type: "preferences",
+		Payload: map[string]any{
+			"interests":    nonNil(p.Interests),
+			"languages":    nonNil(p.Languages),
+			"any_language": p.AnyLanguage,
+		},
+	}); err != nil {
+		slog.Error("Failed to send preferences ack", "client_id", msg.From, "error", err)
+	}
+}
 
-	if ok {
-		err := target.WriteJSON(msg)
-		if err != nil {
-			slog.Error("Failed to send message", "to", msg.To, "error", err)
-		}
+// nonNil turns a nil slice into an empty one so it encodes as [] not null.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
 	}
+	return s
 }
 
 // recordConnectMetrics observes a client-reported connection-timing payload
@@ -0,0 +1,7 @@
+//go:build !matchsim
+
+package main
+
+func main() {
+	serve()
+}
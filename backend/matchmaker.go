@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"strconv"
 	"time"
@@ -10,12 +11,6 @@ import (
 )
 
 const (
-	redisQueueKey      = "matchmaker:queue"
-	redisSessionPfx    = "matchmaker:session:"
-	redisNotifyPfx     = "matchmaker:notify:"
-	redisTriggerKey    = "matchmaker:trigger"
-	redisEnqueueAtHash = "matchmaker:enqueued_at"
-	redisBlocksPfx     = "matchmaker:blocks:"
 	// blocksTTL keeps a stale block SET alive long enough that a quick
 	// reconnect doesn't have to re-hydrate from Postgres, but short enough
 	// that a long-offline user's data is reaped from Redis. The set is
@@ -26,57 +21,155 @@ const (
 	// the head of the queue is dominated by mutually-blocked candidates so
 	// the loop cannot starve other tickers / pub-sub events.
 	maxBlockedRejectionsPerCycle = 32
+	// recentLatencySamples is how many of the newest match-latency
+	// observations are kept in Redis for queue_status wait estimates. The
+	// leader pushes them; every pod reads them, since the Prometheus
+	// histogram is only populated on whichever pod happens to lead.
+	recentLatencySamples = 100
+	// defaultTagMatchWait is how long a user who declared interests holds
+	// out for a partner sharing one before accepting a random match.
+	defaultTagMatchWait = 10 * time.Second
+	// maxQueueScan bounds how many queued users a single pairing pass loads
+	// per shard. Anyone beyond it is picked up on a later pass as the head
+	// drains.
+	maxQueueScan = 500
 )
 
 // MatchMaker manages the matching queue via Redis, allowing multiple backend
-// instances to share state.
+// instances to share state. Every instance enqueues and dequeues its own
+// clients, but only the instance holding the leader lease runs the pairing
+// loop. The queue is split into shards (see shard.go) so no single Redis key
+// carries every enqueue and pop.
 type MatchMaker struct {
-	rdb *redis.Client
+	rdb    redis.UniversalClient
+	leader *leaderElector
+	// tagMatchWait is how long a user with interest tags waits for a
+	// shared-tag partner before falling back to random pairing.
+	tagMatchWait time.Duration
+	// shards is the number of queue partitions. Must be identical on every
+	// pod; changing it requires draining the queue.
+	shards int
+	// shardRebalanceWait is how long a user may wait unpaired in their home
+	// shard before being moved to the overflow shard.
+	shardRebalanceWait time.Duration
+	// rejections throttles candidate_rejected audit events.
+	rejections rejectionLog
 }
 
-func NewMatchMaker(rdb *redis.Client) *MatchMaker {
-	return &MatchMaker{rdb: rdb}
+func NewMatchMaker(rdb redis.UniversalClient) *MatchMaker {
+	return &MatchMaker{
+		rdb:                rdb,
+		leader:             newLeaderElector(rdb, podID()),
+		tagMatchWait:       defaultTagMatchWait,
+		shards:             1,
+		shardRebalanceWait: defaultShardRebalanceWait,
+	}
 }
 
-// Add enqueues a user ID into the Redis waiting queue.
+// Add enqueues a user ID into their home shard's waiting queue.
 func (m *MatchMaker) Add(ctx context.Context, userID string) {
-	now := time.Now().UnixNano()
-	if err := m.rdb.RPush(ctx, redisQueueKey, userID).Err(); err != nil {
+	m.add(ctx, userID, false, "")
+}
+
+// add enqueues the user into the regular queue or, if priority is set, the
+// priority lane of their home shard and wakes the pairing loop. reason is
+// the requeue reason, if any, for the audit log.
+func (m *MatchMaker) add(ctx context.Context, userID string, priority bool, reason string) {
+	shard := m.homeShard(userID)
+	if err := m.enqueue(ctx, userID, shard, time.Now(), priority); err != nil {
 		slog.Error("MatchMaker: failed to enqueue user", "user_id", userID, "error", err)
 		return
 	}
-	if err := m.rdb.HSet(ctx, redisEnqueueAtHash, userID, now).Err(); err != nil {
-		slog.Error("MatchMaker: failed to record enqueue time", "user_id", userID, "error", err)
-	}
-	slog.Info("Adding client to match queue", "client_id", userID)
+	slog.Info("Adding client to match queue", "client_id", userID, "priority", priority)
+	m.audit(ctx, AuditEvent{Type: auditEnqueued, UserID: userID, Reason: reason, Detail: map[string]any{
+		"shard": shard, "lane": laneLabel(priority),
+	}})
 	// Signal all instances that a new user is waiting.
 	m.rdb.Publish(ctx, redisTriggerKey, "1")
 }
 
-// Remove deletes a user ID from the Redis waiting queue.
+// enqueue appends the user to a shard's queue (or its priority lane),
+// records the enqueue time and the shard in their profile, and indexes their
+// interest tags in that shard.
+func (m *MatchMaker) enqueue(ctx context.Context, userID string, shard int, at time.Time, priority bool) error {
+	list := queueKey(shard)
+	if priority {
+		list = priorityQueueKey(shard)
+	}
+	if err := m.rdb.RPush(ctx, list, userID).Err(); err != nil {
+		return err
+	}
+	if err := m.rdb.HSet(ctx, enqueuedAtKey(shard), userID, at.UnixNano()).Err(); err != nil {
+		slog.Error("MatchMaker: failed to record enqueue time", "user_id", userID, "error", err)
+	}
+	if err := m.rdb.HSet(ctx, profileKey(userID), "shard", shard).Err(); err != nil {
+		slog.Error("MatchMaker: failed to record shard", "user_id", userID, "error", err)
+	}
+	m.indexTags(ctx, userID, shard)
+	return nil
+}
+
+// Remove deletes a user ID from the waiting queue. Every shard is cleared,
+// not just the recorded one, so a user caught mid-rebalance cannot be left
+// behind as a ghost entry.
 func (m *MatchMaker) Remove(ctx context.Context, userID string) {
-	if err := m.rdb.LRem(ctx, redisQueueKey, 0, userID).Err(); err != nil {
+	m.remove(ctx, userID, "disconnected")
+}
+
+// remove dequeues the user, recording reason in the audit log, and reports
+// whether they were queued.
+func (m *MatchMaker) remove(ctx context.Context, userID, reason string) bool {
+	shard := m.shardOf(ctx, userID)
+	pipe := m.rdb.Pipeline()
+	var removed []*redis.IntCmd
+	for s := 0; s < m.shards; s++ {
+		removed = append(removed,
+			pipe.LRem(ctx, queueKey(s), 0, userID),
+			pipe.LRem(ctx, priorityQueueKey(s), 0, userID))
+		pipe.HDel(ctx, enqueuedAtKey(s), userID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
 		slog.Error("MatchMaker: failed to dequeue user", "user_id", userID, "error", err)
-		return
+		return false
+	}
+	m.unindexTags(ctx, userID, shard)
+	slog.Info("Removed client from match queue", "client_id", userID, "reason", reason)
+	for _, cmd := range removed {
+		if cmd.Val() > 0 {
+			m.audit(ctx, AuditEvent{Type: auditDequeued, UserID: userID, Reason: reason})
+			return true
+		}
 	}
-	m.rdb.HDel(ctx, redisEnqueueAtHash, userID)
-	slog.Info("Removed client from match queue", "client_id", userID)
+	return false
+}
+
+// isQueued reports whether the user is currently waiting in either lane of
+// their shard.
+func (m *MatchMaker) isQueued(ctx context.Context, userID string) bool {
+	shard := m.shardOf(ctx, userID)
+	pipe := m.rdb.Pipeline()
+	regular := pipe.LPos(ctx, queueKey(shard), userID, redis.LPosArgs{})
+	priority := pipe.LPos(ctx, priorityQueueKey(shard), userID, redis.LPosArgs{})
+	_, _ = pipe.Exec(ctx)
+	return regular.Err() == nil || priority.Err() == nil
 }
 
-// observeMatchLatency reads the enqueue timestamps for a matched pair and
-// records the elapsed seconds for each into the match-latency histogram. The
-// hash entries are deleted after observation so the hash does not grow.
-func (m *MatchMaker) observeMatchLatency(ctx context.Context, ids ...string) {
+// observeMatchLatency reads the enqueue timestamps for a matched pair from
+// their shard and records the elapsed seconds for each into the
+// match-latency histogram. The hash entries are deleted after observation so
+// the hash does not grow.
+func (m *MatchMaker) observeMatchLatency(ctx context.Context, shard int, ids ...string) {
 	if len(ids) == 0 {
 		return
 	}
-	vals, err := m.rdb.HMGet(ctx, redisEnqueueAtHash, ids...).Result()
+	vals, err := m.rdb.HMGet(ctx, enqueuedAtKey(shard), ids...).Result()
 	if err != nil {
 		slog.Error("MatchMaker: failed to read enqueue times", "error", err)
 		return
 	}
 	now := time.Now().UnixNano()
-	for i, raw := range vals {
+	samples := make([]any, 0, len(vals))
+	for _, raw := range vals {
 		s, ok := raw.(string)
 		if !ok {
 			continue
@@ -90,40 +183,51 @@ func (m *MatchMaker) observeMatchLatency(ctx context.Context, ids ...string) {
 			continue
 		}
 		matchLatencySeconds.Observe(dt.Seconds())
-		_ = i
+		samples = append(samples, dt.Milliseconds())
+	}
+	pipe := m.rdb.Pipeline()
+	pipe.HDel(ctx, enqueuedAtKey(shard), ids...)
+	if len(samples) > 0 {
+		pipe.LPush(ctx, redisRecentLatency, samples...)
+		pipe.LTrim(ctx, redisRecentLatency, 0, recentLatencySamples-1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("MatchMaker: failed to record match latency", "error", err)
 	}
-	m.rdb.HDel(ctx, redisEnqueueAtHash, ids...)
 }
 
-// popPairScript atomically pops two user IDs from the front of the queue.
-// Returns an empty table if fewer than 2 users are waiting, preventing
-// races between concurrent backend instances.
-var popPairScript = redis.NewScript(`
-local queue = KEYS[1]
-if redis.call('LLEN', queue) < 2 then
-    return {}
+// claimPairScript atomically removes two specific user IDs from a shard's
+// queue and priority lane, but only if both are still in one of them. The
+// pairing pass picks partners from a snapshot; a user who disconnected
+// (Remove on another pod) after the snapshot must not be matched, and the
+// survivor must stay queued.
+var claimPairScript = redis.NewScript(`
+local function queued(id)
+    return redis.call('LPOS', KEYS[1], id) or redis.call('LPOS', KEYS[2], id)
+end
+if not queued(ARGV[1]) or not queued(ARGV[2]) then
+    return 0
 end
-local c1 = redis.call('LPOP', queue)
-local c2 = redis.call('LPOP', queue)
-return {c1, c2}
+for _, key in ipairs(KEYS) do
+    redis.call('LREM', key, 1, ARGV[1])
+    redis.call('LREM', key, 1, ARGV[2])
+end
+return 1
 `)
 
-func (m *MatchMaker) tryMatch(ctx context.Context) (string, string, error) {
-	result, err := popPairScript.Run(ctx, m.rdb, []string{redisQueueKey}).StringSlice()
+func (m *MatchMaker) claimPair(ctx context.Context, shard int, a, b string) (bool, error) {
+	n, err := claimPairScript.Run(ctx, m.rdb, []string{queueKey(shard), priorityQueueKey(shard)}, a, b).Int()
 	if err != nil {
-		return "", "", err
-	}
-	if len(result) < 2 {
-		return "", "", nil
+		return false, err
 	}
-	return result[0], result[1], nil
+	return n == 1, nil
 }
 
 // HydrateBlocks replaces the user's block SET in Redis with `subs`. Called on
 // connect after loading the user's blocks from Postgres. Empty subs leaves no
 // key behind so SISMEMBER short-circuits.
 func (m *MatchMaker) HydrateBlocks(ctx context.Context, userID string, subs []string) {
-	key := redisBlocksPfx + userID
+	key := blocksKey(userID)
 	pipe := m.rdb.TxPipeline()
 	pipe.Del(ctx, key)
 	if len(subs) > 0 {
@@ -144,7 +248,7 @@ func (m *MatchMaker) HydrateBlocks(ctx context.Context, userID string, subs []st
 // rehydrate from Postgres. Used by /report and /block when the blocker's
 // session is currently active on some backend instance.
 func (m *MatchMaker) AddBlock(ctx context.Context, blockerSub, blockedSub string) {
-	key := redisBlocksPfx + blockerSub
+	key := blocksKey(blockerSub)
 	exists, err := m.rdb.Exists(ctx, key).Result()
 	if err != nil {
 		slog.Error("MatchMaker: blocks EXISTS failed", "user_id", blockerSub, "error", err)
@@ -160,7 +264,7 @@ func (m *MatchMaker) AddBlock(ctx context.Context, blockerSub, blockedSub string
 
 // ClearBlocks removes the user's block SET from Redis on disconnect.
 func (m *MatchMaker) ClearBlocks(ctx context.Context, userID string) {
-	if err := m.rdb.Del(ctx, redisBlocksPfx+userID).Err(); err != nil {
+	if err := m.rdb.Del(ctx, blocksKey(userID)).Err(); err != nil {
 		slog.Error("MatchMaker: failed to clear blocks", "user_id", userID, "error", err)
 	}
 }
@@ -169,12 +273,12 @@ func (m *MatchMaker) ClearBlocks(ctx context.Context, userID string) {
 // other in their block SET. A Redis error is treated as not-blocked so a
 // transient outage doesn't strand users in the queue forever.
 func (m *MatchMaker) pairBlocked(ctx context.Context, a, b string) bool {
-	if blocked, err := m.rdb.SIsMember(ctx, redisBlocksPfx+a, b).Result(); err == nil && blocked {
+	if blocked, err := m.rdb.SIsMember(ctx, blocksKey(a), b).Result(); err == nil && blocked {
 		return true
 	} else if err != nil {
 		slog.Error("MatchMaker: SISMEMBER failed", "blocker", a, "blocked", b, "error", err)
 	}
-	if blocked, err := m.rdb.SIsMember(ctx, redisBlocksPfx+b, a).Result(); err == nil && blocked {
+	if blocked, err := m.rdb.SIsMember(ctx, blocksKey(b), a).Result(); err == nil && blocked {
 		return true
 	} else if err != nil {
 		slog.Error("MatchMaker: SISMEMBER failed", "blocker", b, "blocked", a, "error", err)
@@ -182,84 +286,87 @@ func (m *MatchMaker) pairBlocked(ctx context.Context, a, b string) bool {
 	return false
 }
 
-// SetSession records a user -> peer mapping in Redis with a 24-hour TTL.
-func (m *MatchMaker) SetSession(ctx context.Context, userID, peerID string) {
-	if err := m.rdb.Set(ctx, redisSessionPfx+userID, peerID, 24*time.Hour).Err(); err != nil {
+// SetSession records a user -> peer mapping, and the ID and start time of
+// the match that paired them and the handle the user knows the peer by, in
+// Redis with a 24-hour TTL. Any state left over from the user's previous
+// match is replaced.
+func (m *MatchMaker) SetSession(ctx context.Context, userID, peerID, matchID, peerHandle string) {
+	key := matchKey(userID)
+	pipe := m.rdb.TxPipeline()
+	pipe.Set(ctx, sessionKey(userID), peerID, 24*time.Hour)
+	pipe.Del(ctx, key)
+	pipe.HSet(ctx, key, "id", matchID, "started_at", time.Now().UnixMilli(), "peer_handle", peerHandle)
+	pipe.Expire(ctx, key, 24*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
 		slog.Error("MatchMaker: failed to set session", "user_id", userID, "error", err)
 	}
 }
 
-// DeleteSession removes a user's peer mapping from Redis.
+// Session returns the user's current peer, or "" if they have none.
+func (m *MatchMaker) Session(ctx context.Context, userID string) string {
+	peer, err := m.rdb.Get(ctx, sessionKey(userID)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		slog.Error("MatchMaker: failed to read session", "user_id", userID, "error", err)
+	}
+	return peer
+}
+
+// CurrentMatch returns the user's current peer and the ID of the match that
+// paired them, or empty strings if they have none.
+func (m *MatchMaker) CurrentMatch(ctx context.Context, userID string) (peerID, matchID string) {
+	st, err := m.loadMatchState(ctx, userID)
+	if err != nil {
+		slog.Error("MatchMaker: failed to read session", "user_id", userID, "error", err)
+		return "", ""
+	}
+	return st.Peer, st.ID
+}
+
+// DeleteSession removes a user's peer mapping and match state from Redis.
 func (m *MatchMaker) DeleteSession(ctx context.Context, userID string) {
-	if err := m.rdb.Del(ctx, redisSessionPfx+userID).Err(); err != nil {
+	if err := m.rdb.Del(ctx, sessionKey(userID), matchKey(userID)).Err(); err != nil {
 		slog.Error("MatchMaker: failed to delete session", "user_id", userID, "error", err)
 	}
 }
 
-// Run starts the matching loop. It responds to trigger pub/sub messages from
-// any instance and falls back to a periodic ticker so no matches are missed.
+// Run starts the matching loop. It keeps the leader lease renewed (or keeps
+// trying to acquire it) and, while leading, responds to trigger pub/sub
+// messages from any instance and falls back to a periodic ticker so no
+// matches are missed. Followers ignore triggers. On ctx cancellation the lease
+// is released so a follower takes over without waiting out the TTL.
 func (m *MatchMaker) Run(ctx context.Context) {
 	sub := m.rdb.Subscribe(ctx, redisTriggerKey)
 	defer func() { _ = sub.Close() }()
 
+	defer func() {
+		rctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		m.leader.resign(rctx)
+	}()
+
 	ticker := time.NewTicker(500 * time.Millisecond)
 	defer ticker.Stop()
 
+	leaseTicker := time.NewTicker(leaderRenewInterval)
+	defer leaseTicker.Stop()
+
+	m.leader.step(ctx)
+
 	triggerCh := sub.Channel()
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-leaseTicker.C:
+			m.leader.step(ctx)
 		case <-triggerCh:
-			m.processMatches(ctx)
-		case <-ticker.C:
-			m.processMatches(ctx)
-		}
-	}
-}
-
-// processMatches drains all matchable pairs from the shared queue.
-func (m *MatchMaker) processMatches(ctx context.Context) {
-	rejections := 0
-	for {
-		id1, id2, err := m.tryMatch(ctx)
-		if err != nil {
-			slog.Error("MatchMaker: tryMatch error", "error", err)
-			return
-		}
-		if id1 == "" {
-			return
-		}
-
-		if m.pairBlocked(ctx, id1, id2) {
-			blockedPairingsTotal.Inc()
-			slog.Info("MatchMaker: rejected blocked pair", "client1", id1, "client2", id2)
-			// Re-queue both at the tail so a different candidate has a
-			// chance to land between them on the next pop.
-			if err := m.rdb.RPush(ctx, redisQueueKey, id1, id2).Err(); err != nil {
-				slog.Error("MatchMaker: requeue after block failed", "error", err)
-				return
+			if m.leader.IsLeader() {
+				m.processMatches(ctx)
 			}
-			rejections++
-			if rejections >= maxBlockedRejectionsPerCycle {
-				return
+		case <-ticker.C:
+			if m.leader.IsLeader() {
+				m.processMatches(ctx)
 			}
-			continue
-		}
-
-		slog.Info("Matching clients", "client1", id1, "client2", id2)
-		matchesTotal.Inc()
-		m.observeMatchLatency(ctx, id1, id2)
-		m.SetSession(ctx, id1, id2)
-		m.SetSession(ctx, id2, id1)
-
-		// Publish match notifications on per-user channels so any backend
-		// instance holding the matched client's WebSocket can deliver it.
-		if err := m.rdb.Publish(ctx, redisNotifyPfx+id1, id2).Err(); err != nil {
-			slog.Error("MatchMaker: failed to notify client", "client_id", id1, "error", err)
-		}
-		if err := m.rdb.Publish(ctx, redisNotifyPfx+id2, id1).Err(); err != nil {
-			slog.Error("MatchMaker: failed to notify client", "client_id", id2, "error", err)
 		}
 	}
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"reflect"
 	"testing"
 	"time"
 
@@ -33,32 +35,33 @@ func TestMatchMaker_AddEnqueuesAndRecordsTimestamp(t *testing.T) {
 
 	mm.Add(ctx, "alice")
 
-	if got, _ := client.LLen(ctx, redisQueueKey).Result(); got != 1 {
+	if got, _ := client.LLen(ctx, queueKey(0)).Result(); got != 1 {
 		t.Fatalf("queue length: want 1, got %d", got)
 	}
-	if !mr.Exists(redisEnqueueAtHash) {
-		t.Fatalf("expected %q hash to exist after Add", redisEnqueueAtHash)
+	if !mr.Exists(enqueuedAtKey(0)) {
+		t.Fatalf("expected %q hash to exist after Add", enqueuedAtKey(0))
 	}
-	if !hashHas(t, client, redisEnqueueAtHash, "alice") {
+	if !hashHas(t, client, enqueuedAtKey(0), "alice") {
 		t.Fatalf("expected enqueue timestamp for alice")
 	}
 }
 
-func TestMatchMaker_TryMatchPopsTwoUsers(t *testing.T) {
+func TestMatchMaker_ProcessMatchesPairsTwoUsers(t *testing.T) {
 	mm, _, client := newTestMatchMaker(t)
 	ctx := context.Background()
 
 	mm.Add(ctx, "alice")
 	mm.Add(ctx, "bob")
 
-	a, b, err := mm.tryMatch(ctx)
-	if err != nil {
-		t.Fatalf("tryMatch: %v", err)
+	mm.processMatches(ctx)
+
+	if peer, _ := client.Get(ctx, sessionKey("alice")).Result(); peer != "bob" {
+		t.Fatalf("alice's session: want bob, got %q", peer)
 	}
-	if a != "alice" || b != "bob" {
-		t.Fatalf("want (alice, bob), got (%q, %q)", a, b)
+	if peer, _ := client.Get(ctx, sessionKey("bob")).Result(); peer != "alice" {
+		t.Fatalf("bob's session: want alice, got %q", peer)
 	}
-	if got, _ := client.LLen(ctx, redisQueueKey).Result(); got != 0 {
+	if got, _ := client.LLen(ctx, queueKey(0)).Result(); got != 0 {
 		t.Fatalf("queue length after match: want 0, got %d", got)
 	}
 }
@@ -69,16 +72,35 @@ func TestMatchMaker_SingleUserWaits(t *testing.T) {
 
 	mm.Add(ctx, "alice")
 
-	a, b, err := mm.tryMatch(ctx)
+	mm.processMatches(ctx)
+
+	// User must remain enqueued for the next pairing attempt.
+	if got, _ := client.LLen(ctx, queueKey(0)).Result(); got != 1 {
+		t.Fatalf("queue length after no-match: want 1, got %d", got)
+	}
+	if n, _ := client.Exists(ctx, sessionKey("alice")).Result(); n != 0 {
+		t.Fatalf("alice should have no session while waiting alone")
+	}
+}
+
+func TestMatchMaker_ClaimPairSkipsDepartedUser(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	mm.Add(ctx, "alice")
+	mm.Add(ctx, "bob")
+	// bob disconnects on another pod after the leader took its snapshot.
+	mm.Remove(ctx, "bob")
+
+	ok, err := mm.claimPair(ctx, 0, "alice", "bob")
 	if err != nil {
-		t.Fatalf("tryMatch: %v", err)
+		t.Fatalf("claimPair: %v", err)
 	}
-	if a != "" || b != "" {
-		t.Fatalf("expected no match with one user, got (%q, %q)", a, b)
+	if ok {
+		t.Fatalf("claimPair must fail when one side already left the queue")
 	}
-	// User must remain enqueued for the next pairing attempt.
-	if got, _ := client.LLen(ctx, redisQueueKey).Result(); got != 1 {
-		t.Fatalf("queue length after no-match: want 1, got %d", got)
+	if got, _ := client.LLen(ctx, queueKey(0)).Result(); got != 1 {
+		t.Fatalf("alice must stay queued after a failed claim; queue length %d", got)
 	}
 }
 
@@ -89,10 +111,10 @@ func TestMatchMaker_RemoveOnDisconnect(t *testing.T) {
 	mm.Add(ctx, "alice")
 	mm.Remove(ctx, "alice")
 
-	if got, _ := client.LLen(ctx, redisQueueKey).Result(); got != 0 {
+	if got, _ := client.LLen(ctx, queueKey(0)).Result(); got != 0 {
 		t.Fatalf("queue length after Remove: want 0, got %d", got)
 	}
-	if hashHas(t, client, redisEnqueueAtHash, "alice") {
+	if hashHas(t, client, enqueuedAtKey(0), "alice") {
 		t.Fatalf("expected enqueue timestamp for alice to be cleared")
 	}
 }
@@ -108,12 +130,12 @@ func TestMatchMaker_ObserveMatchLatencyClearsHash(t *testing.T) {
 	// (also exercises the path where dt > 0).
 	mr.FastForward(50 * time.Millisecond)
 
-	mm.observeMatchLatency(ctx, "alice", "bob")
+	mm.observeMatchLatency(ctx, 0, "alice", "bob")
 
-	if hashHas(t, client, redisEnqueueAtHash, "alice") {
+	if hashHas(t, client, enqueuedAtKey(0), "alice") {
 		t.Fatalf("alice timestamp not cleared after observeMatchLatency")
 	}
-	if hashHas(t, client, redisEnqueueAtHash, "bob") {
+	if hashHas(t, client, enqueuedAtKey(0), "bob") {
 		t.Fatalf("bob timestamp not cleared after observeMatchLatency")
 	}
 }
@@ -121,7 +143,7 @@ func TestMatchMaker_ObserveMatchLatencyClearsHash(t *testing.T) {
 func TestMatchMaker_ObserveMatchLatencyEmptyIDsNoop(t *testing.T) {
 	mm, _, _ := newTestMatchMaker(t)
 	// Should not panic, should not touch Redis.
-	mm.observeMatchLatency(context.Background())
+	mm.observeMatchLatency(context.Background(), 0)
 }
 
 func TestMatchMaker_PairBlockedDetectsEitherDirection(t *testing.T) {
@@ -203,7 +225,7 @@ func TestMatchMaker_AddBlockNoopWhenOffline(t *testing.T) {
 	// would leak across reconnects and shadow the DB-backed source of truth.
 	mm.AddBlock(ctx, "alice", "bob")
 
-	exists, err := client.Exists(ctx, redisBlocksPfx+"alice").Result()
+	exists, err := client.Exists(ctx, blocksKey("alice")).Result()
 	if err != nil {
 		t.Fatalf("EXISTS: %v", err)
 	}
@@ -232,7 +254,7 @@ func TestMatchMaker_ClearBlocksRemovesSet(t *testing.T) {
 	mm.HydrateBlocks(ctx, "alice", []string{"bob"})
 	mm.ClearBlocks(ctx, "alice")
 
-	exists, _ := client.Exists(ctx, redisBlocksPfx+"alice").Result()
+	exists, _ := client.Exists(ctx, blocksKey("alice")).Result()
 	if exists != 0 {
 		t.Fatalf("expected blocks key to be cleared, got exists=%d", exists)
 	}
@@ -256,12 +278,12 @@ func TestMatchMaker_ProcessMatchesRejectsBlockedPair(t *testing.T) {
 	// One of {alice, bob} must remain in the queue (whichever is paired with
 	// carol leaves; the other goes back to the tail). Exactly one should be
 	// matched with carol via session mappings.
-	qlen, _ := client.LLen(ctx, redisQueueKey).Result()
+	qlen, _ := client.LLen(ctx, queueKey(0)).Result()
 	if qlen != 1 {
 		t.Fatalf("queue length after process: want 1, got %d", qlen)
 	}
 
-	carolPeer, _ := client.Get(ctx, redisSessionPfx+"carol").Result()
+	carolPeer, _ := client.Get(ctx, sessionKey("carol")).Result()
 	if carolPeer != "alice" && carolPeer != "bob" {
 		t.Fatalf("carol should be matched with alice or bob, got %q", carolPeer)
 	}
@@ -284,3 +306,147 @@ func readCounter(t *testing.T, c interface {
 	}
 	return m.Counter.GetValue()
 }
+
+func TestMatchMaker_ObserveMatchLatencyRecordsRecentSamples(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	mm.Add(ctx, "alice")
+	mm.Add(ctx, "bob")
+	mm.observeMatchLatency(ctx, 0, "alice", "bob")
+
+	if got, _ := client.LLen(ctx, redisRecentLatency).Result(); got != 2 {
+		t.Fatalf("recent latency samples: want 2, got %d", got)
+	}
+}
+
+func TestMatchMaker_RecentLatencyIsCapped(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	for i := 0; i < recentLatencySamples; i++ {
+		mm.Add(ctx, "alice")
+		mm.Add(ctx, "bob")
+		mm.observeMatchLatency(ctx, 0, "alice", "bob")
+	}
+	if got, _ := client.LLen(ctx, redisRecentLatency).Result(); got != recentLatencySamples {
+		t.Fatalf("recent latency samples: want cap %d, got %d", recentLatencySamples, got)
+	}
+}
+
+func addWithInterests(ctx context.Context, mm *MatchMaker, id string, tags ...string) {
+	mm.SetProfile(ctx, id, Profile{Interests: tags})
+	mm.Add(ctx, id)
+}
+
+// backdate rewrites a user's enqueue timestamp so the tag fallback wait can be
+// exercised without sleeping.
+func backdate(t *testing.T, client *redis.Client, id string, d time.Duration) {
+	t.Helper()
+	ts := time.Now().Add(-d).UnixNano()
+	if err := client.HSet(context.Background(), enqueuedAtKey(0), id, ts).Err(); err != nil {
+		t.Fatalf("HSet: %v", err)
+	}
+}
+
+func TestMatchMaker_PrefersSharedTags(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	addWithInterests(ctx, mm, "alice", "music", "chess")
+	addWithInterests(ctx, mm, "bob")
+	addWithInterests(ctx, mm, "carol", "games")
+	addWithInterests(ctx, mm, "dave", "chess", "music")
+
+	mm.processMatches(ctx)
+
+	if peer, _ := client.Get(ctx, sessionKey("alice")).Result(); peer != "dave" {
+		t.Fatalf("alice should be paired with dave (shared tags), got %q", peer)
+	}
+	// bob (no tags) and carol (tags, but nobody shares them and she has not
+	// waited long enough) must both still be waiting.
+	if got, _ := client.LLen(ctx, queueKey(0)).Result(); got != 2 {
+		t.Fatalf("queue length: want 2, got %d", got)
+	}
+
+	msgs := readEvents(t, mm, "alice")
+	if len(msgs) != 1 || msgs[0].Type != "match" {
+		t.Fatalf("want one match event, got %+v", msgs)
+	}
+	var ev MatchEvent
+	raw, _ := json.Marshal(msgs[0].Payload)
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		t.Fatalf("decode match event: %v", err)
+	}
+	// The peer is named by a handle that only alice can resolve, and the
+	// server picks exactly one side to send the offer.
+	if peer, _ := mm.ResolvePeer(ctx, "alice", ev.PeerID); peer != "dave" || !reflect.DeepEqual(ev.SharedTags, []string{"music", "chess"}) || !ev.Offerer {
+		t.Fatalf("match event: want dave's handle with [music chess] as offerer, got %+v", ev)
+	}
+
+	// The matched users must no longer be in the tag indexes.
+	if n, _ := client.SCard(ctx, tagKey(0, "music")).Result(); n != 0 {
+		t.Fatalf("music tag index should be empty after match, has %d", n)
+	}
+}
+
+func TestMatchMaker_TagFallbackAfterWait(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	addWithInterests(ctx, mm, "alice", "music")
+	addWithInterests(ctx, mm, "bob")
+
+	mm.processMatches(ctx)
+	if got, _ := client.LLen(ctx, queueKey(0)).Result(); got != 2 {
+		t.Fatalf("alice should hold out for a shared tag; queue length %d", got)
+	}
+
+	backdate(t, client, "alice", mm.tagMatchWait+time.Second)
+	mm.processMatches(ctx)
+
+	if peer, _ := client.Get(ctx, sessionKey("alice")).Result(); peer != "bob" {
+		t.Fatalf("alice should fall back to bob after the tag wait, got %q", peer)
+	}
+}
+
+func TestMatchMaker_SetInterestsReindexesQueuedUser(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	addWithInterests(ctx, mm, "alice", "music")
+	mm.SetInterests(ctx, "alice", []string{"games"})
+
+	if ok, _ := client.SIsMember(ctx, tagKey(0, "music"), "alice").Result(); ok {
+		t.Fatalf("alice should have been removed from the music index")
+	}
+	if ok, _ := client.SIsMember(ctx, tagKey(0, "games"), "alice").Result(); !ok {
+		t.Fatalf("alice should be in the games index")
+	}
+
+	mm.Remove(ctx, "alice")
+	if n, _ := client.SCard(ctx, tagKey(0, "games")).Result(); n != 0 {
+		t.Fatalf("Remove should clear the tag index, games has %d", n)
+	}
+}
+
+func TestMatchMaker_OnlyPairsSharedLanguage(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	mm.SetProfile(ctx, "alice", Profile{Languages: []string{"en"}})
+	mm.SetProfile(ctx, "bob", Profile{Languages: []string{"de"}, AnyLanguage: true})
+	mm.SetProfile(ctx, "carol", Profile{Languages: []string{"es", "en"}})
+	mm.Add(ctx, "alice")
+	mm.Add(ctx, "bob")
+	mm.Add(ctx, "carol")
+
+	mm.processMatches(ctx)
+
+	if peer, _ := client.Get(ctx, sessionKey("alice")).Result(); peer != "carol" {
+		t.Fatalf("alice should skip bob (no common language) and pair with carol, got %q", peer)
+	}
+	if got, _ := client.LRange(ctx, queueKey(0), 0, -1).Result(); !reflect.DeepEqual(got, []string{"bob"}) {
+		t.Fatalf("bob should remain queued, queue is %v", got)
+	}
+}
@@ -0,0 +1,424 @@
+//go:build matchsim
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/redis/go-redis/v9"
+)
+
+// The matchmaker simulation harness. MatchMaker is part of package main and
+// cannot be imported by a separate command, so the harness is built from
+// this package with the matchsim build tag (`go build -tags matchsim`), which
+// swaps the server's main for the simulator's. The server build leaves it
+// and miniredis out. It drives real MatchMaker instances (leader election,
+// shards, pairing, requeue) against an in-process miniredis or a real Redis,
+// with a synthetic population, and reports the numbers needed to compare
+// pairing strategies offline.
+
+func main() {
+	os.Exit(runMatchSim(os.Args[1:]))
+}
+
+// simConfig describes one simulation run.
+type simConfig struct {
+	RedisAddr     string        `json:"redis_addr,omitempty"`
+	Duration      time.Duration `json:"duration_ns"`
+	Drain         time.Duration `json:"drain_ns"`
+	Tick          time.Duration `json:"tick_ns"`
+	Pods          int           `json:"pods"`
+	Shards        int           `json:"shards"`
+	ArrivalRate   float64       `json:"arrival_rate"`
+	BlockDensity  float64       `json:"block_density"`
+	AbandonRate   float64       `json:"abandon_rate"`
+	CallDuration  time.Duration `json:"call_duration_ns"`
+	RequeueProb   float64       `json:"requeue_prob"`
+	Tags          int           `json:"tags"`
+	TagShare      float64       `json:"tag_share"`
+	TagMatchWait  time.Duration `json:"tag_match_wait_ns"`
+	RebalanceWait time.Duration `json:"rebalance_wait_ns"`
+	Seed          int64         `json:"seed"`
+}
+
+func defaultSimConfig() simConfig {
+	return simConfig{
+		Duration:      30 * time.Second,
+		Drain:         5 * time.Second,
+		Tick:          50 * time.Millisecond,
+		Pods:          3,
+		Shards:        1,
+		ArrivalRate:   20,
+		BlockDensity:  0.01,
+		AbandonRate:   0.02,
+		CallDuration:  10 * time.Second,
+		RequeueProb:   0.7,
+		Tags:          20,
+		TagShare:      0.3,
+		TagMatchWait:  defaultTagMatchWait,
+		RebalanceWait: defaultShardRebalanceWait,
+		Seed:          1,
+	}
+}
+
+// simReport is the outcome of a run. Wait times are from entering the queue
+// (arrival or requeue) to being matched.
+type simReport struct {
+	Config          simConfig `json:"config"`
+	Elapsed         float64   `json:"elapsed_seconds"`
+	Arrivals        int       `json:"arrivals"`
+	Requeues        int       `json:"requeues"`
+	Matches         int       `json:"matches"`
+	MatchesPerSec   float64   `json:"matches_per_second"`
+	Abandoned       int       `json:"abandoned"`
+	StillWaiting    int       `json:"still_waiting"`
+	WaitP50         float64   `json:"wait_p50_seconds"`
+	WaitP90         float64   `json:"wait_p90_seconds"`
+	WaitP99         float64   `json:"wait_p99_seconds"`
+	WaitMax         float64   `json:"wait_max_seconds"`
+	LongestWaiting  float64   `json:"longest_still_waiting_seconds"`
+	BlockedPairs    float64   `json:"blocked_pairs"`
+	BlockedPerMatch float64   `json:"blocked_pairs_per_match"`
+	PriorityShare   float64   `json:"priority_lane_share"`
+}
+
+// simUser is one synthetic client. A user is either waiting (in the queue)
+// or in a call until callEnds.
+type simUser struct {
+	id         string
+	pod        int
+	waiting    bool
+	enqueuedAt time.Time
+	callEnds   time.Time
+	lastMatch  string
+}
+
+// simulation holds the state of one run. It is driven from a single goroutine;
+// only the MatchMaker pairing loops run concurrently, inside Redis.
+type simulation struct {
+	cfg    simConfig
+	rng    *rand.Rand
+	pods   []*MatchMaker
+	online []*simUser
+	index  map[string]int
+	nextID int
+
+	waits    []float64
+	report   simReport
+	priority float64
+	regular  float64
+}
+
+func runMatchSim(args []string) int {
+	cfg := defaultSimConfig()
+	fs := flag.NewFlagSet("matchsim", flag.ContinueOnError)
+	fs.StringVar(&cfg.RedisAddr, "redis", "", "Redis address to run against; the database must be empty (default: in-process miniredis)")
+	fs.DurationVar(&cfg.Duration, "duration", cfg.Duration, "how long users keep arriving")
+	fs.DurationVar(&cfg.Drain, "drain", cfg.Drain, "extra time after arrivals stop for the queue to settle")
+	fs.DurationVar(&cfg.Tick, "tick", cfg.Tick, "simulation step")
+	fs.IntVar(&cfg.Pods, "pods", cfg.Pods, "number of MatchMaker instances (only the leader pairs)")
+	fs.IntVar(&cfg.Shards, "shards", cfg.Shards, "queue shards")
+	fs.Float64Var(&cfg.ArrivalRate, "arrival-rate", cfg.ArrivalRate, "new users per second (Poisson)")
+	fs.Float64Var(&cfg.BlockDensity, "block-density", cfg.BlockDensity, "probability that a new user has blocked any given online user")
+	fs.Float64Var(&cfg.AbandonRate, "abandon-rate", cfg.AbandonRate, "per-second probability that a waiting user disconnects")
+	fs.DurationVar(&cfg.CallDuration, "call-duration", cfg.CallDuration, "mean call length (exponential)")
+	fs.Float64Var(&cfg.RequeueProb, "requeue-prob", cfg.RequeueProb, "probability a user asks for a next match after a call rather than leaving")
+	fs.IntVar(&cfg.Tags, "tags", cfg.Tags, "size of the interest tag vocabulary")
+	fs.Float64Var(&cfg.TagShare, "tag-share", cfg.TagShare, "fraction of users declaring one to three interests")
+	fs.DurationVar(&cfg.TagMatchWait, "tag-wait", cfg.TagMatchWait, "MATCH_TAG_WAIT")
+	fs.DurationVar(&cfg.RebalanceWait, "rebalance-wait", cfg.RebalanceWait, "SHARD_REBALANCE_WAIT")
+	fs.Int64Var(&cfg.Seed, "seed", cfg.Seed, "random seed")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	verbose := fs.Bool("v", false, "keep matchmaker info logs")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if cfg.Pods < 1 || cfg.Shards < 1 || cfg.Shards > maxQueueShards || cfg.ArrivalRate <= 0 || cfg.Tick <= 0 {
+		fmt.Fprintln(os.Stderr, "matchsim: pods and arrival-rate must be positive, shards between 1 and", maxQueueShards)
+		return 2
+	}
+	if !*verbose {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	}
+
+	report, err := simulate(context.Background(), cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "matchsim:", err)
+		return 1
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		report.print(os.Stdout)
+	}
+	return 0
+}
+
+// simulate runs one simulation to completion.
+func simulate(ctx context.Context, cfg simConfig) (simReport, error) {
+	addr := cfg.RedisAddr
+	if addr == "" {
+		mr, err := miniredis.Run()
+		if err != nil {
+			return simReport{}, err
+		}
+		defer mr.Close()
+		addr = mr.Addr()
+	}
+
+	s := &simulation{
+		cfg:    cfg,
+		rng:    rand.New(rand.NewSource(cfg.Seed)),
+		index:  make(map[string]int),
+		report: simReport{Config: cfg},
+	}
+	// Pairing loops must stop before their clients close.
+	runCtx, stop := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	var clients []*redis.Client
+	defer func() {
+		stop()
+		wg.Wait()
+		for _, c := range clients {
+			_ = c.Close()
+		}
+	}()
+	for i := range cfg.Pods {
+		client := redis.NewClient(&redis.Options{Addr: addr})
+		clients = append(clients, client)
+		if i == 0 {
+			n, err := client.DBSize(ctx).Result()
+			if err != nil {
+				return simReport{}, err
+			}
+			if n > 0 {
+				return simReport{}, fmt.Errorf("refusing to run against a non-empty Redis database (%d keys)", n)
+			}
+		}
+		mm := NewMatchMaker(client)
+		mm.leader = newLeaderElector(client, "matchsim-pod-"+strconv.Itoa(i))
+		mm.shards = cfg.Shards
+		mm.tagMatchWait = cfg.TagMatchWait
+		mm.shardRebalanceWait = cfg.RebalanceWait
+		s.pods = append(s.pods, mm)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mm.Run(runCtx)
+		}()
+	}
+
+	blockedBefore := counterValue(blockedPairingsTotal)
+	lanesBefore := [2]float64{counterValue(laneMatchesTotal.WithLabelValues("priority")), counterValue(laneMatchesTotal.WithLabelValues("regular"))}
+
+	start := time.Now()
+	arrivalsEnd := start.Add(cfg.Duration)
+	end := arrivalsEnd.Add(cfg.Drain)
+	nextArrival := start
+	ticker := time.NewTicker(cfg.Tick)
+	defer ticker.Stop()
+	for now := start; now.Before(end); now = <-ticker.C {
+		for nextArrival.Before(now) && now.Before(arrivalsEnd) {
+			s.arrive(ctx, now)
+			nextArrival = nextArrival.Add(time.Duration(s.rng.ExpFloat64() / cfg.ArrivalRate * float64(time.Second)))
+		}
+		if err := s.collectMatches(ctx, now); err != nil {
+			return simReport{}, err
+		}
+		s.step(ctx, now)
+	}
+
+	s.report.Elapsed = time.Since(start).Seconds()
+	s.report.BlockedPairs = counterValue(blockedPairingsTotal) - blockedBefore
+	s.priority = counterValue(laneMatchesTotal.WithLabelValues("priority")) - lanesBefore[0]
+	s.regular = counterValue(laneMatchesTotal.WithLabelValues("regular")) - lanesBefore[1]
+	s.finish(time.Now())
+	return s.report, nil
+}
+
+// arrive connects a new user to a random pod: blocks, profile, enqueue, in
+// the same order as handleConnections.
+func (s *simulation) arrive(ctx context.Context, now time.Time) {
+	u := &simUser{
+		id:         "sim-" + strconv.Itoa(s.nextID),
+		pod:        s.rng.Intn(len(s.pods)),
+		waiting:    true,
+		enqueuedAt: now,
+	}
+	s.nextID++
+	mm := s.pods[u.pod]
+
+	var blocked []string
+	if s.cfg.BlockDensity > 0 {
+		for _, v := range s.online {
+			if s.rng.Float64() < s.cfg.BlockDensity {
+				blocked = append(blocked, v.id)
+			}
+		}
+	}
+	mm.HydrateBlocks(ctx, u.id, blocked)
+
+	var p Profile
+	if s.cfg.Tags > 0 && s.rng.Float64() < s.cfg.TagShare {
+		for range 1 + s.rng.Intn(3) {
+			p.Interests = append(p.Interests, "tag"+strconv.Itoa(s.rng.Intn(s.cfg.Tags)))
+		}
+		p.Interests = normalizeInterests(p.Interests)
+	}
+	mm.SetProfile(ctx, u.id, p)
+	mm.Add(ctx, u.id)
+
+	s.index[u.id] = len(s.online)
+	s.online = append(s.online, u)
+	s.report.Arrivals++
+}
+
+// collectMatches finds waiting users whose match state changed since they
+// were last seen, i.e. who were paired.
+func (s *simulation) collectMatches(ctx context.Context, now time.Time) error {
+	var waiting []*simUser
+	for _, u := range s.online {
+		if u.waiting {
+			waiting = append(waiting, u)
+		}
+	}
+	if len(waiting) == 0 {
+		return nil
+	}
+	rdb := s.pods[0].rdb
+	pipe := rdb.Pipeline()
+	cmds := make([]*redis.StringCmd, len(waiting))
+	for i, u := range waiting {
+		cmds[i] = pipe.HGet(ctx, matchKey(u.id), "id")
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	for i, u := range waiting {
+		id := cmds[i].Val()
+		if id == "" || id == u.lastMatch {
+			continue
+		}
+		u.lastMatch = id
+		u.waiting = false
+		u.callEnds = now.Add(time.Duration(s.rng.ExpFloat64() * float64(s.cfg.CallDuration)))
+		s.waits = append(s.waits, now.Sub(u.enqueuedAt).Seconds())
+		s.pods[u.pod].MarkConnected(ctx, u.id)
+		s.report.Matches++
+	}
+	return nil
+}
+
+// step applies churn: waiting users giving up, and calls ending in either a
+// next_match or a disconnect.
+func (s *simulation) step(ctx context.Context, now time.Time) {
+	abandon := 1 - math.Exp(-s.cfg.AbandonRate*s.cfg.Tick.Seconds())
+	for _, u := range append([]*simUser(nil), s.online...) {
+		switch {
+		case u.waiting && s.rng.Float64() < abandon:
+			s.report.Abandoned++
+			s.disconnect(ctx, u)
+		case !u.waiting && now.After(u.callEnds):
+			if s.rng.Float64() < s.cfg.RequeueProb {
+				s.pods[u.pod].Requeue(ctx, u.id)
+				u.waiting = true
+				u.enqueuedAt = now
+				s.report.Requeues++
+			} else {
+				s.disconnect(ctx, u)
+			}
+		}
+	}
+}
+
+// disconnect mirrors the cleanup in handleConnections.
+func (s *simulation) disconnect(ctx context.Context, u *simUser) {
+	mm := s.pods[u.pod]
+	mm.Remove(ctx, u.id)
+	mm.leaveMatch(ctx, u.id, leaveDisconnect)
+	mm.ClearProfile(ctx, u.id)
+	mm.DeleteSession(ctx, u.id)
+	mm.ClearBlocks(ctx, u.id)
+
+	i := s.index[u.id]
+	last := s.online[len(s.online)-1]
+	s.online[i] = last
+	s.index[last.id] = i
+	s.online = s.online[:len(s.online)-1]
+	delete(s.index, u.id)
+}
+
+func (s *simulation) finish(now time.Time) {
+	r := &s.report
+	if r.Elapsed > 0 {
+		r.MatchesPerSec = float64(r.Matches) / 2 / r.Elapsed
+	}
+	r.Matches /= 2 // both sides of a pair were counted
+	sort.Float64s(s.waits)
+	r.WaitP50 = percentile(s.waits, 0.50)
+	r.WaitP90 = percentile(s.waits, 0.90)
+	r.WaitP99 = percentile(s.waits, 0.99)
+	if n := len(s.waits); n > 0 {
+		r.WaitMax = s.waits[n-1]
+	}
+	for _, u := range s.online {
+		if u.waiting {
+			r.StillWaiting++
+			r.LongestWaiting = math.Max(r.LongestWaiting, now.Sub(u.enqueuedAt).Seconds())
+		}
+	}
+	if r.Matches > 0 {
+		r.BlockedPerMatch = r.BlockedPairs / float64(r.Matches)
+	}
+	if total := s.priority + s.regular; total > 0 {
+		r.PriorityShare = s.priority / total
+	}
+}
+
+// percentile returns the p-quantile of sorted values by nearest rank.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(0, min(i, len(sorted)-1))]
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
+
+func (r simReport) print(w io.Writer) {
+	c := r.Config
+	fmt.Fprintf(w, "matchsim: %d pods, %d shards, %.1f arrivals/s for %s (+%s drain), seed %d\n",
+		c.Pods, c.Shards, c.ArrivalRate, c.Duration, c.Drain, c.Seed)
+	fmt.Fprintf(w, "  population   %d arrivals, %d requeues, %d abandoned, %d still waiting\n",
+		r.Arrivals, r.Requeues, r.Abandoned, r.StillWaiting)
+	fmt.Fprintf(w, "  throughput   %d matches, %.2f matches/s\n", r.Matches, r.MatchesPerSec)
+	fmt.Fprintf(w, "  wait         p50 %.2fs  p90 %.2fs  p99 %.2fs\n", r.WaitP50, r.WaitP90, r.WaitP99)
+	fmt.Fprintf(w, "  fairness     max wait %.2fs, longest still waiting %.2fs\n", r.WaitMax, r.LongestWaiting)
+	fmt.Fprintf(w, "  blocks       %.0f rejected pairs, %.3f per match\n", r.BlockedPairs, r.BlockedPerMatch)
+	fmt.Fprintf(w, "  lanes        %.1f%% of matched users from the priority lane\n", 100*r.PriorityShare)
+}
@@ -0,0 +1,45 @@
+//go:build matchsim
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	vals := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for p, want := range map[float64]float64{0.5: 5, 0.9: 9, 0.99: 10, 0: 1} {
+		if got := percentile(vals, p); got != want {
+			t.Fatalf("p%v = %v, want %v", p, got, want)
+		}
+	}
+	if got := percentile(nil, 0.5); got != 0 {
+		t.Fatalf("empty = %v", got)
+	}
+}
+
+func TestSimulate_Smoke(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a real-time simulation")
+	}
+	cfg := defaultSimConfig()
+	cfg.Duration = time.Second
+	cfg.Drain = 500 * time.Millisecond
+	cfg.ArrivalRate = 100
+	cfg.Pods = 2
+	cfg.Shards = 2
+	cfg.CallDuration = 200 * time.Millisecond
+
+	r, err := simulate(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("simulate: %v", err)
+	}
+	if r.Arrivals == 0 || r.Matches == 0 || r.Requeues == 0 {
+		t.Fatalf("expected arrivals, matches and requeues, got %+v", r)
+	}
+	if r.WaitP50 > r.WaitP99 || r.WaitP99 > r.WaitMax {
+		t.Fatalf("percentiles out of order: %+v", r)
+	}
+}
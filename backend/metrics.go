@@ -53,6 +53,191 @@ var (
 		Name: "bananatalk_blocked_pairings_total",
 		Help: "Total number of candidate pairs the matchmaker rejected because one side had blocked the other.",
 	})
+
+	tagMatchesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bananatalk_tag_matches_total",
+		Help: "Total number of matches where both users shared at least one interest tag.",
+	})
+
+	// languageMatchesTotal and languageMatchWaitSeconds are labelled by the
+	// order-independent pair of each side's primary language ("en-es"), with
+	// "und" standing in for a user whose language is unknown and "other" for
+	// one outside metricLanguages.
+	languageMatchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_language_matches_total",
+		Help: "Total number of matches, labelled by the pair of primary languages.",
+	}, []string{"pair"})
+
+	languageMatchWaitSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bananatalk_language_match_wait_seconds",
+		Help:    "Server-measured queue wait of each matched user, labelled by the pair of primary languages.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60},
+	}, []string{"pair"})
+
+	// matchmakerLeader is 1 on the pod currently holding the matchmaker
+	// lease and 0 elsewhere; sum() across pods should never exceed 1.
+	matchmakerLeader = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bananatalk_matchmaker_leader",
+		Help: "Whether this pod holds the matchmaker leader lease (1) or not (0), labelled by pod.",
+	}, []string{"pod"})
+
+	leaderTransitionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bananatalk_matchmaker_leader_transitions_total",
+		Help: "Total number of times this pod acquired the matchmaker leader lease.",
+	})
+
+	// queueLength is only updated by the leader, once per pairing pass.
+	queueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bananatalk_queue_length",
+		Help: "Number of users waiting in each queue shard as of the last pairing pass.",
+	}, []string{"shard"})
+
+	shardRebalancedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bananatalk_shard_rebalanced_total",
+		Help: "Total number of lone waiters moved to the overflow shard by the matchmaker.",
+	})
+
+	// eventsDeliveredTotal counts stream events written to a socket. The
+	// redelivered label is true for events a previous socket left
+	// unacknowledged.
+	eventsDeliveredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_events_delivered_total",
+		Help: "Total number of per-user stream events delivered to a WebSocket, by kind and whether they were redelivered.",
+	}, []string{"kind", "redelivered"})
+
+	// poolAssignmentsTotal counts connects by the matching pool they were
+	// routed to and whether the trust score or an admin override decided.
+	poolAssignmentsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_pool_assignments_total",
+		Help: "Total number of WebSocket connects, labelled by assigned matching pool and decision source.",
+	}, []string{"pool", "source"})
+
+	callRatingsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_call_ratings_total",
+		Help: "Total number of accepted post-call ratings, labelled by rating (up/down).",
+	}, []string{"rating"})
+
+	// qualityTierMatchesTotal is labelled by the order-independent pair of
+	// quality tiers ("high-high", "high-standard", "standard-standard").
+	qualityTierMatchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_quality_tier_matches_total",
+		Help: "Total number of matches, labelled by the pair of rating-based quality tiers.",
+	}, []string{"pair"})
+
+	// requeuesTotal is labelled by lane ("priority", "regular") and the
+	// reason the lane was chosen (see requeue.go).
+	requeuesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_requeues_total",
+		Help: "Total number of next_match requeues, labelled by lane and reason.",
+	}, []string{"lane", "reason"})
+
+	// laneMatchesTotal counts matched users (two per match) by the lane they
+	// were paired from, so the priority lane's share of matches is
+	// sum(rate(...{lane="priority"})) / sum(rate(...)).
+	laneMatchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_lane_matched_users_total",
+		Help: "Total number of matched users, labelled by the queue lane they were paired from.",
+	}, []string{"lane"})
+
+	// ageVerificationsTotal is labelled by provider and result ("adult",
+	// "minor", "unknown", "error").
+	ageVerificationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_age_verifications_total",
+		Help: "Total number of age verification attempts on connect, labelled by provider and result.",
+	}, []string{"provider", "result"})
+
+	ageGateRefusalsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bananatalk_age_gate_refusals_total",
+		Help: "Total number of WebSocket connections refused in AGE_STRICT mode because the user's age band is unknown.",
+	})
+
+	termsRefusalsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bananatalk_terms_refusals_total",
+		Help: "Total number of WebSocket connections refused because the user has not accepted the current TERMS_VERSION.",
+	})
+
+	clientRTTSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bananatalk_client_rtt_seconds",
+		Help:    "Smoothed WebSocket ping round-trip time between clients and this pod.",
+		Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.15, 0.2, 0.3, 0.5, 1, 2},
+	})
+
+	// connectOutcomesTotal is labelled by the order-independent pair of the
+	// two users' regions ("eu-west|us-east") and whether the call got media
+	// flowing ("ok") or was given up on ("fail").
+	connectOutcomesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_connect_outcomes_total",
+		Help: "Total number of calls that connected or were abandoned unconnected, labelled by region pair and outcome.",
+	}, []string{"pair", "outcome"})
+
+	matchEstimatedRTTSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bananatalk_match_estimated_rtt_seconds",
+		Help:    "The matchmaker's estimate of the round trip between the two users of each match.",
+		Buckets: []float64{0.05, 0.1, 0.15, 0.2, 0.3, 0.4, 0.5, 0.75, 1, 2},
+	})
+
+	// matchmakerPaused is only updated by the leader, once per pairing pass;
+	// followers keep their last value, so use max() across pods.
+	matchmakerPaused = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bananatalk_matchmaker_paused",
+		Help: "Whether an admin has paused pairing (1) or not (0), as of the leader's last pass.",
+	})
+
+	// adminQueueActionsTotal is labelled by action ("pause", "resume",
+	// "list", "evict").
+	adminQueueActionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_admin_queue_actions_total",
+		Help: "Total number of matchmaker admin actions served by this pod, labelled by action.",
+	}, []string{"action"})
+
+	// tokenRejectionsTotal is labelled by the tokenErr* code returned to
+	// the client ("missing_token", "invalid_token", "token_expired",
+	// "invalid_token_claims", "token_wrong_audience").
+	tokenRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_token_rejections_total",
+		Help: "Total number of rejected bearer tokens, labelled by reason.",
+	}, []string{"reason"})
+
+	// sessionTokensIssuedTotal is labelled by grant ("login", "refresh").
+	sessionTokensIssuedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_session_tokens_issued_total",
+		Help: "Total number of access/refresh token pairs issued, labelled by grant.",
+	}, []string{"grant"})
+
+	// sessionRefreshFailuresTotal is labelled by reason ("invalid",
+	// "expired", "reused", "banned"). "reused" means a refresh token was
+	// presented twice, i.e. it probably leaked.
+	sessionRefreshFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_session_refresh_failures_total",
+		Help: "Total number of refused /auth/refresh calls, labelled by reason.",
+	}, []string{"reason"})
+
+	// socketReauthsTotal is labelled by result ("ok", "failed").
+	socketReauthsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_socket_reauths_total",
+		Help: "Total number of in-band reauth messages, labelled by result.",
+	}, []string{"result"})
+
+	// socketPolicyClosesTotal is labelled by reason ("token_expired",
+	// "account_suspended", "account_deleted").
+	socketPolicyClosesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_socket_policy_closes_total",
+		Help: "Total number of WebSockets closed for policy, labelled by reason.",
+	}, []string{"reason"})
+
+	// accountDeletionsTotal is labelled by whether the user's row was kept
+	// pseudonymized for moderation ("true") or deleted ("false").
+	accountDeletionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_account_deletions_total",
+		Help: "Total number of accounts deleted through DELETE /me, labelled by pseudonymized.",
+	}, []string{"pseudonymized"})
+
+	// dataExportsTotal is labelled by how the export was served: "inline",
+	// "async" once a background export is uploaded, or "failed".
+	dataExportsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bananatalk_data_exports_total",
+		Help: "Total number of personal data exports built for GET /me/export, labelled by mode.",
+	}, []string{"mode"})
 )
 
 func init() {
@@ -64,6 +249,34 @@ func init() {
 		connectTimeSeconds,
 		queueWaitSeconds,
 		blockedPairingsTotal,
+		tagMatchesTotal,
+		languageMatchesTotal,
+		languageMatchWaitSeconds,
+		matchmakerLeader,
+		leaderTransitionsTotal,
+		queueLength,
+		shardRebalancedTotal,
+		eventsDeliveredTotal,
+		poolAssignmentsTotal,
+		callRatingsTotal,
+		qualityTierMatchesTotal,
+		requeuesTotal,
+		laneMatchesTotal,
+		ageVerificationsTotal,
+		ageGateRefusalsTotal,
+		termsRefusalsTotal,
+		clientRTTSeconds,
+		connectOutcomesTotal,
+		matchEstimatedRTTSeconds,
+		matchmakerPaused,
+		adminQueueActionsTotal,
+		tokenRejectionsTotal,
+		sessionTokensIssuedTotal,
+		sessionRefreshFailuresTotal,
+		socketReauthsTotal,
+		socketPolicyClosesTotal,
+		accountDeletionsTotal,
+		dataExportsTotal,
 	)
 }
 
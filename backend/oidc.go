@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deployments can accept ID tokens from their own OpenID Connect providers
+// besides Google and Apple. Each is configured in OIDC_ISSUERS with a name,
+// its issuer URL and the audiences its tokens must be issued to. Signing keys
+// are found through the issuer's discovery document. Users are stored under
+// the issuer's name as provider, so their principal ID is "<name>:<subject>".
+
+// oidcIssuers are the configured issuers by issuer URL. Read from
+// OIDC_ISSUERS in main.
+var oidcIssuers map[string]*oidcIssuer
+
+var (
+	oidcNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+	// oidcReservedNames are providers the backend assigns itself.
+	oidcReservedNames = []string{providerGoogle, providerApple, providerDeleted}
+	// oidcReservedIssuers are verified by their own code paths.
+	oidcReservedIssuers = []string{appleIssuer, sessionIssuer, "https://accounts.google.com", "accounts.google.com"}
+	// oidcFixedClaims are checked before mapping and read afterwards (exp
+	// bounds the socket), so a mapping must not replace them.
+	oidcFixedClaims = []string{"iss", "aud", "exp", "nbf", "iat"}
+)
+
+// oidcIssuerConfig is one entry of OIDC_ISSUERS.
+type oidcIssuerConfig struct {
+	Name      string   `json:"name"`
+	Issuer    string   `json:"issuer"`
+	Audiences []string `json:"audiences"`
+	// Claims maps a claim the backend reads (sub, AGE_CLAIM) to the claim
+	// this issuer puts it in, e.g. {"sub": "oid"}.
+	Claims map[string]string `json:"claims,omitempty"`
+}
+
+// oidcIssuer verifies one issuer's ID tokens. Its discovery document is
+// fetched on first use and kept; a failed fetch is retried at most every
+// jwksMinRefresh.
+type oidcIssuer struct {
+	name      string
+	issuer    string
+	audiences []string
+	claims    map[string]string
+	client    *http.Client
+
+	mu        sync.Mutex
+	keys      *jwksCache
+	attempted time.Time
+}
+
+// parseOIDCIssuers parses OIDC_ISSUERS, a JSON array of oidcIssuerConfig.
+func parseOIDCIssuers(v string) (map[string]*oidcIssuer, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+	var cfgs []oidcIssuerConfig
+	if err := json.Unmarshal([]byte(v), &cfgs); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	out := make(map[string]*oidcIssuer, len(cfgs))
+	names := map[string]bool{}
+	for _, c := range cfgs {
+		switch {
+		case !oidcNamePattern.MatchString(c.Name):
+			return nil, fmt.Errorf("issuer name %q: want lowercase letters, digits, - or _", c.Name)
+		case slices.Contains(oidcReservedNames, c.Name):
+			return nil, fmt.Errorf("issuer name %q is reserved", c.Name)
+		case names[c.Name]:
+			return nil, fmt.Errorf("duplicate issuer name %q", c.Name)
+		case slices.Contains(oidcReservedIssuers, c.Issuer):
+			return nil, fmt.Errorf("issuer %q is built in", c.Issuer)
+		case out[c.Issuer] != nil:
+			return nil, fmt.Errorf("duplicate issuer %q", c.Issuer)
+		case len(c.Audiences) == 0:
+			return nil, fmt.Errorf("issuer %q: audiences are required", c.Name)
+		}
+		for ours := range c.Claims {
+			if slices.Contains(oidcFixedClaims, ours) {
+				return nil, fmt.Errorf("issuer %q: claim %q cannot be mapped", c.Name, ours)
+			}
+		}
+		if u, err := url.Parse(c.Issuer); err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("issuer %q: want an https URL", c.Issuer)
+		}
+		names[c.Name] = true
+		out[c.Issuer] = &oidcIssuer{
+			name:      c.Name,
+			issuer:    c.Issuer,
+			audiences: c.Audiences,
+			claims:    c.Claims,
+			client:    &http.Client{Timeout: 5 * time.Second},
+		}
+	}
+	return out, nil
+}
+
+// jwks returns the issuer's key cache, discovering its key set URL first.
+func (p *oidcIssuer) jwks(ctx context.Context) (*jwksCache, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keys != nil {
+		return p.keys, nil
+	}
+	if time.Since(p.attempted) < jwksMinRefresh {
+		return nil, fmt.Errorf("oidc %s: discovery failed recently", p.name)
+	}
+	p.attempted = time.Now()
+	jwksURI, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = newJWKSCache(jwksURI)
+	p.keys.client = p.client
+	return p.keys, nil
+}
+
+// discover fetches the issuer's discovery document and returns its key set
+// URL. The document must name the configured issuer exactly (OpenID Connect
+// Discovery 1.0, section 4.3).
+func (p *oidcIssuer) discover(ctx context.Context) (string, error) {
+	u := strings.TrimSuffix(p.issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oidc %s: discovery: %w", p.name, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc %s: discovery: status %d", p.name, resp.StatusCode)
+	}
+	var meta struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return "", fmt.Errorf("oidc %s: discovery: %w", p.name, err)
+	}
+	if meta.Issuer != p.issuer {
+		return "", fmt.Errorf("oidc %s: discovery names issuer %q", p.name, meta.Issuer)
+	}
+	if meta.JWKSURI == "" {
+		return "", fmt.Errorf("oidc %s: discovery has no jwks_uri", p.name)
+	}
+	return meta.JWKSURI, nil
+}
+
+// verify validates one of the issuer's ID tokens and returns the mapped
+// subject and claims, with the same tokenErr* codes as verifyTokenClaims.
+func (p *oidcIssuer) verify(ctx context.Context, token string) (sub string, claims map[string]any, code string, err error) {
+	keys, err := p.jwks(ctx)
+	if err != nil {
+		return "", nil, tokenErrInvalid, err
+	}
+	c, err := verifyJWT(ctx, token, keys)
+	if err != nil {
+		return "", nil, tokenErrInvalid, err
+	}
+	if iss := c.str("iss"); iss != p.issuer {
+		return "", nil, tokenErrInvalid, fmt.Errorf("oidc %s: unexpected issuer %q", p.name, iss)
+	}
+	if !c.hasAudience(p.audiences) {
+		return "", nil, tokenErrWrongAudience, fmt.Errorf("oidc %s: unexpected audience %v", p.name, c["aud"])
+	}
+	if c.unix("exp") <= time.Now().Unix() {
+		return "", nil, tokenErrExpired, nil
+	}
+	c = p.mapClaims(c)
+	if c.str("sub") == "" {
+		return "", nil, tokenErrNoSub, nil
+	}
+	return c.str("sub"), c, "", nil
+}
+
+// mapClaims copies the claims with the issuer's claim mapping applied. A
+// mapped claim the token lacks is removed rather than left as the issuer's
+// own claim of that name, which may mean something else.
+func (p *oidcIssuer) mapClaims(c jwtClaims) jwtClaims {
+	if len(p.claims) == 0 {
+		return c
+	}
+	out := make(jwtClaims, len(c))
+	for k, v := range c {
+		out[k] = v
+	}
+	for ours, theirs := range p.claims {
+		if v, ok := c[theirs]; ok {
+			out[ours] = v
+		} else {
+			delete(out, ours)
+		}
+	}
+	return out
+}
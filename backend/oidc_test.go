@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+const testOIDCAudience = "bananatalk-partner"
+
+// oidcFixture is a local OpenID provider: it serves a discovery document and
+// the test JWK Set over TLS, and is installed as the only OIDC_ISSUERS entry.
+type oidcFixture struct {
+	key         *rsa.PrivateKey
+	issuer      string
+	discoveries atomic.Int32
+}
+
+func newOIDCFixture(t *testing.T, claims map[string]string) *oidcFixture {
+	t.Helper()
+	key, jwks := readTestKeys(t)
+	f := &oidcFixture{key: key}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			f.discoveries.Add(1)
+			_ = json.NewEncoder(w).Encode(map[string]string{"issuer": f.issuer, "jwks_uri": f.issuer + "/keys"})
+		case "/keys":
+			_, _ = w.Write(jwks)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	f.issuer = srv.URL
+
+	cfg, _ := json.Marshal([]oidcIssuerConfig{{Name: "acme", Issuer: f.issuer, Audiences: []string{testOIDCAudience}, Claims: claims}})
+	issuers, err := parseOIDCIssuers(string(cfg))
+	if err != nil {
+		t.Fatalf("parseOIDCIssuers: %v", err)
+	}
+	issuers[f.issuer].client = srv.Client()
+	prev := oidcIssuers
+	oidcIssuers = issuers
+	t.Cleanup(func() { oidcIssuers = prev })
+	return f
+}
+
+func (f *oidcFixture) claims() map[string]any {
+	return map[string]any{
+		"iss": f.issuer,
+		"aud": testOIDCAudience,
+		"sub": "employee-42",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestVerifyToken_OIDCIssuer(t *testing.T) {
+	f := newOIDCFixture(t, nil)
+	stubValidator(t, func(context.Context, string, string) (*idtoken.Payload, error) {
+		t.Fatalf("Google's verifier should not see a partner token")
+		return nil, nil
+	})
+
+	for range 2 {
+		sub, code, err := verifyToken(context.Background(), signTestToken(t, f.key, "TEST_KID_1", f.claims()))
+		if code != "" || err != nil {
+			t.Fatalf("code=%q err=%v", code, err)
+		}
+		if p, s := splitPrincipal(sub); sub != "acme:employee-42" || p != "acme" || s != "employee-42" {
+			t.Fatalf("sub = %q", sub)
+		}
+	}
+	if n := f.discoveries.Load(); n != 1 {
+		t.Fatalf("discovery fetched %d times, want once", n)
+	}
+}
+
+func TestVerifyToken_OIDCIssuerRejects(t *testing.T) {
+	f := newOIDCFixture(t, nil)
+	ctx := context.Background()
+
+	with := func(k string, v any) map[string]any {
+		c := f.claims()
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+	cases := []struct {
+		name   string
+		kid    string
+		claims map[string]any
+		want   string
+	}{
+		{"wrong audience", "TEST_KID_1", with("aud", "someone-else"), tokenErrWrongAudience},
+		{"expired", "TEST_KID_1", with("exp", time.Now().Add(-time.Minute).Unix()), tokenErrExpired},
+		{"no subject", "TEST_KID_1", with("sub", nil), tokenErrNoSub},
+		{"unknown key", "OTHER_KID", f.claims(), tokenErrInvalid},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, code, _ := verifyToken(ctx, signTestToken(t, f.key, tc.kid, tc.claims)); code != tc.want {
+				t.Fatalf("code = %q, want %q", code, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerifyToken_OIDCClaimMapping(t *testing.T) {
+	f := newOIDCFixture(t, map[string]string{"sub": "oid", "birthdate": "dob"})
+	ctx := context.Background()
+
+	c := f.claims()
+	c["oid"] = "0000-aaaa"
+	c["dob"] = "1990-01-01"
+	sub, claims, code, err := verifyTokenClaims(ctx, signTestToken(t, f.key, "TEST_KID_1", c))
+	if code != "" || err != nil {
+		t.Fatalf("code=%q err=%v", code, err)
+	}
+	if sub != "acme:0000-aaaa" || claims["birthdate"] != "1990-01-01" {
+		t.Fatalf("sub=%q claims=%v", sub, claims)
+	}
+
+	// Without the mapped claim the issuer's own sub is not used instead.
+	delete(c, "oid")
+	if _, _, code, _ := verifyTokenClaims(ctx, signTestToken(t, f.key, "TEST_KID_1", c)); code != tokenErrNoSub {
+		t.Fatalf("code = %q, want %q", code, tokenErrNoSub)
+	}
+}
+
+func TestParseOIDCIssuers_Rejects(t *testing.T) {
+	for _, v := range []string{
+		`not json`,
+		`[{"name":"Acme","issuer":"https://id.acme.test","audiences":["x"]}]`,
+		`[{"name":"apple","issuer":"https://id.acme.test","audiences":["x"]}]`,
+		`[{"name":"acme","issuer":"http://id.acme.test","audiences":["x"]}]`,
+		`[{"name":"acme","issuer":"https://accounts.google.com","audiences":["x"]}]`,
+		`[{"name":"acme","issuer":"https://id.acme.test"}]`,
+		`[{"name":"acme","issuer":"https://id.acme.test","audiences":["x"],"claims":{"exp":"expires"}}]`,
+		`[{"name":"acme","issuer":"https://id.acme.test","audiences":["x"]},{"name":"acme","issuer":"https://id2.acme.test","audiences":["x"]}]`,
+	} {
+		if _, err := parseOIDCIssuers(v); err == nil {
+			t.Errorf("parseOIDCIssuers(%s) accepted", strings.TrimSpace(v))
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MatchEvent is the payload of the `match` event delivered to each side of a
+// new pair through their event stream (see Deliver). PeerID is the peer's
+// handle for this match, never their user ID (see peerhandle.go). Offerer
+// tells exactly one side to create the WebRTC offer.
+type MatchEvent struct {
+	MatchID    string   `json:"match_id"`
+	PeerID     string   `json:"peer_id"`
+	SharedTags []string `json:"shared_tags"`
+	Offerer    bool     `json:"offerer"`
+}
+
+// newMatchID returns a random identifier for one pairing, shared by both
+// sides. Clients echo it back in rate_call.
+func newMatchID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// waiter is one queued user as seen by a single pairing pass.
+type waiter struct {
+	ID         string
+	Shard      int
+	Priority   bool      // queued in the shard's priority lane
+	EnqueuedAt time.Time // zero if the timestamp was missing
+	Profile    Profile
+}
+
+// acceptsRandom reports whether w may be paired without a shared tag: users
+// who declared no interests always may; users who did only once they have
+// waited tagMatchWait for a shared-tag partner.
+func (w waiter) acceptsRandom(now time.Time, tagWait time.Duration) bool {
+	if len(w.Profile.Interests) == 0 || w.EnqueuedAt.IsZero() {
+		return true
+	}
+	return now.Sub(w.EnqueuedAt) >= tagWait
+}
+
+// compatible applies the hard pairing constraints that need no Redis
+// round-trip. Blocks are checked separately, and lazily, by isBlocked.
+func compatible(a, b waiter) bool {
+	return a.Profile.AgeBand == b.Profile.AgeBand &&
+		a.Profile.Pool == b.Profile.Pool &&
+		languagesCompatible(a.Profile, b.Profile)
+}
+
+// loadWaiters snapshots the head of one shard's queue together with each
+// user's enqueue time and profile. The priority lane comes first, so its
+// users are considered, and chosen as partners, before fresh entrants.
+func (m *MatchMaker) loadWaiters(ctx context.Context, shard int) ([]waiter, error) {
+	pipe := m.rdb.Pipeline()
+	priorityCmd := pipe.LRange(ctx, priorityQueueKey(shard), 0, maxQueueScan-1)
+	regularCmd := pipe.LRange(ctx, queueKey(shard), 0, maxQueueScan-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	prioritized := len(priorityCmd.Val())
+	ids := append(priorityCmd.Val(), regularCmd.Val()...)
+	if len(ids) > maxQueueScan {
+		ids = ids[:maxQueueScan]
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	stamps, err := m.rdb.HMGet(ctx, enqueuedAtKey(shard), ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := m.loadProfiles(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]waiter, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for i, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		w := waiter{ID: id, Shard: shard, Priority: i < prioritized, Profile: profiles[id]}
+		if s, ok := stamps[i].(string); ok {
+			if ns, err := strconv.ParseInt(s, 10, 64); err == nil {
+				w.EnqueuedAt = time.Unix(0, ns)
+			}
+		}
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+// pairingPass carries the per-call state of processMatches: who has already
+// been paired and which candidate pairs were found blocked, so a blocked pair
+// is checked (and counted) once per pass rather than once per direction.
+type pairingPass struct {
+	m          *MatchMaker
+	shard      int
+	now        time.Time
+	waiters    []waiter
+	pos        map[string]int
+	paired     map[string]bool
+	blocked    map[[2]string]bool
+	rejections int
+	// stats are the per-region-pair connect outcomes, loaded once per
+	// processMatches for every shard.
+	stats connectStats
+}
+
+func (p *pairingPass) isBlocked(ctx context.Context, a, b string) bool {
+	key := [2]string{a, b}
+	if b < a {
+		key = [2]string{b, a}
+	}
+	if v, ok := p.blocked[key]; ok {
+		return v
+	}
+	v := p.m.pairBlocked(ctx, a, b)
+	p.blocked[key] = v
+	if v {
+		blockedPairingsTotal.Inc()
+		p.rejections++
+		slog.Info("MatchMaker: rejected blocked pair", "client1", a, "client2", b)
+		p.m.auditRejection(ctx, a, b, "blocked", p.now)
+	}
+	return v
+}
+
+func (p *pairingPass) exhausted() bool {
+	return p.rejections >= maxBlockedRejectionsPerCycle
+}
+
+// partnerFor picks the best unpaired partner for u. Users sharing at least
+// one tag with u are found through the per-tag indexes and preferred, most
+// overlap first, then same quality tier, then the priority lane, then lowest
+// estimated RTT (see latencyRank), then queue order. If none is available
+// and both sides accept a random match, a waiter in u's quality tier is
+// chosen, else one of any tier, in the same priority/RTT/queue order.
+// Candidates that fail the hard constraints (see compatible) are never
+// chosen.
+func (p *pairingPass) partnerFor(ctx context.Context, u waiter) (waiter, bool) {
+	if len(u.Profile.Interests) > 0 {
+		for _, v := range p.tagCandidates(ctx, u) {
+			if !compatible(u, v) {
+				continue
+			}
+			if p.exhausted() {
+				return waiter{}, false
+			}
+			if !p.isBlocked(ctx, u.ID, v.ID) {
+				return v, true
+			}
+		}
+	}
+
+	if !u.acceptsRandom(p.now, p.m.tagMatchWait) {
+		return waiter{}, false
+	}
+	// Two sweeps: first only partners in u's quality tier, so highly rated
+	// users meet each other, then anyone.
+	for _, sameTierOnly := range []bool{true, false} {
+		var candidates []waiter
+		for _, v := range p.waiters {
+			if v.ID == u.ID || p.paired[v.ID] || !v.acceptsRandom(p.now, p.m.tagMatchWait) || !compatible(u, v) {
+				continue
+			}
+			if sameTierOnly && qualityTier(u.Profile) != qualityTier(v.Profile) {
+				continue
+			}
+			candidates = append(candidates, v)
+		}
+		p.sortByLatency(u, candidates)
+		for _, v := range candidates {
+			if p.exhausted() {
+				return waiter{}, false
+			}
+			if !p.isBlocked(ctx, u.ID, v.ID) {
+				return v, true
+			}
+		}
+	}
+	return waiter{}, false
+}
+
+// tagCandidates returns the unpaired waiters in this snapshot that share a
+// tag with u, ordered by overlap (desc), same quality tier, then queue
+// position.
+func (p *pairingPass) tagCandidates(ctx context.Context, u waiter) []waiter {
+	keys := make([]string, len(u.Profile.Interests))
+	for i, t := range u.Profile.Interests {
+		keys[i] = tagKey(p.shard, t)
+	}
+	ids, err := p.m.rdb.SUnion(ctx, keys...).Result()
+	if err != nil {
+		slog.Error("MatchMaker: tag index lookup failed", "client_id", u.ID, "error", err)
+		return nil
+	}
+	var out []waiter
+	for _, id := range ids {
+		i, ok := p.pos[id]
+		if !ok || id == u.ID || p.paired[id] {
+			continue
+		}
+		out = append(out, p.waiters[i])
+	}
+	sort.SliceStable(out, func(a, b int) bool {
+		oa := len(sharedTags(u.Profile.Interests, out[a].Profile.Interests))
+		ob := len(sharedTags(u.Profile.Interests, out[b].Profile.Interests))
+		if oa != ob {
+			return oa > ob
+		}
+		ta := qualityTier(out[a].Profile) == qualityTier(u.Profile)
+		tb := qualityTier(out[b].Profile) == qualityTier(u.Profile)
+		if ta != tb {
+			return ta
+		}
+		return p.closer(u, out[a], out[b])
+	})
+	return out
+}
+
+// sortByLatency orders candidates, given in queue order, for u: priority
+// lane first, then lowest estimated RTT bucket, then queue order.
+func (p *pairingPass) sortByLatency(u waiter, candidates []waiter) {
+	if latencyBucket <= 0 {
+		return
+	}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		return p.closer(u, candidates[a], candidates[b])
+	})
+}
+
+// closer reports whether a should be preferred over b as u's partner,
+// all else being equal.
+func (p *pairingPass) closer(u, a, b waiter) bool {
+	if a.Priority != b.Priority {
+		return a.Priority
+	}
+	ra, rb := latencyRank(u.Profile, a.Profile, p.stats), latencyRank(u.Profile, b.Profile, p.stats)
+	if ra != rb {
+		return ra < rb
+	}
+	return p.pos[a.ID] < p.pos[b.ID]
+}
+
+// processMatches runs one pairing pass per shard concurrently, then hands
+// whoever is left unpaired to the rebalancer so lone waiters in different
+// shards can still meet. Nothing happens while an admin has paused pairing.
+func (m *MatchMaker) processMatches(ctx context.Context) {
+	if m.paused(ctx) {
+		matchmakerPaused.Set(1)
+		return
+	}
+	matchmakerPaused.Set(0)
+	now := time.Now()
+	var stats connectStats
+	if latencyBucket > 0 {
+		stats = m.loadConnectStats(ctx)
+	}
+	leftovers := make([][]waiter, m.shards)
+	var wg sync.WaitGroup
+	for s := 0; s < m.shards; s++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			leftovers[shard] = m.processShard(ctx, shard, now, stats)
+		}(s)
+	}
+	wg.Wait()
+	m.rebalance(ctx, leftovers, now)
+}
+
+// processShard pairs as many waiters as it can from one snapshot of a
+// shard's queue and returns the ones it could not pair. Waiters are
+// considered oldest first; each claims its best partner atomically, so a user
+// who left the queue after the snapshot is skipped.
+func (m *MatchMaker) processShard(ctx context.Context, shard int, now time.Time, stats connectStats) []waiter {
+	waiters, err := m.loadWaiters(ctx, shard)
+	if err != nil {
+		slog.Error("MatchMaker: failed to load queue", "shard", shard, "error", err)
+		return nil
+	}
+	queueLength.WithLabelValues(strconv.Itoa(shard)).Set(float64(len(waiters)))
+	if len(waiters) < 2 {
+		return waiters
+	}
+
+	p := &pairingPass{
+		m:       m,
+		shard:   shard,
+		now:     now,
+		waiters: waiters,
+		pos:     make(map[string]int, len(waiters)),
+		paired:  make(map[string]bool, len(waiters)),
+		blocked: make(map[[2]string]bool),
+		stats:   stats,
+	}
+	for i, w := range waiters {
+		p.pos[w.ID] = i
+	}
+
+	for _, u := range waiters {
+		if p.exhausted() {
+			// Users not yet considered are not leftovers; they simply
+			// weren't reached this pass.
+			return nil
+		}
+		if p.paired[u.ID] {
+			continue
+		}
+		v, ok := p.partnerFor(ctx, u)
+		if !ok {
+			continue
+		}
+
+		claimed, err := m.claimPair(ctx, shard, u.ID, v.ID)
+		if err != nil {
+			slog.Error("MatchMaker: claim pair failed", "shard", shard, "error", err)
+			return nil
+		}
+		// Either way neither side is reconsidered this pass: on success they
+		// are matched, on failure at least one of them already left.
+		p.paired[u.ID] = true
+		p.paired[v.ID] = true
+		if !claimed {
+			m.auditRejection(ctx, u.ID, v.ID, "claim_lost", now)
+			continue
+		}
+		m.completeMatch(ctx, u, v, estimatedRTT(u.Profile, v.Profile, stats))
+	}
+
+	var left []waiter
+	for _, w := range waiters {
+		if !p.paired[w.ID] {
+			left = append(left, w)
+		}
+	}
+	return left
+}
+
+// completeMatch records sessions and metrics for a claimed pair and notifies
+// both sides. est is the pair's estimated RTT.
+func (m *MatchMaker) completeMatch(ctx context.Context, a, b waiter, est time.Duration) {
+	shared := sharedTags(a.Profile.Interests, b.Profile.Interests)
+	matchID := newMatchID()
+	slog.Info("Matching clients", "match_id", matchID, "client1", a.ID, "client2", b.ID, "shared_tags", shared)
+	matchesTotal.Inc()
+	if len(shared) > 0 {
+		tagMatchesTotal.Inc()
+	}
+	qualityTierMatchesTotal.WithLabelValues(qualityTierPairLabel(a.Profile, b.Profile)).Inc()
+	laneMatchesTotal.WithLabelValues(laneLabel(a.Priority)).Inc()
+	laneMatchesTotal.WithLabelValues(laneLabel(b.Priority)).Inc()
+	matchEstimatedRTTSeconds.Observe(est.Seconds())
+	observeLanguagePair(a, b, time.Now())
+	m.observeMatchLatency(ctx, a.Shard, a.ID, b.ID)
+	m.unindexTags(ctx, a.ID, a.Shard)
+	m.unindexTags(ctx, b.ID, b.Shard)
+	aSeesB := m.issuePeerHandle(ctx, a.ID, b.ID, matchID)
+	bSeesA := m.issuePeerHandle(ctx, b.ID, a.ID, matchID)
+	m.SetSession(ctx, a.ID, b.ID, matchID, aSeesB)
+	m.SetSession(ctx, b.ID, a.ID, matchID, bSeesA)
+	now := time.Now()
+	for _, pair := range [][2]waiter{{a, b}, {b, a}} {
+		w := pair[0]
+		detail := map[string]any{
+			"shard": w.Shard, "lane": laneLabel(w.Priority), "shared_tags": nonNil(shared),
+			"est_rtt_ms": est.Milliseconds(), "region": w.Profile.Region,
+		}
+		if !w.EnqueuedAt.IsZero() {
+			detail["wait_ms"] = now.Sub(w.EnqueuedAt).Milliseconds()
+		}
+		m.audit(ctx, AuditEvent{At: now, Type: auditMatched, UserID: w.ID, PeerID: pair[1].ID, MatchID: matchID, Detail: detail})
+	}
+
+	// Deliver through per-user event streams so whichever backend instance
+	// holds the matched client's WebSocket forwards it, even across a
+	// reconnect.
+	// Clients only see each other's handles, so the server picks who sends
+	// the WebRTC offer.
+	m.notifyMatch(ctx, a.ID, b.ID, MatchEvent{MatchID: matchID, PeerID: aSeesB, SharedTags: shared, Offerer: a.ID < b.ID})
+	m.notifyMatch(ctx, b.ID, a.ID, MatchEvent{MatchID: matchID, PeerID: bSeesA, SharedTags: shared, Offerer: b.ID < a.ID})
+}
+
+// observeLanguagePair records the match and each side's wait under the
+// pair's language label, so per-language-pair match rate and wait time can be
+// compared (e.g. whether "es-es" users wait much longer than "en-en").
+func observeLanguagePair(a, b waiter, now time.Time) {
+	label := languagePairLabel(a.Profile, b.Profile)
+	languageMatchesTotal.WithLabelValues(label).Inc()
+	for _, w := range []waiter{a, b} {
+		if w.EnqueuedAt.IsZero() {
+			continue
+		}
+		if dt := now.Sub(w.EnqueuedAt); dt >= 0 {
+			languageMatchWaitSeconds.WithLabelValues(label).Observe(dt.Seconds())
+		}
+	}
+}
+
+func (m *MatchMaker) notifyMatch(ctx context.Context, userID, peerID string, ev MatchEvent) {
+	if ev.SharedTags == nil {
+		ev.SharedTags = []string{}
+	}
+	if err := m.Deliver(ctx, userID, Message{Type: "match", Payload: ev}); err != nil {
+		slog.Error("MatchMaker: failed to notify client", "client_id", userID, "error", err)
+		m.audit(ctx, AuditEvent{Type: auditNotifyFailed, UserID: userID, PeerID: peerID, MatchID: ev.MatchID, Reason: err.Error()})
+		return
+	}
+	m.audit(ctx, AuditEvent{Type: auditNotified, UserID: userID, PeerID: peerID, MatchID: ev.MatchID})
+}
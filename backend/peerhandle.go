@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Clients never see another user's ID, which for Google users is their
+// stable, cross-app Google subject. Each match instead gives both sides a
+// random handle for the other: the `match` event's peer_id, the `from` of
+// relayed messages, and what /report and /block accept. Handles are
+// resolved server-side and only for the user they were issued to, so a
+// leaked handle is useless to anyone else and says nothing about the
+// person behind it once the match is over.
+
+// peerHandleTTL keeps a handle resolvable for as long as the match session
+// itself, so a call can still be reported or blocked after it ended.
+const peerHandleTTL = 24 * time.Hour
+
+func newPeerHandle() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// issuePeerHandle mints the handle by which viewer will know peer for this
+// match. It returns "" if the handle could not be stored.
+func (m *MatchMaker) issuePeerHandle(ctx context.Context, viewer, peer, matchID string) string {
+	handle := newPeerHandle()
+	key := peerHandleKey(handle)
+	pipe := m.rdb.TxPipeline()
+	pipe.HSet(ctx, key, "user", peer, "viewer", viewer, "match", matchID)
+	pipe.Expire(ctx, key, peerHandleTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("MatchMaker: failed to store peer handle", "user_id", viewer, "match_id", matchID, "error", err)
+		return ""
+	}
+	return handle
+}
+
+// ResolvePeer returns the user behind a handle issued to viewer, and false
+// if the handle is unknown, expired, or was issued to someone else.
+func (m *MatchMaker) ResolvePeer(ctx context.Context, viewer, handle string) (string, bool) {
+	if handle == "" {
+		return "", false
+	}
+	h, err := m.rdb.HGetAll(ctx, peerHandleKey(handle)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		slog.Error("MatchMaker: failed to resolve peer handle", "user_id", viewer, "error", err)
+		return "", false
+	}
+	if h["viewer"] != viewer || h["user"] == "" {
+		return "", false
+	}
+	return h["user"], true
+}
+
+// PeerHandle returns the handle by which the user knows their current or
+// most recent peer, or "" if they have none.
+func (m *MatchMaker) PeerHandle(ctx context.Context, userID string) string {
+	handle, err := m.rdb.HGet(ctx, matchKey(userID), "peer_handle").Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		slog.Error("MatchMaker: failed to read peer handle", "user_id", userID, "error", err)
+	}
+	return handle
+}
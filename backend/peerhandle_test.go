@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// pairPeers records a match between a and b as the pairing pass does and
+// returns the handle each was given for the other.
+func pairPeers(ctx context.Context, mm *MatchMaker, a, b, matchID string) (aSeesB, bSeesA string) {
+	aSeesB = mm.issuePeerHandle(ctx, a, b, matchID)
+	bSeesA = mm.issuePeerHandle(ctx, b, a, matchID)
+	mm.SetSession(ctx, a, b, matchID, aSeesB)
+	mm.SetSession(ctx, b, a, matchID, bSeesA)
+	return aSeesB, bSeesA
+}
+
+func TestPeerHandle_ResolvesOnlyForItsViewer(t *testing.T) {
+	mm, _, _ := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	aliceSeesBob, bobSeesAlice := pairPeers(ctx, mm, "alice", "bob", "m1")
+	if aliceSeesBob == "" || aliceSeesBob == bobSeesAlice || aliceSeesBob == "bob" {
+		t.Fatalf("handles = %q, %q", aliceSeesBob, bobSeesAlice)
+	}
+	if got := mm.PeerHandle(ctx, "alice"); got != aliceSeesBob {
+		t.Fatalf("PeerHandle(alice) = %q, want %q", got, aliceSeesBob)
+	}
+	if sub, ok := mm.ResolvePeer(ctx, "alice", aliceSeesBob); !ok || sub != "bob" {
+		t.Fatalf("ResolvePeer(alice) = %q, %v", sub, ok)
+	}
+	for _, c := range []struct{ viewer, handle string }{
+		{"carol", aliceSeesBob}, // someone else's handle
+		{"bob", aliceSeesBob},   // the peer's own handle
+		{"alice", "bob"},        // a raw user ID
+		{"alice", ""},
+	} {
+		if sub, ok := mm.ResolvePeer(ctx, c.viewer, c.handle); ok {
+			t.Errorf("ResolvePeer(%q, %q) = %q, want no match", c.viewer, c.handle, sub)
+		}
+	}
+
+	// A new match gets new handles; the old one still resolves, so the
+	// previous call can be reported.
+	aliceSeesDave, _ := pairPeers(ctx, mm, "alice", "dave", "m2")
+	if aliceSeesDave == aliceSeesBob {
+		t.Fatalf("handles must not be reused across matches")
+	}
+	if sub, ok := mm.ResolvePeer(ctx, "alice", aliceSeesBob); !ok || sub != "bob" {
+		t.Fatalf("previous match's handle: %q, %v", sub, ok)
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/text/language"
+)
+
+const (
+	// maxInterestTags caps how many interests a client may declare. Beyond a
+	// handful the overlap stops meaning anything and the per-tag index
+	// fan-out on enqueue grows for no benefit.
+	maxInterestTags = 5
+	// maxInterestTagLen bounds a single tag so a hostile client can't park
+	// kilobytes in Redis under a tag key.
+	maxInterestTagLen = 24
+	// maxLanguages caps how many spoken languages are recorded per user.
+	maxLanguages = 5
+)
+
+// metricLanguages are the primary languages that get their own label in the
+// per-language-pair metrics; any other is counted as "other". Languages come
+// from the client and x/text knows thousands of base codes, so without this
+// any client could mint new series by cycling set_preferences. Replaced by
+// METRIC_LANGUAGES in main.
+var metricLanguages = parseMetricLanguages(
+	"en,es,pt,fr,de,it,nl,pl,ru,uk,tr,ar,fa,hi,bn,ur,id,ms,vi,th,tl,ja,ko,zh,sw",
+)
+
+// parseMetricLanguages parses METRIC_LANGUAGES, a comma-separated list of
+// language codes, into the set of base codes it names.
+func parseMetricLanguages(v string) map[string]bool {
+	out := map[string]bool{}
+	for _, code := range strings.Split(v, ",") {
+		for _, base := range normalizeLanguages([]string{code}) {
+			out[base] = true
+		}
+	}
+	return out
+}
+
+// Profile holds the matching attributes a client declared for this session.
+// It lives in a Redis hash (see profileKey) so the leader can read it
+// regardless of which pod holds the client's socket.
+type Profile struct {
+	Interests []string
+	// Languages are ISO 639 base codes ("en", "es"), most preferred first.
+	// Empty means unknown: the user is then treated as language-agnostic
+	// rather than unmatchable.
+	Languages []string
+	// AnyLanguage opts the user into partners with no language in common.
+	// Only takes effect when both sides have opted in.
+	AnyLanguage bool
+	// Pool segregates users who may only be paired with each other (see
+	// trust.go). Empty is the general population.
+	Pool string
+	// Quality is the user's smoothed share of thumbs-up ratings (see
+	// rating.go). Zero means not loaded and is treated as neutral.
+	Quality float64
+	// AgeBand is "adult", "minor" or "" for unknown (see age.go). Users are
+	// never paired across bands.
+	AgeBand string
+	// RTT is the user's smoothed round trip to their pod, zero until the
+	// first pong, and Region the pod's region (see latency.go).
+	RTT    time.Duration
+	Region string
+	// Pod is the replica holding the user's socket, for admins.
+	Pod string
+}
+
+// languagesCompatible reports whether a and b may be paired on language
+// grounds: they share a language, both opted into any language, or either
+// side's languages are unknown.
+func languagesCompatible(a, b Profile) bool {
+	if len(a.Languages) == 0 || len(b.Languages) == 0 {
+		return true
+	}
+	if a.AnyLanguage && b.AnyLanguage {
+		return true
+	}
+	return len(sharedTags(a.Languages, b.Languages)) > 0
+}
+
+// primaryLanguage is the label used for per-language-pair metrics: the
+// user's first language if it is in metricLanguages, else "other".
+func (p Profile) primaryLanguage() string {
+	if len(p.Languages) == 0 {
+		return "und"
+	}
+	if !metricLanguages[p.Languages[0]] {
+		return "other"
+	}
+	return p.Languages[0]
+}
+
+// languagePairLabel is the order-independent metric label for a pair, e.g.
+// "en-es". Labels only name metricLanguages, "other" and "und", so the label
+// set stays bounded whatever clients send.
+func languagePairLabel(a, b Profile) string {
+	la, lb := a.primaryLanguage(), b.primaryLanguage()
+	if lb < la {
+		la, lb = lb, la
+	}
+	return la + "-" + lb
+}
+
+// normalizeLanguages maps each entry to its ISO 639 base language ("en-US"
+// and "en_GB" both become "en"), dropping unparseable entries and
+// duplicates, and keeps at most maxLanguages in the order given.
+func normalizeLanguages(raw []string) []string {
+	out := make([]string, 0, len(raw))
+	seen := make(map[string]bool, len(raw))
+	for _, r := range raw {
+		r = strings.ReplaceAll(strings.TrimSpace(r), "_", "-")
+		if r == "" || r == "*" {
+			continue
+		}
+		tag, err := language.Parse(r)
+		if err != nil {
+			continue
+		}
+		base, conf := tag.Base()
+		if conf == language.No {
+			continue
+		}
+		code := base.String()
+		if code == "und" || seen[code] {
+			continue
+		}
+		seen[code] = true
+		out = append(out, code)
+		if len(out) == maxLanguages {
+			break
+		}
+	}
+	return out
+}
+
+// languagesFromRequest records the user's spoken languages at connect time.
+// An explicit `?languages=en,es` (or repeated `?language=`) wins; otherwise
+// the Accept-Language header is used in q-value order. `?any_language=true`
+// opts into cross-language matches.
+func languagesFromRequest(r *http.Request) (langs []string, anyLanguage bool) {
+	q := r.URL.Query()
+	anyLanguage, _ = strconv.ParseBool(q.Get("any_language"))
+
+	var raw []string
+	for _, v := range q["languages"] {
+		raw = append(raw, strings.Split(v, ",")...)
+	}
+	raw = append(raw, q["language"]...)
+	if len(raw) > 0 {
+		return normalizeLanguages(raw), anyLanguage
+	}
+
+	tags, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if err != nil {
+		return nil, anyLanguage
+	}
+	for _, t := range tags {
+		raw = append(raw, t.String())
+	}
+	return normalizeLanguages(raw), anyLanguage
+}
+
+// normalizeInterests lowercases and trims each tag, drops empty, overlong or
+// malformed tags and duplicates, and keeps at most maxInterestTags in the
+// order given. Tags may contain letters, digits, '-' and '_'.
+func normalizeInterests(raw []string) []string {
+	out := make([]string, 0, len(raw))
+	seen := make(map[string]bool, len(raw))
+	for _, t := range raw {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || len(t) > maxInterestTagLen || seen[t] || !validTag(t) {
+			continue
+		}
+		seen[t] = true
+		out = append(out, t)
+		if len(out) == maxInterestTags {
+			break
+		}
+	}
+	return out
+}
+
+func validTag(t string) bool {
+	for _, r := range t {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// interestsFromQuery reads interest tags from the /ws upgrade URL. Both
+// `?interests=music,games` and repeated `?interest=music&interest=games` are
+// accepted.
+func interestsFromQuery(q url.Values) []string {
+	var raw []string
+	for _, v := range q["interests"] {
+		raw = append(raw, strings.Split(v, ",")...)
+	}
+	raw = append(raw, q["interest"]...)
+	return normalizeInterests(raw)
+}
+
+// interestsFromPayload extracts the `interests` array from a
+// set_preferences message payload. Non-string entries are ignored.
+func interestsFromPayload(payload interface{}) ([]string, bool) {
+	m, ok := payload.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	list, ok := m["interests"].([]interface{})
+	if !ok {
+		return nil, false
+	}
+	raw := make([]string, 0, len(list))
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			raw = append(raw, s)
+		}
+	}
+	return normalizeInterests(raw), true
+}
+
+// preferencesFromPayload extracts the optional fields of a set_preferences
+// message payload. Absent fields are returned as nil so the caller leaves
+// the corresponding preference unchanged.
+func preferencesFromPayload(payload interface{}) (interests, languages []string, anyLanguage *bool, ok bool) {
+	m, ok := payload.(map[string]interface{})
+	if !ok {
+		return nil, nil, nil, false
+	}
+	if _, present := m["interests"]; present {
+		interests, _ = interestsFromPayload(payload)
+		if interests == nil {
+			interests = []string{}
+		}
+	}
+	if list, present := m["languages"].([]interface{}); present {
+		raw := make([]string, 0, len(list))
+		for _, v := range list {
+			if s, ok := v.(string); ok {
+				raw = append(raw, s)
+			}
+		}
+		languages = normalizeLanguages(raw)
+	}
+	if v, present := m["any_language"].(bool); present {
+		anyLanguage = &v
+	}
+	return interests, languages, anyLanguage, true
+}
+
+func encodeProfile(p Profile) map[string]any {
+	anyLang := "0"
+	if p.AnyLanguage {
+		anyLang = "1"
+	}
+	return map[string]any{
+		"interests":    strings.Join(p.Interests, ","),
+		"languages":    strings.Join(p.Languages, ","),
+		"any_language": anyLang,
+		"pool":         p.Pool,
+		"quality":      strconv.FormatFloat(p.Quality, 'f', 3, 64),
+		"age_band":     p.AgeBand,
+		"rtt_ms":       strconv.FormatInt(p.RTT.Milliseconds(), 10),
+		"region":       p.Region,
+		"pod":          p.Pod,
+	}
+}
+
+func decodeProfile(h map[string]string) Profile {
+	quality, _ := strconv.ParseFloat(h["quality"], 64)
+	rttMs, _ := strconv.ParseInt(h["rtt_ms"], 10, 64)
+	return Profile{
+		Interests:   splitTags(h["interests"]),
+		Languages:   splitTags(h["languages"]),
+		AnyLanguage: h["any_language"] == "1",
+		Pool:        h["pool"],
+		Quality:     quality,
+		AgeBand:     h["age_band"],
+		RTT:         time.Duration(rttMs) * time.Millisecond,
+		Region:      h["region"],
+		Pod:         h["pod"],
+	}
+}
+
+// SetProfile stores the user's matching attributes. Called on connect, before
+// the user is enqueued, so the first pairing pass already sees them.
+func (m *MatchMaker) SetProfile(ctx context.Context, userID string, p Profile) {
+	key := profileKey(userID)
+	pipe := m.rdb.TxPipeline()
+	pipe.HSet(ctx, key, encodeProfile(p))
+	pipe.Expire(ctx, key, blocksTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("MatchMaker: failed to store profile", "user_id", userID, "error", err)
+	}
+}
+
+// SetInterests replaces the user's interest tags mid-session (the
+// set_preferences message). If the user is currently queued the per-tag
+// indexes are moved over so the change applies to the next pairing pass.
+func (m *MatchMaker) SetInterests(ctx context.Context, userID string, interests []string) {
+	queued := m.isQueued(ctx, userID)
+	shard := m.shardOf(ctx, userID)
+	if queued {
+		m.unindexTags(ctx, userID, shard)
+	}
+	if err := m.rdb.HSet(ctx, profileKey(userID), "interests", strings.Join(interests, ",")).Err(); err != nil {
+		slog.Error("MatchMaker: failed to update interests", "user_id", userID, "error", err)
+	}
+	if queued {
+		m.indexTags(ctx, userID, shard)
+	}
+}
+
+// SetLanguages replaces the user's spoken languages and any-language opt-in
+// mid-session. Languages are not indexed, so no queue bookkeeping is needed.
+func (m *MatchMaker) SetLanguages(ctx context.Context, userID string, languages []string, anyLanguage bool) {
+	enc := encodeProfile(Profile{Languages: languages, AnyLanguage: anyLanguage})
+	p := map[string]any{"languages": enc["languages"], "any_language": enc["any_language"]}
+	if err := m.rdb.HSet(ctx, profileKey(userID), p).Err(); err != nil {
+		slog.Error("MatchMaker: failed to update languages", "user_id", userID, "error", err)
+	}
+}
+
+// Profile returns the user's stored matching attributes.
+func (m *MatchMaker) Profile(ctx context.Context, userID string) Profile {
+	h, err := m.rdb.HGetAll(ctx, profileKey(userID)).Result()
+	if err != nil {
+		slog.Error("MatchMaker: failed to read profile", "user_id", userID, "error", err)
+	}
+	return decodeProfile(h)
+}
+
+// ClearProfile removes the user's profile on disconnect. Must run after
+// Remove, which reads the profile to clean up the tag indexes.
+func (m *MatchMaker) ClearProfile(ctx context.Context, userID string) {
+	if err := m.rdb.Del(ctx, profileKey(userID)).Err(); err != nil {
+		slog.Error("MatchMaker: failed to clear profile", "user_id", userID, "error", err)
+	}
+}
+
+func (m *MatchMaker) interests(ctx context.Context, userID string) []string {
+	raw, err := m.rdb.HGet(ctx, profileKey(userID), "interests").Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		slog.Error("MatchMaker: failed to read interests", "user_id", userID, "error", err)
+	}
+	return splitTags(raw)
+}
+
+func splitTags(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	return strings.Split(raw, ",")
+}
+
+// loadProfiles reads the profiles of every given user in one pipeline.
+// Users without a profile (e.g. enqueued by an older pod) get the zero value.
+func (m *MatchMaker) loadProfiles(ctx context.Context, ids []string) (map[string]Profile, error) {
+	pipe := m.rdb.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, profileKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	out := make(map[string]Profile, len(ids))
+	for i, id := range ids {
+		out[id] = decodeProfile(cmds[i].Val())
+	}
+	return out, nil
+}
+
+// indexTags adds a queued user to their shard's per-tag waiting sets so the
+// pairing pass can find everyone sharing a tag with one SUNION.
+func (m *MatchMaker) indexTags(ctx context.Context, userID string, shard int) {
+	tags := m.interests(ctx, userID)
+	if len(tags) == 0 {
+		return
+	}
+	pipe := m.rdb.Pipeline()
+	for _, t := range tags {
+		pipe.SAdd(ctx, tagKey(shard, t), userID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("MatchMaker: failed to index tags", "user_id", userID, "error", err)
+	}
+}
+
+// unindexTags removes a user from a shard's per-tag waiting sets. Called
+// whenever the user leaves that shard's queue (matched, disconnected, moved,
+// preferences changed).
+func (m *MatchMaker) unindexTags(ctx context.Context, userID string, shard int) {
+	tags := m.interests(ctx, userID)
+	if len(tags) == 0 {
+		return
+	}
+	pipe := m.rdb.Pipeline()
+	for _, t := range tags {
+		pipe.SRem(ctx, tagKey(shard, t), userID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("MatchMaker: failed to unindex tags", "user_id", userID, "error", err)
+	}
+}
+
+// sharedTags returns the tags present in both a and b, in a's order.
+func sharedTags(a, b []string) []string {
+	if len(a) == 0 || len(b) == 0 {
+		return nil
+	}
+	in := make(map[string]bool, len(b))
+	for _, t := range b {
+		in[t] = true
+	}
+	var out []string
+	for _, t := range a {
+		if in[t] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
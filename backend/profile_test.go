@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeInterests(t *testing.T) {
+	got := normalizeInterests([]string{" Music", "music", "", "board games", "k-pop", "a_very_long_tag_that_exceeds_limit", "Chess", "go", "art", "film"})
+	want := []string{"music", "k-pop", "chess", "go", "art"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("normalizeInterests: want %v, got %v", want, got)
+	}
+}
+
+func TestInterestsFromQuery_BothForms(t *testing.T) {
+	q, _ := url.ParseQuery("interests=music,games&interest=Art&interest=music")
+	got := interestsFromQuery(q)
+	want := []string{"music", "games", "art"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("interestsFromQuery: want %v, got %v", want, got)
+	}
+}
+
+func TestInterestsFromPayload(t *testing.T) {
+	got, ok := interestsFromPayload(map[string]interface{}{
+		"interests": []interface{}{"Music", 42, "games"},
+	})
+	if !ok {
+		t.Fatalf("expected payload to parse")
+	}
+	if want := []string{"music", "games"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("interestsFromPayload: want %v, got %v", want, got)
+	}
+	if _, ok := interestsFromPayload("nope"); ok {
+		t.Fatalf("non-object payload must be rejected")
+	}
+}
+
+func TestSharedTags(t *testing.T) {
+	got := sharedTags([]string{"music", "games", "art"}, []string{"art", "music"})
+	if want := []string{"music", "art"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("sharedTags: want %v, got %v", want, got)
+	}
+	if got := sharedTags(nil, []string{"music"}); got != nil {
+		t.Fatalf("sharedTags with empty side: want nil, got %v", got)
+	}
+}
+
+func TestNormalizeLanguages(t *testing.T) {
+	got := normalizeLanguages([]string{"en-US", "en_GB", "ES", "*", "not a tag!", "pt-BR"})
+	if want := []string{"en", "es", "pt"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("normalizeLanguages: want %v, got %v", want, got)
+	}
+}
+
+func TestLanguagesFromRequest_AcceptLanguage(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.Header.Set("Accept-Language", "fr;q=0.5, de-DE, en;q=0.8")
+	langs, anyLang := languagesFromRequest(req)
+	if want := []string{"de", "en", "fr"}; !reflect.DeepEqual(langs, want) {
+		t.Fatalf("languages: want %v (q-value order), got %v", want, langs)
+	}
+	if anyLang {
+		t.Fatalf("any_language should default to false")
+	}
+}
+
+func TestLanguagesFromRequest_ExplicitOverridesHeader(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/ws?languages=es,pt&any_language=true", nil)
+	req.Header.Set("Accept-Language", "en-US")
+	langs, anyLang := languagesFromRequest(req)
+	if want := []string{"es", "pt"}; !reflect.DeepEqual(langs, want) {
+		t.Fatalf("languages: want %v, got %v", want, langs)
+	}
+	if !anyLang {
+		t.Fatalf("any_language=true should be honored")
+	}
+}
+
+func TestLanguagesCompatible(t *testing.T) {
+	en := Profile{Languages: []string{"en"}}
+	enEs := Profile{Languages: []string{"es", "en"}}
+	de := Profile{Languages: []string{"de"}}
+	deAny := Profile{Languages: []string{"de"}, AnyLanguage: true}
+	enAny := Profile{Languages: []string{"en"}, AnyLanguage: true}
+	unknown := Profile{}
+
+	cases := []struct {
+		name string
+		a, b Profile
+		want bool
+	}{
+		{"shared language", en, enEs, true},
+		{"no shared language", en, de, false},
+		{"only one side opted into any", en, deAny, false},
+		{"both opted into any", enAny, deAny, true},
+		{"unknown language is agnostic", unknown, de, true},
+	}
+	for _, c := range cases {
+		if got := languagesCompatible(c.a, c.b); got != c.want {
+			t.Errorf("%s: want %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestLanguagePairLabelIsOrderIndependent(t *testing.T) {
+	a := Profile{Languages: []string{"es"}}
+	b := Profile{Languages: []string{"en"}}
+	if languagePairLabel(a, b) != "en-es" || languagePairLabel(b, a) != "en-es" {
+		t.Fatalf("want en-es both ways, got %q / %q", languagePairLabel(a, b), languagePairLabel(b, a))
+	}
+	if got := languagePairLabel(Profile{}, b); got != "en-und" {
+		t.Fatalf("unknown language label: want en-und, got %q", got)
+	}
+}
+
+func TestLanguagePairLabelFoldsUnlistedLanguages(t *testing.T) {
+	prev := metricLanguages
+	metricLanguages = parseMetricLanguages("en, es-MX ,,x-bogus")
+	t.Cleanup(func() { metricLanguages = prev })
+
+	if len(metricLanguages) != 2 || !metricLanguages["es"] {
+		t.Fatalf("metricLanguages = %v; want en and es", metricLanguages)
+	}
+	a := Profile{Languages: normalizeLanguages([]string{"gsw"})}
+	b := Profile{Languages: []string{"en"}}
+	if got := languagePairLabel(a, b); got != "en-other" {
+		t.Fatalf("unlisted language label: want en-other, got %q", got)
+	}
+}
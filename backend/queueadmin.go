@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// PauseState is whether pairing is paused cluster-wide, and since when.
+// While paused users still join and leave the queue; nobody is matched.
+type PauseState struct {
+	Paused bool       `json:"paused"`
+	Since  *time.Time `json:"since,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+}
+
+// Pause stops pairing on every replica until Resume. It is a flag the leader
+// checks before each pass, so a leader failover does not lose it.
+func (m *MatchMaker) Pause(ctx context.Context, reason string) (PauseState, error) {
+	now := time.Now().UTC()
+	st := PauseState{Paused: true, Since: &now, Reason: reason}
+	raw, _ := json.Marshal(st)
+	set, err := m.rdb.SetNX(ctx, redisPausedKey, raw, 0).Result()
+	if err != nil {
+		return PauseState{}, err
+	}
+	if !set {
+		// Already paused: keep the original time and reason.
+		return m.PauseState(ctx)
+	}
+	return st, nil
+}
+
+// Resume lets the leader pair again and wakes it up straight away.
+func (m *MatchMaker) Resume(ctx context.Context) error {
+	if err := m.rdb.Del(ctx, redisPausedKey).Err(); err != nil {
+		return err
+	}
+	m.rdb.Publish(ctx, redisTriggerKey, "resume")
+	return nil
+}
+
+// PauseState reads the cluster-wide pause flag.
+func (m *MatchMaker) PauseState(ctx context.Context) (PauseState, error) {
+	raw, err := m.rdb.Get(ctx, redisPausedKey).Result()
+	if errors.Is(err, redis.Nil) {
+		return PauseState{}, nil
+	}
+	if err != nil {
+		return PauseState{}, err
+	}
+	st := PauseState{Paused: true}
+	_ = json.Unmarshal([]byte(raw), &st)
+	st.Paused = true
+	return st, nil
+}
+
+// paused reports whether pairing is paused. A Redis error counts as not
+// paused: the pass that follows would fail on the same error anyway.
+func (m *MatchMaker) paused(ctx context.Context) bool {
+	n, err := m.rdb.Exists(ctx, redisPausedKey).Result()
+	if err != nil {
+		slog.Error("MatchMaker: failed to read pause flag", "error", err)
+		return false
+	}
+	return n > 0
+}
+
+// QueueEntry is one waiting user as shown to admins. UserID is the
+// internal user ID, zero if the user has no row (which should not happen).
+type QueueEntry struct {
+	UserID      int64     `json:"user_id"`
+	Sub         string    `json:"sub"`
+	Shard       int       `json:"shard"`
+	Lane        string    `json:"lane"`
+	Position    int       `json:"position"`
+	EnqueuedAt  time.Time `json:"enqueued_at"`
+	WaitSeconds float64   `json:"wait_seconds"`
+	Pod         string    `json:"pod"`
+}
+
+// listQueue returns up to limit waiting users across all shards, longest
+// waiting first. Position is within the user's shard, priority lane first,
+// as in queue_status. UserID is left for the caller to fill in.
+func (m *MatchMaker) listQueue(ctx context.Context, limit int) ([]QueueEntry, error) {
+	pipe := m.rdb.Pipeline()
+	lanes := make([][2]*redis.StringSliceCmd, m.shards)
+	stamps := make([]*redis.MapStringStringCmd, m.shards)
+	for s := range lanes {
+		lanes[s] = [2]*redis.StringSliceCmd{
+			pipe.LRange(ctx, priorityQueueKey(s), 0, -1),
+			pipe.LRange(ctx, queueKey(s), 0, -1),
+		}
+		stamps[s] = pipe.HGetAll(ctx, enqueuedAtKey(s))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var out []QueueEntry
+	for s, cmds := range lanes {
+		prioritized := len(cmds[0].Val())
+		for i, id := range append(cmds[0].Val(), cmds[1].Val()...) {
+			e := QueueEntry{Sub: id, Shard: s, Lane: laneLabel(i < prioritized), Position: i + 1}
+			if ns, err := strconv.ParseInt(stamps[s].Val()[id], 10, 64); err == nil {
+				e.EnqueuedAt = time.Unix(0, ns).UTC()
+				e.WaitSeconds = now.Sub(e.EnqueuedAt).Seconds()
+			}
+			out = append(out, e)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].WaitSeconds > out[j].WaitSeconds })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+
+	pipe = m.rdb.Pipeline()
+	pods := make([]*redis.StringCmd, len(out))
+	for i, e := range out {
+		pods[i] = pipe.HGet(ctx, profileKey(e.Sub), "pod")
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	for i := range out {
+		out[i].Pod = pods[i].Val()
+	}
+	return out, nil
+}
+
+// Evict takes a user out of the queue and tells their client, which goes
+// back to idle until the user asks for a match again. It reports false if
+// the user was not queued.
+func (m *MatchMaker) Evict(ctx context.Context, userID string) bool {
+	if !m.remove(ctx, userID, "admin_evicted") {
+		return false
+	}
+	if err := m.Deliver(ctx, userID, Message{Type: "queue_evicted"}); err != nil {
+		slog.Error("MatchMaker: failed to notify evicted client", "client_id", userID, "error", err)
+	}
+	return true
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func readPausedGauge(t *testing.T) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := matchmakerPaused.Write(&m); err != nil {
+		t.Fatalf("gauge Write: %v", err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestMatchMaker_PauseStopsPairing(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	st, err := mm.Pause(ctx, "incident 42")
+	if err != nil || !st.Paused || st.Since == nil {
+		t.Fatalf("Pause = %+v, %v", st, err)
+	}
+	if again, _ := mm.Pause(ctx, "someone else"); again.Reason != "incident 42" {
+		t.Fatalf("pausing twice should keep the original reason, got %q", again.Reason)
+	}
+
+	mm.Add(ctx, "alice")
+	mm.Add(ctx, "bob")
+	mm.processMatches(ctx)
+	if client.Exists(ctx, sessionKey("alice")).Val() != 0 {
+		t.Fatalf("nobody should be matched while paused")
+	}
+	if got := readPausedGauge(t); got != 1 {
+		t.Fatalf("paused gauge = %v, want 1", got)
+	}
+
+	if err := mm.Resume(ctx); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if st, _ := mm.PauseState(ctx); st.Paused {
+		t.Fatalf("still paused after Resume: %+v", st)
+	}
+	mm.processMatches(ctx)
+	if peer, _ := client.Get(ctx, sessionKey("alice")).Result(); peer != "bob" {
+		t.Fatalf("alice paired with %q after resume, want bob", peer)
+	}
+	if got := readPausedGauge(t); got != 0 {
+		t.Fatalf("paused gauge = %v, want 0", got)
+	}
+}
+
+func TestMatchMaker_ListQueue(t *testing.T) {
+	mm, _, _ := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	mm.SetProfile(ctx, "first", Profile{Pod: "pod-a"})
+	mm.Add(ctx, "first")
+	mm.SetProfile(ctx, "second", Profile{Pod: "pod-b"})
+	mm.Add(ctx, "second")
+	mm.SetProfile(ctx, "victim", Profile{Pod: "pod-a"})
+	mm.add(ctx, "victim", true, requeuePeerSkipped)
+
+	items, err := mm.listQueue(ctx, 10)
+	if err != nil {
+		t.Fatalf("listQueue: %v", err)
+	}
+	if len(items) != 3 || items[0].Sub != "first" || items[2].Sub != "victim" {
+		t.Fatalf("items = %+v, want longest waiting first", items)
+	}
+	if v := items[2]; v.Lane != "priority" || v.Position != 1 || v.Pod != "pod-a" || v.EnqueuedAt.IsZero() {
+		t.Fatalf("victim entry = %+v", v)
+	}
+	if items[1].Pod != "pod-b" || items[1].Position != 3 {
+		t.Fatalf("second entry = %+v", items[1])
+	}
+	if items, _ := mm.listQueue(ctx, 1); len(items) != 1 {
+		t.Fatalf("limit not applied: %d items", len(items))
+	}
+}
+
+func TestMatchMaker_Evict(t *testing.T) {
+	mm, _, _ := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	mm.Add(ctx, "alice")
+	if !mm.Evict(ctx, "alice") {
+		t.Fatalf("Evict should report the user was queued")
+	}
+	if mm.isQueued(ctx, "alice") {
+		t.Fatalf("alice still queued")
+	}
+	if msgs := readEvents(t, mm, "alice"); len(msgs) != 1 || msgs[0].Type != "queue_evicted" {
+		t.Fatalf("alice should be told, got %+v", msgs)
+	}
+	evs, _ := mm.auditTimeline(ctx, auditUserKey("alice"))
+	if last := evs[len(evs)-1]; last.Type != auditDequeued || last.Reason != "admin_evicted" {
+		t.Fatalf("last audit event = %+v", last)
+	}
+	if mm.Evict(ctx, "alice") {
+		t.Fatalf("evicting a user who isn't queued should report false")
+	}
+}
+
+func TestAdminPauseResume(t *testing.T) {
+	mm, _, _ := newTestMatchMaker(t)
+	prevMM := matchMaker
+	matchMaker = mm
+	t.Cleanup(func() { matchMaker = prevMM })
+
+	before := readCounter(t, adminQueueActionsTotal.WithLabelValues("pause"))
+	rr := httptest.NewRecorder()
+	adminPauseMatchmaker(rr, httptest.NewRequest(http.MethodPost, "/admin/api/matchmaker/pause", bytes.NewBufferString(`{"reason":"deploy"}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("pause status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if got := readCounter(t, adminQueueActionsTotal.WithLabelValues("pause")); got != before+1 {
+		t.Fatalf("pause not counted: %v -> %v", before, got)
+	}
+
+	rr = httptest.NewRecorder()
+	adminMatchmakerStatus(rr, httptest.NewRequest(http.MethodGet, "/admin/api/matchmaker", nil))
+	var st PauseState
+	_ = json.NewDecoder(rr.Body).Decode(&st)
+	if !st.Paused || st.Reason != "deploy" {
+		t.Fatalf("status = %+v", st)
+	}
+
+	rr = httptest.NewRecorder()
+	adminResumeMatchmaker(rr, httptest.NewRequest(http.MethodPost, "/admin/api/matchmaker/resume", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("resume status=%d", rr.Code)
+	}
+	if st, _ := mm.PauseState(context.Background()); st.Paused {
+		t.Fatalf("still paused after resume")
+	}
+
+	rr = httptest.NewRecorder()
+	adminPauseMatchmaker(rr, httptest.NewRequest(http.MethodGet, "/admin/api/matchmaker/pause", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET pause status=%d, want 405", rr.Code)
+	}
+}
+
+func TestAdminQueueAndEvict(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+
+	mm, _, _ := newTestMatchMaker(t)
+	prevMM := matchMaker
+	matchMaker = mm
+	t.Cleanup(func() { matchMaker = prevMM })
+
+	id, _, _ := upsertUser(ctx, "waiting")
+	mm.Add(ctx, "waiting")
+
+	rr := httptest.NewRecorder()
+	adminListQueue(rr, httptest.NewRequest(http.MethodGet, "/admin/api/queue", nil))
+	var body struct {
+		Items []QueueEntry `json:"items"`
+	}
+	_ = json.NewDecoder(rr.Body).Decode(&body)
+	if len(body.Items) != 1 || body.Items[0].UserID != id || body.Items[0].Sub != "waiting" {
+		t.Fatalf("queue = %+v", body.Items)
+	}
+
+	path := "/admin/api/users/" + strconv.FormatInt(id, 10) + "/evict"
+	rr = httptest.NewRecorder()
+	adminUserAction(rr, httptest.NewRequest(http.MethodPost, path, nil))
+	var res struct {
+		Evicted bool `json:"evicted"`
+	}
+	_ = json.NewDecoder(rr.Body).Decode(&res)
+	if rr.Code != http.StatusOK || !res.Evicted {
+		t.Fatalf("evict status=%d body=%+v", rr.Code, res)
+	}
+	if mm.isQueued(ctx, "waiting") {
+		t.Fatalf("user still queued after evict")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// queueStatusInterval is how often waiting clients receive a queue_status
+// event. Short enough that the "about Ns" estimate feels live, long enough
+// that a full queue doesn't turn into a write storm.
+const queueStatusInterval = 3 * time.Second
+
+// QueueStatus is the payload of the `queue_status` event pushed to clients
+// still waiting for a match. Position is 1-based. EstimatedWaitSeconds is
+// nil until the cluster has observed at least one match.
+type QueueStatus struct {
+	Waiting              int      `json:"waiting"`
+	Position             int      `json:"position"`
+	EstimatedWaitSeconds *float64 `json:"estimated_wait_seconds"`
+}
+
+// queueSnapshot is one read of the shared queue, reused for every local
+// client in a single queue_status round.
+type queueSnapshot struct {
+	positions map[string]int
+	waiting   int
+	estimate  *float64
+}
+
+// snapshotQueue reads every shard's queue plus the recent match-latency
+// samples in one round-trip. LRANGE over the full lists is O(N) once per tick,
+// which is cheaper than an LPOS per local client once the queue is
+// non-trivial. Position is within the user's own shard, since that is the
+// line they are actually paired from, and counts the shard's priority lane
+// ahead of its regular queue; waiting counts the whole cluster.
+func (m *MatchMaker) snapshotQueue(ctx context.Context) (queueSnapshot, error) {
+	pipe := m.rdb.Pipeline()
+	queueCmds := make([][2]*redis.StringSliceCmd, m.shards)
+	for s := range queueCmds {
+		queueCmds[s] = [2]*redis.StringSliceCmd{
+			pipe.LRange(ctx, priorityQueueKey(s), 0, -1),
+			pipe.LRange(ctx, queueKey(s), 0, -1),
+		}
+	}
+	latencyCmd := pipe.LRange(ctx, redisRecentLatency, 0, -1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return queueSnapshot{}, err
+	}
+
+	snap := queueSnapshot{positions: make(map[string]int)}
+	for _, cmds := range queueCmds {
+		ids := append(cmds[0].Val(), cmds[1].Val()...)
+		snap.waiting += len(ids)
+		for i, id := range ids {
+			if _, seen := snap.positions[id]; !seen {
+				snap.positions[id] = i + 1
+			}
+		}
+	}
+
+	samples := make([]float64, 0, len(latencyCmd.Val()))
+	for _, raw := range latencyCmd.Val() {
+		ms, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || ms < 0 {
+			continue
+		}
+		samples = append(samples, float64(ms)/1000.0)
+	}
+	snap.estimate = estimateWait(samples)
+	return snap, nil
+}
+
+// status returns the queue_status payload for userID, or false if the user
+// is not in the queue (already matched, or mid-call).
+func (s queueSnapshot) status(userID string) (QueueStatus, bool) {
+	pos, ok := s.positions[userID]
+	if !ok {
+		return QueueStatus{}, false
+	}
+	return QueueStatus{
+		Waiting:              s.waiting,
+		Position:             pos,
+		EstimatedWaitSeconds: s.estimate,
+	}, true
+}
+
+// estimateWait returns the median of the recent match latencies, rounded to
+// whole seconds (minimum 1) since the UI only ever shows "about Ns". The
+// median rather than the mean keeps one user who sat alone overnight from
+// inflating everyone's estimate.
+func estimateWait(samples []float64) *float64 {
+	if len(samples) == 0 {
+		return nil
+	}
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	median := sorted[mid]
+	if len(sorted)%2 == 0 {
+		median = (sorted[mid-1] + sorted[mid]) / 2
+	}
+	est := math.Max(1, math.Round(median))
+	return &est
+}
+
+// runQueueStatusLoop periodically pushes a queue_status event to every client
+// connected to this pod that is still waiting. Each pod only notifies its own
+// sockets, so the work scales with local connections rather than cluster
+// size.
+func runQueueStatusLoop(ctx context.Context) {
+	ticker := time.NewTicker(queueStatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			broadcastQueueStatus(ctx)
+		}
+	}
+}
+
+func broadcastQueueStatus(ctx context.Context) {
+	list := snapshotClients()
+	if len(list) == 0 {
+		return
+	}
+	snap, err := matchMaker.snapshotQueue(ctx)
+	if err != nil {
+		slog.Error("Queue status: snapshot failed", "error", err)
+		return
+	}
+	for _, c := range list {
+		st, ok := snap.status(c.ID)
+		if !ok {
+			continue
+		}
+		if err := c.WriteJSON(Message{Type: "queue_status", Payload: st}); err != nil {
+			slog.Debug("Queue status: write failed", "client_id", c.ID, "error", err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEstimateWait_NoSamples(t *testing.T) {
+	if got := estimateWait(nil); got != nil {
+		t.Fatalf("want nil estimate with no samples, got %v", *got)
+	}
+}
+
+func TestEstimateWait_MedianIgnoresOutlier(t *testing.T) {
+	got := estimateWait([]float64{4, 5, 6, 3600})
+	if got == nil || *got != 6 {
+		t.Fatalf("want median ~6s (5.5 rounded), got %v", got)
+	}
+}
+
+func TestEstimateWait_FloorsAtOneSecond(t *testing.T) {
+	got := estimateWait([]float64{0.05, 0.1, 0.2})
+	if got == nil || *got != 1 {
+		t.Fatalf("want 1s floor, got %v", got)
+	}
+}
+
+func TestSnapshotQueue_PositionsAndEstimate(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	mm.Add(ctx, "alice")
+	mm.Add(ctx, "bob")
+	mm.Add(ctx, "carol")
+	client.LPush(ctx, redisRecentLatency, 4000, 5000, 6000)
+
+	snap, err := mm.snapshotQueue(ctx)
+	if err != nil {
+		t.Fatalf("snapshotQueue: %v", err)
+	}
+
+	st, ok := snap.status("bob")
+	if !ok {
+		t.Fatalf("bob should be waiting")
+	}
+	if st.Waiting != 3 || st.Position != 2 {
+		t.Fatalf("bob: want waiting=3 position=2, got waiting=%d position=%d", st.Waiting, st.Position)
+	}
+	if st.EstimatedWaitSeconds == nil || *st.EstimatedWaitSeconds != 5 {
+		t.Fatalf("estimate: want 5s, got %v", st.EstimatedWaitSeconds)
+	}
+
+	if _, ok := snap.status("dave"); ok {
+		t.Fatalf("dave is not in the queue and should get no status")
+	}
+}
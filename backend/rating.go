@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	// qualityPriorRatings and qualityPriorShare smooth the quality score
+	// toward neutral: a user is scored as if they already had this many
+	// ratings at this share. One thumbs-up from a single partner therefore
+	// barely moves them; a consistent record does.
+	qualityPriorRatings = 10.0
+	qualityPriorShare   = 0.5
+	// qualityWindow is how far back ratings count. Behaviour changes, and
+	// a user shouldn't be held to how calls went a year ago.
+	qualityWindow = 90 * 24 * time.Hour
+	// highQualityThreshold is the smoothed share at which a user counts as
+	// highly rated. With the prior above that takes at least ten thumbs-up,
+	// plus three more for every thumbs-down.
+	highQualityThreshold = 0.75
+)
+
+// Quality tiers. The matchmaker prefers partners in the same tier.
+const (
+	qualityTierHigh     = "high"
+	qualityTierStandard = "standard"
+)
+
+// qualityScore smooths a user's thumbs-up share with the prior.
+func qualityScore(up, down int) float64 {
+	return (float64(up) + qualityPriorRatings*qualityPriorShare) /
+		(float64(up+down) + qualityPriorRatings)
+}
+
+func qualityTier(p Profile) string {
+	if p.Quality >= highQualityThreshold {
+		return qualityTierHigh
+	}
+	return qualityTierStandard
+}
+
+// qualityTierPairLabel is the order-independent tier pair of a match, e.g.
+// "high-standard", for bananatalk_quality_tier_matches_total.
+func qualityTierPairLabel(a, b Profile) string {
+	ta, tb := qualityTier(a), qualityTier(b)
+	if tb < ta {
+		ta, tb = tb, ta
+	}
+	return ta + "-" + tb
+}
+
+// userQuality loads the user's quality score for their profile. Failures
+// fall back to neutral; ratings are a preference, not a constraint.
+func userQuality(ctx context.Context, id int64, sub string) float64 {
+	up, down, err := loadRatingCounts(ctx, id, time.Now().Add(-qualityWindow))
+	if err != nil {
+		slog.Error("Failed to load rating counts", "user_id", sub, "error", err)
+		return qualityPriorShare
+	}
+	return qualityScore(up, down)
+}
+
+// parseRating maps the rate_call rating field to the stored value.
+func parseRating(v any) (int, bool) {
+	switch v {
+	case "up":
+		return 1, true
+	case "down":
+		return -1, true
+	}
+	return 0, false
+}
+
+// rateCall handles a rate_call message:
+//
+//	{ "match_id": "…", "rating": "up" | "down" }
+//
+// The rated user is resolved server-side from the sender's session, and the
+// match ID must be that of the sender's current (or just-ended) match, so a
+// client can only rate someone it was actually paired with. Re-rating the
+// same match replaces the earlier rating. Accepted ratings are acknowledged
+// with a `rating_recorded` event.
+func rateCall(msg Message) {
+	payload, ok := msg.Payload.(map[string]any)
+	if !ok {
+		return
+	}
+	matchID, _ := payload["match_id"].(string)
+	rating, ok := parseRating(payload["rating"])
+	if !ok || matchID == "" {
+		return
+	}
+
+	ctx := context.Background()
+	peer, current := matchMaker.CurrentMatch(ctx, msg.From)
+	if peer == "" || current != matchID {
+		slog.Info("Ignoring rate_call for a match that isn't the sender's", "client_id", msg.From, "match_id", matchID)
+		return
+	}
+	if err := recordRating(ctx, msg.From, peer, matchID, rating); err != nil {
+		slog.Error("Failed to record rating", "client_id", msg.From, "match_id", matchID, "error", err)
+		return
+	}
+	label := "up"
+	if rating < 0 {
+		label = "down"
+	}
+	callRatingsTotal.WithLabelValues(label).Inc()
+
+	clientsMu.Lock()
+	c, ok := clients[msg.From]
+	clientsMu.Unlock()
+	if !ok {
+		return
+	}
+	if err := c.WriteJSON(Message{
+		Type:    "rating_recorded",
+		Payload: map[string]any{"match_id": matchID, "rating": label},
+	}); err != nil {
+		slog.Error("Failed to send rating ack", "client_id", msg.From, "error", err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQualityScore(t *testing.T) {
+	cases := []struct {
+		up, down int
+		wantTier string
+	}{
+		{0, 0, qualityTierStandard},
+		{1, 0, qualityTierStandard},
+		{9, 0, qualityTierStandard},
+		{10, 0, qualityTierHigh},
+		{40, 10, qualityTierHigh},
+		{39, 10, qualityTierStandard},
+		{20, 20, qualityTierStandard},
+	}
+	for _, tc := range cases {
+		q := qualityScore(tc.up, tc.down)
+		if got := qualityTier(Profile{Quality: q}); got != tc.wantTier {
+			t.Fatalf("up=%d down=%d: quality %.3f tier %q, want %q", tc.up, tc.down, q, got, tc.wantTier)
+		}
+	}
+	if q := qualityScore(0, 0); q != qualityPriorShare {
+		t.Fatalf("no ratings should score neutral, got %v", q)
+	}
+}
+
+func TestMatchMaker_PrefersSameQualityTier(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	for _, u := range []struct {
+		id      string
+		quality float64
+	}{
+		{"star1", 0.9},
+		{"plain1", 0.5},
+		{"star2", 0.8},
+		{"plain2", 0.5},
+	} {
+		mm.SetProfile(ctx, u.id, Profile{Quality: u.quality})
+		mm.Add(ctx, u.id)
+	}
+
+	mm.processMatches(ctx)
+
+	for a, b := range map[string]string{"star1": "star2", "plain1": "plain2"} {
+		if peer, _ := client.Get(ctx, sessionKey(a)).Result(); peer != b {
+			t.Fatalf("%s paired with %q, want %q", a, peer, b)
+		}
+	}
+}
+
+func TestMatchMaker_QualityTierIsOnlyAPreference(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	mm.SetProfile(ctx, "star", Profile{Quality: 0.9})
+	mm.Add(ctx, "star")
+	mm.SetProfile(ctx, "plain", Profile{Quality: 0.5})
+	mm.Add(ctx, "plain")
+
+	mm.processMatches(ctx)
+
+	if peer, _ := client.Get(ctx, sessionKey("star")).Result(); peer != "plain" {
+		t.Fatalf("users in different tiers must still be paired when alone, got %q", peer)
+	}
+}
+
+func TestCompleteMatch_SharesMatchID(t *testing.T) {
+	mm, _, _ := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	addWithInterests(ctx, mm, "alice")
+	addWithInterests(ctx, mm, "bob")
+	mm.processMatches(ctx)
+
+	peerA, idA := mm.CurrentMatch(ctx, "alice")
+	peerB, idB := mm.CurrentMatch(ctx, "bob")
+	if peerA != "bob" || peerB != "alice" || idA == "" || idA != idB {
+		t.Fatalf("alice=(%q,%q) bob=(%q,%q): want peers with one shared match ID", peerA, idA, peerB, idB)
+	}
+
+	msgs := readEvents(t, mm, "alice")
+	if len(msgs) != 1 {
+		t.Fatalf("want one match event, got %+v", msgs)
+	}
+	raw, _ := json.Marshal(msgs[0].Payload)
+	var ev MatchEvent
+	_ = json.Unmarshal(raw, &ev)
+	if ev.MatchID != idA {
+		t.Fatalf("match event carries %q, session has %q", ev.MatchID, idA)
+	}
+}
+
+func TestRateCall_RecordsAndReplaces(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+
+	mm, _, _ := newTestMatchMaker(t)
+	prevMM := matchMaker
+	matchMaker = mm
+	t.Cleanup(func() { matchMaker = prevMM })
+
+	_, _, _ = upsertUser(ctx, "rater")
+	ratedID, _, _ := upsertUser(ctx, "rated")
+	mm.SetSession(ctx, "rater", "rated", "match-1", "")
+
+	rate := func(matchID, rating string) {
+		rateCall(Message{Type: "rate_call", From: "rater", Payload: map[string]any{
+			"match_id": matchID, "rating": rating,
+		}})
+	}
+	rate("match-1", "down")
+	rate("match-1", "up")      // replaces the first rating
+	rate("someone-else", "up") // not the rater's match: ignored
+	rate("match-1", "meh")     // invalid: ignored
+
+	up, down, err := loadRatingCounts(ctx, ratedID, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("loadRatingCounts: %v", err)
+	}
+	if up != 1 || down != 0 {
+		t.Fatalf("up=%d down=%d, want 1/0", up, down)
+	}
+}
+
+func TestAdminRatingsDaily(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+
+	a, _, _ := upsertUser(ctx, "a")
+	b, _, _ := upsertUser(ctx, "b")
+	if _, err := db.Exec(ctx,
+		`INSERT INTO call_ratings (rater_id, rated_id, match_id, rating, created_at) VALUES
+		 ($1, $2, 'm1', 1, NOW()),
+		 ($2, $1, 'm1', -1, NOW()),
+		 ($1, $2, 'm2', 1, NOW() - INTERVAL '1 day'),
+		 ($1, $2, 'm3', 1, NOW() - INTERVAL '400 days')`,
+		a, b,
+	); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	adminRatingsDaily(rr, httptest.NewRequest(http.MethodGet, "/admin/api/ratings/daily?days=7", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	var body struct {
+		Items []RatingDay `json:"items"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	var up, down int
+	for _, d := range body.Items {
+		up += d.Up
+		down += d.Down
+	}
+	if up != 2 || down != 1 {
+		t.Fatalf("7-day totals up=%d down=%d, want 2/1 (items %+v)", up, down, body.Items)
+	}
+	if last := body.Items[len(body.Items)-1]; last.Day != time.Now().UTC().Format(time.DateOnly) || last.Up != 1 || last.Down != 1 {
+		t.Fatalf("today = %+v", last)
+	}
+}
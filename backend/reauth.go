@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A socket outlives the token it was opened with unless the client renews
+// it in-band. reauthWarning before the token lapses the client is sent
+// `reauth_required`; it answers with `reauth` carrying a fresh token
+// (usually from /auth/refresh). A socket whose token is reauthGrace past
+// expiry is closed with a policy-violation close frame, as is a banned
+// user's socket as soon as the ban reaches the pod holding it.
+var (
+	reauthWarning = 2 * time.Minute
+	reauthGrace   = 15 * time.Second
+)
+
+// Reasons sent in the close frame when a socket is closed for policy.
+const (
+	closeTokenExpired     = "token_expired"
+	closeAccountSuspended = "account_suspended"
+)
+
+// tokenExpiry returns when a verified token's claims say it lapses.
+func tokenExpiry(claims map[string]any) time.Time {
+	return time.Unix(jwtClaims(claims).unix("exp"), 0)
+}
+
+// setExpiry records when the client's current token lapses and wakes
+// watchTokenExpiry to reschedule.
+func (c *Client) setExpiry(at time.Time) {
+	c.expiresAt.Store(at.Unix())
+	select {
+	case c.reauthed <- struct{}{}:
+	default:
+	}
+}
+
+// closePolicy ends the connection with a policy-violation close frame
+// naming the reason. The read loop then fails and runs the usual cleanup.
+func (c *Client) closePolicy(reason string) {
+	socketPolicyClosesTotal.WithLabelValues(reason).Inc()
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	if err := c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait)); err != nil {
+		slog.Debug("Failed to send close frame", "client_id", c.ID, "error", err)
+	}
+	_ = c.Conn.Close()
+}
+
+// watchTokenExpiry warns the client before its token lapses and closes the
+// socket once it has, unless a reauth moved the expiry on. It returns when
+// done is closed.
+func watchTokenExpiry(c *Client, done <-chan struct{}) {
+	var warned int64
+	for {
+		exp := time.Unix(c.expiresAt.Load(), 0)
+		now := time.Now()
+		var wait time.Duration
+		switch warnAt, closeAt := exp.Add(-reauthWarning), exp.Add(reauthGrace); {
+		case now.Before(warnAt):
+			wait = warnAt.Sub(now)
+		case now.Before(closeAt):
+			if warned != exp.Unix() {
+				warned = exp.Unix()
+				if err := c.WriteJSON(Message{Type: "reauth_required", Payload: map[string]any{
+					"expires_at": exp.Unix(),
+				}}); err != nil {
+					slog.Warn("Failed to send reauth_required", "client_id", c.ID, "error", err)
+				}
+			}
+			wait = closeAt.Sub(now)
+		default:
+			slog.Info("Closing socket with expired token", "client_id", c.ID)
+			c.closePolicy(closeTokenExpired)
+			return
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-done:
+			t.Stop()
+			return
+		case <-c.reauthed:
+			t.Stop()
+		case <-t.C:
+		}
+	}
+}
+
+// reauthPayload is the payload of a client's `reauth` message.
+type reauthPayload struct {
+	Token string `json:"token"`
+}
+
+// handleReauth renews the client's token from a `reauth` message. The new
+// token must be for the same user. A refused token is answered with
+// `reauth_failed` and leaves the current expiry alone, so the client may
+// retry until the socket is closed; a banned user is disconnected.
+func handleReauth(ctx context.Context, c *Client, msg Message) {
+	var p reauthPayload
+	if raw, err := json.Marshal(msg.Payload); err == nil {
+		_ = json.Unmarshal(raw, &p)
+	}
+	sub, claims, code, verr := verifyTokenClaims(ctx, p.Token)
+	if code == "" && sub != c.ID {
+		code = tokenErrInvalid
+		slog.Warn("Reauth token is for another user", "client_id", c.ID)
+	}
+	if code != "" {
+		logTokenFailure(code, verr, p.Token, c.Conn.RemoteAddr().String())
+		socketReauthsTotal.WithLabelValues("failed").Inc()
+		if err := c.WriteJSON(Message{Type: "reauth_failed", Payload: errorResponse{Code: code, Error: tokenErrMessage(code)}}); err != nil {
+			slog.Warn("Failed to send reauth_failed", "client_id", c.ID, "error", err)
+		}
+		return
+	}
+	if banned, err := isUserBanned(ctx, sub); err != nil {
+		slog.Error("Reauth: failed to check ban status", "client_id", c.ID, "error", err)
+	} else if banned {
+		slog.Info("Closing banned user's socket on reauth", "client_id", c.ID)
+		c.closePolicy(closeAccountSuspended)
+		return
+	}
+
+	exp := tokenExpiry(claims)
+	c.setExpiry(exp)
+	socketReauthsTotal.WithLabelValues("ok").Inc()
+	if err := c.WriteJSON(Message{Type: "reauth_ok", Payload: map[string]any{"expires_at": exp.Unix()}}); err != nil {
+		slog.Warn("Failed to send reauth_ok", "client_id", c.ID, "error", err)
+	}
+}
+
+// suspendClient closes a just-banned user's socket on whichever pod holds
+// it: the account_suspended event travels through their event stream, and
+// the holding pod closes the socket on receipt (see suspendOnEvent).
+func suspendClient(ctx context.Context, sub string) {
+	if err := matchMaker.Deliver(ctx, sub, Message{Type: closeAccountSuspended}); err != nil {
+		slog.Error("Failed to deliver suspension", "user_id", sub, "error", err)
+		// Still sever a socket held by this pod.
+		disconnectClient(sub)
+	}
+}
+
+// suspendOnEvent handles an account_suspended event for the client. The
+// ban is re-checked so a stale event, for a ban lifted before it arrived,
+// does not cut off the new connection; if the check fails the socket is
+// closed anyway.
+func suspendOnEvent(ctx context.Context, c *Client) {
+	if banned, err := isUserBanned(ctx, c.ID); err == nil && !banned {
+		slog.Info("Ignoring suspension for a user no longer banned", "client_id", c.ID)
+		return
+	} else if err != nil {
+		slog.Error("Failed to confirm suspension", "client_id", c.ID, "error", err)
+	}
+	slog.Info("Closing suspended user's socket", "client_id", c.ID)
+	c.closePolicy(closeAccountSuspended)
+}
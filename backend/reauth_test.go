@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// socketPair upgrades a test connection and returns the server's Client,
+// with its token lapsing at exp, and the dialled client side. Reauth
+// messages the client sends are handled as in handleConnections.
+func socketPair(t *testing.T, id string, exp time.Time) (*Client, *websocket.Conn) {
+	t.Helper()
+	ready := make(chan *Client, 1)
+	stopped := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := &Client{ID: id, Conn: conn, reauthed: make(chan struct{}, 1)}
+		c.expiresAt.Store(exp.Unix())
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			defer close(stopped)
+			watchTokenExpiry(c, done)
+		}()
+		ready <- c
+		for {
+			var msg Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if msg.Type == "reauth" {
+				handleReauth(context.Background(), c, msg)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	// The watcher reads package settings tests override, so it must be gone
+	// before their cleanups restore them.
+	t.Cleanup(func() {
+		_ = conn.Close()
+		<-stopped
+	})
+	return <-ready, conn
+}
+
+func shortReauthWindow(t *testing.T, warning, grace time.Duration) {
+	prevWarning, prevGrace := reauthWarning, reauthGrace
+	reauthWarning, reauthGrace = warning, grace
+	t.Cleanup(func() { reauthWarning, reauthGrace = prevWarning, prevGrace })
+}
+
+func readMessage(t *testing.T, conn *websocket.Conn) Message {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg Message
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return msg
+}
+
+func TestWatchTokenExpiry_WarnsThenCloses(t *testing.T) {
+	shortReauthWindow(t, time.Hour, time.Second)
+	_, conn := socketPair(t, "user-1", time.Now())
+
+	if msg := readMessage(t, conn); msg.Type != "reauth_required" {
+		t.Fatalf("want reauth_required, got %+v", msg)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.ClosePolicyViolation || ce.Text != closeTokenExpired {
+		t.Fatalf("want a policy close for the expired token, got %v", err)
+	}
+}
+
+func TestHandleReauth_RefusesBadTokens(t *testing.T) {
+	shortReauthWindow(t, time.Minute, time.Second)
+	useSessionKeys(t, "k1="+testSessionKey(1))
+	c, conn := socketPair(t, "user-1", time.Now().Add(time.Hour))
+
+	other, _ := issueAccessToken("user-2", time.Now())
+	for _, token := range []string{"garbage", other} {
+		if err := conn.WriteJSON(Message{Type: "reauth", Payload: map[string]any{"token": token}}); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		msg := readMessage(t, conn)
+		p, _ := msg.Payload.(map[string]any)
+		if msg.Type != "reauth_failed" || p["code"] != tokenErrInvalid {
+			t.Fatalf("reauth with %.10s…: got %+v", token, msg)
+		}
+	}
+	if got := time.Unix(c.expiresAt.Load(), 0); time.Until(got) < 59*time.Minute {
+		t.Fatalf("a refused reauth must not change the expiry, got %v", got)
+	}
+}
+
+func TestHandleReauth_ExtendsExpiry(t *testing.T) {
+	setupTestDB(t)
+	shortReauthWindow(t, time.Hour, time.Second)
+	useSessionKeys(t, "k1="+testSessionKey(1))
+	_, conn := socketPair(t, "user-1", time.Now().Add(time.Minute))
+
+	if msg := readMessage(t, conn); msg.Type != "reauth_required" {
+		t.Fatalf("want reauth_required, got %+v", msg)
+	}
+	fresh, _ := issueAccessToken("user-1", time.Now())
+	if err := conn.WriteJSON(Message{Type: "reauth", Payload: map[string]any{"token": fresh}}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	msg := readMessage(t, conn)
+	p, _ := msg.Payload.(map[string]any)
+	if exp, _ := p["expires_at"].(float64); msg.Type != "reauth_ok" || int64(exp) <= time.Now().Add(time.Minute).Unix() {
+		t.Fatalf("want reauth_ok with the new expiry, got %+v", msg)
+	}
+	// Still inside the warning window for the new token, so the client is
+	// warned again rather than disconnected.
+	if msg := readMessage(t, conn); msg.Type != "reauth_required" {
+		t.Fatalf("want a fresh reauth_required, got %+v", msg)
+	}
+
+	// A ban discovered on reauth closes the socket.
+	id, _, _ := upsertUser(context.Background(), "user-1")
+	if _, _, _, err := banUser(context.Background(), id, Ban{Source: banSourceAdmin}); err != nil {
+		t.Fatalf("banUser: %v", err)
+	}
+	_ = conn.WriteJSON(Message{Type: "reauth", Payload: map[string]any{"token": fresh}})
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.ClosePolicyViolation || ce.Text != closeAccountSuspended {
+		t.Fatalf("want a policy close for the ban, got %v", err)
+	}
+}
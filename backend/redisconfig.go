@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisOptionsFromEnv builds client options for the three supported
+// deployments. redis.NewUniversalClient picks the client type from them:
+//
+//   - REDIS_MASTER_NAME set: Sentinel failover; REDIS_ADDR lists sentinels.
+//   - REDIS_CLUSTER=true, or several REDIS_ADDR entries: Redis Cluster;
+//     REDIS_ADDR lists seed nodes.
+//   - Otherwise: a single node at REDIS_ADDR.
+func redisOptionsFromEnv() *redis.UniversalOptions {
+	var addrs []string
+	for _, a := range strings.Split(getEnv("REDIS_ADDR", "localhost:6379"), ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	opts := &redis.UniversalOptions{
+		Addrs:            addrs,
+		Password:         os.Getenv("REDIS_PASSWORD"),
+		MasterName:       os.Getenv("REDIS_MASTER_NAME"),
+		SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+		IsClusterMode:    strings.EqualFold(os.Getenv("REDIS_CLUSTER"), "true"),
+	}
+	if dbStr := os.Getenv("REDIS_DB"); dbStr != "" {
+		if db, err := strconv.Atoi(dbStr); err == nil {
+			opts.DB = db
+		}
+	}
+	return opts
+}
+
+// redisMode names the topology redis.NewUniversalClient will choose for
+// opts, for logging.
+func redisMode(opts *redis.UniversalOptions) string {
+	switch {
+	case opts.MasterName != "":
+		return "sentinel"
+	case opts.IsClusterMode || len(opts.Addrs) > 1:
+		return "cluster"
+	default:
+		return "single"
+	}
+}
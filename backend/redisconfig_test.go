@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisOptionsFromEnv(t *testing.T) {
+	cases := []struct {
+		name     string
+		env      map[string]string
+		wantMode string
+		wantAddr []string
+	}{
+		{"default", nil, "single", []string{"localhost:6379"}},
+		{"single", map[string]string{"REDIS_ADDR": "redis:6379"}, "single", []string{"redis:6379"}},
+		{"sentinel", map[string]string{
+			"REDIS_ADDR":        "s1:26379, s2:26379,s3:26379",
+			"REDIS_MASTER_NAME": "mymaster",
+		}, "sentinel", []string{"s1:26379", "s2:26379", "s3:26379"}},
+		{"cluster seeds", map[string]string{"REDIS_ADDR": "n1:6379,n2:6379"}, "cluster", []string{"n1:6379", "n2:6379"}},
+		{"cluster endpoint", map[string]string{
+			"REDIS_ADDR":    "cfg.example:6379",
+			"REDIS_CLUSTER": "true",
+		}, "cluster", []string{"cfg.example:6379"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, k := range []string{"REDIS_ADDR", "REDIS_MASTER_NAME", "REDIS_CLUSTER", "REDIS_DB"} {
+				t.Setenv(k, tc.env[k])
+			}
+			opts := redisOptionsFromEnv()
+			if got := redisMode(opts); got != tc.wantMode {
+				t.Fatalf("mode = %q, want %q", got, tc.wantMode)
+			}
+			if !reflect.DeepEqual(opts.Addrs, tc.wantAddr) {
+				t.Fatalf("addrs = %v, want %v", opts.Addrs, tc.wantAddr)
+			}
+
+			client := redis.NewUniversalClient(opts)
+			defer client.Close()
+			_, isCluster := client.(*redis.ClusterClient)
+			if isCluster != (tc.wantMode == "cluster") {
+				t.Fatalf("NewUniversalClient returned %T for mode %s", client, tc.wantMode)
+			}
+		})
+	}
+}
@@ -21,7 +21,7 @@ const (
 var storageClient Storage
 
 // reportHandler accepts multipart form uploads of a screenshot plus the
-// reported user's google_sub and a reason string. The screenshot is stored
+// reported user's peer handle and a reason string. The screenshot is stored
 // in object storage and a row is persisted in the reports table. If the
 // reported user crosses the 24-hour threshold they are auto-banned.
 func reportHandler(w http.ResponseWriter, r *http.Request) {
@@ -54,12 +54,19 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	reportedSub := strings.TrimSpace(r.FormValue("reported_user_id"))
+	// reported_user_id is the peer handle from the match event; the
+	// reported user's own ID never reaches the client.
+	reportedHandle := strings.TrimSpace(r.FormValue("reported_user_id"))
 	reason := strings.TrimSpace(r.FormValue("reason"))
-	if reportedSub == "" {
+	if reportedHandle == "" {
 		writeError(w, http.StatusBadRequest, "missing_reported_user", "reported_user_id is required")
 		return
 	}
+	reportedSub, ok := matchMaker.ResolvePeer(ctx, reporterSub, reportedHandle)
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown_peer", "reported_user_id is not a recent match")
+		return
+	}
 	if reportedSub == reporterSub {
 		writeError(w, http.StatusBadRequest, "self_report", "cannot report yourself")
 		return
@@ -91,18 +98,17 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	reportedID, err := getUserIDByGoogleSub(ctx, reportedSub)
+	reportedID, err := getUserIDBySub(ctx, reportedSub)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Every matched user has a row from connecting, so the reported user
+		// has deleted their account since.
+		writeError(w, http.StatusNotFound, "unknown_peer", "reported_user_id is not a recent match")
+		return
+	}
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			// Reported user has never connected; create a stub record so we
-			// can still track reports against them.
-			reportedID, _, err = upsertUser(ctx, reportedSub)
-		}
-		if err != nil {
-			slog.Error("report: lookup reported", "error", err)
-			writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
-			return
-		}
+		slog.Error("report: lookup reported", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
 	}
 
 	key, err := screenshotKey()
@@ -135,12 +141,8 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 
 	if banned {
 		slog.Info("Auto-banned user", "reported_sub", reportedSub, "reported_id", reportedID)
-		// Sever any active WebSocket the banned user has open.
-		clientsMu.Lock()
-		if c, ok := clients[reportedSub]; ok {
-			_ = c.Conn.Close()
-		}
-		clientsMu.Unlock()
+		// Sever any active WebSocket the banned user has open, on any pod.
+		suspendClient(ctx, reportedSub)
 	}
 
 	bannedLabel := "false"
@@ -161,7 +163,7 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // authenticate extracts and validates the bearer token from the request.
-// Returns the google_sub of the authenticated user.
+// Returns the principal ID (see principalID) of the authenticated user.
 func authenticate(ctx context.Context, r *http.Request) (string, bool) {
 	token := bearerToken(r)
 	sub, code, verr := verifyToken(ctx, token)
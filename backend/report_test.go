@@ -22,7 +22,7 @@ func setupTestDB(t *testing.T) {
 	if err != nil {
 		t.Fatalf("initDB: %v", err)
 	}
-	if _, err := pool.Exec(ctx, `TRUNCATE reports, blocks, users RESTART IDENTITY CASCADE`); err != nil {
+	if _, err := pool.Exec(ctx, `TRUNCATE reports, blocks, users, account_deletions RESTART IDENTITY CASCADE`); err != nil {
 		t.Fatalf("truncate: %v", err)
 	}
 	db = pool
@@ -102,13 +102,16 @@ func TestRecordReport_AutoBansAfterThreshold(t *testing.T) {
 		}
 	}
 
-	var bannedAt *string
-	if err := db.QueryRow(ctx, `SELECT banned_at::text FROM users WHERE id = $1`, reported).Scan(&bannedAt); err != nil {
+	var bannedAt, source *string
+	if err := db.QueryRow(ctx, `SELECT banned_at::text, ban_source FROM users WHERE id = $1`, reported).Scan(&bannedAt, &source); err != nil {
 		t.Fatalf("select banned_at: %v", err)
 	}
 	if bannedAt == nil {
 		t.Fatalf("banned_at should be set after Threshold+1 reports")
 	}
+	if source == nil || *source != banSourceAuto {
+		t.Fatalf("ban_source = %v, want %q", source, banSourceAuto)
+	}
 
 	// And isUserBanned should now report true.
 	wasBanned, err := isUserBanned(ctx, "reported-user-sub")
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// defaultPriorityRequeueWindow is how short a match must have been for a
+	// user whose partner skipped them to be requeued in the priority lane.
+	// A partner who leaves after a real conversation is a normal outcome.
+	defaultPriorityRequeueWindow = 10 * time.Second
+	// maxPriorityRequeues caps how many priority requeues a user is granted
+	// per priorityGrantPeriod. Without it two accounts could skip each other
+	// in a loop and live permanently at the front of the line.
+	maxPriorityRequeues = 3
+	priorityGrantPeriod = 10 * time.Minute
+	// connectGiveUpWait is how long a call must have been given to connect
+	// before the user who abandons it still counts as stuck rather than as
+	// skipping. A few seconds covers ICE on a bad network.
+	connectGiveUpWait = 5 * time.Second
+)
+
+// How a user left a match, recorded on their partner's match state.
+const (
+	leaveSkip       = "skip"
+	leaveDisconnect = "disconnect"
+)
+
+// Reasons a requeue went to the priority lane, or why it didn't. These are
+// the reason label of bananatalk_requeues_total.
+const (
+	requeuePeerSkipped      = "peer_skipped"
+	requeuePeerDisconnected = "peer_disconnected"
+	requeueNeverConnected   = "never_connected"
+	requeueLimited          = "limited"
+	requeueNone             = "none"
+)
+
+// priorityRequeueWindow is read from PRIORITY_REQUEUE_WINDOW in main. Zero
+// disables the instant-skip rule; disconnects and failed calls still count.
+var priorityRequeueWindow = defaultPriorityRequeueWindow
+
+// matchState is a user's view of their current or most recent match, kept
+// in the matchKey hash. Left is set when the user themselves moved on;
+// PeerLeft when their partner did so first, with how. Connected is set once
+// either side reported media flowing (connect_metrics).
+type matchState struct {
+	ID        string
+	Peer      string
+	StartedAt time.Time
+	Left      string
+	PeerLeft  string
+	Connected bool
+}
+
+func (m *MatchMaker) loadMatchState(ctx context.Context, userID string) (matchState, error) {
+	pipe := m.rdb.Pipeline()
+	peerCmd := pipe.Get(ctx, sessionKey(userID))
+	stateCmd := pipe.HGetAll(ctx, matchKey(userID))
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return matchState{}, err
+	}
+	h := stateCmd.Val()
+	st := matchState{
+		ID:        h["id"],
+		Peer:      peerCmd.Val(),
+		Left:      h["left"],
+		PeerLeft:  h["peer_left"],
+		Connected: h["connected"] == "1",
+	}
+	if ms, err := strconv.ParseInt(h["started_at"], 10, 64); err == nil {
+		st.StartedAt = time.UnixMilli(ms)
+	}
+	return st, nil
+}
+
+// setMatchFieldScript sets a match-state field only if the hash still
+// describes the given match and the field is not already set. A partner's
+// state may have moved on to a new match by the time we write to it.
+var setMatchFieldScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'id') ~= ARGV[1] then
+    return 0
+end
+return redis.call('HSETNX', KEYS[1], ARGV[2], ARGV[3])
+`)
+
+// setMatchField reports whether the field was newly set.
+func (m *MatchMaker) setMatchField(ctx context.Context, userID, matchID, field, value string) bool {
+	n, err := setMatchFieldScript.Run(ctx, m.rdb, []string{matchKey(userID)}, matchID, field, value).Int()
+	if err != nil {
+		slog.Error("MatchMaker: failed to update match state", "user_id", userID, "field", field, "error", err)
+	}
+	return n == 1
+}
+
+// MarkConnected records that the user's current call got media flowing.
+// Both sides are marked, since either one reporting it proves the call
+// connected. The first report also counts towards the pair's connect
+// outcomes (see latency.go).
+func (m *MatchMaker) MarkConnected(ctx context.Context, userID string) {
+	st, err := m.loadMatchState(ctx, userID)
+	if err != nil || st.ID == "" {
+		return
+	}
+	first := m.setMatchField(ctx, userID, st.ID, "connected", "1")
+	if st.Peer != "" {
+		m.setMatchField(ctx, st.Peer, st.ID, "connected", "1")
+		if first {
+			m.recordConnectOutcome(ctx, userID, st.Peer, true)
+		}
+	}
+}
+
+// leaveMatch records that the user moved on from their current match, for
+// the given reason. If their partner hasn't left yet, the partner's state
+// notes that they were left behind and, on a disconnect, the partner is sent
+// a bye so their client ends the call. It returns the state as it was before
+// leaving, and false if there was no match to leave.
+func (m *MatchMaker) leaveMatch(ctx context.Context, userID, reason string) (matchState, bool) {
+	st, err := m.loadMatchState(ctx, userID)
+	if err != nil {
+		slog.Error("MatchMaker: failed to read match state", "user_id", userID, "error", err)
+		return matchState{}, false
+	}
+	if st.ID == "" || st.Left != "" {
+		return st, false
+	}
+	m.setMatchField(ctx, userID, st.ID, "left", reason)
+	if st.PeerLeft != "" || st.Peer == "" {
+		return st, true
+	}
+	m.setMatchField(ctx, st.Peer, st.ID, "peer_left", reason)
+	// The first to leave a call that was given time to connect but never
+	// did records it as a failed connect.
+	if !st.Connected && !st.StartedAt.IsZero() && time.Since(st.StartedAt) >= connectGiveUpWait {
+		m.recordConnectOutcome(ctx, userID, st.Peer, false)
+	}
+	if reason == leaveDisconnect && m.Session(ctx, st.Peer) == userID {
+		if err := m.Deliver(ctx, st.Peer, Message{Type: "bye", From: m.PeerHandle(ctx, st.Peer)}); err != nil {
+			slog.Error("MatchMaker: failed to notify abandoned peer", "client_id", st.Peer, "error", err)
+		}
+	}
+	return st, true
+}
+
+// priorityReason decides whether a user leaving the given match has earned
+// the priority lane, and returns the reason label. Whoever leaves a working
+// call first never has: a skipper must not be rewarded for skipping. Only a
+// call that never connected, after being given connectGiveUpWait, lets the
+// first to leave in too.
+func priorityReason(st matchState, now time.Time) string {
+	lasted := now.Sub(st.StartedAt)
+	if st.StartedAt.IsZero() {
+		lasted = 0
+	}
+	switch {
+	case st.PeerLeft == leaveDisconnect:
+		return requeuePeerDisconnected
+	case st.PeerLeft == leaveSkip && !st.Connected:
+		return requeueNeverConnected
+	case st.PeerLeft == leaveSkip && priorityRequeueWindow > 0 && lasted < priorityRequeueWindow:
+		return requeuePeerSkipped
+	case st.PeerLeft == "" && !st.Connected && lasted >= connectGiveUpWait:
+		return requeueNeverConnected
+	}
+	return ""
+}
+
+// grantPriority spends one of the user's priority requeues for the current
+// period, reporting false once they are used up.
+func (m *MatchMaker) grantPriority(ctx context.Context, userID string) bool {
+	key := priorityGrantsKey(userID)
+	pipe := m.rdb.TxPipeline()
+	n := pipe.Incr(ctx, key)
+	pipe.ExpireNX(ctx, key, priorityGrantPeriod)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("MatchMaker: failed to count priority requeue", "user_id", userID, "error", err)
+		return false
+	}
+	return n.Val() <= maxPriorityRequeues
+}
+
+// Requeue puts a user who asked for their next match (next_match) back in
+// the queue. Users whose previous match ended on them (the partner skipped
+// within priorityRequeueWindow or disconnected, or the call never
+// connected) go to the priority lane and are paired ahead of fresh
+// entrants, within their allowance. A user who is already queued is left
+// where they are, so repeated next_match messages cannot reset anyone's
+// place in line.
+func (m *MatchMaker) Requeue(ctx context.Context, userID string) {
+	if m.isQueued(ctx, userID) {
+		return
+	}
+	reason := requeueNone
+	if st, ok := m.leaveMatch(ctx, userID, leaveSkip); ok {
+		if r := priorityReason(st, time.Now()); r != "" {
+			reason = r
+			if !m.grantPriority(ctx, userID) {
+				slog.Info("Priority requeue allowance used up", "client_id", userID, "reason", r)
+				reason = requeueLimited
+			}
+		}
+	}
+	priority := reason != requeueNone && reason != requeueLimited
+	requeuesTotal.WithLabelValues(laneLabel(priority), reason).Inc()
+	m.add(ctx, userID, priority, reason)
+}
+
+// laneLabel is the lane label of the requeue and lane-match metrics.
+func laneLabel(priority bool) string {
+	if priority {
+		return "priority"
+	}
+	return "regular"
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// startMatch pairs a and b as if the matchmaker had, with the match having
+// started `ago`, and optionally with media flowing.
+func startMatch(t *testing.T, mm *MatchMaker, client *redis.Client, a, b string, ago time.Duration, connected bool) {
+	t.Helper()
+	ctx := context.Background()
+	pairPeers(ctx, mm, a, b, "m-"+a+"-"+b)
+	started := time.Now().Add(-ago).UnixMilli()
+	for _, id := range []string{a, b} {
+		client.HSet(ctx, matchKey(id), "started_at", strconv.FormatInt(started, 10))
+	}
+	if connected {
+		mm.MarkConnected(ctx, a)
+	}
+}
+
+func inPriorityLane(t *testing.T, client *redis.Client, id string) bool {
+	t.Helper()
+	ids, err := client.LRange(context.Background(), priorityQueueKey(0), 0, -1).Result()
+	if err != nil {
+		t.Fatalf("LRange: %v", err)
+	}
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRequeue_InstantSkipPrioritizesOnlyTheVictim(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	startMatch(t, mm, client, "alice", "bob", 2*time.Second, true)
+	mm.Requeue(ctx, "bob") // bob skips
+	mm.Requeue(ctx, "alice")
+
+	if inPriorityLane(t, client, "bob") {
+		t.Fatalf("the skipper must not get the priority lane")
+	}
+	if !inPriorityLane(t, client, "alice") {
+		t.Fatalf("the skipped user should be in the priority lane")
+	}
+	if !mm.isQueued(ctx, "alice") || !mm.isQueued(ctx, "bob") {
+		t.Fatalf("both users should be queued")
+	}
+}
+
+func TestRequeue_SkipAfterRealCallIsRegular(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	startMatch(t, mm, client, "alice", "bob", time.Minute, true)
+	mm.Requeue(ctx, "bob")
+	mm.Requeue(ctx, "alice")
+
+	if inPriorityLane(t, client, "alice") {
+		t.Fatalf("a skip after a minute-long call should not earn priority")
+	}
+}
+
+func TestRequeue_PeerDisconnect(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	startMatch(t, mm, client, "alice", "bob", time.Minute, true)
+	mm.leaveMatch(ctx, "bob", leaveDisconnect)
+
+	msgs := readEvents(t, mm, "alice")
+	if len(msgs) != 1 || msgs[0].Type != "bye" || msgs[0].From != mm.PeerHandle(ctx, "alice") {
+		t.Fatalf("alice should be sent a bye from bob, got %+v", msgs)
+	}
+	mm.Requeue(ctx, "alice")
+	if !inPriorityLane(t, client, "alice") {
+		t.Fatalf("a user whose partner disconnected should be in the priority lane")
+	}
+}
+
+func TestRequeue_NeverConnected(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	// Bailing on a call before it had a chance to connect is a skip.
+	startMatch(t, mm, client, "alice", "bob", time.Second, false)
+	mm.Requeue(ctx, "alice")
+	if inPriorityLane(t, client, "alice") {
+		t.Fatalf("leaving before connectGiveUpWait should not earn priority")
+	}
+	mm.Remove(ctx, "alice")
+
+	// Giving up on a call that never connected is not.
+	startMatch(t, mm, client, "carol", "dave", connectGiveUpWait+time.Second, false)
+	mm.Requeue(ctx, "carol")
+	mm.Requeue(ctx, "dave")
+	if !inPriorityLane(t, client, "carol") || !inPriorityLane(t, client, "dave") {
+		t.Fatalf("both sides of a call that never connected should be prioritized")
+	}
+}
+
+func TestRequeue_PriorityIsRateLimited(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	for i := range maxPriorityRequeues + 1 {
+		peer := "peer" + strconv.Itoa(i)
+		startMatch(t, mm, client, "alice", peer, time.Second, true)
+		mm.Requeue(ctx, peer)
+		mm.Requeue(ctx, "alice")
+		want := i < maxPriorityRequeues
+		if got := inPriorityLane(t, client, "alice"); got != want {
+			t.Fatalf("requeue %d: priority=%v, want %v", i, got, want)
+		}
+		mm.Remove(ctx, "alice")
+		mm.Remove(ctx, peer)
+	}
+}
+
+func TestRequeue_IgnoredWhileQueued(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	mm.Add(ctx, "alice")
+	mm.Requeue(ctx, "alice")
+	if n := client.LLen(ctx, queueKey(0)).Val() + client.LLen(ctx, priorityQueueKey(0)).Val(); n != 1 {
+		t.Fatalf("queued user requeued again: %d entries", n)
+	}
+}
+
+func TestMatchMaker_PriorityLanePairedFirst(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	for _, id := range []string{"fresh1", "fresh2"} {
+		mm.SetProfile(ctx, id, Profile{})
+		mm.Add(ctx, id)
+	}
+	mm.SetProfile(ctx, "victim", Profile{})
+	mm.add(ctx, "victim", true, requeuePeerSkipped)
+
+	snap, err := mm.snapshotQueue(ctx)
+	if err != nil {
+		t.Fatalf("snapshotQueue: %v", err)
+	}
+	if st, _ := snap.status("victim"); st.Position != 1 || st.Waiting != 3 {
+		t.Fatalf("victim status = %+v, want position 1 of 3", st)
+	}
+
+	mm.processMatches(ctx)
+
+	if peer, _ := client.Get(ctx, sessionKey("victim")).Result(); peer != "fresh1" {
+		t.Fatalf("victim paired with %q, want fresh1", peer)
+	}
+	if client.LLen(ctx, priorityQueueKey(0)).Val() != 0 {
+		t.Fatalf("claimed priority user left in the lane")
+	}
+	if !mm.isQueued(ctx, "fresh2") {
+		t.Fatalf("fresh2 should still be waiting")
+	}
+}
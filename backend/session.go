@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// sessionIssuer is the iss of the access tokens this backend signs.
+	sessionIssuer = "bananatalk"
+
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+	// minSessionKeyBytes is the shortest HS256 secret accepted; shorter
+	// than the hash output weakens the MAC.
+	minSessionKeyBytes = 32
+
+	// authRequestsPerMinute caps /auth/login and /auth/refresh calls per
+	// client IP. A well-behaved app refreshes every few minutes at most.
+	authRequestsPerMinute = 20
+)
+
+var (
+	// accessTokenTTL and refreshTokenTTL are read from ACCESS_TOKEN_TTL and
+	// REFRESH_TOKEN_TTL in main.
+	accessTokenTTL  = defaultAccessTokenTTL
+	refreshTokenTTL = defaultRefreshTokenTTL
+	// sessionKeys signs and verifies access tokens. Set in main from
+	// SESSION_SIGNING_KEYS; nil disables /auth/login and /auth/refresh.
+	sessionKeys *sessionKeyring
+	authLimiter *ipRateLimiter
+)
+
+// Sentinel errors from rotateRefreshToken, mapped to response codes by
+// refreshHandler.
+var (
+	errRefreshInvalid = errors.New("refresh token not found or revoked")
+	errRefreshExpired = errors.New("refresh token expired")
+	errRefreshReused  = errors.New("refresh token reused")
+	errRefreshBanned  = errors.New("user banned")
+)
+
+// sessionKeyring holds the HS256 secrets access tokens are signed with, by
+// kid. New tokens are signed with the active key; the others still verify,
+// so a key can be rotated out without logging everybody out.
+type sessionKeyring struct {
+	active string
+	keys   map[string][]byte
+}
+
+// parseSessionKeys parses SESSION_SIGNING_KEYS: comma-separated
+// kid=base64-secret pairs, the first of which signs new tokens.
+func parseSessionKeys(v string) (*sessionKeyring, error) {
+	k := &sessionKeyring{keys: make(map[string][]byte)}
+	for _, pair := range strings.Split(v, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kid, b64, ok := strings.Cut(pair, "=")
+		if !ok || kid == "" {
+			return nil, fmt.Errorf("session key %q: want kid=base64-secret", pair)
+		}
+		secret, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, fmt.Errorf("session key %q: %w", kid, err)
+		}
+		if len(secret) < minSessionKeyBytes {
+			return nil, fmt.Errorf("session key %q: secret must be at least %d bytes", kid, minSessionKeyBytes)
+		}
+		if _, dup := k.keys[kid]; dup {
+			return nil, fmt.Errorf("session key %q listed twice", kid)
+		}
+		if k.active == "" {
+			k.active = kid
+		}
+		k.keys[kid] = secret
+	}
+	if k.active == "" {
+		return nil, errors.New("no session keys")
+	}
+	return k, nil
+}
+
+// sign returns a compact HS256 JWS of claims under the active key.
+func (k *sessionKeyring) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: "HS256", Kid: k.active})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	return signingInput + "." + enc.EncodeToString(k.mac(k.active, signingInput)), nil
+}
+
+func (k *sessionKeyring) mac(kid, signingInput string) []byte {
+	h := hmac.New(sha256.New, k.keys[kid])
+	h.Write([]byte(signingInput))
+	return h.Sum(nil)
+}
+
+// verify checks a token's signature under the key its kid names and returns
+// its claims.
+func (k *sessionKeyring) verify(token string) (jwtClaims, error) {
+	header, signingInput, sig, err := splitJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("jwt: unsupported alg %q", header.Alg)
+	}
+	if _, ok := k.keys[header.Kid]; !ok {
+		return nil, errUnknownKey
+	}
+	if !hmac.Equal(sig, k.mac(header.Kid, signingInput)) {
+		return nil, errors.New("jwt: signature mismatch")
+	}
+	return parseJWTClaims(token)
+}
+
+// issueAccessToken signs a short-lived access token for sub.
+func issueAccessToken(sub string, now time.Time) (string, error) {
+	return sessionKeys.sign(map[string]any{
+		"iss": sessionIssuer,
+		"sub": sub,
+		"iat": now.Unix(),
+		"exp": now.Add(accessTokenTTL).Unix(),
+	})
+}
+
+// verifySessionToken validates an access token issued by issueAccessToken,
+// with the same tokenErr* codes as verifyTokenClaims.
+func verifySessionToken(token string) (sub string, claims map[string]any, code string, err error) {
+	if sessionKeys == nil {
+		return "", nil, tokenErrInvalid, errors.New("session tokens are not configured")
+	}
+	c, err := sessionKeys.verify(token)
+	if err != nil {
+		return "", nil, tokenErrInvalid, err
+	}
+	if iss := c.str("iss"); iss != sessionIssuer {
+		return "", nil, tokenErrInvalid, fmt.Errorf("session token: unexpected issuer %q", iss)
+	}
+	if c.unix("exp") <= time.Now().Unix() {
+		return "", nil, tokenErrExpired, nil
+	}
+	if c.str("sub") == "" {
+		return "", nil, tokenErrNoSub, nil
+	}
+	return c.str("sub"), c, "", nil
+}
+
+// newRefreshToken returns a random opaque refresh token and the hash it is
+// stored under. Only the hash is persisted, so a database leak does not
+// leak usable tokens.
+func newRefreshToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashRefreshToken(token), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newTokenFamily returns the ID shared by a login's chain of rotated
+// refresh tokens; reuse of any one of them revokes the whole chain.
+func newTokenFamily() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// tokenResponse is the body of a successful /auth/login or /auth/refresh.
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+	UserID           string `json:"user_id"`
+}
+
+func writeTokenResponse(w http.ResponseWriter, sub, access, refresh string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(tokenResponse{
+		AccessToken:      access,
+		TokenType:        "Bearer",
+		ExpiresIn:        int64(accessTokenTTL.Seconds()),
+		RefreshToken:     refresh,
+		RefreshExpiresIn: int64(refreshTokenTTL.Seconds()),
+		UserID:           sub,
+	})
+}
+
+// authPreamble runs the checks shared by both /auth endpoints and decodes
+// the JSON body into dst. It writes the error response and returns false if
+// the request should go no further.
+func authPreamble(w http.ResponseWriter, r *http.Request, dst any) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return false
+	}
+	if sessionKeys == nil {
+		writeError(w, http.StatusServiceUnavailable, "sessions_disabled", "session tokens are not configured")
+		return false
+	}
+	if authLimiter != nil && !authLimiter.allow(r) {
+		w.Header().Set("Retry-After", "60")
+		writeError(w, http.StatusTooManyRequests, "rate_limited", "too many requests, retry shortly")
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 16<<10) // ID tokens are a few KiB.
+	defer func() { _ = r.Body.Close() }()
+	if err := json.NewDecoder(r.Body).Decode(dst); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "invalid JSON body")
+		return false
+	}
+	return true
+}
+
+// loginHandler exchanges a Google or Apple ID token for an access token and
+// a refresh token signed by this backend.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDToken string `json:"id_token"`
+	}
+	if !authPreamble(w, r, &req) {
+		return
+	}
+	ctx := r.Context()
+
+	sub, claims, code, verr := verifyProviderToken(ctx, req.IDToken)
+	if code != "" {
+		logTokenFailure(code, verr, req.IDToken, r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, code, tokenErrMessage(code))
+		return
+	}
+
+	id, _, err := upsertUser(ctx, sub)
+	if err != nil {
+		slog.Error("login: upsert user", "user_id", sub, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal server error")
+		return
+	}
+	banned, err := isUserBanned(ctx, sub)
+	if err != nil {
+		slog.Error("login: check ban status", "user_id", sub, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal server error")
+		return
+	}
+	if banned {
+		slog.Info("Banned user denied login", "user_id", sub)
+		writeError(w, http.StatusForbidden, "account_suspended", "account suspended")
+		return
+	}
+	// Access tokens carry no provider claims, so store what the ID token
+	// says about the user's age now; /ws reads the stored band.
+	resolveAgeBand(ctx, id, sub, claims)
+
+	family, err := newTokenFamily()
+	if err != nil {
+		slog.Error("login: token family", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal server error")
+		return
+	}
+	issueSession(w, "login", func(hash string, exp time.Time) (string, error) {
+		return sub, insertRefreshToken(ctx, id, family, hash, exp)
+	})
+}
+
+// refreshHandler trades a refresh token for a new access token and a new
+// refresh token. Each refresh token works once: presenting one that was
+// already used means it leaked, so its whole family is revoked.
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if !authPreamble(w, r, &req) {
+		return
+	}
+	if req.RefreshToken == "" {
+		writeError(w, http.StatusBadRequest, "missing_refresh_token", "refresh_token is required")
+		return
+	}
+	ctx := r.Context()
+
+	issueSession(w, "refresh", func(hash string, exp time.Time) (string, error) {
+		return rotateRefreshToken(ctx, hashRefreshToken(req.RefreshToken), hash, exp)
+	})
+}
+
+// issueSession creates a refresh token, has store persist its hash and
+// name the user it belongs to, and writes both tokens.
+func issueSession(w http.ResponseWriter, grant string, store func(hash string, exp time.Time) (sub string, err error)) {
+	now := time.Now()
+	refresh, hash, err := newRefreshToken()
+	var sub string
+	if err == nil {
+		sub, err = store(hash, now.Add(refreshTokenTTL))
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, errRefreshInvalid):
+		sessionRefreshFailuresTotal.WithLabelValues("invalid").Inc()
+		writeError(w, http.StatusUnauthorized, "invalid_refresh_token", "refresh token invalid or revoked")
+		return
+	case errors.Is(err, errRefreshExpired):
+		sessionRefreshFailuresTotal.WithLabelValues("expired").Inc()
+		writeError(w, http.StatusUnauthorized, "refresh_token_expired", "refresh token expired")
+		return
+	case errors.Is(err, errRefreshReused):
+		sessionRefreshFailuresTotal.WithLabelValues("reused").Inc()
+		slog.Warn("Refresh token reused; session revoked", "user_id", sub)
+		writeError(w, http.StatusUnauthorized, "refresh_token_reused", "refresh token already used; sign in again")
+		return
+	case errors.Is(err, errRefreshBanned):
+		sessionRefreshFailuresTotal.WithLabelValues("banned").Inc()
+		writeError(w, http.StatusForbidden, "account_suspended", "account suspended")
+		return
+	default:
+		slog.Error("auth: store refresh token", "grant", grant, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal server error")
+		return
+	}
+
+	access, err := issueAccessToken(sub, now)
+	if err != nil {
+		slog.Error("auth: sign access token", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal server error")
+		return
+	}
+	sessionTokensIssuedTotal.WithLabelValues(grant).Inc()
+	writeTokenResponse(w, sub, access, refresh)
+}
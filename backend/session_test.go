@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+func testSessionKey(fill byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, minSessionKeyBytes))
+}
+
+// useSessionKeys installs a keyring parsed from spec for the test.
+func useSessionKeys(t *testing.T, spec string) *sessionKeyring {
+	t.Helper()
+	k, err := parseSessionKeys(spec)
+	if err != nil {
+		t.Fatalf("parseSessionKeys: %v", err)
+	}
+	prev := sessionKeys
+	sessionKeys = k
+	t.Cleanup(func() { sessionKeys = prev })
+	return k
+}
+
+func TestParseSessionKeys(t *testing.T) {
+	k, err := parseSessionKeys("new=" + testSessionKey(1) + ", old=" + testSessionKey(2))
+	if err != nil {
+		t.Fatalf("parseSessionKeys: %v", err)
+	}
+	if k.active != "new" || len(k.keys) != 2 {
+		t.Fatalf("keyring = active %q, %d keys", k.active, len(k.keys))
+	}
+	for _, bad := range []string{
+		"",
+		"nokid",
+		"k=not-base64!",
+		"k=" + base64.StdEncoding.EncodeToString([]byte("short")),
+		"k=" + testSessionKey(1) + ",k=" + testSessionKey(2),
+	} {
+		if _, err := parseSessionKeys(bad); err == nil {
+			t.Errorf("parseSessionKeys(%q) should fail", bad)
+		}
+	}
+}
+
+func TestSessionToken_RoundTripAndRotation(t *testing.T) {
+	useSessionKeys(t, "k1="+testSessionKey(1))
+	token, err := issueAccessToken("apple:abc", time.Now())
+	if err != nil {
+		t.Fatalf("issueAccessToken: %v", err)
+	}
+
+	sub, code, err := verifyToken(context.Background(), token)
+	if code != "" || err != nil || sub != "apple:abc" {
+		t.Fatalf("verifyToken = %q, %q, %v", sub, code, err)
+	}
+
+	// A new signing key is prepended; tokens signed with k1 still verify.
+	useSessionKeys(t, "k2="+testSessionKey(2)+",k1="+testSessionKey(1))
+	if _, code, _ := verifyToken(context.Background(), token); code != "" {
+		t.Fatalf("token signed with the previous key rejected: %q", code)
+	}
+	fresh, _ := issueAccessToken("apple:abc", time.Now())
+	if h, _, _, _ := splitJWT(fresh); h.Kid != "k2" {
+		t.Fatalf("new tokens signed with %q, want k2", h.Kid)
+	}
+
+	// Once k1 is retired its tokens stop working.
+	useSessionKeys(t, "k2="+testSessionKey(2))
+	if _, code, _ := verifyToken(context.Background(), token); code != tokenErrInvalid {
+		t.Fatalf("retired key: code = %q, want %q", code, tokenErrInvalid)
+	}
+}
+
+func TestSessionToken_Rejects(t *testing.T) {
+	k := useSessionKeys(t, "k1="+testSessionKey(1))
+	ctx := context.Background()
+
+	prevTTL := accessTokenTTL
+	accessTokenTTL = -time.Second
+	expired, _ := issueAccessToken("user-1", time.Now())
+	accessTokenTTL = prevTTL
+	if _, code, _ := verifyToken(ctx, expired); code != tokenErrExpired {
+		t.Fatalf("expired: code = %q", code)
+	}
+
+	valid, _ := issueAccessToken("user-1", time.Now())
+	parts := strings.Split(valid, ".")
+	forged, _ := json.Marshal(map[string]any{"iss": sessionIssuer, "sub": "someone-else", "exp": time.Now().Add(time.Hour).Unix()})
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+	if _, code, _ := verifyToken(ctx, tampered); code != tokenErrInvalid {
+		t.Fatalf("tampered payload: code = %q", code)
+	}
+
+	none, _ := json.Marshal(jwtHeader{Alg: "none", Kid: "k1"})
+	unsigned := base64.RawURLEncoding.EncodeToString(none) + "." + parts[1] + "."
+	if _, code, _ := verifyToken(ctx, unsigned); code != tokenErrInvalid {
+		t.Fatalf("alg none: code = %q", code)
+	}
+
+	wrongIss, _ := k.sign(map[string]any{"iss": "someone", "sub": "user-1", "exp": time.Now().Add(time.Hour).Unix()})
+	if _, _, code, _ := verifySessionToken(wrongIss); code != tokenErrInvalid {
+		t.Fatalf("wrong issuer: code = %q", code)
+	}
+}
+
+func TestVerifyProviderToken_RefusesSessionTokens(t *testing.T) {
+	useSessionKeys(t, "k1="+testSessionKey(1))
+	wantErr := errors.New("not a google token")
+	stubValidator(t, func(context.Context, string, string) (*idtoken.Payload, error) {
+		return nil, wantErr
+	})
+	token, _ := issueAccessToken("user-1", time.Now())
+	if _, _, code, _ := verifyProviderToken(context.Background(), token); code != tokenErrInvalid {
+		t.Fatalf("an access token must not log in: code = %q", code)
+	}
+}
+
+func TestAuthHandlers_Disabled(t *testing.T) {
+	prev := sessionKeys
+	sessionKeys = nil
+	t.Cleanup(func() { sessionKeys = prev })
+
+	rr := httptest.NewRecorder()
+	loginHandler(rr, httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(`{"id_token":"x"}`)))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	refreshHandler(rr, httptest.NewRequest(http.MethodGet, "/auth/refresh", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET status = %d, want 405", rr.Code)
+	}
+}
+
+func postAuth(t *testing.T, h http.HandlerFunc, path, body string) (int, tokenResponse, errorResponse) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	h(rr, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	var ok tokenResponse
+	var fail errorResponse
+	if rr.Code == http.StatusOK {
+		_ = json.NewDecoder(rr.Body).Decode(&ok)
+	} else {
+		_ = json.NewDecoder(rr.Body).Decode(&fail)
+	}
+	return rr.Code, ok, fail
+}
+
+func TestAuthLoginAndRefresh(t *testing.T) {
+	setupTestDB(t)
+	useSessionKeys(t, "k1="+testSessionKey(1))
+	stubValidator(t, func(context.Context, string, string) (*idtoken.Payload, error) {
+		return &idtoken.Payload{Audience: googleClientIDs[0], Subject: "google-user", Expires: time.Now().Add(time.Hour).Unix()}, nil
+	})
+
+	status, login, _ := postAuth(t, loginHandler, "/auth/login", `{"id_token":"google-id-token"}`)
+	if status != http.StatusOK || login.UserID != "google-user" || login.RefreshToken == "" {
+		t.Fatalf("login: %d %+v", status, login)
+	}
+	if sub, code, _ := verifyToken(context.Background(), login.AccessToken); code != "" || sub != "google-user" {
+		t.Fatalf("access token: sub=%q code=%q", sub, code)
+	}
+
+	refresh := func(token string) (int, tokenResponse, errorResponse) {
+		return postAuth(t, refreshHandler, "/auth/refresh", `{"refresh_token":"`+token+`"}`)
+	}
+	status, second, _ := refresh(login.RefreshToken)
+	if status != http.StatusOK || second.RefreshToken == login.RefreshToken {
+		t.Fatalf("refresh: %d %+v", status, second)
+	}
+
+	// Replaying the spent token revokes the whole family, including the
+	// token it was rotated into.
+	if status, _, e := refresh(login.RefreshToken); status != http.StatusUnauthorized || e.Code != "refresh_token_reused" {
+		t.Fatalf("reuse: %d %+v", status, e)
+	}
+	if status, _, e := refresh(second.RefreshToken); status != http.StatusUnauthorized || e.Code != "invalid_refresh_token" {
+		t.Fatalf("after reuse: %d %+v", status, e)
+	}
+
+	// A ban revokes every session.
+	_, third, _ := postAuth(t, loginHandler, "/auth/login", `{"id_token":"google-id-token"}`)
+	id, _ := getUserIDBySub(context.Background(), "google-user")
+	if _, _, _, err := banUser(context.Background(), id, Ban{Source: banSourceAdmin}); err != nil {
+		t.Fatalf("banUser: %v", err)
+	}
+	if status, _, e := refresh(third.RefreshToken); status != http.StatusUnauthorized || e.Code != "invalid_refresh_token" {
+		t.Fatalf("after ban: %d %+v", status, e)
+	}
+	if status, _, e := postAuth(t, loginHandler, "/auth/login", `{"id_token":"google-id-token"}`); status != http.StatusForbidden || e.Code != "account_suspended" {
+		t.Fatalf("banned login: %d %+v", status, e)
+	}
+}
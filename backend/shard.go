@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// overflowShard is where lone waiters are gathered when their own shard
+	// has nobody to pair them with. Users already in it are never moved, so
+	// stragglers converge instead of bouncing between shards.
+	overflowShard = 0
+	// defaultShardRebalanceWait is how long a user may sit unpaired in their
+	// home shard before the coordinator moves them to the overflow shard.
+	defaultShardRebalanceWait = 3 * time.Second
+	// maxQueueShards caps MATCHMAKER_SHARDS. Remove and queue_status touch
+	// every shard, so the count must stay small.
+	maxQueueShards = 64
+)
+
+// homeShard deterministically spreads users across shards so enqueue
+// traffic is split evenly regardless of which pod accepted the socket.
+func (m *MatchMaker) homeShard(userID string) int {
+	if m.shards <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(userID))
+	return int(h.Sum32() % uint32(m.shards))
+}
+
+// shardOf returns the shard the user is currently queued in. It is recorded
+// in the profile on enqueue because the coordinator may have moved the user
+// away from their home shard.
+func (m *MatchMaker) shardOf(ctx context.Context, userID string) int {
+	raw, err := m.rdb.HGet(ctx, profileKey(userID), "shard").Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			slog.Error("MatchMaker: failed to read shard", "user_id", userID, "error", err)
+		}
+		return m.homeShard(userID)
+	}
+	s, err := strconv.Atoi(raw)
+	if err != nil || s < 0 || s >= m.shards {
+		return m.homeShard(userID)
+	}
+	return s
+}
+
+// rebalance moves users left unpaired in their shard for longer than
+// shardRebalanceWait into the overflow shard, so two lone waiters in
+// different shards still meet. It only moves anyone when at least two users
+// are left over cluster-wide; a single user alone would gain nothing.
+func (m *MatchMaker) rebalance(ctx context.Context, leftovers [][]waiter, now time.Time) {
+	total := 0
+	for _, ws := range leftovers {
+		total += len(ws)
+	}
+	if total < 2 {
+		return
+	}
+	moved := 0
+	for shard, ws := range leftovers {
+		if shard == overflowShard {
+			continue
+		}
+		for _, w := range ws {
+			if w.EnqueuedAt.IsZero() || now.Sub(w.EnqueuedAt) < m.shardRebalanceWait {
+				continue
+			}
+			if m.moveWaiter(ctx, w, overflowShard) {
+				moved++
+			}
+		}
+	}
+	if moved > 0 {
+		shardRebalancedTotal.Add(float64(moved))
+		slog.Info("MatchMaker: rebalanced lone waiters", "moved", moved, "to_shard", overflowShard)
+		m.rdb.Publish(ctx, redisTriggerKey, "1")
+	}
+}
+
+// moveWaiter transfers a queued user to another shard, keeping their
+// original enqueue time and lane so the move doesn't cost them their place in
+// line.
+// The source and destination keys live in different slots, so this cannot
+// be one script; LREM's count guards against moving a user who already left,
+// and the profile check afterwards catches one who disconnects mid-move.
+func (m *MatchMaker) moveWaiter(ctx context.Context, w waiter, dst int) bool {
+	src := queueKey(w.Shard)
+	if w.Priority {
+		src = priorityQueueKey(w.Shard)
+	}
+	n, err := m.rdb.LRem(ctx, src, 1, w.ID).Result()
+	if err != nil || n == 0 {
+		if err != nil {
+			slog.Error("MatchMaker: rebalance LREM failed", "user_id", w.ID, "error", err)
+		}
+		return false
+	}
+	m.rdb.HDel(ctx, enqueuedAtKey(w.Shard), w.ID)
+	m.unindexTags(ctx, w.ID, w.Shard)
+
+	if exists, err := m.rdb.Exists(ctx, profileKey(w.ID)).Result(); err != nil || exists == 0 {
+		return false
+	}
+	at := w.EnqueuedAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+	if err := m.enqueue(ctx, w.ID, dst, at, w.Priority); err != nil {
+		slog.Error("MatchMaker: rebalance enqueue failed", "user_id", w.ID, "error", err)
+		return false
+	}
+	m.audit(ctx, AuditEvent{Type: auditRebalanced, UserID: w.ID, Detail: map[string]any{"from_shard": w.Shard, "to_shard": dst}})
+	return true
+}
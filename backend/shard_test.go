@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// usersInShards returns one user ID per requested shard, found by probing
+// homeShard, so tests don't depend on specific hash values.
+func usersInShards(mm *MatchMaker, shards ...int) []string {
+	out := make([]string, len(shards))
+	n := 0
+	for i, want := range shards {
+		for ; ; n++ {
+			id := fmt.Sprintf("user-%d", n)
+			if mm.homeShard(id) == want {
+				out[i] = id
+				n++
+				break
+			}
+		}
+	}
+	return out
+}
+
+func TestShard_KeysShareHashTag(t *testing.T) {
+	for _, key := range []string{queueKey(3), enqueuedAtKey(3), tagKey(3, "music")} {
+		if !strings.Contains(key, "{q3}") {
+			t.Fatalf("key %q lacks the {q3} hash tag", key)
+		}
+	}
+}
+
+func TestShard_AddUsesHomeShardAndRemoveClears(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	mm.shards = 4
+	ctx := context.Background()
+
+	ids := usersInShards(mm, 2)
+	mm.SetProfile(ctx, ids[0], Profile{Interests: []string{"music"}})
+	mm.Add(ctx, ids[0])
+
+	if got, _ := client.LLen(ctx, queueKey(2)).Result(); got != 1 {
+		t.Fatalf("expected user in shard 2, queue length %d", got)
+	}
+	if got := mm.shardOf(ctx, ids[0]); got != 2 {
+		t.Fatalf("shardOf = %d, want 2", got)
+	}
+	if ok, _ := client.SIsMember(ctx, tagKey(2, "music"), ids[0]).Result(); !ok {
+		t.Fatalf("tag not indexed in the user's shard")
+	}
+
+	mm.Remove(ctx, ids[0])
+	if got, _ := client.LLen(ctx, queueKey(2)).Result(); got != 0 {
+		t.Fatalf("queue length after Remove = %d, want 0", got)
+	}
+	if n, _ := client.SCard(ctx, tagKey(2, "music")).Result(); n != 0 {
+		t.Fatalf("tag index not cleared after Remove")
+	}
+}
+
+func TestShard_PairsWithinShard(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	mm.shards = 4
+	ctx := context.Background()
+
+	ids := usersInShards(mm, 3, 3)
+	addWithInterests(ctx, mm, ids[0])
+	addWithInterests(ctx, mm, ids[1])
+
+	mm.processMatches(ctx)
+
+	if got, _ := client.Get(ctx, sessionKey(ids[0])).Result(); got != ids[1] {
+		t.Fatalf("session for %s = %q, want %q", ids[0], got, ids[1])
+	}
+	if got, _ := client.LLen(ctx, queueKey(3)).Result(); got != 0 {
+		t.Fatalf("shard 3 not drained, length %d", got)
+	}
+}
+
+func TestShard_RebalanceMovesLoneWaiters(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	mm.shards = 4
+	ctx := context.Background()
+
+	ids := usersInShards(mm, 1, 2)
+	addWithInterests(ctx, mm, ids[0])
+	addWithInterests(ctx, mm, ids[1])
+
+	// Before the rebalance wait elapses each stays alone in its own shard.
+	mm.processMatches(ctx)
+	if got, _ := client.LLen(ctx, queueKey(1)).Result(); got != 1 {
+		t.Fatalf("user moved before the rebalance wait elapsed")
+	}
+
+	old := time.Now().Add(-2 * mm.shardRebalanceWait).UnixNano()
+	client.HSet(ctx, enqueuedAtKey(1), ids[0], old)
+	client.HSet(ctx, enqueuedAtKey(2), ids[1], old)
+
+	before := readCounter(t, shardRebalancedTotal)
+	mm.processMatches(ctx)
+	if got := readCounter(t, shardRebalancedTotal) - before; got != 2 {
+		t.Fatalf("rebalanced %v users, want 2", got)
+	}
+	if got, _ := client.LLen(ctx, queueKey(overflowShard)).Result(); got != 2 {
+		t.Fatalf("overflow shard length %d, want 2", got)
+	}
+	if got := mm.shardOf(ctx, ids[0]); got != overflowShard {
+		t.Fatalf("shardOf after move = %d, want %d", got, overflowShard)
+	}
+	if !hashHas(t, client, enqueuedAtKey(overflowShard), ids[0]) {
+		t.Fatalf("enqueue time not carried over to the overflow shard")
+	}
+
+	mm.processMatches(ctx)
+	if got, _ := client.Get(ctx, sessionKey(ids[0])).Result(); got != ids[1] {
+		t.Fatalf("rebalanced users not paired: session %q", got)
+	}
+}
+
+func TestShard_RebalanceLeavesSingleWaiter(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	mm.shards = 4
+	ctx := context.Background()
+
+	ids := usersInShards(mm, 2)
+	addWithInterests(ctx, mm, ids[0])
+	client.HSet(ctx, enqueuedAtKey(2), ids[0], time.Now().Add(-time.Hour).UnixNano())
+
+	mm.processMatches(ctx)
+	if got, _ := client.LLen(ctx, queueKey(2)).Result(); got != 1 {
+		t.Fatalf("a lone user cluster-wide should not be moved")
+	}
+}
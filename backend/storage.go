@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
@@ -23,6 +24,9 @@ type Storage interface {
 	// assumed to be publicly readable and that URL is returned directly;
 	// otherwise a presigned/short-lived URL is generated.
 	Sign(ctx context.Context, key string, ttl time.Duration) (string, error)
+	// Delete removes the object under key. Deleting an object that does not
+	// exist is not an error, so a failed purge can simply be retried.
+	Delete(ctx context.Context, key string) error
 }
 
 func newStorage(ctx context.Context) (Storage, error) {
@@ -106,6 +110,16 @@ func (s *s3Storage) Sign(ctx context.Context, key string, ttl time.Duration) (st
 	return req.URL, nil
 }
 
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	if _, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	}); err != nil {
+		return fmt.Errorf("s3 delete: %w", err)
+	}
+	return nil
+}
+
 // --- GCS ---
 
 type gcsStorage struct {
@@ -158,3 +172,11 @@ func (g *gcsStorage) Sign(ctx context.Context, key string, ttl time.Duration) (s
 	}
 	return signed, nil
 }
+
+func (g *gcsStorage) Delete(ctx context.Context, key string) error {
+	err := g.client.Bucket(g.bucket).Object(key).Delete(ctx)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("gcs delete: %w", err)
+	}
+	return nil
+}
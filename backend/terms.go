@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Users must accept the current terms of service (the community
+// guidelines) before they can reach other users. The current version is an
+// opaque string, e.g. a date, read from TERMS_VERSION along with the URL of
+// its text; publishing new terms means bumping it, after which /ws refuses
+// everyone until they accept the new version. Connected users are not cut
+// off. Empty TERMS_VERSION disables the check.
+var (
+	termsVersion string
+	termsURL     string
+)
+
+// termsErrorResponse is errorResponse for terms refusals, naming the
+// version to accept and where to read it.
+type termsErrorResponse struct {
+	errorResponse
+	TermsVersion string `json:"terms_version"`
+	TermsURL     string `json:"terms_url,omitempty"`
+}
+
+func writeTermsError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(termsErrorResponse{
+		errorResponse: errorResponse{Code: code, Error: message},
+		TermsVersion:  termsVersion,
+		TermsURL:      termsURL,
+	}); err != nil {
+		slog.Error("writeTermsError encode failed", "error", err)
+	}
+}
+
+// requireTerms refuses a connect with 403 terms_not_accepted unless the user
+// accepted the current terms. It reports whether the connect may go on.
+func requireTerms(ctx context.Context, w http.ResponseWriter, id int64, userID string) bool {
+	if termsVersion == "" {
+		return true
+	}
+	ok, err := hasAcceptedTerms(ctx, id, termsVersion)
+	if err != nil {
+		slog.Error("Failed to check terms acceptance", "user_id", userID, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal server error")
+		return false
+	}
+	if !ok {
+		termsRefusalsTotal.Inc()
+		slog.Info("User denied connection until terms are accepted", "user_id", userID, "terms_version", termsVersion)
+		writeTermsError(w, http.StatusForbidden, "terms_not_accepted", "the current terms of service must be accepted")
+		return false
+	}
+	return true
+}
+
+// termsHandler serves GET /terms: the current version and its URL, so the
+// app can show them before the user has connected.
+func termsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	if termsVersion == "" {
+		writeError(w, http.StatusNotFound, "terms_not_configured", "no terms of service are configured")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"version": termsVersion, "url": termsURL})
+}
+
+type acceptTermsRequest struct {
+	Version string `json:"version"`
+}
+
+type acceptTermsResponse struct {
+	Version    string    `json:"version"`
+	AcceptedAt time.Time `json:"accepted_at"`
+}
+
+// acceptTermsHandler serves POST /me/accept-terms. The body names the
+// version the user was shown; it must be the current one, so a user who
+// read terms that were replaced meanwhile is asked again (409, with the
+// current version).
+func acceptTermsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	ctx := r.Context()
+
+	sub, ok := authenticate(ctx, r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid_token", "token invalid or expired")
+		return
+	}
+	if termsVersion == "" {
+		writeError(w, http.StatusNotFound, "terms_not_configured", "no terms of service are configured")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<10)
+	defer func() { _ = r.Body.Close() }()
+	var req acceptTermsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version == "" {
+		writeError(w, http.StatusBadRequest, "invalid_body", "body must be {\"version\": \"...\"}")
+		return
+	}
+	if req.Version != termsVersion {
+		writeTermsError(w, http.StatusConflict, "terms_version_mismatch", "these terms have been replaced")
+		return
+	}
+
+	id, _, err := upsertUser(ctx, sub)
+	if err != nil {
+		slog.Error("accept terms: upsert user", "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
+	}
+	at, err := recordTermsAcceptance(ctx, id, req.Version)
+	if err != nil {
+		slog.Error("accept terms: record", "user_id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
+	}
+	slog.Info("Terms accepted", "user_id", id, "terms_version", req.Version)
+	writeJSON(w, http.StatusOK, acceptTermsResponse{Version: req.Version, AcceptedAt: at})
+}
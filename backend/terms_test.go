@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+func useTerms(t *testing.T, version, url string) {
+	t.Helper()
+	prevVersion, prevURL := termsVersion, termsURL
+	termsVersion, termsURL = version, url
+	t.Cleanup(func() { termsVersion, termsURL = prevVersion, prevURL })
+}
+
+func postAcceptTerms(t *testing.T, sub, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/me/accept-terms", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+sub)
+	rr := httptest.NewRecorder()
+	acceptTermsHandler(rr, req)
+	return rr
+}
+
+func stubSubjectValidator(t *testing.T) {
+	t.Helper()
+	stubValidator(t, func(_ context.Context, token, _ string) (*idtoken.Payload, error) {
+		return &idtoken.Payload{Audience: googleClientIDs[0], Subject: token, Expires: time.Now().Add(time.Hour).Unix()}, nil
+	})
+}
+
+func TestTermsHandler(t *testing.T) {
+	useTerms(t, "", "")
+	rr := httptest.NewRecorder()
+	termsHandler(rr, httptest.NewRequest(http.MethodGet, "/terms", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("without TERMS_VERSION: %d", rr.Code)
+	}
+
+	useTerms(t, "2026-10-01", "https://example.com/terms")
+	rr = httptest.NewRecorder()
+	termsHandler(rr, httptest.NewRequest(http.MethodGet, "/terms", nil))
+	var body map[string]string
+	_ = json.NewDecoder(rr.Body).Decode(&body)
+	if rr.Code != http.StatusOK || body["version"] != "2026-10-01" || body["url"] != "https://example.com/terms" {
+		t.Fatalf("GET /terms: %d %v", rr.Code, body)
+	}
+}
+
+func TestAcceptTerms_RejectsBadRequests(t *testing.T) {
+	stubSubjectValidator(t)
+	useTerms(t, "v2", "https://example.com/terms/v2")
+
+	if rr := postAcceptTerms(t, "alice", `{}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("empty body: %d", rr.Code)
+	}
+	rr := postAcceptTerms(t, "alice", `{"version":"v1"}`)
+	var body termsErrorResponse
+	_ = json.NewDecoder(rr.Body).Decode(&body)
+	if rr.Code != http.StatusConflict || body.Code != "terms_version_mismatch" || body.TermsVersion != "v2" {
+		t.Fatalf("stale version: %d %+v", rr.Code, body)
+	}
+}
+
+func TestRequireTerms_UntilAccepted(t *testing.T) {
+	setupTestDB(t)
+	stubSubjectValidator(t)
+	useTerms(t, "v1", "https://example.com/terms/v1")
+	ctx := context.Background()
+	id, _, _ := upsertUser(ctx, "alice")
+
+	rr := httptest.NewRecorder()
+	if requireTerms(ctx, rr, id, "alice") {
+		t.Fatalf("connect allowed before accepting")
+	}
+	var body termsErrorResponse
+	_ = json.NewDecoder(rr.Body).Decode(&body)
+	if rr.Code != http.StatusForbidden || body.Code != "terms_not_accepted" || body.TermsVersion != "v1" {
+		t.Fatalf("refusal: %d %+v", rr.Code, body)
+	}
+
+	if rr := postAcceptTerms(t, "alice", `{"version":"v1"}`); rr.Code != http.StatusOK {
+		t.Fatalf("accept: %d %s", rr.Code, rr.Body)
+	}
+	if !requireTerms(ctx, httptest.NewRecorder(), id, "alice") {
+		t.Fatalf("connect refused after accepting")
+	}
+
+	// New terms need accepting again.
+	useTerms(t, "v2", "https://example.com/terms/v2")
+	if requireTerms(ctx, httptest.NewRecorder(), id, "alice") {
+		t.Fatalf("connect allowed after the terms changed")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Matching pools. Users in the shadow pool are only ever paired with each
+// other; everyone else shares the general pool. The general pool is stored as
+// the empty Profile.Pool so profiles written before pools existed need no
+// migration.
+const (
+	poolGeneral = "general"
+	poolShadow  = "shadow"
+)
+
+const (
+	// defaultTrustShadowThreshold is the score below which a user is routed
+	// to the shadow pool. With the weights below, one fresh report on an
+	// established account leaves a user above it; two, or one on an account
+	// made today, put them below.
+	defaultTrustShadowThreshold = 65.0
+
+	// trustReportWeight is the penalty for one report filed right now. Older
+	// reports count for less, halving every trustReportHalfLife, so a user
+	// who was reported once months ago is not punished forever.
+	trustReportWeight   = 20.0
+	trustReportHalfLife = 7 * 24 * time.Hour
+	// trustReportHistory bounds how many reports are read per assessment.
+	// Anything older than the newest few dozen has decayed to nothing.
+	trustReportHistory = 50
+	// trustLifetimeReportWeight is a small undecayed penalty per lifetime
+	// report, so a long record of reports never fully washes out.
+	trustLifetimeReportWeight = 2.0
+	trustMaxLifetimePenalty   = 20.0
+
+	// Blocks are weaker evidence than reports (blocking costs nothing and
+	// carries no reason), so each weighs less and the total is capped.
+	trustBlockWeight      = 3.0
+	trustMaxBlockPenalty  = 25.0
+	trustNewAccountWeight = 15.0
+	// trustNewAccountPeriod is how long a new account's penalty takes to
+	// fade out linearly. Throwaway accounts made to evade a ban start under
+	// suspicion.
+	trustNewAccountPeriod = 7 * 24 * time.Hour
+)
+
+// trustShadowThreshold is read from TRUST_SHADOW_THRESHOLD in main. Zero or
+// less disables the shadow pool except for admin overrides.
+var trustShadowThreshold = defaultTrustShadowThreshold
+
+// trustInputs are the signals a trust score is computed from.
+type trustInputs struct {
+	AccountCreatedAt time.Time   `json:"account_created_at"`
+	ReportTimes      []time.Time `json:"-"`
+	ReportsTotal     int         `json:"reports_total"`
+	BlocksReceived   int         `json:"blocks_received"`
+}
+
+// trustScore rates a user from 0 (certainly abusive) to 100 (no signal of
+// abuse). It is a heuristic for routing, not a verdict: the shadow pool is
+// where borderline users go while moderators catch up with their reports.
+func trustScore(in trustInputs, now time.Time) float64 {
+	score := 100.0
+
+	for _, at := range in.ReportTimes {
+		age := now.Sub(at)
+		if age < 0 {
+			age = 0
+		}
+		score -= trustReportWeight * math.Pow(0.5, float64(age)/float64(trustReportHalfLife))
+	}
+	score -= math.Min(trustMaxLifetimePenalty, trustLifetimeReportWeight*float64(in.ReportsTotal))
+	score -= math.Min(trustMaxBlockPenalty, trustBlockWeight*float64(in.BlocksReceived))
+
+	if age := now.Sub(in.AccountCreatedAt); age < trustNewAccountPeriod {
+		if age < 0 {
+			age = 0
+		}
+		score -= trustNewAccountWeight * (1 - float64(age)/float64(trustNewAccountPeriod))
+	}
+
+	return math.Max(0, math.Min(100, math.Round(score*10)/10))
+}
+
+// TrustAssessment is a user's current score and the pool it puts them in.
+// It is what the admin trust endpoint returns.
+type TrustAssessment struct {
+	UserID    int64       `json:"user_id"`
+	Score     float64     `json:"score"`
+	Threshold float64     `json:"threshold"`
+	Pool      string      `json:"pool"`
+	Override  *string     `json:"override"`
+	Inputs    trustInputs `json:"inputs"`
+}
+
+// poolForScore applies the threshold.
+func poolForScore(score float64) string {
+	if trustShadowThreshold > 0 && score < trustShadowThreshold {
+		return poolShadow
+	}
+	return poolGeneral
+}
+
+// assessTrust scores a user and resolves their pool. An admin override, if
+// set, wins over the score.
+func assessTrust(ctx context.Context, id int64) (TrustAssessment, error) {
+	in, override, err := loadTrustInputs(ctx, id)
+	if err != nil {
+		return TrustAssessment{}, err
+	}
+	a := TrustAssessment{
+		UserID:    id,
+		Score:     trustScore(in, time.Now()),
+		Threshold: trustShadowThreshold,
+		Override:  override,
+		Inputs:    in,
+	}
+	a.Pool = poolForScore(a.Score)
+	if override != nil {
+		a.Pool = *override
+	}
+	return a, nil
+}
+
+// matchPool returns the Profile.Pool value for a connecting user. Scoring
+// failures fall back to the general pool: a Postgres hiccup should degrade
+// moderation, not lock everyone out of matching.
+func matchPool(ctx context.Context, id int64, sub string) string {
+	a, err := assessTrust(ctx, id)
+	if err != nil {
+		slog.Error("Failed to assess trust", "user_id", sub, "error", err)
+		return ""
+	}
+	source := "score"
+	if a.Override != nil {
+		source = "override"
+	}
+	poolAssignmentsTotal.WithLabelValues(a.Pool, source).Inc()
+	if a.Pool == poolShadow {
+		slog.Info("Routing user to shadow pool", "user_id", sub, "score", a.Score, "source", source)
+		return poolShadow
+	}
+	return ""
+}
+
+// validPool reports whether p names a pool an admin may pin a user to.
+func validPool(p string) bool {
+	return p == poolGeneral || p == poolShadow
+}
+
+// SetPool moves a connected user to another pool for the rest of their
+// session. Offline users have no profile and are left alone; they are
+// assessed again on their next connect.
+func (m *MatchMaker) SetPool(ctx context.Context, userID, pool string) {
+	if pool == poolGeneral {
+		pool = ""
+	}
+	m.setLiveProfileField(ctx, userID, "pool", pool)
+}
+
+// setLiveProfileField updates one profile field only if the profile still
+// exists, so it cannot resurrect (without a TTL) the profile of a user who
+// disconnected in the meantime.
+func (m *MatchMaker) setLiveProfileField(ctx context.Context, userID, field, value string) {
+	if err := setProfileFieldScript.Run(ctx, m.rdb, []string{profileKey(userID)}, field, value).Err(); err != nil {
+		slog.Error("MatchMaker: failed to update profile", "user_id", userID, "field", field, "error", err)
+	}
+}
+
+var setProfileFieldScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+    return redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+end
+return 0
+`)
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTrustScore(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-90 * 24 * time.Hour)
+
+	cases := []struct {
+		name      string
+		in        trustInputs
+		wantPool  string
+		wantScore float64
+	}{
+		{"clean established account", trustInputs{AccountCreatedAt: old}, poolGeneral, 100},
+		{"brand-new account", trustInputs{AccountCreatedAt: now}, poolGeneral, 85},
+		{"one fresh report", trustInputs{
+			AccountCreatedAt: old, ReportsTotal: 1, ReportTimes: []time.Time{now},
+		}, poolGeneral, 78},
+		{"two fresh reports", trustInputs{
+			AccountCreatedAt: old, ReportsTotal: 2, ReportTimes: []time.Time{now, now},
+		}, poolShadow, 56},
+		{"one fresh report on a new account", trustInputs{
+			AccountCreatedAt: now, ReportsTotal: 1, ReportTimes: []time.Time{now},
+		}, poolShadow, 63},
+		{"two reports long ago", trustInputs{
+			AccountCreatedAt: old, ReportsTotal: 2,
+			ReportTimes: []time.Time{now.Add(-70 * 24 * time.Hour), now.Add(-70 * 24 * time.Hour)},
+		}, poolGeneral, 96},
+		{"blocks are capped", trustInputs{AccountCreatedAt: old, BlocksReceived: 1000}, poolGeneral, 75},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := trustScore(tc.in, now)
+			if got != tc.wantScore {
+				t.Fatalf("score = %v, want %v", got, tc.wantScore)
+			}
+			if pool := poolForScore(got); pool != tc.wantPool {
+				t.Fatalf("pool = %q, want %q", pool, tc.wantPool)
+			}
+		})
+	}
+}
+
+func TestTrustScore_NeverNegative(t *testing.T) {
+	now := time.Now()
+	in := trustInputs{AccountCreatedAt: now, ReportsTotal: 50, BlocksReceived: 50}
+	for range 50 {
+		in.ReportTimes = append(in.ReportTimes, now)
+	}
+	if got := trustScore(in, now); got != 0 {
+		t.Fatalf("score = %v, want 0", got)
+	}
+}
+
+func TestMatchMaker_ShadowPoolIsSegregated(t *testing.T) {
+	mm, _, client := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	for _, u := range []struct{ id, pool string }{
+		{"shady1", poolShadow},
+		{"alice", ""},
+		{"shady2", poolShadow},
+		{"bob", ""},
+	} {
+		mm.SetProfile(ctx, u.id, Profile{Pool: u.pool})
+		mm.Add(ctx, u.id)
+	}
+
+	mm.processMatches(ctx)
+
+	for a, b := range map[string]string{"shady1": "shady2", "alice": "bob"} {
+		if peer, _ := client.Get(ctx, sessionKey(a)).Result(); peer != b {
+			t.Fatalf("%s paired with %q, want %q", a, peer, b)
+		}
+	}
+}
+
+func TestMatchMaker_SetPoolMovesLiveUserOnly(t *testing.T) {
+	mm, mr, _ := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	mm.SetProfile(ctx, "alice", Profile{})
+	mm.SetPool(ctx, "alice", poolShadow)
+	if got := mm.Profile(ctx, "alice").Pool; got != poolShadow {
+		t.Fatalf("pool = %q, want shadow", got)
+	}
+	mm.SetPool(ctx, "alice", poolGeneral)
+	if got := mm.Profile(ctx, "alice").Pool; got != "" {
+		t.Fatalf("general pool should be stored as empty, got %q", got)
+	}
+
+	mm.SetPool(ctx, "offline", poolShadow)
+	if mr.Exists(profileKey("offline")) {
+		t.Fatalf("SetPool must not create a profile for an offline user")
+	}
+}
+
+func TestInsertBlock_CountsBlocksReceived(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+
+	a, _, _ := upsertUser(ctx, "sub-a")
+	b, _, _ := upsertUser(ctx, "sub-b")
+
+	for range 2 {
+		if err := insertBlock(ctx, a, b); err != nil {
+			t.Fatalf("insertBlock: %v", err)
+		}
+	}
+	// b blocking back finds the rows already there: nobody's count moves.
+	if err := insertBlock(ctx, b, a); err != nil {
+		t.Fatalf("insertBlock reverse: %v", err)
+	}
+
+	for id, want := range map[int64]int{a: 0, b: 1} {
+		var got int
+		if err := db.QueryRow(ctx, `SELECT blocks_received_count FROM users WHERE id = $1`, id).Scan(&got); err != nil {
+			t.Fatalf("select: %v", err)
+		}
+		if got != want {
+			t.Fatalf("user %d blocks_received_count = %d, want %d", id, got, want)
+		}
+	}
+}
+
+func TestAdminPool_OverrideAndClear(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+
+	mm, _, _ := newTestMatchMaker(t)
+	prevMM := matchMaker
+	matchMaker = mm
+	t.Cleanup(func() { matchMaker = prevMM })
+
+	id, _, err := upsertUser(ctx, "pinned-sub")
+	if err != nil {
+		t.Fatalf("upsertUser: %v", err)
+	}
+	mm.SetProfile(ctx, "pinned-sub", Profile{})
+
+	post := func(body string) TrustAssessment {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/admin/api/users/"+strconv.FormatInt(id, 10)+"/pool", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		adminUserAction(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("POST pool %s: status=%d body=%s", body, rr.Code, rr.Body.String())
+		}
+		var a TrustAssessment
+		if err := json.NewDecoder(rr.Body).Decode(&a); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return a
+	}
+
+	if a := post(`{"pool":"shadow"}`); a.Pool != poolShadow || a.Override == nil {
+		t.Fatalf("after pin: %+v", a)
+	}
+	if got := mm.Profile(ctx, "pinned-sub").Pool; got != poolShadow {
+		t.Fatalf("live profile pool = %q, want shadow", got)
+	}
+	if got := matchPool(ctx, id, "pinned-sub"); got != poolShadow {
+		t.Fatalf("matchPool with override = %q, want shadow", got)
+	}
+
+	if a := post(`{"pool":null}`); a.Override != nil || a.Pool != poolForScore(a.Score) {
+		t.Fatalf("after clear: %+v", a)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/api/users/"+strconv.FormatInt(id, 10)+"/pool", bytes.NewBufferString(`{"pool":"vip"}`))
+	rr := httptest.NewRecorder()
+	adminUserAction(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("unknown pool: status=%d, want 400", rr.Code)
+	}
+}
+
+func TestMatchMaker_SetLanguagesKeepsPool(t *testing.T) {
+	mm, _, _ := newTestMatchMaker(t)
+	ctx := context.Background()
+
+	mm.SetProfile(ctx, "shady", Profile{Pool: poolShadow, Quality: 0.8})
+	mm.SetLanguages(ctx, "shady", []string{"en"}, true)
+
+	if p := mm.Profile(ctx, "shady"); p.Pool != poolShadow || p.Quality != 0.8 {
+		t.Fatalf("changing languages must not touch pool or quality, got %+v", p)
+	}
+}
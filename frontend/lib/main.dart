@@ -5,13 +5,12 @@ import 'package:flutter/material.dart';
 import 'package:flutter/rendering.dart';
 import 'package:flutter/services.dart';
 import 'package:flutter_riverpod/flutter_riverpod.dart';
-import 'package:flutter_secure_storage/flutter_secure_storage.dart';
 import 'package:flutter_webrtc/flutter_webrtc.dart';
 import 'package:google_sign_in/google_sign_in.dart';
-import 'package:jwt_decoder/jwt_decoder.dart';
 import 'package:permission_handler/permission_handler.dart';
 
 import 'call_state.dart';
+import 'services/auth_service.dart';
 import 'services/logger_service.dart';
 import 'services/report_service.dart';
 import 'signaling.dart';
@@ -45,7 +44,9 @@ class MyApp extends StatelessWidget {
 // For physical devices or iOS Simulator: Use your computer's local IP (e.g., '192.168.1.27')
 const String serverUrl = 'wss://bt.lystic.dev/ws';
 const String reportUrl = 'https://bt.lystic.dev/report';
-const String blocksUrl = 'https://bt.lystic.dev/blocks';
+const String authLoginUrl = 'https://bt.lystic.dev/auth/login';
+const String authRefreshUrl = 'https://bt.lystic.dev/auth/refresh';
+const String accountUrl = 'https://bt.lystic.dev/me';
 // ---------------------
 
 class ChatScreen extends ConsumerStatefulWidget {
@@ -63,7 +64,6 @@ class _ChatScreenState extends ConsumerState<ChatScreen>
   final RTCVideoRenderer _remoteRenderer = RTCVideoRenderer();
   final ReportService _reportService = ReportService(
     endpoint: Uri.parse(reportUrl),
-    blocksEndpoint: Uri.parse(blocksUrl),
   );
   final GlobalKey _remoteVideoKey = GlobalKey();
 
@@ -79,6 +79,10 @@ class _ChatScreenState extends ConsumerState<ChatScreen>
   bool _micEnabled = true;
   bool _camEnabled = true;
 
+  /// Thumbs-up (true) / thumbs-down (false) given to the current call, or
+  /// null if not rated yet. Reset on every new match.
+  bool? _rating;
+
   @override
   void initState() {
     super.initState();
@@ -102,10 +106,6 @@ class _ChatScreenState extends ConsumerState<ChatScreen>
     ));
     _connect(widget.token);
     _initRenderers();
-    // Hydrate the local block list from the server before the user can hit
-    // JOIN. Fire-and-forget: a missed sync (offline launch, server blip)
-    // falls back to whatever is already in SharedPrefs.
-    _reportService.syncFromServer(token: widget.token);
   }
 
   void _connect(String token) {
@@ -138,21 +138,50 @@ class _ChatScreenState extends ConsumerState<ChatScreen>
 
     _remoteRenderer.addListener(_onRemoteRendererChanged);
 
-    _signaling.onCallEnded = () {
+    _signaling.onCallEnded = () async {
       if (!mounted) return;
       final s = ref.read(callProvider).state;
-      // Already idle or re-entering match queue — nothing to do.
-      if (s == CallState.idle || s == CallState.matching) return;
-      _signaling.dispose();
+      // Already idle or re-entering match queue — nothing to do. A report in
+      // progress ends the call itself once submitted.
+      if (s != CallState.connected) return;
+      // The partner left. Re-enter the queue on the same connection; the
+      // server puts us ahead of fresh entrants if the call ended on us.
+      final nextMatch = _signaling.findNextMatch();
       setState(() {
         _remoteRenderer.srcObject = null;
+        _rating = null;
       });
+      ref.read(callProvider.notifier).startMatching();
+      ScaffoldMessenger.of(context).showSnackBar(
+        const SnackBar(content: Text('Partner left, finding someone new')),
+      );
+      await nextMatch;
+    };
+
+    _signaling.onQueueEvicted = () {
+      if (!mounted) return;
       ref.read(callProvider.notifier).endCall();
       ScaffoldMessenger.of(context).showSnackBar(
-        const SnackBar(content: Text('Call ended')),
+        const SnackBar(content: Text('You were removed from the queue')),
       );
     };
 
+    // Keep the socket's token fresh; the backend closes it once the token
+    // it holds lapses. The cached token is the one about to lapse, so always
+    // refresh.
+    _signaling.onReauthRequired = authService.refresh;
+
+    _signaling.onSessionClosed = (reason) async {
+      // Closed by our own DELETE /me; _deleteAccount signs out.
+      if (!mounted || reason == 'account_deleted') return;
+      ScaffoldMessenger.of(context).showSnackBar(SnackBar(
+        content: Text(reason == 'account_suspended'
+            ? 'Your account has been suspended'
+            : 'Your session expired, please sign in again'),
+      ));
+      await _signOut();
+    };
+
     _signaling.onServerShutdown = () async {
       if (!mounted) return;
       // Treat the in-progress match/call as gone: drop the remote video,
@@ -213,6 +242,7 @@ class _ChatScreenState extends ConsumerState<ChatScreen>
     setState(() {
       _remoteRenderer.srcObject = null;
       _isSliding = false;
+      _rating = null;
     });
     ref.read(callProvider.notifier).startMatching();
     await nextMatch;
@@ -302,7 +332,7 @@ class _ChatScreenState extends ConsumerState<ChatScreen>
     }
 
     final ok = await _reportService.submit(
-      token: widget.token,
+      token: _signaling.token,
       reportedUserId: reportedId,
       reason: reason,
       frameBytes: frame,
@@ -387,6 +417,12 @@ class _ChatScreenState extends ConsumerState<ChatScreen>
     setState(() => _camEnabled = next);
   }
 
+  void _rate(bool thumbsUp) {
+    HapticFeedback.selectionClick();
+    _signaling.rateCall(thumbsUp);
+    setState(() => _rating = thumbsUp);
+  }
+
   void _endCall() {
     _signaling.sendBye();
     _signaling.dispose();
@@ -397,8 +433,7 @@ class _ChatScreenState extends ConsumerState<ChatScreen>
   }
 
   Future<void> _signOut() async {
-    const storage = FlutterSecureStorage();
-    await storage.delete(key: 'auth_token');
+    await authService.signOut();
     try {
       await GoogleSignIn.instance.signOut();
     } catch (e, stack) {
@@ -410,6 +445,39 @@ class _ChatScreenState extends ConsumerState<ChatScreen>
     );
   }
 
+  Future<void> _deleteAccount() async {
+    final confirmed = await showDialog<bool>(
+      context: context,
+      builder: (context) => AlertDialog(
+        title: const Text('Delete account?'),
+        content: const Text(
+            'Your account and everything linked to it will be permanently '
+            'deleted. This cannot be undone.'),
+        actions: [
+          TextButton(
+            onPressed: () => Navigator.of(context).pop(false),
+            child: const Text('Cancel'),
+          ),
+          TextButton(
+            onPressed: () => Navigator.of(context).pop(true),
+            child: const Text('Delete'),
+          ),
+        ],
+      ),
+    );
+    if (confirmed != true) return;
+    final ok = await authService.deleteAccount(_signaling.token);
+    if (!mounted) return;
+    if (!ok) {
+      ScaffoldMessenger.of(context).showSnackBar(
+        const SnackBar(
+            content: Text('Could not delete your account, try again later')),
+      );
+      return;
+    }
+    await _signOut();
+  }
+
   /// Returns content shown in the black background area when no remote stream.
   Widget _buildBackgroundContent(CallState state) {
     return switch (state) {
@@ -461,6 +529,11 @@ class _ChatScreenState extends ConsumerState<ChatScreen>
                 style: TextButton.styleFrom(foregroundColor: Colors.white70),
                 child: const Text('Sign Out'),
               ),
+              TextButton(
+                onPressed: _deleteAccount,
+                style: TextButton.styleFrom(foregroundColor: Colors.red[200]),
+                child: const Text('Delete Account'),
+              ),
             ],
           ),
         ),
@@ -498,6 +571,27 @@ class _ChatScreenState extends ConsumerState<ChatScreen>
                     ),
                   ],
                 ),
+                const SizedBox(height: 16),
+                Row(
+                  mainAxisAlignment: MainAxisAlignment.center,
+                  children: [
+                    _CircleToolbarButton(
+                      tooltip: 'Good call',
+                      icon: _rating == true
+                          ? Icons.thumb_up
+                          : Icons.thumb_up_outlined,
+                      onPressed: () => _rate(true),
+                    ),
+                    const SizedBox(width: 24),
+                    _CircleToolbarButton(
+                      tooltip: 'Bad call',
+                      icon: _rating == false
+                          ? Icons.thumb_down
+                          : Icons.thumb_down_outlined,
+                      onPressed: () => _rate(false),
+                    ),
+                  ],
+                ),
               ],
             ),
           ),
@@ -651,6 +745,12 @@ class _CircleToolbarButton extends StatelessWidget {
 const String webClientId =
     '774973448609-nio4jsbacsm16irumk21v66js92d8j2e.apps.googleusercontent.com';
 
+final authService = AuthService(
+  loginEndpoint: Uri.parse(authLoginUrl),
+  refreshEndpoint: Uri.parse(authRefreshUrl),
+  accountEndpoint: Uri.parse(accountUrl),
+);
+
 class LoginScreen extends StatefulWidget {
   const LoginScreen({super.key});
 
@@ -659,7 +759,6 @@ class LoginScreen extends StatefulWidget {
 }
 
 class _LoginScreenState extends State<LoginScreen> {
-  final _storage = const FlutterSecureStorage();
   bool _loading = true;
 
   @override
@@ -670,21 +769,15 @@ class _LoginScreenState extends State<LoginScreen> {
 
   Future<void> _initAndCheckSignIn() async {
     try {
-      // 1. Check local storage first
-      String? cachedToken = await _storage.read(key: 'auth_token');
+      // 1. Reuse the stored session, refreshing it if the access token
+      // has expired.
+      final cachedToken =
+          await authService.cachedAccessToken() ?? await authService.refresh();
       if (cachedToken != null) {
-        bool isExpired = JwtDecoder.isExpired(cachedToken);
-        if (isExpired) {
-          LoggerService()
-              .logInfo('LoginScreen', 'Cached token expired, clearing...');
-          await _storage.delete(key: 'auth_token');
-          cachedToken = null;
-        } else {
-          LoggerService().logInfo('LoginScreen',
-              'Found cached token, skipping Google Sign-In init');
-          _navigateToChat(cachedToken);
-          return;
-        }
+        LoggerService().logInfo(
+            'LoginScreen', 'Found session, skipping Google Sign-In init');
+        _navigateToChat(cachedToken);
+        return;
       }
 
       // 2. Initialize Google Sign-In if no token found
@@ -729,8 +822,16 @@ class _LoginScreenState extends State<LoginScreen> {
       final idToken = auth.idToken;
 
       if (idToken != null) {
-        await _storage.write(key: 'auth_token', value: idToken);
-        _navigateToChat(idToken);
+        final accessToken = await authService.login(idToken);
+        if (accessToken != null) {
+          _navigateToChat(accessToken);
+        } else {
+          LoggerService().logError('LoginScreen', 'Backend login failed',
+              null, StackTrace.current);
+          setState(() {
+            _loading = false;
+          });
+        }
       } else {
         // Handle missing token...
         LoggerService().logError(
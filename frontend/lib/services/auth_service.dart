@@ -0,0 +1,113 @@
+import 'dart:convert';
+
+import 'package:flutter_secure_storage/flutter_secure_storage.dart';
+import 'package:http/http.dart' as http;
+import 'package:jwt_decoder/jwt_decoder.dart';
+
+import 'logger_service.dart';
+
+/// Trades a Google ID token for the backend's own session tokens and keeps
+/// them fresh. The access token is what the rest of the app sends as its
+/// bearer token; the refresh token never leaves this class.
+class AuthService {
+  static const String _accessKey = 'auth_token';
+  static const String _refreshKey = 'refresh_token';
+
+  final Uri loginEndpoint;
+  final Uri refreshEndpoint;
+  final Uri accountEndpoint;
+  final FlutterSecureStorage _storage;
+  final http.Client _client;
+
+  AuthService({
+    required this.loginEndpoint,
+    required this.refreshEndpoint,
+    required this.accountEndpoint,
+    FlutterSecureStorage? storage,
+    http.Client? client,
+  })  : _storage = storage ?? const FlutterSecureStorage(),
+        _client = client ?? http.Client();
+
+  /// Returns the stored access token if it has not expired yet.
+  Future<String?> cachedAccessToken() async {
+    final token = await _storage.read(key: _accessKey);
+    if (token == null || JwtDecoder.isExpired(token)) return null;
+    return token;
+  }
+
+  /// Exchanges a provider ID token at `/auth/login`. Returns the new access
+  /// token, or null if the backend refused or could not be reached.
+  Future<String?> login(String idToken) =>
+      _exchange(loginEndpoint, {'id_token': idToken});
+
+  /// Trades the stored refresh token for a new pair. Returns null, and
+  /// forgets the session, if there is none or the backend refused it.
+  Future<String?> refresh() async {
+    final refreshToken = await _storage.read(key: _refreshKey);
+    if (refreshToken == null) return null;
+    return _exchange(refreshEndpoint, {'refresh_token': refreshToken});
+  }
+
+  /// Permanently deletes the account at `DELETE /me` and forgets the
+  /// session. Returns false if the backend did not confirm the deletion.
+  Future<bool> deleteAccount(String accessToken) async {
+    try {
+      final res = await _client.delete(
+        accountEndpoint,
+        headers: {'Authorization': 'Bearer $accessToken'},
+      );
+      if (res.statusCode != 200) {
+        LoggerService().logError(
+          'AuthService',
+          'Account deletion failed: ${res.statusCode} ${res.body}',
+          null,
+          StackTrace.current,
+        );
+        return false;
+      }
+      await signOut();
+      return true;
+    } catch (e, s) {
+      LoggerService().logError('AuthService', 'Account deletion exception', e, s);
+      return false;
+    }
+  }
+
+  Future<void> signOut() async {
+    await _storage.delete(key: _accessKey);
+    await _storage.delete(key: _refreshKey);
+  }
+
+  Future<String?> _exchange(Uri endpoint, Map<String, String> body) async {
+    try {
+      final res = await _client.post(
+        endpoint,
+        headers: {'Content-Type': 'application/json'},
+        body: jsonEncode(body),
+      );
+      if (res.statusCode != 200) {
+        LoggerService().logError(
+          'AuthService',
+          '${endpoint.path} failed: ${res.statusCode} ${res.body}',
+          null,
+          StackTrace.current,
+        );
+        // The credential is no good; anything else (rate limit, outage)
+        // may pass.
+        if (res.statusCode == 401 || res.statusCode == 403) {
+          await signOut();
+        }
+        return null;
+      }
+      final data = jsonDecode(res.body) as Map<String, dynamic>;
+      final access = data['access_token'] as String;
+      await _storage.write(key: _accessKey, value: access);
+      await _storage.write(
+          key: _refreshKey, value: data['refresh_token'] as String);
+      return access;
+    } catch (e, s) {
+      LoggerService().logError('AuthService', 'Token exchange exception', e, s);
+      return null;
+    }
+  }
+}
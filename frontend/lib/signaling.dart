@@ -10,9 +10,16 @@ typedef OnLocalStream = void Function(MediaStream stream);
 typedef OnRemoteStream = void Function(MediaStream stream);
 typedef OnTimingReport = void Function(ConnectTiming timing);
 
+/// WebSocket close code the backend uses when it ends a session for policy:
+/// an expired token or a suspended account.
+const int _closePolicyViolation = 1008;
+
 class Signaling {
   final String serverUrl;
-  final String token;
+
+  /// The bearer token the socket was opened with, replaced on every
+  /// successful reauth so a reconnect uses the fresh one.
+  String token;
   WebSocketChannel? _channel;
   RTCPeerConnection? _peerConnection;
   MediaStream? _localStream;
@@ -29,14 +36,35 @@ class Signaling {
   /// "Reconnecting…" state and call back into [reconnect].
   void Function()? onServerShutdown;
 
+  /// Fired when a moderator takes this user out of the matching queue. The
+  /// socket stays open; the user is no longer waiting for a match.
+  void Function()? onQueueEvicted;
+
+  /// Asked for a fresh access token when the backend sends
+  /// `reauth_required` ahead of the current one lapsing. Returning null
+  /// lets the socket be closed once it does.
+  Future<String?> Function()? onReauthRequired;
+
+  /// Fired when the backend closes the socket for policy, with the reason
+  /// from the close frame (`token_expired`, `account_suspended` or
+  /// `account_deleted`).
+  void Function(String reason)? onSessionClosed;
+
   /// Fired once per match when the timing report is sent to the backend.
   /// The renderer can also drive [reportFirstFrame] later if it detects an
   /// actual painted frame; that just enriches the same in-memory report.
   OnTimingReport? onTimingReport;
 
-  String? _selfId;
+  /// The peer's handle for the current match. It is only meaningful to the
+  /// backend, which resolves it for relaying, reports and blocks.
   String? _remoteId;
 
+  /// Interest tags shared with the current peer, from the `match` event.
+  List<String> sharedTags = const [];
+
+  /// Server-assigned ID of the current match, echoed back by [rateCall].
+  String? _matchId;
+
   /// Set when a `server_shutdown` message has been received. Suppresses the
   /// onCallEnded path that would otherwise fire when the channel closes
   /// moments later — the renderer is reconnecting, not ending the call.
@@ -76,6 +104,10 @@ class Signaling {
       onDone: () {
         LoggerService().logInfo('Signaling', 'WebSocket closed');
         if (_serverShutdownInFlight) return;
+        if (channel.closeCode == _closePolicyViolation) {
+          onSessionClosed?.call(channel.closeReason ?? '');
+          return;
+        }
         onCallEnded?.call();
       },
     );
@@ -123,16 +155,20 @@ class Signaling {
 
     switch (type) {
       case 'init':
-        _selfId = payload;
-        LoggerService().logInfo('Signaling', 'My ID: $_selfId');
+        LoggerService().logInfo('Signaling', 'Connected');
         break;
       case 'match':
-        _remoteId = payload;
+        // Payload is {match_id, peer_id, shared_tags, offerer}.
+        _remoteId = payload is Map ? payload['peer_id'] : payload;
+        _matchId = payload is Map ? payload['match_id'] : null;
+        sharedTags = payload is Map
+            ? List<String>.from(payload['shared_tags'] ?? const [])
+            : const [];
         _timing?.matchAssignedAt = DateTime.now();
         LoggerService().logInfo('Signaling',
             'Matched with: $_remoteId (queue_wait=${_timing?.matchAssignedAt?.difference(_timing!.queueJoinedAt).inMilliseconds}ms)');
-        // Glare prevention: lower-ID peer is the offerer.
-        if (_selfId!.compareTo(_remoteId!) < 0) {
+        // Glare prevention: the backend picks exactly one offerer.
+        if (payload is Map && payload['offerer'] == true) {
           _timing?.role = PeerRole.offerer;
           LoggerService().logInfo('Signaling', 'I am the offerer');
           _createOffer();
@@ -160,6 +196,18 @@ class Signaling {
       case 'server_shutdown':
         _handleServerShutdown();
         break;
+      case 'queue_evicted':
+        LoggerService().logInfo('Signaling', 'Removed from the match queue');
+        onQueueEvicted?.call();
+        break;
+      case 'reauth_required':
+        _reauth();
+        break;
+      case 'reauth_failed':
+        LoggerService().logError('Signaling',
+            'Reauth refused: ${payload is Map ? payload['code'] : payload}',
+            null, StackTrace.current);
+        break;
     }
   }
 
@@ -374,10 +422,29 @@ class Signaling {
     }));
   }
 
+  /// Renews the socket's token in-band, without dropping the call.
+  Future<void> _reauth() async {
+    final fresh = await onReauthRequired?.call();
+    if (fresh == null) return;
+    token = fresh;
+    _send('reauth', {'token': fresh});
+  }
+
   void sendBye() {
     _send('bye', {}, to: _remoteId);
   }
 
+  /// Rates the current (or just-ended) call. Rating again before the next
+  /// match replaces the earlier rating.
+  void rateCall(bool thumbsUp) {
+    final matchId = _matchId;
+    if (matchId == null) return;
+    _send('rate_call', {
+      'match_id': matchId,
+      'rating': thumbsUp ? 'up' : 'down',
+    });
+  }
+
   /// Tears down the current peer connection and re-enters the matching queue,
   /// keeping the local stream and WebSocket connection alive. The new PC is
   /// pre-warmed in the same call so the next match starts with media + ICE